@@ -29,6 +29,9 @@ type Config struct {
 	ListenSocket string `yaml:"listenSocket"`
 	// StorageDir is a directory to store all pulled images in.
 	StorageDir string `yaml:"storageDir"`
+	// StorageQuota is a maximum total size of pulled images in bytes. Once exceeded,
+	// least recently used images are removed. Zero means no quota.
+	StorageQuota uint64 `yaml:"storageQuota"`
 	// StreamingURL is an address to serve streaming requests on (exec, attach, portforward).
 	StreamingURL string `yaml:"streamingURL"`
 	// CNIBinDir is a directory to look for CNI plugin binaries.
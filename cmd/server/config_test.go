@@ -32,6 +32,7 @@ func TestParseConfig(t *testing.T) {
 	_, err = tempConfig.WriteString(`
 listenSocket: /home/user/singularity.sock
 storageDir: /var/lib/cri-images
+storageQuota: 10737418240
 streamingURL: 127.0.0.12:8080
 cniBinDir: /opt/cni/bin
 cniConfDir: /etc/cni/net.d
@@ -61,6 +62,7 @@ baseRunDir: /var/run/cri
 			expectConfig: Config{
 				ListenSocket: "/home/user/singularity.sock",
 				StorageDir:   "/var/lib/cri-images",
+				StorageQuota: 10737418240,
 				StreamingURL: "127.0.0.12:8080",
 				CNIBinDir:    "/opt/cni/bin",
 				CNIConfDir:   "/etc/cni/net.d",
@@ -152,7 +152,11 @@ func main() {
 
 func startCRI(ctx context.Context, wg *sync.WaitGroup, config Config) error {
 	imageIndex := index.NewImageIndex()
-	syImage, err := image.NewSingularityRegistry(config.StorageDir, imageIndex)
+	syImage, err := image.NewSingularityRegistry(
+		config.StorageDir,
+		imageIndex,
+		image.WithStorageQuota(config.StorageQuota),
+	)
 	if err != nil {
 		return fmt.Errorf("could not create Singularity image service: %v", err)
 	}
@@ -28,6 +28,7 @@ require (
 	github.com/sirupsen/logrus v1.2.0 // indirect
 	github.com/stretchr/testify v1.4.0
 	github.com/sylabs/scs-library-client v0.4.4
+	github.com/sylabs/sif v1.0.8
 	github.com/sylabs/singularity v0.0.0-20190918134918-5d9975e95fa7
 	github.com/syndtr/gocapability v0.0.0-20180916011248-d98352740cb2 // indirect
 	github.com/tchap/go-patricia v2.2.6+incompatible
@@ -44,7 +45,7 @@ require (
 	k8s.io/client-go v0.0.0-20181010045704-56e7a63b5e38
 	k8s.io/klog v0.2.0 // indirect
 	k8s.io/kubernetes v1.12.5
-	k8s.io/utils v0.0.0-20181115163542-0d26856f57b3 // indirect
+	k8s.io/utils v0.0.0-20181115163542-0d26856f57b3
 )
 
 replace (
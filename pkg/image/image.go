@@ -22,6 +22,7 @@ import (
 	"fmt"
 	"io"
 	"io/ioutil"
+	"net/http"
 	"os"
 	"os/exec"
 	"path/filepath"
@@ -32,6 +33,7 @@ import (
 	"github.com/golang/glog"
 	specs "github.com/opencontainers/image-spec/specs-go/v1"
 	library "github.com/sylabs/scs-library-client/client"
+	"github.com/sylabs/sif/pkg/sif"
 	"github.com/sylabs/singularity-cri/pkg/rand"
 	"github.com/sylabs/singularity-cri/pkg/singularity"
 	"github.com/sylabs/singularity-cri/pkg/slice"
@@ -63,6 +65,12 @@ type Info struct {
 	Path      string             `json:"path"`
 	Ref       *Reference         `json:"ref"`
 	OciConfig *specs.ImageConfig `json:"ociConfig,omitempty"`
+	Arch      string             `json:"arch,omitempty"`
+	Labels    map[string]string  `json:"labels,omitempty"`
+	// CompressionRatio is how many times fewer bytes were transferred
+	// than stored when image was pulled. It is zero if transfer size
+	// is unknown, e.g. for images built from other registries.
+	CompressionRatio float64 `json:"compressionRatio,omitempty"`
 
 	mu     sync.RWMutex
 	usedBy []string
@@ -117,7 +125,7 @@ func Pull(ctx context.Context, location string, ref *Reference, auth *k8s.AuthCo
 		}
 	}
 
-	err := pullImage(ctx, ref, auth, pullPath)
+	ratio, err := pullImage(ctx, ref, auth, pullPath)
 	if err != nil {
 		cleanup()
 		return nil, fmt.Errorf("could not pull image: %v", err)
@@ -138,6 +146,10 @@ func Pull(ctx context.Context, location string, ref *Reference, auth *k8s.AuthCo
 
 	info.Path = path
 	info.Ref = ref
+	info.CompressionRatio = ratio
+	if ratio != 0 {
+		glog.V(4).Infof("Pulled %s with compression ratio %.2f", ref, ratio)
+	}
 	return info, nil
 }
 
@@ -238,29 +250,35 @@ func (i *Info) Matches(filter *k8s.ImageFilter) bool {
 	return false
 }
 
-func pullImage(ctx context.Context, ref *Reference, auth *k8s.AuthConfig, pullPath string) error {
+// pullImage pulls image referenced by ref to pullPath. Library images are
+// transferred compressed when library supports it, in that case compression
+// ratio achieved is returned. For other images returned ratio is zero.
+func pullImage(ctx context.Context, ref *Reference, auth *k8s.AuthConfig, pullPath string) (float64, error) {
 	pullURL := strings.TrimPrefix(ref.String(), ref.URI()+"/")
 	switch ref.URI() {
 	case singularity.LibraryDomain:
+		transport := newCompressedTransport(nil)
 		config := &library.Config{
-			BaseURL:   auth.GetServerAddress(),
-			AuthToken: auth.GetPassword(),
+			BaseURL:    auth.GetServerAddress(),
+			AuthToken:  auth.GetPassword(),
+			HTTPClient: &http.Client{Transport: transport},
 		}
 		client, err := library.NewClient(config)
 		if err != nil {
-			return fmt.Errorf("could not create library client: %v", err)
+			return 0, fmt.Errorf("could not create library client: %v", err)
 		}
 		w, err := os.Create(pullPath)
 		if err != nil {
-			return fmt.Errorf("could not create file to pull image: %v", err)
+			return 0, fmt.Errorf("could not create file to pull image: %v", err)
 		}
 		parts := strings.Split(pullURL, ":")
 		// don't check index out of range since we add :latest by default when parsing ref
 		err = client.DownloadImage(ctx, w, runtime.GOARCH, parts[0], parts[1], nil)
 		_ = w.Close()
 		if err != nil {
-			return fmt.Errorf("could not pull library image: %v", err)
+			return 0, fmt.Errorf("could not pull library image: %v", err)
 		}
+		return transport.ratio(), nil
 	case singularity.DockerDomain:
 		var errMsg bytes.Buffer
 		if auth.GetServerAddress() != "" {
@@ -279,12 +297,12 @@ func pullImage(ctx context.Context, ref *Reference, auth *k8s.AuthConfig, pullPa
 		buildCmd.Stdout = ioutil.Discard
 		err := buildCmd.Run()
 		if err != nil {
-			return fmt.Errorf("could not build image: %s", &errMsg)
+			return 0, fmt.Errorf("could not build image: %s", &errMsg)
 		}
 	default:
-		return fmt.Errorf("unknown image registry: %s", ref.URI())
+		return 0, fmt.Errorf("unknown image registry: %s", ref.URI())
 	}
-	return nil
+	return 0, nil
 }
 
 func sifInfo(sifPath string) (*Info, error) {
@@ -314,6 +332,13 @@ func sifInfo(sifPath string) (*Info, error) {
 	if err != nil {
 		glog.Errorf("Could not fetch OCI config for image %s: %v", sifPath, err)
 	}
+	arch, labels, err := fetchSIFMeta(sifPath)
+	if err != nil {
+		glog.Errorf("Could not fetch SIF metadata for image %s: %v", sifPath, err)
+	}
+	if ociConfig != nil {
+		labels = mergeLabels(ociConfig.Labels, labels)
+	}
 
 	return &Info{
 		ID:        checksum,
@@ -321,9 +346,57 @@ func sifInfo(sifPath string) (*Info, error) {
 		Size:      uint64(fi.Size()),
 		Path:      sifPath,
 		OciConfig: ociConfig,
+		Arch:      arch,
+		Labels:    labels,
 	}, nil
 }
 
+// fetchSIFMeta reads architecture the image is built for from SIF header
+// and labels from the labels data object. Images without labels data
+// object are not treated as an error, nil labels are returned instead.
+func fetchSIFMeta(imgPath string) (string, map[string]string, error) {
+	fimg, err := sif.LoadContainer(imgPath, true)
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to load SIF image %s: %v", imgPath, err)
+	}
+	defer fimg.UnloadContainer()
+
+	var arch string
+	sifArch := string(fimg.Header.Arch[:sif.HdrArchLen-1])
+	if sifArch != sif.HdrArchUnknown {
+		arch = sif.GetGoArch(sifArch)
+	}
+
+	var labels map[string]string
+	for _, desc := range fimg.DescrArr {
+		if !desc.Used || desc.Datatype != sif.DataLabels {
+			continue
+		}
+		err := json.Unmarshal(desc.GetData(&fimg), &labels)
+		if err != nil {
+			return arch, nil, fmt.Errorf("failed to decode labels: %v", err)
+		}
+		break
+	}
+	return arch, labels, nil
+}
+
+// mergeLabels returns labels from both maps, values from
+// the second one take precedence.
+func mergeLabels(first, second map[string]string) map[string]string {
+	if len(first) == 0 {
+		return second
+	}
+	labels := make(map[string]string, len(first)+len(second))
+	for k, v := range first {
+		labels[k] = v
+	}
+	for k, v := range second {
+		labels[k] = v
+	}
+	return labels
+}
+
 func fetchOCIConfig(imgPath string) (*specs.ImageConfig, error) {
 	const ociConfigSection = "oci-config.json"
 
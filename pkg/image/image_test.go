@@ -717,3 +717,38 @@ func TestInfo_MarshalJSON(t *testing.T) {
 		})
 	}
 }
+
+func TestMergeLabels(t *testing.T) {
+	tt := []struct {
+		name   string
+		first  map[string]string
+		second map[string]string
+		expect map[string]string
+	}{
+		{
+			name: "no labels",
+		},
+		{
+			name:   "first only",
+			first:  map[string]string{"maintainer": "sylabs"},
+			expect: map[string]string{"maintainer": "sylabs"},
+		},
+		{
+			name:   "second only",
+			second: map[string]string{"org.label-schema.build-arch": "amd64"},
+			expect: map[string]string{"org.label-schema.build-arch": "amd64"},
+		},
+		{
+			name:   "second overrides first",
+			first:  map[string]string{"maintainer": "sylabs", "version": "1"},
+			second: map[string]string{"version": "2"},
+			expect: map[string]string{"maintainer": "sylabs", "version": "2"},
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			require.Equal(t, tc.expect, mergeLabels(tc.first, tc.second))
+		})
+	}
+}
@@ -0,0 +1,143 @@
+// Copyright (c) 2018-2019 Sylabs, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package image
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync/atomic"
+)
+
+// contentDecoder decodes image transferred with the particular Content-Encoding.
+type contentDecoder struct {
+	encoding string
+	decode   func(r io.Reader) (io.ReadCloser, error)
+}
+
+// contentDecoders lists supported compressed encodings in order of preference.
+// Encodings such as zstd may be added here once their decoders are available.
+var contentDecoders = []contentDecoder{
+	{
+		encoding: "gzip",
+		decode: func(r io.Reader) (io.ReadCloser, error) {
+			return gzip.NewReader(r)
+		},
+	},
+}
+
+// compressedTransport asks registry for compressed image transfer and
+// decompresses responses, so that images are always stored decompressed.
+// When registry does not compress response it is passed as is.
+type compressedTransport struct {
+	base http.RoundTripper
+
+	// received and decoded are the number of bytes
+	// received over the wire and after decompression.
+	received int64
+	decoded  int64
+}
+
+func newCompressedTransport(base http.RoundTripper) *compressedTransport {
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	return &compressedTransport{base: base}
+}
+
+// RoundTrip implements http.RoundTripper interface.
+func (t *compressedTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	encodings := make([]string, len(contentDecoders))
+	for i, d := range contentDecoders {
+		encodings[i] = d.encoding
+	}
+	req = req.Clone(req.Context())
+	req.Header.Set("Accept-Encoding", strings.Join(encodings, ", "))
+
+	res, err := t.base.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+
+	body := io.ReadCloser(&countingReader{ReadCloser: res.Body, n: &t.received})
+	encoding := strings.ToLower(strings.TrimSpace(res.Header.Get("Content-Encoding")))
+	if encoding != "" && encoding != "identity" {
+		decoder, ok := findDecoder(encoding)
+		if !ok {
+			res.Body.Close()
+			return nil, fmt.Errorf("unsupported content encoding %q", encoding)
+		}
+		decoded, err := decoder.decode(body)
+		if err != nil {
+			res.Body.Close()
+			return nil, fmt.Errorf("could not decode %s response: %v", encoding, err)
+		}
+		body = &decodedBody{ReadCloser: decoded, raw: res.Body}
+		res.Header.Del("Content-Encoding")
+		res.Header.Del("Content-Length")
+		res.ContentLength = -1
+		res.Uncompressed = true
+	}
+	res.Body = &countingReader{ReadCloser: body, n: &t.decoded}
+	return res, nil
+}
+
+// ratio returns compression ratio achieved, i.e. how many times
+// fewer bytes were transferred than stored. It is 1 for uncompressed
+// transfer and 0 if nothing was transferred.
+func (t *compressedTransport) ratio() float64 {
+	received := atomic.LoadInt64(&t.received)
+	if received == 0 {
+		return 0
+	}
+	return float64(atomic.LoadInt64(&t.decoded)) / float64(received)
+}
+
+func findDecoder(encoding string) (contentDecoder, bool) {
+	for _, d := range contentDecoders {
+		if d.encoding == encoding {
+			return d, true
+		}
+	}
+	return contentDecoder{}, false
+}
+
+// countingReader counts bytes read from the underlying reader.
+type countingReader struct {
+	io.ReadCloser
+	n *int64
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	atomic.AddInt64(r.n, int64(n))
+	return n, err
+}
+
+// decodedBody closes both decoder and the raw response body.
+type decodedBody struct {
+	io.ReadCloser
+	raw io.Closer
+}
+
+func (b *decodedBody) Close() error {
+	err := b.ReadCloser.Close()
+	if rawErr := b.raw.Close(); err == nil {
+		err = rawErr
+	}
+	return err
+}
@@ -0,0 +1,92 @@
+// Copyright (c) 2018-2019 Sylabs, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package image
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestCompressedTransport(t *testing.T) {
+	image := bytes.Repeat([]byte("SIF_MAGIC"), 4096)
+	var compressed bytes.Buffer
+	gz := gzip.NewWriter(&compressed)
+	_, err := gz.Write(image)
+	require.NoError(t, err)
+	require.NoError(t, gz.Close())
+
+	tt := []struct {
+		name        string
+		encoding    string
+		body        []byte
+		expectRatio float64
+		expectError string
+	}{
+		{
+			name:        "uncompressed",
+			body:        image,
+			expectRatio: 1,
+		},
+		{
+			name:        "gzip",
+			encoding:    "gzip",
+			body:        compressed.Bytes(),
+			expectRatio: float64(len(image)) / float64(compressed.Len()),
+		},
+		{
+			name:        "unsupported encoding",
+			encoding:    "br",
+			body:        image,
+			expectError: `unsupported content encoding "br"`,
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				require.True(t, strings.Contains(r.Header.Get("Accept-Encoding"), "gzip"))
+				if tc.encoding != "" {
+					w.Header().Set("Content-Encoding", tc.encoding)
+				}
+				w.Write(tc.body)
+			}))
+			defer srv.Close()
+
+			transport := newCompressedTransport(nil)
+			client := &http.Client{Transport: transport}
+			res, err := client.Get(srv.URL)
+			if tc.expectError != "" {
+				require.Error(t, err)
+				require.Contains(t, err.Error(), tc.expectError)
+				return
+			}
+			require.NoError(t, err)
+			data, err := ioutil.ReadAll(res.Body)
+			require.NoError(t, err)
+			require.NoError(t, res.Body.Close())
+
+			require.Equal(t, image, data)
+			require.Empty(t, res.Header.Get("Content-Encoding"))
+			require.InDelta(t, tc.expectRatio, transport.ratio(), 0.001)
+		})
+	}
+}
@@ -82,6 +82,24 @@ func (i *ImageIndex) Remove(id string) error {
 	return nil
 }
 
+// Untag removes tag from the image it references, image itself is kept in
+// index and may still be found by its ID, digests and other tags. If tag
+// does not reference any image ErrNotFound is returned.
+func (i *ImageIndex) Untag(tag string) error {
+	tag = image.NormalizedImageRef(tag)
+	id := i.readRef(tag)
+	if id == "" {
+		return ErrNotFound
+	}
+	imgInfo, err := i.find(id)
+	if err != nil {
+		return err
+	}
+	imgInfo.Ref.RemoveTag(tag)
+	i.removeRefs(tag)
+	return nil
+}
+
 // Iterate calls handler func on each pod registered in index.
 func (i *ImageIndex) Iterate(handler func(image *image.Info)) {
 	innerIterate := func(key string, item interface{}) {
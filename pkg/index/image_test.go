@@ -200,3 +200,30 @@ func AdvancedTestImageIndex(t *testing.T) {
 		require.Equal(t, 2, count)
 	})
 }
+
+func TestImageIndex_Untag(t *testing.T) {
+	indx := NewImageIndex()
+
+	ref, err := image.ParseRef("busybox:1.29")
+	require.NoError(t, err, "could not parse busybox ref")
+	ref.AddTags([]string{"busybox:latest"})
+	busybox := &image.Info{
+		ID:  "busybox",
+		Ref: ref,
+	}
+	require.NoError(t, indx.Add(busybox))
+
+	require.NoError(t, indx.Untag("busybox"))
+	require.Equal(t, []string{"busybox:1.29"}, busybox.Ref.Tags())
+	_, err = indx.Find("busybox:latest")
+	require.Equal(t, ErrNotFound, err)
+
+	found, err := indx.Find("busybox:1.29")
+	require.NoError(t, err)
+	require.Equal(t, busybox, found)
+	found, err = indx.Find("busybox")
+	require.NoError(t, err)
+	require.Equal(t, busybox, found)
+
+	require.Equal(t, ErrNotFound, indx.Untag("busybox:latest"))
+}
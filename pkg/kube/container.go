@@ -65,8 +65,11 @@ type Container struct {
 	stdin         io.WriteCloser
 
 	cli        *runtime.CLIClient
+	sync       *runtime.Observer
 	syncChan   <-chan runtime.State
 	syncCancel context.CancelFunc
+
+	execs execTracker
 }
 
 // NewContainer constructs Container instance. Container is thread safe to use.
@@ -103,15 +106,7 @@ func (c *Container) PodID() string {
 
 // State returns current container state understood by k8s.
 func (c *Container) State() k8s.ContainerState {
-	switch c.runtimeState {
-	case runtime.StateCreated:
-		return k8s.ContainerState_CONTAINER_CREATED
-	case runtime.StateRunning:
-		return k8s.ContainerState_CONTAINER_RUNNING
-	case runtime.StateExited:
-		return k8s.ContainerState_CONTAINER_EXITED
-	}
-	return k8s.ContainerState_CONTAINER_UNKNOWN
+	return runtime.ContainerState(c.runtimeState)
 }
 
 // CreatedAt returns pod creation time in Unix nano.
@@ -155,21 +150,19 @@ func (c *Container) ExitDescription() string {
 // K8s requires us to return CamelCase here, but we will fallback to full description
 // in case of unknown container state.
 func (c *Container) StateReason() string {
-	const (
-		reasonCompleted = "Completed"
-		reasonError     = "Error"
-	)
-
 	if c.runtimeState == runtime.StateRunning {
 		// no need for any reason here
 		return ""
 	}
 
 	if c.runtimeState == runtime.StateExited {
+		if c.sync != nil && c.sync.StartErr() != nil {
+			return runtime.ReasonStartError
+		}
 		if c.ExitCode() == 0 {
-			return reasonCompleted
+			return runtime.ReasonCompleted
 		}
-		return reasonError
+		return runtime.ReasonError
 	}
 
 	// fallback to the description as a last resort
@@ -348,7 +341,8 @@ func (c *Container) Remove() error {
 
 // ExecSync runs passed command inside a container and returns result.
 func (c *Container) ExecSync(timeout time.Duration, cmd []string) (*k8s.ExecSyncResponse, error) {
-	ctx := context.Background()
+	ctx, done := c.execs.track(context.Background())
+	defer done()
 	if timeout > 0 {
 		var cancel context.CancelFunc
 		ctx, cancel = context.WithTimeout(ctx, timeout)
@@ -371,28 +365,33 @@ func (c *Container) ExecSync(timeout time.Duration, cmd []string) (*k8s.ExecSync
 }
 
 // Exec executes a command inside a container with attaching passed io streams to it.
+// If command exits with non-zero code, returned error wraps *exec.ExitError.
+// Command is killed if container exits before it is over.
 func (c *Container) Exec(cmd []string, stdin io.Reader, stdout, stderr io.Writer) error {
-	ctx := context.Background()
+	ctx, done := c.execs.track(context.Background())
+	defer done()
 
 	if c.imgInfo.Ref.URI() != singularity.DockerDomain || c.imgInfo.OciConfig == nil {
 		cmd = append([]string{singularity.ExecScript}, cmd...)
 	}
 	err := c.cli.Exec(ctx, c.id, stdin, stdout, stderr, cmd, c.execEnvs)
 	if err != nil {
-		return fmt.Errorf("exec returned error: %v", err)
+		return fmt.Errorf("exec returned error: %w", err)
 	}
 
 	return nil
 }
 
 // PrepareExec creates an instance of exec.Cmd that may be used
-// later to run a command inside an allocated tty.
-func (c *Container) PrepareExec(cmd []string) *exec.Cmd {
-	ctx := context.Background()
+// later to run a command inside an allocated tty. Command is killed
+// if container exits before it is over. Returned func should be
+// called once command is over.
+func (c *Container) PrepareExec(cmd []string) (*exec.Cmd, func()) {
+	ctx, done := c.execs.track(context.Background())
 	if c.imgInfo.Ref.URI() != singularity.DockerDomain || c.imgInfo.OciConfig == nil {
 		cmd = append([]string{singularity.ExecScript}, cmd...)
 	}
-	return c.cli.PrepareExec(ctx, c.id, cmd, c.execEnvs)
+	return c.cli.PrepareExec(ctx, c.id, cmd, c.execEnvs), done
 }
 
 // ReopenLogFile reopens container log file.
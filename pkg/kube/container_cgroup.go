@@ -0,0 +1,131 @@
+// Copyright (c) 2018-2019 Sylabs, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kube
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/containerd/cgroups"
+	"golang.org/x/sys/unix"
+)
+
+// cgroupRoot is where cgroup hierarchies are mounted on host.
+const cgroupRoot = "/sys/fs/cgroup"
+
+// readCgroupUsage returns total CPU time in nanoseconds and memory in bytes
+// used by the cgroup process with the passed pid belongs to. Both cgroup v1
+// and unified cgroup v2 hierarchies are supported.
+func readCgroupUsage(pid int) (uint64, uint64, error) {
+	if isUnifiedCgroup(cgroupRoot) {
+		return readCgroupV2Usage(cgroupRoot, fmt.Sprintf("/proc/%d/cgroup", pid))
+	}
+	return readCgroupV1Usage(pid)
+}
+
+// isUnifiedCgroup checks whether cgroup v2 hierarchy is mounted at root.
+func isUnifiedCgroup(root string) bool {
+	var st unix.Statfs_t
+	if err := unix.Statfs(root, &st); err != nil {
+		return false
+	}
+	return st.Type == unix.CGROUP2_SUPER_MAGIC
+}
+
+// readCgroupV1Usage reads usage from cpuacct and memory controllers.
+func readCgroupV1Usage(pid int) (uint64, uint64, error) {
+	cgroup, err := cgroups.Load(cgroups.V1, cgroups.PidPath(pid))
+	if err != nil {
+		return 0, 0, fmt.Errorf("could not load cgroups: %v", err)
+	}
+
+	metrics, err := cgroup.Stat(cgroups.IgnoreNotExist)
+	if err != nil {
+		return 0, 0, fmt.Errorf("could not fetch metrics: %v", err)
+	}
+
+	var cpuTotal uint64
+	var memoryTotal uint64
+	if metrics.CPU != nil && metrics.CPU.Usage != nil {
+		cpuTotal = metrics.CPU.Usage.Total
+	}
+	if metrics.Memory != nil && metrics.Memory.Usage != nil {
+		memoryTotal = metrics.Memory.Usage.Usage
+	}
+	return cpuTotal, memoryTotal, nil
+}
+
+// readCgroupV2Usage reads usage of the cgroup listed in procCgroup,
+// i.e. /proc/<pid>/cgroup file, from the unified hierarchy at root.
+func readCgroupV2Usage(root, procCgroup string) (uint64, uint64, error) {
+	f, err := os.Open(procCgroup)
+	if err != nil {
+		return 0, 0, fmt.Errorf("could not open process cgroup: %v", err)
+	}
+	defer f.Close()
+	path, err := parseCgroupV2Path(f)
+	if err != nil {
+		return 0, 0, err
+	}
+	dir := filepath.Join(root, path)
+
+	cpuStat, err := ioutil.ReadFile(filepath.Join(dir, "cpu.stat"))
+	if err != nil {
+		return 0, 0, fmt.Errorf("could not read cpu stat: %v", err)
+	}
+	var cpuUsec uint64
+	for _, line := range strings.Split(string(cpuStat), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 2 && fields[0] == "usage_usec" {
+			cpuUsec, err = strconv.ParseUint(fields[1], 10, 64)
+			if err != nil {
+				return 0, 0, fmt.Errorf("could not parse cpu usage: %v", err)
+			}
+		}
+	}
+
+	memory, err := ioutil.ReadFile(filepath.Join(dir, "memory.current"))
+	if err != nil {
+		return 0, 0, fmt.Errorf("could not read memory usage: %v", err)
+	}
+	memoryTotal, err := strconv.ParseUint(strings.TrimSpace(string(memory)), 10, 64)
+	if err != nil {
+		return 0, 0, fmt.Errorf("could not parse memory usage: %v", err)
+	}
+	return cpuUsec * uint64(time.Microsecond), memoryTotal, nil
+}
+
+// parseCgroupV2Path returns path of the unified hierarchy cgroup
+// read from /proc/<pid>/cgroup formatted r, i.e. the 0::<path> entry.
+func parseCgroupV2Path(r io.Reader) (string, error) {
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		parts := strings.SplitN(scanner.Text(), ":", 3)
+		if len(parts) == 3 && parts[0] == "0" && parts[1] == "" {
+			return parts[2], nil
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return "", fmt.Errorf("could not read process cgroup: %v", err)
+	}
+	return "", fmt.Errorf("process is not in cgroup v2 hierarchy")
+}
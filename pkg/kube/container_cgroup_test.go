@@ -0,0 +1,126 @@
+// Copyright (c) 2018-2019 Sylabs, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kube
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/sylabs/singularity-cri/pkg/singularity/runtime"
+)
+
+func TestParseCgroupV2Path(t *testing.T) {
+	tt := []struct {
+		name      string
+		input     string
+		expect    string
+		expectErr bool
+	}{
+		{
+			name:   "unified",
+			input:  "0::/kubepods/pod1/container\n",
+			expect: "/kubepods/pod1/container",
+		},
+		{
+			name:   "hybrid",
+			input:  "12:memory:/kubepods/pod1\n1:name=systemd:/kubepods/pod1\n0::/kubepods/pod1\n",
+			expect: "/kubepods/pod1",
+		},
+		{
+			name:      "v1 only",
+			input:     "12:memory:/kubepods/pod1\n11:cpu,cpuacct:/kubepods/pod1\n",
+			expectErr: true,
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			path, err := parseCgroupV2Path(strings.NewReader(tc.input))
+			if tc.expectErr {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tc.expect, path)
+		})
+	}
+}
+
+func TestReadCgroupV2Usage(t *testing.T) {
+	root, err := ioutil.TempDir("", "cri-test-cgroup-")
+	require.NoError(t, err)
+	defer os.RemoveAll(root)
+
+	dir := filepath.Join(root, "kubepods", "container")
+	require.NoError(t, os.MkdirAll(dir, 0755))
+	procCgroup := filepath.Join(root, "cgroup")
+	require.NoError(t, ioutil.WriteFile(procCgroup, []byte("0::/kubepods/container\n"), 0644))
+
+	_, _, err = readCgroupV2Usage(root, procCgroup)
+	require.Error(t, err, "missing cgroup files should be reported")
+
+	cpuStat := "usage_usec 1500\nuser_usec 1000\nsystem_usec 500\n"
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "cpu.stat"), []byte(cpuStat), 0644))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "memory.current"), []byte("4096\n"), 0644))
+
+	cpu, memory, err := readCgroupV2Usage(root, procCgroup)
+	require.NoError(t, err)
+	require.Equal(t, uint64(1500000), cpu)
+	require.Equal(t, uint64(4096), memory)
+}
+
+func TestContainer_Stat(t *testing.T) {
+	baseDir, err := ioutil.TempDir("", "cri-test-stat-")
+	require.NoError(t, err)
+	defer os.RemoveAll(baseDir)
+
+	for _, state := range []runtime.State{runtime.StateUnknown, runtime.StateCreated, runtime.StateExited} {
+		t.Run(state.String(), func(t *testing.T) {
+			// cgroup of process that is not live is never read
+			c := &Container{baseDir: baseDir, runtimeState: state}
+			stat, err := c.Stat()
+			require.NoError(t, err)
+			require.NotNil(t, stat.Fs)
+			require.Zero(t, stat.CPU)
+			require.Zero(t, stat.Memory)
+		})
+	}
+}
+
+func TestContainer_IsLive(t *testing.T) {
+	tt := []struct {
+		state  runtime.State
+		expect bool
+	}{
+		{state: runtime.StateUnknown},
+		{state: runtime.StateCreating},
+		{state: runtime.StateCreated},
+		{state: runtime.StateRunning, expect: true},
+		{state: runtime.StatePaused, expect: true},
+		{state: runtime.StateResumed, expect: true},
+		{state: runtime.StateExited},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.state.String(), func(t *testing.T) {
+			c := &Container{runtimeState: tc.state}
+			require.Equal(t, tc.expect, c.isLive())
+		})
+	}
+}
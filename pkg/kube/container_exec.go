@@ -0,0 +1,67 @@
+// Copyright (c) 2018-2019 Sylabs, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kube
+
+import (
+	"context"
+	"sync"
+)
+
+// execTracker keeps track of commands executed inside a container or
+// pod, so that they are stopped once the container or pod exits.
+type execTracker struct {
+	mu      sync.Mutex
+	next    int
+	cancels map[int]context.CancelFunc
+	exited  bool
+}
+
+// track returns context that is done once the container exits and
+// a func that should be called once command is over. If container
+// has already exited returned context is done.
+func (t *execTracker) track(ctx context.Context) (context.Context, func()) {
+	ctx, cancel := context.WithCancel(ctx)
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.exited {
+		cancel()
+		return ctx, func() {}
+	}
+	if t.cancels == nil {
+		t.cancels = make(map[int]context.CancelFunc)
+	}
+	id := t.next
+	t.next++
+	t.cancels[id] = cancel
+	return ctx, func() {
+		t.mu.Lock()
+		delete(t.cancels, id)
+		t.mu.Unlock()
+		cancel()
+	}
+}
+
+// stop stops all tracked commands. Commands tracked
+// after stop is called are stopped immediately.
+func (t *execTracker) stop() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.exited = true
+	for id, cancel := range t.cancels {
+		cancel()
+		delete(t.cancels, id)
+	}
+}
@@ -0,0 +1,42 @@
+// Copyright (c) 2018-2019 Sylabs, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kube
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestExecTracker(t *testing.T) {
+	var tracker execTracker
+
+	ctx1, done1 := tracker.track(context.Background())
+	ctx2, _ := tracker.track(context.Background())
+
+	done1()
+	require.Error(t, ctx1.Err(), "finished command context should be done")
+	require.NoError(t, ctx2.Err(), "running command should not be stopped")
+	require.Len(t, tracker.cancels, 1)
+
+	tracker.stop()
+	require.Error(t, ctx2.Err(), "running command should be stopped on exit")
+	require.Empty(t, tracker.cancels)
+
+	ctx3, done3 := tracker.track(context.Background())
+	require.Error(t, ctx3.Err(), "command should not start after exit")
+	done3()
+}
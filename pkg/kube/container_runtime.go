@@ -31,10 +31,14 @@ func (c *Container) spawnOCIContainer() error {
 
 	syncCtx, cancel := context.WithCancel(context.Background())
 	c.syncCancel = cancel
-	c.syncChan, err = runtime.ObserveState(syncCtx, c.socketPath())
+	c.sync, err = runtime.Observe(syncCtx, c.socketPath(),
+		runtime.WithContainerID(c.id),
+		runtime.OnState(runtime.StateExited, c.onExited),
+	)
 	if err != nil {
 		return fmt.Errorf("could not listen for state changes: %v", err)
 	}
+	c.syncChan = c.sync.States()
 
 	glog.V(3).Infof("Creating container %s", c.id)
 	// Allocate PTY only if no TTY was explicitly requested by a user.
@@ -72,8 +76,33 @@ func (c *Container) Pid() int {
 	return c.ociState.Pid
 }
 
+// isLive returns true if container process is running or paused according
+// to the observer. For containers not observed by this instance, e.g. ones
+// that were created before restart, the last known state is used instead.
+func (c *Container) isLive() bool {
+	state := c.runtimeState
+	if c.sync != nil {
+		state = c.sync.Current()
+	}
+	switch state {
+	case runtime.StateRunning, runtime.StatePaused, runtime.StateResumed:
+		return true
+	}
+	return false
+}
+
+// onExited stops commands executed inside the container once it exits.
+func (c *Container) onExited(runtime.StateEvent) error {
+	c.execs.stop()
+	return nil
+}
+
 func (c *Container) expectState(expect runtime.State) error {
 	c.runtimeState = <-c.syncChan
+	// runtime may report it is preparing container before creating it
+	for c.runtimeState == runtime.StatePreparing && expect != runtime.StatePreparing {
+		c.runtimeState = <-c.syncChan
+	}
 	if c.runtimeState != expect {
 		return fmt.Errorf("unexpected container state: %v", c.runtimeState)
 	}
@@ -19,7 +19,6 @@ import (
 	"os"
 	"strconv"
 
-	"github.com/containerd/cgroups"
 	"github.com/opencontainers/runtime-spec/specs-go"
 	"github.com/sylabs/singularity-cri/pkg/fs"
 	k8s "k8s.io/kubernetes/pkg/kubelet/apis/cri/runtime/v1alpha2"
@@ -35,38 +34,29 @@ type ContainerStat struct {
 	CPU uint64
 }
 
-// Stat fetches information about container resources usage. This method
-// implies that cpuacct and memory cgroups controllers are mounted on host
-// at /sys/fs/cgroups/cpuacct and  /sys/fs/cgroups/memory respectively.
+// Stat fetches information about container resources usage. CPU and memory
+// usage are read from container's cgroup only while observer reports container
+// is live, i.e. running or paused, they are zero otherwise. Both cgroup v1 and
+// v2 hierarchies are supported, v1 controllers are expected to be mounted on
+// host at /sys/fs/cgroup/cpuacct and /sys/fs/cgroup/memory respectively.
 func (c *Container) Stat() (*ContainerStat, error) {
 	fsInfo, err := fs.Usage(c.baseDir)
 	if err != nil {
 		return nil, fmt.Errorf("could not get fs usage: %v", err)
 	}
-	cgroup, err := cgroups.Load(cgroups.V1, cgroups.PidPath(c.Pid()))
-	if err != nil {
-		return nil, fmt.Errorf("could not load cgroups: %v", err)
+	stat := &ContainerStat{
+		Fs: fsInfo,
 	}
-
-	metrics, err := cgroup.Stat(cgroups.IgnoreNotExist)
-	if err != nil {
-		return nil, fmt.Errorf("could not fetch metrics: %v", err)
+	// cgroup of exited container may be removed already
+	if !c.isLive() {
+		return stat, nil
 	}
 
-	var cpuTotal uint64
-	var memoryTotal uint64
-	if metrics.CPU != nil && metrics.CPU.Usage != nil {
-		cpuTotal = metrics.CPU.Usage.Total
-	}
-	if metrics.Memory != nil && metrics.Memory.Usage != nil {
-		memoryTotal = metrics.Memory.Usage.Usage
+	stat.CPU, stat.Memory, err = readCgroupUsage(c.Pid())
+	if err != nil {
+		return nil, err
 	}
-
-	return &ContainerStat{
-		Fs:     fsInfo,
-		Memory: memoryTotal,
-		CPU:    cpuTotal,
-	}, nil
+	return stat, nil
 }
 
 // UpdateResources updates container resources according to the passed request.
@@ -52,8 +52,10 @@ type Pod struct {
 	containers []*Container
 
 	cli        *runtime.CLIClient
+	sync       *runtime.Observer
 	syncChan   <-chan runtime.State
 	syncCancel context.CancelFunc
+	forwards   execTracker
 
 	network *network.PodNetwork
 }
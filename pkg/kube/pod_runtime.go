@@ -41,10 +41,14 @@ func (p *Pod) spawnOCIPod() error {
 
 	syncCtx, cancel := context.WithCancel(context.Background())
 	p.syncCancel = cancel
-	p.syncChan, err = runtime.ObserveState(syncCtx, p.socketPath())
+	p.sync, err = runtime.Observe(syncCtx, p.socketPath(),
+		runtime.WithContainerID(p.id),
+		runtime.OnState(runtime.StateExited, p.onExited),
+	)
 	if err != nil {
 		return fmt.Errorf("could not listen for state changes: %v", err)
 	}
+	p.syncChan = p.sync.States()
 
 	glog.V(3).Infof("Creating pod %s", p.id)
 	pty, err := p.cli.Create(p.id, p.bundlePath(), false, false, "--empty-process", "--sync-socket", p.socketPath())
@@ -106,8 +110,25 @@ func (p *Pod) Pid() int {
 	return p.ociState.Pid
 }
 
+// TrackPortForward returns context that is done once the pod exits and
+// a func that should be called once port forwarding is over, so that
+// forwarding into pod's network namespace is torn down with the pod.
+func (p *Pod) TrackPortForward() (context.Context, func()) {
+	return p.forwards.track(context.Background())
+}
+
+// onExited stops port forwarding into the pod once it exits.
+func (p *Pod) onExited(runtime.StateEvent) error {
+	p.forwards.stop()
+	return nil
+}
+
 func (p *Pod) expectState(expect runtime.State) error {
 	p.runtimeState = <-p.syncChan
+	// runtime may report it is preparing pod before creating it
+	for p.runtimeState == runtime.StatePreparing && expect != runtime.StatePreparing {
+		p.runtimeState = <-p.syncChan
+	}
 	if p.runtimeState != expect {
 		return fmt.Errorf("unexpected pod state: %v", p.runtimeState)
 	}
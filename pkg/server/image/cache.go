@@ -0,0 +1,231 @@
+// Copyright (c) 2018-2019 Sylabs, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package image
+
+import (
+	"context"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/sylabs/singularity-cri/pkg/image"
+)
+
+// CacheStats holds image cache counters that may be used for monitoring.
+type CacheStats struct {
+	// Hits is the number of pulls that were served without downloading an image.
+	Hits uint64
+	// Misses is the number of pulls that resulted in image download.
+	Misses uint64
+	// Evictions is the number of images removed to fit into storage quota.
+	Evictions uint64
+}
+
+// imageCache keeps track of pulled images stored by their digest. It makes sure
+// concurrent pulls of the same image result in a single download and selects
+// least recently used images for eviction once storage quota is exceeded.
+type imageCache struct {
+	quota uint64 // zero means no quota
+
+	mu      sync.Mutex
+	entries map[string]*cacheEntry
+	pulls   map[string]*pullCall
+	stats   CacheStats
+}
+
+type cacheEntry struct {
+	info     *image.Info
+	refs     int
+	lastUsed time.Time
+}
+
+// pullCall is an in-flight pull other pullers of the same image wait for.
+type pullCall struct {
+	done chan struct{}
+	info *image.Info
+	err  error
+	// abandoned is set when pull failed because ctx of the puller
+	// that called fn is done, so waiters should retry it themselves.
+	abandoned bool
+}
+
+func newImageCache(quota uint64) *imageCache {
+	return &imageCache{
+		quota:   quota,
+		entries: make(map[string]*cacheEntry),
+		pulls:   make(map[string]*pullCall),
+	}
+}
+
+// track adds already stored image to the cache without counting it as a miss.
+// Image modification time is used as its last usage time.
+func (c *imageCache) track(info *image.Info) {
+	lastUsed := time.Now()
+	if fi, err := os.Stat(info.Path); err == nil {
+		lastUsed = fi.ModTime()
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries[info.ID] = &cacheEntry{
+		info:     info,
+		lastUsed: lastUsed,
+	}
+}
+
+// hit looks for image with the passed ID in the cache and bumps its reference
+// count if found. It returns false if image should be downloaded.
+func (c *imageCache) hit(id string) (*image.Info, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entry, ok := c.entries[id]
+	if !ok {
+		return nil, false
+	}
+	c.use(entry)
+	c.stats.Hits++
+	return entry.info, true
+}
+
+// pull calls fn to download the image unless image with the same key is being
+// pulled already, in which case it waits for that pull to complete and returns
+// its result. Successfully pulled image is added to the cache. Passed fn should
+// be bound to ctx: if it fails once ctx is done, the pull is considered abandoned
+// and one of the waiters calls its own fn instead. Waiters stop waiting once
+// their ctx is done.
+func (c *imageCache) pull(ctx context.Context, key string, fn func() (*image.Info, error)) (*image.Info, error) {
+	c.mu.Lock()
+	for {
+		call, ok := c.pulls[key]
+		if !ok {
+			break
+		}
+		c.mu.Unlock()
+		select {
+		case <-call.done:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		c.mu.Lock()
+		if call.abandoned {
+			continue
+		}
+		if call.err != nil {
+			c.mu.Unlock()
+			return nil, call.err
+		}
+		if entry, ok := c.entries[call.info.ID]; ok {
+			c.use(entry)
+		}
+		c.stats.Hits++
+		c.mu.Unlock()
+		return call.info, nil
+	}
+	call := &pullCall{done: make(chan struct{})}
+	c.pulls[key] = call
+	c.mu.Unlock()
+
+	call.info, call.err = fn()
+
+	c.mu.Lock()
+	delete(c.pulls, key)
+	c.stats.Misses++
+	call.abandoned = call.err != nil && ctx.Err() != nil
+	if call.err == nil {
+		entry, ok := c.entries[call.info.ID]
+		if !ok {
+			entry = &cacheEntry{info: call.info}
+			c.entries[call.info.ID] = entry
+		}
+		c.use(entry)
+	}
+	c.mu.Unlock()
+	close(call.done)
+	return call.info, call.err
+}
+
+// use must be called with c.mu held.
+func (c *imageCache) use(entry *cacheEntry) {
+	entry.refs++
+	entry.lastUsed = time.Now()
+}
+
+// refs returns how many times image was pulled since it was added to the cache.
+func (c *imageCache) refs(id string) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entry, ok := c.entries[id]
+	if !ok {
+		return 0
+	}
+	return entry.refs
+}
+
+// remove removes image from the cache. It is called once image
+// is removed from the storage.
+func (c *imageCache) remove(id string, evicted bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	delete(c.entries, id)
+	if evicted {
+		c.stats.Evictions++
+	}
+}
+
+// victims returns least recently used images that should be removed to fit into
+// the quota. Images that are used by containers and image with keep ID are
+// never selected. When quota cannot be met with the rest images, all of them
+// are returned.
+func (c *imageCache) victims(keep string) []*image.Info {
+	if c.quota == 0 {
+		return nil
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var total uint64
+	candidates := make([]*cacheEntry, 0, len(c.entries))
+	for id, entry := range c.entries {
+		total += entry.info.Size
+		if id != keep && len(entry.info.UsedBy()) == 0 {
+			candidates = append(candidates, entry)
+		}
+	}
+	sort.Slice(candidates, func(i, j int) bool {
+		return candidates[i].lastUsed.Before(candidates[j].lastUsed)
+	})
+
+	var victims []*image.Info
+	for _, entry := range candidates {
+		if total <= c.quota {
+			break
+		}
+		victims = append(victims, entry.info)
+		total -= entry.info.Size
+	}
+	return victims
+}
+
+// counters returns current cache counters.
+func (c *imageCache) counters() CacheStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.stats
+}
@@ -0,0 +1,176 @@
+// Copyright (c) 2018-2019 Sylabs, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package image
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/sylabs/singularity-cri/pkg/image"
+)
+
+func TestImageCache_Pull(t *testing.T) {
+	c := newImageCache(0)
+
+	var downloads int32
+	release := make(chan struct{})
+	pull := func() (*image.Info, error) {
+		atomic.AddInt32(&downloads, 1)
+		<-release
+		return &image.Info{ID: "foo", Size: 1}, nil
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			info, err := c.pull(context.Background(), "foo", pull)
+			require.NoError(t, err)
+			require.Equal(t, "foo", info.ID)
+		}()
+	}
+	// give all pullers a chance to join the first pull
+	time.Sleep(time.Millisecond * 50)
+	close(release)
+	wg.Wait()
+
+	require.Equal(t, int32(1), downloads)
+	require.Equal(t, CacheStats{Hits: 3, Misses: 1}, c.counters())
+	require.Equal(t, 4, c.refs("foo"))
+
+	info, ok := c.hit("foo")
+	require.True(t, ok)
+	require.Equal(t, "foo", info.ID)
+	_, ok = c.hit("bar")
+	require.False(t, ok)
+	require.Equal(t, CacheStats{Hits: 4, Misses: 1}, c.counters())
+	require.Equal(t, 5, c.refs("foo"))
+}
+
+func TestImageCache_PullError(t *testing.T) {
+	c := newImageCache(0)
+
+	_, err := c.pull(context.Background(), "foo", func() (*image.Info, error) {
+		return nil, fmt.Errorf("no network")
+	})
+	require.EqualError(t, err, "no network")
+	_, ok := c.hit("foo")
+	require.False(t, ok)
+	require.Equal(t, CacheStats{Misses: 1}, c.counters())
+}
+
+func TestImageCache_PullAbandoned(t *testing.T) {
+	c := newImageCache(0)
+
+	ctxA, cancelA := context.WithCancel(context.Background())
+	started := make(chan struct{})
+	errA := make(chan error, 1)
+	go func() {
+		_, err := c.pull(ctxA, "foo", func() (*image.Info, error) {
+			close(started)
+			<-ctxA.Done()
+			return nil, fmt.Errorf("could not pull image: %v", ctxA.Err())
+		})
+		errA <- err
+	}()
+	<-started
+
+	resB := make(chan error, 1)
+	go func() {
+		info, err := c.pull(context.Background(), "foo", func() (*image.Info, error) {
+			return &image.Info{ID: "foo", Size: 1}, nil
+		})
+		if err == nil && info.ID != "foo" {
+			err = fmt.Errorf("unexpected image %s", info.ID)
+		}
+		resB <- err
+	}()
+	// let the second puller join the first pull before it is canceled
+	time.Sleep(time.Millisecond * 50)
+	cancelA()
+
+	require.EqualError(t, <-errA, "could not pull image: context canceled")
+	require.NoError(t, <-resB)
+	require.Equal(t, CacheStats{Misses: 2}, c.counters())
+	require.Equal(t, 1, c.refs("foo"))
+}
+
+func TestImageCache_Victims(t *testing.T) {
+	pull := func(c *imageCache, id string, size uint64) *image.Info {
+		info, err := c.pull(context.Background(), id, func() (*image.Info, error) {
+			return &image.Info{ID: id, Size: size}, nil
+		})
+		require.NoError(t, err)
+		return info
+	}
+
+	tt := []struct {
+		name          string
+		quota         uint64
+		keep          string
+		used          string
+		expectVictims []string
+	}{
+		{
+			name: "no quota",
+		},
+		{
+			name:  "within quota",
+			quota: 6,
+		},
+		{
+			name:          "least recently used",
+			quota:         5,
+			expectVictims: []string{"first"},
+		},
+		{
+			name:          "keep",
+			quota:         3,
+			keep:          "first",
+			expectVictims: []string{"second", "third"},
+		},
+		{
+			name:          "used",
+			quota:         3,
+			used:          "second",
+			expectVictims: []string{"first", "third"},
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			c := newImageCache(tc.quota)
+			for i, id := range []string{"first", "second", "third"} {
+				info := pull(c, id, uint64(i+1))
+				if id == tc.used {
+					info.Borrow("container")
+				}
+				time.Sleep(time.Millisecond)
+			}
+
+			var victims []string
+			for _, info := range c.victims(tc.keep) {
+				victims = append(victims, info.ID)
+			}
+			require.Equal(t, tc.expectVictims, victims)
+		})
+	}
+}
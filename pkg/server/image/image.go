@@ -32,6 +32,7 @@ import (
 	"github.com/sylabs/singularity-cri/pkg/image"
 	"github.com/sylabs/singularity-cri/pkg/index"
 	"github.com/sylabs/singularity-cri/pkg/singularity"
+	"github.com/sylabs/singularity-cri/pkg/slice"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
 	k8s "k8s.io/kubernetes/pkg/kubelet/apis/cri/runtime/v1alpha2"
@@ -46,11 +47,27 @@ type SingularityRegistry struct {
 
 	m        sync.Mutex
 	infoFile *os.File
+
+	quota   uint64
+	cache   *imageCache
+	evictMu sync.Mutex
+}
+
+// Option is run during SingularityRegistry initialization.
+type Option func(s *SingularityRegistry)
+
+// WithStorageQuota sets maximum total size in bytes of pulled images. Once it
+// is exceeded least recently used images that are not used by any container
+// are removed. Zero quota, which is the default, disables eviction.
+func WithStorageQuota(bytes uint64) Option {
+	return func(s *SingularityRegistry) {
+		s.quota = bytes
+	}
 }
 
 // NewSingularityRegistry initializes and returns SingularityRuntime.
 // Singularity must be installed on the host otherwise it will return an error.
-func NewSingularityRegistry(storePath string, index *index.ImageIndex) (*SingularityRegistry, error) {
+func NewSingularityRegistry(storePath string, index *index.ImageIndex, opts ...Option) (*SingularityRegistry, error) {
 	_, err := exec.LookPath(singularity.RuntimeName)
 	if err != nil {
 		return nil, fmt.Errorf("could not find %s on this machine: %v", singularity.RuntimeName, err)
@@ -65,6 +82,10 @@ func NewSingularityRegistry(storePath string, index *index.ImageIndex) (*Singula
 		storage: storePath,
 		images:  index,
 	}
+	for _, opt := range opts {
+		opt(&registry)
+	}
+	registry.cache = newImageCache(registry.quota)
 
 	if err := os.MkdirAll(storePath, 0755); err != nil {
 		return nil, fmt.Errorf("could not create storage directory: %v", err)
@@ -77,6 +98,7 @@ func NewSingularityRegistry(storePath string, index *index.ImageIndex) (*Singula
 	if err != nil {
 		return nil, err
 	}
+	registry.evict("")
 	return &registry, nil
 }
 
@@ -92,12 +114,23 @@ func (s *SingularityRegistry) Shutdown() error {
 	return nil
 }
 
-// PullImage pulls an image with authentication config.
+// PullImage pulls an image with authentication config. Images that are already
+// present are not pulled again, concurrent pulls of the same image result
+// in a single download.
 func (s *SingularityRegistry) PullImage(ctx context.Context, req *k8s.PullImageRequest) (*k8s.PullImageResponse, error) {
 	ref, err := image.ParseRef(req.Image.Image)
 	if err != nil {
 		return nil, status.Errorf(codes.InvalidArgument, "could not parse image reference: %v", err)
 	}
+	if ref.URI() == singularity.LocalFileDomain {
+		info, err := s.pull(ctx, ref, req.GetAuth())
+		if err != nil {
+			return nil, err
+		}
+		return &k8s.PullImageResponse{
+			ImageRef: info.ID,
+		}, nil
+	}
 
 	info, err := image.LibraryInfo(ctx, ref, req.GetAuth())
 	if err == image.ErrNotFound {
@@ -106,31 +139,30 @@ func (s *SingularityRegistry) PullImage(ctx context.Context, req *k8s.PullImageR
 	if err != nil && err != image.ErrNotLibrary {
 		return nil, status.Errorf(codes.Internal, "could not get %s image metadata: %v", ref, err)
 	}
+
+	// image digest is known in advance only for library images
+	key := ref.String()
 	if info != nil {
-		_, err := s.images.Find(info.Sha256)
-		if err == nil {
+		if cached, ok := s.cache.hit(info.ID); ok {
 			glog.V(2).Infof("Image %s is already present with the same checksum, skipping pull", ref)
 			return &k8s.PullImageResponse{
-				ImageRef: info.ID,
+				ImageRef: cached.ID,
 			}, nil
 		}
+		key = info.ID
 	}
 
-	info, err = image.Pull(ctx, s.storage, ref, req.GetAuth())
+	info, err = s.cache.pull(ctx, key, func() (*image.Info, error) {
+		return s.pull(ctx, ref, req.GetAuth())
+	})
 	if err != nil {
-		return nil, status.Errorf(codes.Internal, "could not pull image: %v", err)
-	}
-	if err := info.Verify(); err != nil {
-		info.Remove()
-		return nil, status.Errorf(codes.InvalidArgument, "could not verify image: %v", err)
-	}
-	if err = s.images.Add(info); err != nil {
-		info.Remove()
-		return nil, status.Errorf(codes.Internal, "could not index image: %v", err)
-	}
-	if err = s.dumpInfo(); err != nil {
-		glog.Errorf("Could not dump registry info: %v", err)
+		if _, ok := status.FromError(err); ok {
+			return nil, err
+		}
+		// waiter's own context is done, tell timeout from cancellation
+		return nil, status.Errorf(status.FromContextError(err).Code(), "could not pull image: %v", err)
 	}
+	s.evict(info.ID)
 	return &k8s.PullImageResponse{
 		ImageRef: info.ID,
 	}, nil
@@ -138,6 +170,9 @@ func (s *SingularityRegistry) PullImage(ctx context.Context, req *k8s.PullImageR
 
 // RemoveImage removes the image.
 // This call is idempotent, and does not return an error if the image has already been removed.
+// Image referenced by the passed tag along with other tags is only untagged and is
+// still available under the rest of them. Image file is removed only once no container
+// uses the image, otherwise FailedPrecondition error is returned.
 func (s *SingularityRegistry) RemoveImage(ctx context.Context, req *k8s.RemoveImageRequest) (*k8s.RemoveImageResponse, error) {
 	info, err := s.images.Find(req.Image.Image)
 	if err == index.ErrNotFound {
@@ -146,6 +181,16 @@ func (s *SingularityRegistry) RemoveImage(ctx context.Context, req *k8s.RemoveIm
 	if err != nil {
 		return nil, status.Errorf(codes.InvalidArgument, "could not find image: %v", err)
 	}
+	tag := image.NormalizedImageRef(req.Image.Image)
+	if tags := info.Ref.Tags(); len(tags) > 1 && slice.ContainsString(tags, tag) {
+		if err := s.images.Untag(tag); err != nil {
+			return nil, status.Errorf(codes.Internal, "could not untag image: %v", err)
+		}
+		if err = s.dumpInfo(); err != nil {
+			glog.Errorf("Could not dump registry info: %v", err)
+		}
+		return &k8s.RemoveImageResponse{}, nil
+	}
 	err = info.Remove()
 	if err == image.ErrIsUsed {
 		return nil, status.Errorf(codes.FailedPrecondition, "unable to remove image: %v", err)
@@ -156,6 +201,7 @@ func (s *SingularityRegistry) RemoveImage(ctx context.Context, req *k8s.RemoveIm
 	if err := s.images.Remove(info.ID); err != nil {
 		return nil, status.Errorf(codes.Internal, "could not remove image from index: %v", err)
 	}
+	s.cache.remove(info.ID, false)
 	if err = s.dumpInfo(); err != nil {
 		glog.Errorf("Could not dump registry info: %v", err)
 	}
@@ -177,40 +223,25 @@ func (s *SingularityRegistry) ImageStatus(ctx context.Context, req *k8s.ImageSta
 	if req.Verbose {
 		verboseInfo = map[string]string{
 			"usedBy": fmt.Sprintf("%v", info.UsedBy()),
+			"pulls":  strconv.Itoa(s.cache.refs(info.ID)),
+			"sha256": info.Sha256,
 		}
-	}
-
-	var uid *k8s.Int64Value
-	var username string
-	if info.OciConfig != nil && info.OciConfig.User != "" {
-		// If conf.User is not empty, possible options are:
-		//     * "user"
-		//     * "uid"
-		//     * "user:group"
-		//     * "uid:gid
-		//     * "user:gid"
-		//     * "uid:group"
-		user := strings.Split(info.OciConfig.User, ":")[0]
-		userID, err := strconv.ParseInt(user, 10, 32)
-		if err != nil {
-			username = user
-		} else {
-			uid = &k8s.Int64Value{
-				Value: userID,
-			}
+		// k8s image has no place for these, so they are reported in verbose info only
+		if info.Arch != "" {
+			verboseInfo["arch"] = info.Arch
+		}
+		if len(info.Labels) > 0 {
+			labels, _ := json.Marshal(info.Labels)
+			verboseInfo["labels"] = string(labels)
+		}
+		if info.CompressionRatio != 0 {
+			verboseInfo["compressionRatio"] = strconv.FormatFloat(info.CompressionRatio, 'f', 2, 64)
 		}
-
 	}
+
 	return &k8s.ImageStatusResponse{
-		Image: &k8s.Image{
-			Id:          info.ID,
-			RepoTags:    info.Ref.Tags(),
-			RepoDigests: info.Ref.Digests(),
-			Size_:       info.Size,
-			Uid:         uid,
-			Username:    username,
-		},
-		Info: verboseInfo,
+		Image: k8sImage(info),
+		Info:  verboseInfo,
 	}, nil
 }
 
@@ -219,12 +250,7 @@ func (s *SingularityRegistry) ListImages(ctx context.Context, req *k8s.ListImage
 	var imgs []*k8s.Image
 	appendToResult := func(info *image.Info) {
 		if info.Matches(req.Filter) {
-			imgs = append(imgs, &k8s.Image{
-				Id:          info.ID,
-				RepoTags:    info.Ref.Tags(),
-				RepoDigests: info.Ref.Digests(),
-				Size_:       info.Size,
-			})
+			imgs = append(imgs, k8sImage(info))
 		}
 	}
 	s.images.Iterate(appendToResult)
@@ -259,6 +285,89 @@ func (s *SingularityRegistry) ImageFsInfo(context.Context, *k8s.ImageFsInfoReque
 	}, nil
 }
 
+// CacheStats returns image cache hit, miss and eviction counters.
+func (s *SingularityRegistry) CacheStats() CacheStats {
+	return s.cache.counters()
+}
+
+// pull downloads image referenced by ref, verifies and indexes it.
+func (s *SingularityRegistry) pull(ctx context.Context, ref *image.Reference, auth *k8s.AuthConfig) (*image.Info, error) {
+	info, err := image.Pull(ctx, s.storage, ref, auth)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "could not pull image: %v", err)
+	}
+	if err := info.Verify(); err != nil {
+		info.Remove()
+		return nil, status.Errorf(codes.InvalidArgument, "could not verify image: %v", err)
+	}
+	if err = s.images.Add(info); err != nil {
+		info.Remove()
+		return nil, status.Errorf(codes.Internal, "could not index image: %v", err)
+	}
+	if err = s.dumpInfo(); err != nil {
+		glog.Errorf("Could not dump registry info: %v", err)
+	}
+	return info, nil
+}
+
+// evict removes least recently used images until pulled images fit into
+// storage quota. Image with keep ID is never removed.
+func (s *SingularityRegistry) evict(keep string) {
+	s.evictMu.Lock()
+	defer s.evictMu.Unlock()
+
+	victims := s.cache.victims(keep)
+	if len(victims) == 0 {
+		return
+	}
+	for _, info := range victims {
+		glog.V(2).Infof("Evicting image %s to fit into storage quota", info.ID)
+		if err := info.Remove(); err != nil {
+			glog.Errorf("Could not evict image %s: %v", info.ID, err)
+			continue
+		}
+		if err := s.images.Remove(info.ID); err != nil {
+			glog.Errorf("Could not remove evicted image %s from index: %v", info.ID, err)
+		}
+		s.cache.remove(info.ID, true)
+	}
+	if err := s.dumpInfo(); err != nil {
+		glog.Errorf("Could not dump registry info: %v", err)
+	}
+}
+
+// k8sImage converts image info to k8s image.
+func k8sImage(info *image.Info) *k8s.Image {
+	var uid *k8s.Int64Value
+	var username string
+	if info.OciConfig != nil && info.OciConfig.User != "" {
+		// If conf.User is not empty, possible options are:
+		//     * "user"
+		//     * "uid"
+		//     * "user:group"
+		//     * "uid:gid
+		//     * "user:gid"
+		//     * "uid:group"
+		user := strings.Split(info.OciConfig.User, ":")[0]
+		userID, err := strconv.ParseInt(user, 10, 32)
+		if err != nil {
+			username = user
+		} else {
+			uid = &k8s.Int64Value{
+				Value: userID,
+			}
+		}
+	}
+	return &k8s.Image{
+		Id:          info.ID,
+		RepoTags:    info.Ref.Tags(),
+		RepoDigests: info.Ref.Digests(),
+		Size_:       info.Size,
+		Uid:         uid,
+		Username:    username,
+	}
+}
+
 // loadInfo reads backup file and restores registry according to it.
 func (s *SingularityRegistry) loadInfo() error {
 	s.m.Lock()
@@ -282,6 +391,7 @@ func (s *SingularityRegistry) loadInfo() error {
 		if err != nil {
 			return fmt.Errorf("could not add decoded image to index: %v", err)
 		}
+		s.cache.track(info)
 	}
 
 	return nil
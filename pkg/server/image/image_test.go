@@ -0,0 +1,158 @@
+// Copyright (c) 2018-2019 Sylabs, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package image
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/sylabs/singularity-cri/pkg/image"
+	"github.com/sylabs/singularity-cri/pkg/index"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	k8s "k8s.io/kubernetes/pkg/kubelet/apis/cri/runtime/v1alpha2"
+)
+
+func TestSingularityRegistry_RemoveImage(t *testing.T) {
+	storage, err := ioutil.TempDir("", "registry-")
+	require.NoError(t, err)
+	defer os.RemoveAll(storage)
+	infoFile, err := os.Create(filepath.Join(storage, registryInfoFile))
+	require.NoError(t, err)
+	s := &SingularityRegistry{
+		storage:  storage,
+		images:   index.NewImageIndex(),
+		infoFile: infoFile,
+		cache:    newImageCache(0),
+	}
+	defer s.Shutdown()
+
+	addImage := func(id string, tags ...string) *image.Info {
+		ref, err := image.ParseRef(tags[0])
+		require.NoError(t, err)
+		ref.AddTags(tags[1:])
+		info := &image.Info{
+			ID:   id,
+			Path: filepath.Join(storage, id),
+			Ref:  ref,
+		}
+		require.NoError(t, ioutil.WriteFile(info.Path, []byte(id), 0644))
+		require.NoError(t, s.images.Add(info))
+		s.cache.track(info)
+		return info
+	}
+	remove := func(ref string) error {
+		_, err := s.RemoveImage(context.Background(), &k8s.RemoveImageRequest{
+			Image: &k8s.ImageSpec{Image: ref},
+		})
+		return err
+	}
+
+	busybox := addImage("2d4c0fae1bfba9ed7e4a1b4bbba9a9a4cd0b9e8f1a06d8a6e7e1c3c4a1b2c3d4",
+		"busybox:1.29",
+		"busybox:latest",
+	)
+	alpine := addImage("5f1c0fae1bfba9ed7e4a1b4bbba9a9a4cd0b9e8f1a06d8a6e7e1c3c4a1b2c3d4",
+		"alpine:3.8",
+	)
+
+	t.Run("referenced image", func(t *testing.T) {
+		alpine.Borrow("container")
+		defer alpine.Return("container")
+
+		err := remove("alpine:3.8")
+		require.Equal(t, codes.FailedPrecondition, status.Code(err))
+		require.FileExists(t, alpine.Path)
+		_, err = s.images.Find(alpine.ID)
+		require.NoError(t, err)
+	})
+
+	t.Run("unreferenced image", func(t *testing.T) {
+		require.NoError(t, remove("alpine:3.8"))
+		_, err := os.Stat(alpine.Path)
+		require.True(t, os.IsNotExist(err), "image file is not removed")
+		_, err = s.images.Find(alpine.ID)
+		require.Equal(t, index.ErrNotFound, err)
+		require.Equal(t, 0, s.cache.refs(alpine.ID))
+
+		// removal is idempotent
+		require.NoError(t, remove("alpine:3.8"))
+	})
+
+	t.Run("image with multiple tags", func(t *testing.T) {
+		busybox.Borrow("container")
+		require.NoError(t, remove("busybox"))
+		require.FileExists(t, busybox.Path)
+		require.Equal(t, []string{"busybox:1.29"}, busybox.Ref.Tags())
+		found, err := s.images.Find("busybox:1.29")
+		require.NoError(t, err)
+		require.Equal(t, busybox.ID, found.ID)
+
+		// the last tag removes image once it is not used
+		err = remove("busybox:1.29")
+		require.Equal(t, codes.FailedPrecondition, status.Code(err))
+		busybox.Return("container")
+		require.NoError(t, remove("busybox:1.29"))
+		_, err = os.Stat(busybox.Path)
+		require.True(t, os.IsNotExist(err), "image file is not removed")
+	})
+}
+
+func TestSingularityRegistry_PullImageWaiter(t *testing.T) {
+	tt := []struct {
+		name       string
+		ctx        func() (context.Context, context.CancelFunc)
+		expectCode codes.Code
+	}{
+		{
+			name: "timeout",
+			ctx: func() (context.Context, context.CancelFunc) {
+				return context.WithTimeout(context.Background(), 10*time.Millisecond)
+			},
+			expectCode: codes.DeadlineExceeded,
+		},
+		{
+			name: "canceled",
+			ctx: func() (context.Context, context.CancelFunc) {
+				ctx, cancel := context.WithCancel(context.Background())
+				time.AfterFunc(10*time.Millisecond, cancel)
+				return ctx, cancel
+			},
+			expectCode: codes.Canceled,
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			s := &SingularityRegistry{cache: newImageCache(0)}
+			ref, err := image.ParseRef("docker://busybox")
+			require.NoError(t, err)
+			// other pull of the same image never finishes
+			s.cache.pulls[ref.String()] = &pullCall{done: make(chan struct{})}
+
+			ctx, cancel := tc.ctx()
+			defer cancel()
+			_, err = s.PullImage(ctx, &k8s.PullImageRequest{
+				Image: &k8s.ImageSpec{Image: "docker://busybox"},
+			})
+			require.Equal(t, tc.expectCode, status.Code(err), "unexpected error: %v", err)
+		})
+	}
+}
@@ -54,6 +54,8 @@ type SingularityRuntime struct {
 	streaming streaming.Server
 
 	networkManager *network.Manager
+
+	status statusCache
 }
 
 // Option is run during SingularityRuntime initialization.
@@ -288,7 +290,8 @@ func (s *SingularityRuntime) PortForward(ctx context.Context, req *k8s.PortForwa
 }
 
 // ContainerStats returns stats of the container. If the container does not
-// exist, the call returns an error.
+// exist, the call returns an error. CPU and memory usage of container that
+// is not running are zero.
 func (s *SingularityRuntime) ContainerStats(ctx context.Context, req *k8s.ContainerStatsRequest) (*k8s.ContainerStatsResponse, error) {
 	c, err := s.findContainer(req.ContainerId)
 	if err != nil {
@@ -346,7 +349,9 @@ func (s *SingularityRuntime) UpdateRuntimeConfig(ctx context.Context, req *k8s.U
 	return &k8s.UpdateRuntimeConfigResponse{}, nil
 }
 
-// Status returns the status of the runtime.
+// Status returns the status of the runtime. Runtime is reported as ready
+// when singularity is installed, its version is compatible and the base
+// run directory is writable. Results of those checks are cached briefly.
 func (s *SingularityRuntime) Status(ctx context.Context, req *k8s.StatusRequest) (*k8s.StatusResponse, error) {
 	runtimeReady := &k8s.RuntimeCondition{
 		Type:   k8s.RuntimeReady,
@@ -357,15 +362,31 @@ func (s *SingularityRuntime) Status(ctx context.Context, req *k8s.StatusRequest)
 		Status: true,
 	}
 	conditions := []*k8s.RuntimeCondition{runtimeReady, networkReady}
+
+	cond := s.runtimeCondition(ctx)
+	if cond.reason != "" {
+		runtimeReady.Status = false
+		runtimeReady.Reason = cond.reason
+		runtimeReady.Message = cond.message
+	}
 	if err := s.networkManager.Status(); err != nil {
 		networkReady.Status = false
 		networkReady.Reason = "NetworkNotReady"
 		networkReady.Message = fmt.Sprintf("sycri: network is not ready: %v", err)
 	}
+
+	var info map[string]string
+	if req.GetVerbose() {
+		info = map[string]string{
+			"runtimeName":    singularity.RuntimeName,
+			"runtimeVersion": cond.version,
+		}
+	}
 	return &k8s.StatusResponse{
 		Status: &k8s.RuntimeStatus{
 			Conditions: conditions,
 		},
+		Info: info,
 	}, nil
 }
 
@@ -0,0 +1,154 @@
+// Copyright (c) 2018-2019 Sylabs, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package runtime
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// statusCacheTTL is how long the result of runtime readiness
+	// checks is reused before Singularity is queried again.
+	statusCacheTTL = 5 * time.Second
+	// statusCheckTimeout limits how long singularity
+	// is waited for during runtime readiness checks.
+	statusCheckTimeout = 2 * time.Second
+
+	// minMajorVersion and minMinorVersion define the oldest
+	// Singularity release that is known to work with sycri.
+	minMajorVersion = 3
+	minMinorVersion = 1
+)
+
+var versionRe = regexp.MustCompile(`(\d+)\.(\d+)(?:\.(\d+))?`)
+
+// runtimeCondition holds the outcome of runtime readiness checks.
+// Empty reason means runtime is ready.
+type runtimeCondition struct {
+	version string
+	reason  string
+	message string
+}
+
+// statusCache caches runtimeCondition for statusCacheTTL to avoid
+// shelling out to singularity on each Status call.
+type statusCache struct {
+	mu      sync.Mutex
+	checked time.Time
+	cond    runtimeCondition
+}
+
+// runtimeCondition returns cached runtime readiness conditions, re-running
+// checks when cache is empty or outdated. Checks run without holding the
+// cache lock and are bound to ctx, so a hanging singularity binary never
+// blocks other callers for longer than statusCheckTimeout.
+func (s *SingularityRuntime) runtimeCondition(ctx context.Context) runtimeCondition {
+	s.status.mu.Lock()
+	if !s.status.checked.IsZero() && time.Since(s.status.checked) < statusCacheTTL {
+		cond := s.status.cond
+		s.status.mu.Unlock()
+		return cond
+	}
+	s.status.mu.Unlock()
+
+	checkCtx, cancel := context.WithTimeout(ctx, statusCheckTimeout)
+	defer cancel()
+	cond := s.checkRuntime(checkCtx)
+	// result of checks interrupted by the caller going away is not cached
+	if ctx.Err() != nil {
+		return cond
+	}
+
+	s.status.mu.Lock()
+	defer s.status.mu.Unlock()
+	s.status.cond = cond
+	s.status.checked = time.Now()
+	return cond
+}
+
+// checkRuntime verifies singularity binary is present and of a compatible
+// version and that base run directory, where sync sockets are created, is writable.
+// Singularity is killed once ctx is done.
+func (s *SingularityRuntime) checkRuntime(ctx context.Context) runtimeCondition {
+	if _, err := exec.LookPath(s.singularity); err != nil {
+		return runtimeCondition{
+			reason:  "SingularityNotFound",
+			message: fmt.Sprintf("sycri: could not find singularity: %v", err),
+		}
+	}
+
+	out, err := exec.CommandContext(ctx, s.singularity, "version").Output()
+	if err != nil {
+		return runtimeCondition{
+			reason:  "SingularityVersionFailed",
+			message: fmt.Sprintf("sycri: could not get singularity version: %v", err),
+		}
+	}
+	version := strings.TrimSpace(string(out))
+	if err := checkVersion(version); err != nil {
+		return runtimeCondition{
+			version: version,
+			reason:  "IncompatibleVersion",
+			message: fmt.Sprintf("sycri: %v", err),
+		}
+	}
+
+	if err := checkWritable(s.baseRunDir); err != nil {
+		return runtimeCondition{
+			version: version,
+			reason:  "RunDirNotWritable",
+			message: fmt.Sprintf("sycri: run directory is not writable: %v", err),
+		}
+	}
+	return runtimeCondition{version: version}
+}
+
+// checkVersion returns an error if passed singularity version is not
+// supported or cannot be parsed.
+func checkVersion(version string) error {
+	match := versionRe.FindStringSubmatch(version)
+	if match == nil {
+		return fmt.Errorf("could not parse singularity version %q", version)
+	}
+	major, _ := strconv.Atoi(match[1])
+	minor, _ := strconv.Atoi(match[2])
+	if major < minMajorVersion || (major == minMajorVersion && minor < minMinorVersion) {
+		return fmt.Errorf("singularity version %s is not supported, at least %d.%d is required",
+			version, minMajorVersion, minMinorVersion)
+	}
+	return nil
+}
+
+// checkWritable makes sure dir exists and a file can be created in it.
+func checkWritable(dir string) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	f, err := ioutil.TempFile(dir, ".sycri-status-")
+	if err != nil {
+		return err
+	}
+	f.Close()
+	return os.Remove(f.Name())
+}
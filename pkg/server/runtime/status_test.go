@@ -0,0 +1,107 @@
+// Copyright (c) 2018-2019 Sylabs, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package runtime
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestCheckVersion(t *testing.T) {
+	tt := []struct {
+		name      string
+		version   string
+		expectErr bool
+	}{
+		{
+			name:    "release",
+			version: "3.1.0",
+		},
+		{
+			name:    "development build",
+			version: "3.1.0-354.g3bc381b61",
+		},
+		{
+			name:    "with prefix",
+			version: "singularity version 3.4.1-1.el7",
+		},
+		{
+			name:    "newer major",
+			version: "4.0",
+		},
+		{
+			name:      "old minor",
+			version:   "3.0.3",
+			expectErr: true,
+		},
+		{
+			name:      "old major",
+			version:   "2.6.1-dist",
+			expectErr: true,
+		},
+		{
+			name:      "garbage",
+			version:   "unknown",
+			expectErr: true,
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			err := checkVersion(tc.version)
+			require.Equal(t, tc.expectErr, err != nil, "unexpected error: %v", err)
+		})
+	}
+}
+
+func TestCheckWritable(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sycri-status-")
+	require.NoError(t, err, "could not create temp dir")
+	defer os.RemoveAll(dir)
+
+	runDir := filepath.Join(dir, "run")
+	require.NoError(t, checkWritable(runDir))
+	files, err := ioutil.ReadDir(runDir)
+	require.NoError(t, err, "could not read run dir")
+	require.Empty(t, files, "check file is left behind")
+
+	file := filepath.Join(dir, "file")
+	require.NoError(t, ioutil.WriteFile(file, nil, 0644))
+	require.Error(t, checkWritable(file))
+}
+
+func TestCheckRuntime_Timeout(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sycri-status-")
+	require.NoError(t, err, "could not create temp dir")
+	defer os.RemoveAll(dir)
+
+	// singularity hangs instead of reporting its version
+	singularity := filepath.Join(dir, "singularity")
+	require.NoError(t, ioutil.WriteFile(singularity, []byte("#!/bin/sh\nexec sleep 10\n"), 0755))
+	s := &SingularityRuntime{singularity: singularity, baseRunDir: filepath.Join(dir, "run")}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	cond := s.checkRuntime(ctx)
+	require.True(t, time.Since(start) < 5*time.Second, "check is not stopped with context")
+	require.Equal(t, "SingularityVersionFailed", cond.reason)
+}
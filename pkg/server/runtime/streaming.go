@@ -17,10 +17,12 @@ package runtime
 import (
 	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"os/exec"
 	"strings"
+	"syscall"
 
 	"github.com/golang/glog"
 	"github.com/kr/pty"
@@ -30,6 +32,7 @@ import (
 	"github.com/sylabs/singularity/pkg/util/unix"
 	"k8s.io/client-go/tools/remotecommand"
 	k8s "k8s.io/kubernetes/pkg/kubelet/apis/cri/runtime/v1alpha2"
+	utilexec "k8s.io/utils/exec"
 )
 
 type streamingRuntime struct {
@@ -57,7 +60,8 @@ func (s *streamingRuntime) Exec(containerID string, cmd []string,
 	var execErr error
 	if tty {
 		// stderr is nil here
-		execCmd := c.PrepareExec(cmd)
+		execCmd, execDone := c.PrepareExec(cmd)
+		defer execDone()
 
 		master, err := pty.Start(execCmd)
 		if err != nil {
@@ -100,7 +104,22 @@ func (s *streamingRuntime) Exec(containerID string, cmd []string,
 	}
 
 	glog.V(4).Infof("Exec for %s returned %v...", containerID, execErr)
-	return execErr
+	return exitError(execErr)
+}
+
+// exitError converts error of the exited command to the one streaming
+// server understands, so that exit code is propagated to the client.
+// Command killed by a signal is reported with 128+signal exit code.
+func exitError(err error) error {
+	var exitErr *exec.ExitError
+	if !errors.As(err, &exitErr) {
+		return err
+	}
+	code := exitErr.ExitCode()
+	if ws, ok := exitErr.Sys().(syscall.WaitStatus); ok && ws.Signaled() {
+		code = 128 + int(ws.Signal())
+	}
+	return utilexec.CodeExitError{Err: err, Code: code}
 }
 
 // Attach attaches passed streams to the container.
@@ -222,7 +241,8 @@ func (s *streamingRuntime) Attach(containerID string,
 }
 
 // PortForward enters pod's NET namespace to forward passed
-// stream to the given port and back.
+// stream to the given port and back. Forwarding is stopped
+// once the pod exits.
 func (s *streamingRuntime) PortForward(podSandboxID string, port int32, stream io.ReadWriteCloser) error {
 	p, err := s.runtime.pods.Find(podSandboxID)
 	if err != nil {
@@ -249,8 +269,11 @@ func (s *streamingRuntime) PortForward(podSandboxID string, port int32, stream i
 	commandString := fmt.Sprintf("%s %s", nsenterPath, strings.Join(args, " "))
 	glog.V(5).Infof("Executing port forwarding command: %s", commandString)
 
+	ctx, done := p.TrackPortForward()
+	defer done()
+
 	var stderr bytes.Buffer
-	cmd := exec.Command(nsenterPath, args...)
+	cmd := exec.CommandContext(ctx, nsenterPath, args...)
 	cmd.Stdout = stream
 	cmd.Stderr = &stderr
 
@@ -273,6 +296,9 @@ func (s *streamingRuntime) PortForward(podSandboxID string, port int32, stream i
 	}()
 
 	if err := cmd.Run(); err != nil {
+		if ctx.Err() != nil {
+			return fmt.Errorf("pod %s has exited", podSandboxID)
+		}
 		return fmt.Errorf("%v: %s", err, stderr.Bytes())
 	}
 
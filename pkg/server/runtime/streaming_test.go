@@ -0,0 +1,67 @@
+// Copyright (c) 2018-2019 Sylabs, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package runtime
+
+import (
+	"fmt"
+	"os/exec"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	utilexec "k8s.io/utils/exec"
+)
+
+func TestExitError(t *testing.T) {
+	tt := []struct {
+		name       string
+		cmd        *exec.Cmd
+		expectCode int
+		expectExit bool
+	}{
+		{
+			name: "command not found",
+			cmd:  exec.Command("/non/existent/command"),
+		},
+		{
+			name:       "non-zero exit code",
+			cmd:        exec.Command("sh", "-c", "exit 3"),
+			expectCode: 3,
+			expectExit: true,
+		},
+		{
+			name:       "killed by signal",
+			cmd:        exec.Command("sh", "-c", "kill -9 $$"),
+			expectCode: 137,
+			expectExit: true,
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			err := exitError(fmt.Errorf("exec returned error: %w", tc.cmd.Run()))
+			if !tc.expectExit {
+				require.Error(t, err)
+				_, ok := err.(utilexec.ExitError)
+				require.False(t, ok)
+				return
+			}
+			exitErr, ok := err.(utilexec.ExitError)
+			require.True(t, ok, "expected exit error, got %v", err)
+			require.Equal(t, tc.expectCode, exitErr.ExitStatus())
+		})
+	}
+
+	require.Nil(t, exitError(nil))
+}
@@ -149,6 +149,18 @@ func (c *CLIClient) Start(id string) error {
 	return run(cmd)
 }
 
+// Pause asks runtime to pause container with passed id.
+func (c *CLIClient) Pause(id string) error {
+	cmd := append(c.ociBaseCmd, "pause", id)
+	return run(cmd)
+}
+
+// Resume asks runtime to resume paused container with passed id.
+func (c *CLIClient) Resume(id string) error {
+	cmd := append(c.ociBaseCmd, "resume", id)
+	return run(cmd)
+}
+
 // ExecSync executes a command inside a container synchronously until
 // context is done and returns the result.
 func (c *CLIClient) ExecSync(ctx context.Context, id string, args, envs []string) (*ExecResponse, error) {
@@ -186,6 +198,7 @@ func (c *CLIClient) ExecSync(ctx context.Context, id string, args, envs []string
 }
 
 // Exec executes passed command inside a container setting io streams to passed ones.
+// If command exits with non-zero code *exec.ExitError is returned as is.
 func (c *CLIClient) Exec(ctx context.Context, id string,
 	stdin io.Reader, stdout, stderr io.Writer,
 	args, envs []string) error {
@@ -196,8 +209,10 @@ func (c *CLIClient) Exec(ctx context.Context, id string,
 	runCmd.Stdin = stdin
 
 	err := runCmd.Run()
-	_, ok := err.(*exec.ExitError)
-	if !ok && err != nil {
+	if _, ok := err.(*exec.ExitError); ok {
+		return err
+	}
+	if err != nil {
 		return fmt.Errorf("could not execute: %v", err)
 	}
 	return nil
@@ -0,0 +1,55 @@
+// Copyright (c) 2018-2019 Sylabs, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package runtimetest provides utilities for testing code
+// that observes container states with package runtime.
+package runtimetest
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/sylabs/singularity-cri/pkg/singularity/runtime"
+)
+
+// SequenceTimeout is how long AssertSequence waits for the channel to be
+// closed, tests may change it before they start.
+var SequenceTimeout = 10 * time.Second
+
+// AssertSequence reads states from ch until it is closed, i.e. observation
+// is over, and asserts they are exactly want in the same order. If ch is not
+// closed within SequenceTimeout, states read so far are reported instead of
+// waiting forever. Failure is reported with the diff of want and read states
+// and AssertSequence returns false.
+func AssertSequence(t testing.TB, ch <-chan runtime.State, want ...runtime.State) bool {
+	t.Helper()
+
+	timeout := time.NewTimer(SequenceTimeout)
+	defer timeout.Stop()
+
+	got := []runtime.State{}
+	for {
+		select {
+		case state, ok := <-ch:
+			if !ok {
+				return assert.Equal(t, append([]runtime.State{}, want...), got, "unexpected state sequence")
+			}
+			got = append(got, state)
+		case <-timeout.C:
+			t.Errorf("State channel is not closed within %v, want %v, got %v so far", SequenceTimeout, want, got)
+			return false
+		}
+	}
+}
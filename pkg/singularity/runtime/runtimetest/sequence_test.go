@@ -0,0 +1,99 @@
+// Copyright (c) 2018-2019 Sylabs, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package runtimetest
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/sylabs/singularity-cri/pkg/singularity/runtime"
+)
+
+// recorder records failures instead of failing the test.
+type recorder struct {
+	testing.TB
+	errors []string
+}
+
+func (r *recorder) Helper() {}
+
+func (r *recorder) Errorf(format string, args ...interface{}) {
+	r.errors = append(r.errors, fmt.Sprintf(format, args...))
+}
+
+func TestAssertSequence(t *testing.T) {
+	tt := []struct {
+		name        string
+		push        []runtime.State
+		want        []runtime.State
+		expectError string
+	}{
+		{
+			name: "match",
+			push: []runtime.State{runtime.StateCreated, runtime.StateRunning, runtime.StateExited},
+			want: []runtime.State{runtime.StateCreated, runtime.StateRunning, runtime.StateExited},
+		},
+		{
+			name:        "mismatch",
+			push:        []runtime.State{runtime.StateCreated, runtime.StateExited},
+			want:        []runtime.State{runtime.StateCreated, runtime.StateRunning, runtime.StateExited},
+			expectError: "unexpected state sequence",
+		},
+		{
+			name:        "extra state",
+			push:        []runtime.State{runtime.StateCreated, runtime.StateRunning, runtime.StateExited},
+			want:        []runtime.State{runtime.StateCreated, runtime.StateExited},
+			expectError: "unexpected state sequence",
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			o, err := runtime.Observe(ctx, "")
+			require.NoError(t, err, "could not listen on socket")
+			require.NoError(t, runtime.PushState(ctx, o.Addr().String(), tc.push...))
+
+			r := &recorder{TB: t}
+			require.Equal(t, tc.expectError == "", AssertSequence(r, o.States(), tc.want...))
+			if tc.expectError == "" {
+				require.Empty(t, r.errors)
+				return
+			}
+			require.Len(t, r.errors, 1)
+			require.Contains(t, r.errors[0], tc.expectError)
+			require.True(t, strings.Contains(r.errors[0], "Diff:"), "no diff in %q", r.errors[0])
+		})
+	}
+}
+
+func TestAssertSequence_Timeout(t *testing.T) {
+	defer func(timeout time.Duration) {
+		SequenceTimeout = timeout
+	}(SequenceTimeout)
+	SequenceTimeout = time.Millisecond * 50
+
+	ch := make(chan runtime.State, 1)
+	ch <- runtime.StateRunning
+	r := &recorder{TB: t}
+	require.False(t, AssertSequence(r, ch, runtime.StateRunning))
+	require.Equal(t, []string{"State channel is not closed within 50ms, want [running], got [running] so far"}, r.errors)
+}
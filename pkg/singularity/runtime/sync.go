@@ -15,14 +15,19 @@
 package runtime
 
 import (
+	"bytes"
 	"context"
+	"crypto/subtle"
+	"crypto/tls"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net"
-
-	"github.com/golang/glog"
-	"github.com/sylabs/singularity/pkg/util/unix"
+	"os"
+	"sync"
+	"syscall"
+	"time"
 )
 
 // State represents an OCI container state.
@@ -39,6 +44,14 @@ func (s State) String() string {
 		return "running"
 	case StateExited:
 		return "exited"
+	case StatePaused:
+		return "paused"
+	case StateResumed:
+		return "resumed"
+	case StatePreparing:
+		return "preparing"
+	case StateError:
+		return "error"
 	}
 	return "unknown"
 }
@@ -54,98 +67,2090 @@ const (
 	StateRunning
 	// StateExited means container has finished possibly with errors.
 	StateExited
+	// StatePaused means container processes are paused at the moment,
+	// e.g. frozen to be checkpointed. It is not a terminal state.
+	StatePaused
+	// StateResumed means container processes are resumed after being paused.
+	StateResumed
+	// StatePreparing means container is not being created yet, e.g. its
+	// image is being pulled. It is optional and precedes StateCreating.
+	StatePreparing
+	// StateError is never reported by the runtime, it is the state of the
+	// event that carries the error observation is stopped with when no
+	// state is received along with it, e.g. on decode failure.
+	StateError
+)
+
+// states lists all known states.
+var states = []State{
+	StateUnknown,
+	StateCreating,
+	StateCreated,
+	StateRunning,
+	StateExited,
+	StatePaused,
+	StateResumed,
+	StatePreparing,
+	StateError,
+}
+
+// MarshalJSON encodes State as its string representation.
+func (s State) MarshalJSON() ([]byte, error) {
+	return json.Marshal(s.String())
+}
+
+// UnmarshalJSON decodes State from its string representation.
+func (s *State) UnmarshalJSON(data []byte) error {
+	var str string
+	if err := json.Unmarshal(data, &str); err != nil {
+		return fmt.Errorf("could not decode state: %v", err)
+	}
+	for _, state := range states {
+		if state.String() == str {
+			*s = state
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown state %q", str)
+}
+
+const (
+	// DefaultMaxStatusSize is the default maximum size of a single status object.
+	DefaultMaxStatusSize = 64 << 10
+	// DefaultBufferSize is the default capacity of the channel states are passed to.
+	DefaultBufferSize = 4
+	// DefaultKeepAlive is the default keep-alive period of tcp sync connections.
+	DefaultKeepAlive = 15 * time.Second
+	// DefaultTerminalSendTimeout is the default time passing the final
+	// state to the channel may block before the state is dropped.
+	DefaultTerminalSendTimeout = 5 * time.Second
+
+	// minAcceptDelay and maxAcceptDelay bound the delay before
+	// accepting connection again after a temporary error.
+	minAcceptDelay = 5 * time.Millisecond
+	maxAcceptDelay = time.Second
+
+	// syncVersion1 is the version of the sync protocol,
+	// see syncStatus for the schema.
+	syncVersion1 = 1
 )
 
+var (
+	errStatusTooLarge = fmt.Errorf("status object is too large")
+	errInvalidToken   = fmt.Errorf("invalid token")
+	errBadHandshake   = fmt.Errorf("unexpected handshake")
+	// errUnsupportedVersion is returned for status objects of unknown
+	// protocol version, they are likely sent by a newer runtime.
+	errUnsupportedVersion = fmt.Errorf("unsupported sync protocol version")
+)
+
+// ErrInactive is reported when no status is received
+// within the inactivity timeout, see WithInactivityTimeout.
+var ErrInactive = fmt.Errorf("no status received within inactivity timeout")
+
+// ErrNoConnection is reported when runtime does not connect to the
+// socket within the connect timeout, see WithConnectTimeout.
+var ErrNoConnection = fmt.Errorf("runtime did not connect within connect timeout")
+
+var (
+	// ErrListen is reported when sync socket cannot be listened on. It is
+	// usually permanent, e.g. because of a bad socket address or permissions.
+	ErrListen = fmt.Errorf("could not listen sync socket")
+	// ErrAccept is reported when connection to the sync socket cannot be
+	// accepted. Temporary accept errors are retried before it is reported.
+	ErrAccept = fmt.Errorf("could not accept sync socket connection")
+	// ErrDecode is reported when status received from the runtime
+	// cannot be decoded.
+	ErrDecode = fmt.Errorf("could not read state")
+	// ErrUnknownStatus is reported along with ErrDecode when status
+	// is not recognized in strict mode, see WithStrictStatuses.
+	ErrUnknownStatus = fmt.Errorf("unknown status")
+)
+
+// observeError tags the underlying error with one of ErrListen, ErrAccept
+// or ErrDecode, so that both can be checked with errors.Is and errors.As.
+type observeError struct {
+	kind error
+	err  error
+}
+
+func (e *observeError) Error() string {
+	return fmt.Sprintf("%v: %v", e.kind, e.err)
+}
+
+// Is reports whether target is the kind of the error.
+func (e *observeError) Is(target error) bool {
+	return target == e.kind
+}
+
+// Unwrap returns the underlying error.
+func (e *observeError) Unwrap() error {
+	return e.err
+}
+
+// StateEvent is a State enriched with the information received
+// from the runtime along with it.
+type StateEvent struct {
+	// State is the observed container state.
+	State State
+	// Status is the raw status string sent by the runtime. It is useful
+	// when State is StateUnknown to find out what was actually received.
+	Status string
+	// Time is the moment the status was decoded.
+	Time time.Time
+	// Pid is the container process pid, if it was reported by the runtime.
+	Pid int
+	// ExitCode is the container process exit code reported by the runtime
+	// along with StateExited. It is zero if runtime has not reported it.
+	ExitCode int
+	// Signal is the number of the signal that killed container process,
+	// if it was reported by the runtime. It is zero otherwise.
+	Signal int
+	// Err is set if observation is stopped because of an error, e.g. because
+	// of the received state or failure to decode the status. Such event is
+	// the last one passed to the channel. Its State is the received one, if
+	// any, and StateError otherwise.
+	Err error
+	// Inferred is set for StateExited that was not reported by the runtime,
+	// but is assumed because connection was closed while container was
+	// running, see WithInferredExit. Status is empty for such event.
+	Inferred bool
+	// Truncated is set along with Inferred if connection was closed in the
+	// middle of a status object, e.g. because runtime was killed mid-write.
+	Truncated bool
+	// Injected is set for the state that was not reported by the runtime,
+	// but was passed manually with Observer.Inject.
+	Injected bool
+	// Snapshot is set if runtime reported the state container is in
+	// rather than a transition, e.g. once it connects, see syncStatus.
+	Snapshot bool
+	// HookErr is set if callback registered with OnPauseResume or command
+	// registered with OnStateCommand without Veto failed for this state.
+	// Observation continues regardless.
+	HookErr error
+	// Raw is the status object as it was received from the runtime, so
+	// that fields not modeled here can be read. It is only set if raw
+	// statuses are kept, see WithRawStatus.
+	Raw json.RawMessage
+	// StartErr is set to StartError for StateExited received
+	// before container has ever reached StateRunning. It is never
+	// set for snapshot, since earlier states may have been missed.
+	StartErr error
+}
+
+// StartError is reported along with StateExited when container exits without
+// ever running, i.e. it failed to start rather than exited after it ran.
+type StartError struct {
+	// Last is the last state container reached before it exited,
+	// i.e. StatePreparing, StateCreating or StateCreated.
+	Last State
+}
+
+// Error implements error interface.
+func (e *StartError) Error() string {
+	return fmt.Sprintf("container exited while %v, it has never run", e.Last)
+}
+
+// StateTimeoutError is reported when container stays in State for longer
+// than the budget set with WithStateTimeout, e.g. when it is stuck creating.
+type StateTimeoutError struct {
+	State   State
+	Timeout time.Duration
+}
+
+// Error implements error interface.
+func (e *StateTimeoutError) Error() string {
+	return fmt.Sprintf("container has not left %v state within %v", e.State, e.Timeout)
+}
+
+// TransitionError is reported in strict mode when the
+// runtime reports states in an unexpected order.
+type TransitionError struct {
+	From State
+	To   State
+}
+
+// Error implements error interface.
+func (e *TransitionError) Error() string {
+	return fmt.Sprintf("invalid state transition from %v to %v", e.From, e.To)
+}
+
+// HookError is reported when a hook registered with OnState vetoes
+// the transition into State by returning Err.
+type HookError struct {
+	State State
+	Err   error
+}
+
+// Error implements error interface.
+func (e *HookError) Error() string {
+	return fmt.Sprintf("%v state hook failed: %v", e.State, e.Err)
+}
+
+// Unwrap returns the error hook returned.
+func (e *HookError) Unwrap() error {
+	return e.Err
+}
+
+// ObserveOption is used to tune state observation.
+type ObserveOption func(o *observer)
+
+// WithClock sets func events are stamped with and latencies are measured by
+// instead of time.Now. It is meant for tests that need deterministic time,
+// production code should not need it.
+func WithClock(now func() time.Time) ObserveOption {
+	return func(o *observer) {
+		o.now = now
+	}
+}
+
+// WithDrainTimeout sets for how long statuses already sent over the current
+// connection are still read after the context is done. By default reading
+// stops as soon as the context is done.
+func WithDrainTimeout(d time.Duration) ObserveOption {
+	return func(o *observer) {
+		o.drainTimeout = d
+	}
+}
+
+// WithTerminalSendTimeout sets how long observer waits for the consumer to
+// receive the final state, i.e. terminal state or event carrying an error,
+// before the state is dropped and observation is over. This makes sure socket
+// is closed once container exits even if consumer has stopped reading the
+// channel. Zero or negative value makes observer wait until the context is
+// done. Default is DefaultTerminalSendTimeout.
+func WithTerminalSendTimeout(d time.Duration) ObserveOption {
+	return func(o *observer) {
+		o.terminalTimeout = d
+	}
+}
+
+// WithStatusMapper sets function that is used to convert statuses received
+// from the runtime to State instead of StatusToState. This is useful when
+// runtime other than Singularity reports states, e.g. runc.
+func WithStatusMapper(toState func(status string) State) ObserveOption {
+	return func(o *observer) {
+		o.toState = toState
+	}
+}
+
+// WithStatusMapping is the same as WithStatusMapper except statuses are
+// converted with the passed map. Statuses not present in the map are
+// converted to StateUnknown.
+func WithStatusMapping(mapping map[string]State) ObserveOption {
+	return WithStatusMapper(func(status string) State {
+		return mapping[status]
+	})
+}
+
+// WithPreparingStatuses sets statuses that are converted to StatePreparing
+// in addition to "preparing", e.g. "pulling" for runtimes that report image
+// preparation with a status of their own. Passed statuses take precedence
+// over status mapper, see WithStatusMapper.
+func WithPreparingStatuses(statuses ...string) ObserveOption {
+	return func(o *observer) {
+		o.preparing = make(map[string]bool, len(statuses))
+		for _, status := range statuses {
+			o.preparing[status] = true
+		}
+	}
+}
+
+// WithStatusFields sets names of the status object field the lifecycle
+// status is read from, e.g. "state" or "phase" for runtimes that do not use
+// "status". Fields are looked up in the passed order and the first present
+// one is used, names are case sensitive. By default "status" field is used.
+func WithStatusFields(fields ...string) ObserveOption {
+	return func(o *observer) {
+		o.statusFields = fields
+	}
+}
+
+// WithRawStatus makes observer keep the status object received from the
+// runtime and pass it along with the event in StateEvent.Raw, e.g. to read
+// annotations runtime attaches to a transition. Note that the object
+// includes token, see WithToken. By default status objects are not kept.
+func WithRawStatus() ObserveOption {
+	return func(o *observer) {
+		o.rawStatus = true
+	}
+}
+
+// WithTerminalStatuses sets statuses that stop observation once received,
+// e.g. "deleted" for runtimes that report a distinct status after the
+// container is stopped. Any other status, including "stopped", is passed
+// to the channel and observation continues. By default observation is
+// stopped once status converted to StateExited is received.
+func WithTerminalStatuses(statuses ...string) ObserveOption {
+	return func(o *observer) {
+		o.terminal = make(map[string]bool, len(statuses))
+		for _, status := range statuses {
+			o.terminal[status] = true
+		}
+	}
+}
+
+// WithMaxStatusSize sets maximum size in bytes of a single status object.
+// Connection that sends bigger object is closed. By default
+// DefaultMaxStatusSize is used, non-positive size disables the limit.
+func WithMaxStatusSize(size int64) ObserveOption {
+	return func(o *observer) {
+		o.maxStatusSize = size
+	}
+}
+
+// WithToken sets token that runtime must pass along with each status.
+// Statuses with missing or wrong token are ignored and connection
+// they were sent over is closed.
+func WithToken(token string) ObserveOption {
+	return func(o *observer) {
+		o.token = token
+	}
+}
+
+// WithHandshake sets prefix runtime sends over each connection before
+// the stream of status objects, e.g. a plaintext line identifying a forked
+// runtime. Prefix is read and validated before decoding, connection that
+// starts with anything else is closed. By default no handshake is expected.
+func WithHandshake(prefix string) ObserveOption {
+	return func(o *observer) {
+		o.handshake = []byte(prefix)
+	}
+}
+
+// WithCoalesce makes observer drop states that are the same as the last known
+// one, e.g. running status runtime re-announces periodically as a keepalive.
+// The first occurrence of each state is always passed. Dropped states still
+// reset the inactivity timeout. By default every received state is passed.
+func WithCoalesce() ObserveOption {
+	return func(o *observer) {
+		o.coalesce = true
+	}
+}
+
+// WithStrictTransitions makes observer validate order of the received states.
+// Container is expected to move from StateCreating to StateExited never going
+// back to any of the previous states. Container may optionally report
+// StatePreparing before StateCreating. StatePaused may only be entered from
+// StateRunning or StateResumed and StateResumed only from StatePaused, so
+// running, paused and resumed states may cycle until container exits.
+// StateCreating is only valid as the very first state or right after
+// StatePreparing. Without this option repeated creating state is passed
+// through with a warning logged. Once invalid transition is received
+// observation is stopped and the event with TransitionError is passed to
+// the events channel. By default states are passed in any order.
+func WithStrictTransitions() ObserveOption {
+	return func(o *observer) {
+		o.strict = true
+	}
+}
+
+// WithStrictStatuses makes observer fail on statuses it does not recognize,
+// e.g. to catch runtime versions that introduce new statuses in conformance
+// tests. Once unknown status is received observation is stopped and the event
+// with ErrDecode wrapping ErrUnknownStatus is passed to the events channel.
+// By default unknown statuses are logged and passed as StateUnknown.
+func WithStrictStatuses() ObserveOption {
+	return func(o *observer) {
+		o.strictStatuses = true
+	}
+}
+
+// WithConnectTimeout makes observer stop observation if runtime does not
+// connect to the socket within timeout since observation is started, e.g.
+// because container has exited before it was observed. Once timeout is
+// exceeded the event with ErrNoConnection is passed to the events channel and
+// the channel is closed, so caller may query container state in some other
+// way. Connect timeout is disabled by default.
+func WithConnectTimeout(timeout time.Duration) ObserveOption {
+	return func(o *observer) {
+		o.connectTimeout = timeout
+	}
+}
+
+// WithInactivityTimeout makes observer stop observation if no status is
+// received within timeout since observation is started or since the last
+// received status. This allows to detect runtime that hangs without closing
+// the connection. Once timeout is exceeded the event with ErrInactive
+// is passed to the events channel and the channel is closed. Timeout may
+// be changed while observation is running, see SetInactivityTimeout.
+// Inactivity timeout is disabled by default.
+func WithInactivityTimeout(timeout time.Duration) ObserveOption {
+	return func(o *observer) {
+		o.inactivityTimeout.store(timeout)
+	}
+}
+
+// WithStateTimeout sets for how long container may stay in state, e.g. that
+// it must reach StateCreated within timeout after StateCreating is received.
+// Once timeout is exceeded the event with StateTimeoutError is passed to the
+// events channel and the channel is closed, so that caller may fail the
+// operation waiting for container instead of hanging. Timeout is measured
+// since container has entered state, receiving the same state again does
+// not reset it. Budgets of different states are independent, passing
+// StateUnknown limits the time until the first state is received. Timeout
+// may be changed while observation is running, see SetStateTimeout. State
+// timeouts are disabled by default, non-positive timeout removes the budget.
+func WithStateTimeout(state State, timeout time.Duration) ObserveOption {
+	return func(o *observer) {
+		if timeout <= 0 {
+			delete(o.stateTimeouts, state)
+			return
+		}
+		if o.stateTimeouts == nil {
+			o.stateTimeouts = make(map[State]time.Duration)
+		}
+		o.stateTimeouts[state] = timeout
+	}
+}
+
+// WithConnIdleTimeout sets for how long a single sync connection may stay
+// silent before it is closed, so that connection to a dead or wedged peer
+// is recycled and runtime may connect again. Timeout is reset each time
+// status is decoded. Unlike WithInactivityTimeout, observation continues
+// once connection is closed. Idle timeout is disabled by default, since
+// runtime may keep connection open without reporting anything for as long
+// as container runs. Timeout may be changed while observation is running,
+// see SetConnIdleTimeout.
+func WithConnIdleTimeout(timeout time.Duration) ObserveOption {
+	return func(o *observer) {
+		o.connIdleTimeout.store(timeout)
+	}
+}
+
+// WithInferredExit makes observer assume container has exited when sync
+// connection is closed or dropped while container is running, paused or
+// resumed, e.g. because runtime has crashed. In that case StateExited with
+// Inferred set is passed to the channel and observation is stopped. This
+// should only be used with runtimes that keep a single connection open for
+// the whole container lifetime, rather than reconnecting to report each state.
+func WithInferredExit() ObserveOption {
+	return func(o *observer) {
+		o.inferExitOnClose = true
+	}
+}
+
+// WithKeepAlive sets keep-alive period of accepted tcp connections, so that
+// half-open connection to a peer that is gone is detected and closed.
+// By default DefaultKeepAlive is used, non-positive period disables
+// keep-alive probes. Other sockets are not affected.
+func WithKeepAlive(period time.Duration) ObserveOption {
+	return func(o *observer) {
+		o.keepAlive = period
+	}
+}
+
+// OnState registers fn to be called once target state is received, before
+// the state is passed to the channel. Hooks are called synchronously, so
+// further states are not read until fn returns, e.g. hook on StateCreated
+// may set up networking before consumer learns container is running. If fn
+// returns an error the transition is vetoed: the state is not passed to
+// the channel, observation is stopped and the event with HookError is
+// passed to the events channel instead, e.g. so that the caller tears down
+// a container that failed a policy check before it is reported running.
+// With Observe the error is reported by Err. Several hooks for the same
+// state are called in the order they are registered.
+func OnState(target State, fn func(StateEvent) error) ObserveOption {
+	return func(o *observer) {
+		if o.hooks == nil {
+			o.hooks = make(map[State][]func(StateEvent) error)
+		}
+		o.hooks[target] = append(o.hooks[target], fn)
+	}
+}
+
+// OnPauseResume registers fn to be called once StatePaused or StateResumed
+// is received, before the state is passed to the channel, e.g. to release
+// CPU reservations of a paused container and restore them on resume. Unlike
+// OnState hooks, error returned by fn does not stop observation, it is logged
+// and passed along with the event in HookErr instead.
+func OnPauseResume(fn func(StateEvent) error) ObserveOption {
+	return func(o *observer) {
+		o.onPauseResume = fn
+	}
+}
+
+// OnTransition registers fn to be called each time container moves to
+// another state, once the new state is passed to the channel, with both
+// the previous and the next state and the time the next one was received.
+// Prev is StateUnknown for the first state. Unknown statuses and repeated
+// states are not transitions. Unlike OnState hooks, fn cannot veto the
+// transition. It is called synchronously, so it should not block. Several
+// callbacks are called in the order they are registered.
+func OnTransition(fn func(prev, next State, at time.Time)) ObserveOption {
+	return func(o *observer) {
+		o.onTransition = append(o.onTransition, fn)
+	}
+}
+
+// OnConnect registers fn to be called each time runtime connects to the socket.
+func OnConnect(fn func(addr net.Addr)) ObserveOption {
+	return func(o *observer) {
+		o.onConnect = fn
+	}
+}
+
+// OnDisconnect registers fn to be called each time connection to the socket
+// is closed. Err is nil if connection is closed by the runtime or once
+// StateExited is received, otherwise it holds the reason connection is closed,
+// e.g. io.ErrUnexpectedEOF if it is closed in the middle of a status object.
+func OnDisconnect(fn func(addr net.Addr, err error)) ObserveOption {
+	return func(o *observer) {
+		o.onDisconnect = fn
+	}
+}
+
+// WithBufferSize sets capacity of the channel states are passed to. With bigger
+// buffer reading from the socket is decoupled from a slow consumer so runtime
+// never stalls reporting states, but consumer may observe transitions later
+// than they actually happened. Unbuffered channel makes each state a sync
+// point between runtime and consumer. By default DefaultBufferSize is used.
+func WithBufferSize(n int) ObserveOption {
+	return func(o *observer) {
+		if n < 0 {
+			n = 0
+		}
+		o.bufferSize = n
+	}
+}
+
+// WithFilter makes observer pass to the channel only states for which
+// filter returns true. Filtered out states are still read from the socket,
+// reported to callbacks and metrics, and StateExited still stops observation
+// and closes the channel even if it is filtered out itself.
+func WithFilter(filter func(State) bool) ObserveOption {
+	return func(o *observer) {
+		o.filter = filter
+	}
+}
+
+// WithListenRetry makes observer retry listening on the socket when it fails
+// because socket directory cannot be created or is not accessible yet, e.g. on
+// node startup before runtime directory is mounted. Listening is attempted
+// at most attempts times, delay between attempts starts with delay and is
+// doubled each time. The last error is returned once all attempts fail.
+// By default listening is attempted once.
+func WithListenRetry(attempts int, delay time.Duration) ObserveOption {
+	return func(o *observer) {
+		o.listenConfig.attempts = attempts
+		o.listenConfig.retryDelay = delay
+	}
+}
+
+// WithFallbackSocketDir makes observer create unix socket in dir, keeping
+// socket file name, if socket directory turns out to be on a read-only
+// filesystem. Runtime must be told the actual socket path, which is reported
+// by Observer.Addr. By default listening fails in this case.
+func WithFallbackSocketDir(dir string) ObserveOption {
+	return func(o *observer) {
+		o.listenConfig.fallbackDir = dir
+	}
+}
+
+// WithSocketDirCleanup makes observer remove directory of unix socket once
+// observation is over and socket file is removed, e.g. when each container
+// has a dedicated socket directory. Directory is only removed if it is empty.
+func WithSocketDirCleanup() ObserveOption {
+	return func(o *observer) {
+		o.listenConfig.removeDir = true
+	}
+}
+
+// WithSocketPermissions sets file mode of the created unix socket.
+// By default DefaultSocketPermissions is used.
+func WithSocketPermissions(mode os.FileMode) ObserveOption {
+	return func(o *observer) {
+		o.listenConfig.mode = mode
+	}
+}
+
+// WithSocketOwner sets owner of the created unix socket. Passing -1
+// as uid or gid leaves corresponding ID unchanged.
+func WithSocketOwner(uid, gid int) ObserveOption {
+	return func(o *observer) {
+		o.listenConfig.uid = uid
+		o.listenConfig.gid = gid
+	}
+}
+
+// WithSocketDirPermissions sets file mode of the directories created for
+// unix socket. Observer creates socket directory along with its parents if
+// they do not exist, e.g. on first boot before runtime directory is
+// provisioned. If socket directory exists with other permissions, a warning
+// is logged. Zero mode disables creating directories. By default
+// DefaultSocketDirPermissions is used and permissions of the existing
+// directory are not checked.
+func WithSocketDirPermissions(mode os.FileMode) ObserveOption {
+	return func(o *observer) {
+		o.listenConfig.dirMode = mode
+		o.listenConfig.checkDirMode = true
+	}
+}
+
+// WithSocketDirOwner sets owner of the directories created for unix socket,
+// see WithSocketDirPermissions. If socket directory exists with other owner,
+// a warning is logged. Passing -1 as uid or gid leaves corresponding ID
+// unchanged. By default directories are owned by the current user.
+func WithSocketDirOwner(uid, gid int) ObserveOption {
+	return func(o *observer) {
+		o.listenConfig.dirUID = uid
+		o.listenConfig.dirGID = gid
+	}
+}
+
+type observer struct {
+	containerID  string
+	log          Logger
+	socket       string
+	opts         []ObserveOption
+	listenConfig listenConfig
+	addr         net.Addr
+	drainTimeout time.Duration
+	toState      func(status string) State
+	bufferSize   int
+	filter       func(State) bool
+	// statusFields holds names of the field status is read from,
+	// nil means the default one of syncStatus is used.
+	statusFields []string
+	rawStatus    bool
+	// envelope is set if status objects are wrapped
+	// in envelopes, see WithEnvelope.
+	envelope bool
+	// newDecoder creates StatusDecoder for every connection,
+	// nil means status objects are decoded as JSON.
+	newDecoder func() StatusDecoder
+	// terminal holds statuses that stop observation,
+	// nil means observation is stopped on StateExited.
+	terminal map[string]bool
+	// preparing holds statuses converted to StatePreparing
+	// regardless of toState.
+	preparing map[string]bool
+
+	maxStatusSize int64
+	token         string
+	handshake     []byte
+
+	// now returns the current time, events are stamped with it
+	now func() time.Time
+
+	metrics   Metrics
+	createdAt time.Time
+	slowSend  time.Duration
+
+	terminalTimeout time.Duration
+
+	tracer Tracer
+	span   Span
+
+	mirrorSocket string
+	mirror       *mirror
+
+	journalPath string
+	journalSize int64
+	journal     *journal
+
+	forwardTo       io.Writer
+	forwardBatch    int
+	forwardInterval time.Duration
+	forwarder       *forwarder
+
+	// deadLetters receives events that could not be delivered,
+	// lostLetters is the number of them dropped as it was full,
+	// it is guarded by mu.
+	deadLetters chan<- DeadLetter
+	lostLetters int
+
+	strict         bool
+	strictStatuses bool
+	coalesce       bool
+
+	hooks         map[State][]func(StateEvent) error
+	onTransition  []func(prev, next State, at time.Time)
+	onCRIEvent    []func(reason string, event StateEvent)
+	commands      map[State][]CommandHook
+	onPauseResume func(StateEvent) error
+	onConnect     func(addr net.Addr)
+	onDisconnect  func(addr net.Addr, err error)
+
+	connectTimeout    time.Duration
+	inactivityTimeout atomicDuration
+	connIdleTimeout   atomicDuration
+	stateTimeouts     map[State]time.Duration // guarded by mu once started
+	keepAlive         time.Duration
+	tlsConfig         *tls.Config
+	// peerCred holds expected credentials of the peer, nil means
+	// any peer is accepted, anyUID, anyGID and anyPID are set if
+	// the corresponding credential is not checked.
+	peerCred               *syscall.Ucred
+	anyUID, anyGID, anyPID bool
+	inferExitOnClose       bool
+	connWorkers            int
+	acceptLimit            *tokenBucket
+	// throttle is consulted before handling
+	// non-terminal statuses, see WithThrottle.
+	throttle func(ctx context.Context) error
+	// inject receives states passed with Observer.Inject,
+	// it is nil unless state injection is enabled.
+	inject chan injection
+	// activeConn is the connection handled according to connConflict,
+	// replaced holds connections closed in favor of newer ones.
+	connConflict ConnConflictPolicy
+	activeMu     sync.Mutex
+	activeConn   net.Conn
+	replaced     map[net.Conn]bool
+	// connected and activity are notified on each accepted connection
+	// and received status, connected is nil unless connect timeout is set.
+	connected chan struct{}
+	activity  chan struct{}
+	// reloadActivity and reloadStates are notified each time
+	// the corresponding timeout is changed, see sync_reload.go.
+	reloadActivity chan struct{}
+	reloadStates   chan struct{}
+	// transitions is notified each time state is passed to the
+	// channel.
+	transitions chan struct{}
+	// route replaces handle to pass statuses to other observers.
+	route func(sendCtx context.Context, status syncStatus) (bool, error)
+	// handleMu serializes handling of statuses received over concurrent
+	// connections, it guards last, finished and the state passed to hooks.
+	handleMu sync.Mutex
+	// last is the last known state passed to the channel.
+	last State
+	// errReported is set once event carrying an error is passed
+	// to the channel, so that it is passed only once.
+	errReported bool
+	// finished is true once terminal status is received.
+	finished bool
+
+	// Only one of the channels is set depending on whether
+	// observer is asked to pass bare states or events.
+	states chan State
+	events chan StateEvent
+
+	// connMu guards conn requests are sent over and pending requests.
+	connMu  sync.Mutex
+	conn    net.Conn
+	lastID  uint64
+	pending map[uint64]chan syncStatus
+	// writeMu serializes requests written to conn.
+	writeMu sync.Mutex
+
+	mu sync.Mutex
+	// err is the reason observation is over, nil if container has exited.
+	err error
+	// startErr is set once container exits without ever running.
+	startErr error
+	// current is the state most recently passed to the channel.
+	current State
+	// waiters are notified once one of the states they wait for is passed.
+	waiters []*stateWaiter
+	// history holds the most recent events passed to the channel.
+	history *eventRing
+	// durations sums time spent in each state passed to the channel.
+	durations stateDurations
+	// done is closed once observation is over and the channel is closed.
+	done chan struct{}
+	// release makes socket available for observation again.
+	release func()
+	// ln is the listener socket is observed on, if any.
+	ln net.Listener
+}
+
+// Observer is a handle to the running observation started with Observe.
+type Observer struct {
+	mu     sync.Mutex
+	o      *observer
+	cancel context.CancelFunc
+	closed bool
+}
+
+// Observe is the same as ObserveState except it returns Observer that
+// additionally reports why observation is over once the channel is closed.
+func Observe(ctx context.Context, socket string, opts ...ObserveOption) (*Observer, error) {
+	o := newObserver(socket, opts...)
+	o.states = make(chan State, o.bufferSize)
+	ctx, cancel := context.WithCancel(ctx)
+	if err := o.start(ctx); err != nil {
+		cancel()
+		return nil, err
+	}
+	return &Observer{o: o, cancel: cancel}, nil
+}
+
+// NewObserver is the same as Observe except observation is not bound to any
+// context, e.g. for init paths that run before a cancellable context exists.
+// Observation is over only once container reaches its terminal state or
+// an error occurs, so Close must be called to stop it and release the
+// socket, otherwise it is kept until the process exits.
+func NewObserver(socket string, opts ...ObserveOption) (*Observer, error) {
+	return Observe(context.Background(), socket, opts...)
+}
+
+// Reset stops the current observation, waits for its channel to be closed
+// and starts observing the same socket again with ctx, e.g. for the next
+// incarnation of the restarted container. Options Observe was called with
+// are preserved, so is the history of events. Once Reset returns, States
+// returns the new channel and other methods report the new observation.
+// If socket cannot be listened on again, the error is returned and
+// Observer keeps reporting the stopped observation.
+func (o *Observer) Reset(ctx context.Context) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	o.cancel()
+	<-o.o.done
+
+	next := newObserver(o.o.socket, o.o.opts...)
+	next.states = make(chan State, next.bufferSize)
+	next.history = o.o.history
+	ctx, cancel := context.WithCancel(ctx)
+	if err := next.start(ctx); err != nil {
+		cancel()
+		return err
+	}
+	o.o, o.cancel, o.closed = next, cancel, false
+	return nil
+}
+
+// Close stops observation and waits until it is over, i.e. the channel
+// is closed, listener is closed and socket may be observed again. If
+// observation has already stopped with an error before Close is called,
+// the error is returned, see Err. Subsequent calls to Close return nil.
+func (o *Observer) Close() error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if o.closed {
+		return nil
+	}
+	o.closed = true
+
+	select {
+	case <-o.o.done:
+		o.cancel()
+		o.o.mu.Lock()
+		defer o.o.mu.Unlock()
+		return o.o.err
+	default:
+	}
+	o.cancel()
+	<-o.o.done
+	return nil
+}
+
+// observer returns the current observation.
+func (o *Observer) observer() *observer {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return o.o
+}
+
+// States returns the channel container states are passed to.
+func (o *Observer) States() <-chan State {
+	return o.observer().states
+}
+
+// Addr returns the address the socket is actually bound to.
+func (o *Observer) Addr() net.Addr {
+	return o.observer().addr
+}
+
+// Current returns the state most recently passed to the channel, regardless
+// of whether it is already read from the channel. Before any state is passed
+// StateUnknown is returned. Current is safe to call concurrently.
+func (o *Observer) Current() State {
+	obs := o.observer()
+	obs.mu.Lock()
+	defer obs.mu.Unlock()
+	return obs.current
+}
+
+// StartErr returns StartError if container has exited without ever
+// running, see StateEvent.StartErr, or nil otherwise.
+func (o *Observer) StartErr() error {
+	obs := o.observer()
+	obs.mu.Lock()
+	defer obs.mu.Unlock()
+	return obs.startErr
+}
+
+// Done returns a channel that is closed once observation is over, i.e.
+// after the states channel is closed, so that many observers may be
+// selected on at once, Err then reports why observation is over. Once
+// Observer is reset, Done returns the channel of the new observation.
+func (o *Observer) Done() <-chan struct{} {
+	return o.observer().done
+}
+
+// Err returns the reason observation is over. It is nil after container has
+// transmitted into StateExited or reported terminal status set with
+// WithTerminalStatuses, context error if context is done before that,
+// or the networking error that caused observation to stop. Err should be
+// called once the states channel or Done is closed, before that it returns nil.
+func (o *Observer) Err() error {
+	obs := o.observer()
+	obs.mu.Lock()
+	defer obs.mu.Unlock()
+	return obs.err
+}
+
+// Next blocks until the next state is passed to the channel and returns it,
+// e.g. to observe container in straight-line code instead of selecting on
+// the channel. Once observation is over ok is false and the error is the one
+// Err reports. If ctx is done before the next state is received, ok is false
+// and ctx error is returned, observation continues so Next may be called
+// again. Since Next reads the same channel States returns, caller should
+// use either the channel or Next but not both on the same Observer.
+func (o *Observer) Next(ctx context.Context) (state State, ok bool, err error) {
+	select {
+	case state, ok = <-o.States():
+		if !ok {
+			return StateUnknown, false, o.Err()
+		}
+		return state, true, nil
+	case <-ctx.Done():
+		return StateUnknown, false, ctx.Err()
+	}
+}
+
 // ObserveState listens on passed socket for container state changes
-// and passes them to the channel. ObserveState creates socket if necessary.
-// The returned channel is buffered to eliminate any goroutine leaks.
+// and passes them to the channel. Socket may be observed only once at a
+// time, ErrAlreadyObserving is returned if socket is being observed
+// already. ObserveState creates socket if necessary, socket names starting
+// with @ denote Linux abstract sockets. Besides unix sockets,
+// tcp://host:port and vsock://cid:port sockets may be observed,
+// use WithTLS to secure them across trust boundaries, e.g. between VMs.
+// The returned channel is buffered to eliminate any goroutine leaks,
+// see WithBufferSize.
 // The channel will be closed if either container has transmitted into
-// StateExited or any error during networking occurred. ObserveState returns
-// error only if it fails to start listener on the passed socket.
-func ObserveState(ctx context.Context, socket string) (<-chan State, error) {
-	ln, err := unix.Listen(socket)
+// StateExited, see WithTerminalStatuses, or any error during networking
+// occurred. ObserveState returns error only if it fails to start listener
+// on the passed socket.
+// Once context is done the channel is closed even if nobody reads from it.
+// Unrecognized statuses are passed as StateUnknown, use ObserveStateEvents
+// to find out the actual status received. Use Observe to find out why
+// the channel is closed.
+func ObserveState(ctx context.Context, socket string, opts ...ObserveOption) (<-chan State, error) {
+	o := newObserver(socket, opts...)
+	o.states = make(chan State, o.bufferSize)
+	if err := o.start(ctx); err != nil {
+		return nil, err
+	}
+	return o.states, nil
+}
+
+// ObserveStateOn is the same as ObserveState except it additionally returns
+// the address the socket is actually bound to. This is useful when an empty
+// socket name is passed, in which case kernel picks an abstract socket name.
+func ObserveStateOn(ctx context.Context, socket string, opts ...ObserveOption) (<-chan State, net.Addr, error) {
+	o := newObserver(socket, opts...)
+	o.states = make(chan State, o.bufferSize)
+	if err := o.start(ctx); err != nil {
+		return nil, nil, err
+	}
+	return o.states, o.addr, nil
+}
+
+// ObserveStateEvents is the same as ObserveState except it passes StateEvent
+// to the channel instead of bare State. If observation is stopped by an
+// error, the last event carries it, see StateEvent.Err, so that a single
+// loop reading the channel may tell failure from the container exit.
+func ObserveStateEvents(ctx context.Context, socket string, opts ...ObserveOption) (<-chan StateEvent, error) {
+	o := newObserver(socket, opts...)
+	o.events = make(chan StateEvent, o.bufferSize)
+	if err := o.start(ctx); err != nil {
+		return nil, err
+	}
+	return o.events, nil
+}
+
+func newObserver(socket string, opts ...ObserveOption) *observer {
+	o := &observer{
+		log:    glogLogger{},
+		socket: socket,
+		opts:   opts,
+		listenConfig: listenConfig{
+			mode:    DefaultSocketPermissions,
+			uid:     -1,
+			gid:     -1,
+			dirMode: DefaultSocketDirPermissions,
+			dirUID:  -1,
+			dirGID:  -1,
+		},
+		toState:         StatusToState,
+		maxStatusSize:   DefaultMaxStatusSize,
+		bufferSize:      DefaultBufferSize,
+		keepAlive:       DefaultKeepAlive,
+		now:             time.Now,
+		slowSend:        DefaultSlowSendThreshold,
+		terminalTimeout: DefaultTerminalSendTimeout,
+		history:         newEventRing(DefaultHistorySize),
+		done:            make(chan struct{}),
+		reloadActivity:  make(chan struct{}, 1),
+		reloadStates:    make(chan struct{}, 1),
+	}
+	for _, opt := range opts {
+		opt(o)
+	}
+	if o.containerID != "" {
+		o.log = taggedLogger{Logger: o.log, tag: o.containerID}
+	}
+	o.listenConfig.log = o.log
+	return o
+}
+
+func (o *observer) start(ctx context.Context) error {
+	o.startSpan(ctx)
+	release, err := claimSocket(o.socket)
 	if err != nil {
-		return nil, fmt.Errorf("could not listen sync socket: %v", err)
+		o.endSpan(err)
+		return err
+	}
+	ln, err := listenRetry(ctx, o.socket, o.listenConfig)
+	if err != nil {
+		release()
+		err = &observeError{kind: ErrListen, err: err}
+		o.endSpan(err)
+		return err
+	}
+	if err := o.startMirror(); err != nil {
+		ln.Close()
+		release()
+		err = &observeError{kind: ErrListen, err: err}
+		o.endSpan(err)
+		return err
+	}
+	if err := o.startJournal(); err != nil {
+		o.stopMirror()
+		ln.Close()
+		release()
+		o.endSpan(err)
+		return err
+	}
+	o.startForwarder()
+	o.release = release
+	o.ln = ln
+	o.addr = ln.Addr()
+	go o.run(ctx, o.wrapTLS(ln))
+	return nil
+}
+
+func (o *observer) run(parent context.Context, ln net.Listener) {
+	ctx, stop := context.WithCancel(parent)
+	defer stop()
+
+	var timeouts []<-chan error
+	if o.connectTimeout > 0 {
+		o.connected = make(chan struct{}, 1)
+		timeouts = append(timeouts, o.watchTimeout(ctx, stop, o.connectTimeout, o.connected, true, ErrNoConnection))
+	}
+	// inactivity and state timeouts are watched even if they are disabled,
+	// since they may be set while observation is running
+	o.activity = make(chan struct{}, 1)
+	timeouts = append(timeouts, o.watchInactivity(ctx, stop))
+	o.transitions = make(chan struct{}, 1)
+	timeouts = append(timeouts, o.watchStateTimeouts(ctx, stop))
+
+	// states are still passed to the channel while draining
+	sendCtx, cancel := withDelay(ctx, o.drainTimeout)
+	defer cancel()
+
+	var injected <-chan error
+	if o.inject != nil {
+		injected = o.serveInjections(ctx, sendCtx, stop)
 	}
 
-	syncChan := make(chan State, 4)
+	var err error
+	defer func() {
+		if injected != nil {
+			// injected state must not be passed once channel is closed
+			stop()
+			if ierr := <-injected; err == nil {
+				err = ierr
+			}
+		}
+		if err == nil && !o.finished {
+			for _, timeout := range timeouts {
+				select {
+				case err = <-timeout:
+				default:
+				}
+				if err != nil {
+					o.sendFinal(parent, StateEvent{State: StateError, Time: o.now(), Err: err})
+					break
+				}
+			}
+		} else if err != nil && !o.errReported {
+			o.sendFinal(parent, StateEvent{State: StateError, Time: o.now(), Err: err})
+		}
+		o.close(parent, err)
+	}()
+	defer ln.Close()
+
+	// closing listener is the only way to unblock Accept
+	unwatch := closeOnDone(ctx, ln)
+	defer close(unwatch)
+
+	var pool *connPool
+	workers := o.connWorkers
+	if o.connConflict != ConnConflictAllow && workers < 2 {
+		workers = 2
+	}
+	if workers > 1 {
+		pool = newConnPool(o, workers, stop)
+		defer func() {
+			stop()
+			if perr := pool.wait(); err == nil {
+				err = perr
+			}
+		}()
+	}
+
+	var acceptDelay time.Duration
+	for {
+		var conn net.Conn
+		conn, err = ln.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				o.log.Debugf("Context is done, stopping observation at %s", o.socket)
+				err = nil
+				return
+			}
+			if isTemporaryAcceptErr(err) {
+				if acceptDelay == 0 {
+					acceptDelay = minAcceptDelay
+				} else if acceptDelay *= 2; acceptDelay > maxAcceptDelay {
+					acceptDelay = maxAcceptDelay
+				}
+				o.log.Warningf("Could not accept sync socket connection at %s, retrying in %v: %v", o.socket, acceptDelay, err)
+				select {
+				case <-ctx.Done():
+				case <-time.After(acceptDelay):
+				}
+				continue
+			}
+			err = &observeError{kind: ErrAccept, err: err}
+			o.log.Errorf("Stopping observation at %s: %v", o.socket, err)
+			return
+		}
+		acceptDelay = 0
+		if o.acceptLimit != nil && !o.acceptLimit.allow(o.now()) {
+			o.log.Warningf("Closing sync connection at %s from %v: accept rate limit exceeded", o.socket, conn.RemoteAddr())
+			conn.Close()
+			continue
+		}
+		notify(o.connected)
+		if pool != nil {
+			pool.dispatch(ctx, sendCtx, conn)
+			continue
+		}
+		var over bool
+		over, err = o.syncOnConn(ctx, sendCtx, conn)
+		if err != nil {
+			o.log.Errorf("Stopping observation at %s: %v", o.socket, err)
+			return
+		}
+		if over || ctx.Err() != nil {
+			return
+		}
+	}
+}
+
+// pauseResume calls OnPauseResume callback if event's state is
+// StatePaused or StateResumed and returns its error, if any.
+func (o *observer) pauseResume(event StateEvent) error {
+	if o.onPauseResume == nil || (event.State != StatePaused && event.State != StateResumed) {
+		return nil
+	}
+	if err := o.onPauseResume(event); err != nil {
+		o.log.Warningf("%v state callback failed at %s: %v", event.State, o.socket, err)
+		return err
+	}
+	return nil
+}
+
+// setKeepAlive configures keep-alive probes of tcp connection.
+func (o *observer) setKeepAlive(conn net.Conn) {
+	if tc, ok := conn.(*tls.Conn); ok {
+		conn = tc.NetConn()
+	}
+	tcp, ok := conn.(*net.TCPConn)
+	if !ok {
+		return
+	}
+	if o.keepAlive <= 0 {
+		tcp.SetKeepAlive(false)
+		return
+	}
+	if err := tcp.SetKeepAlive(true); err != nil {
+		o.log.Warningf("Could not enable keep-alive at %s: %v", o.socket, err)
+		return
+	}
+	tcp.SetKeepAlivePeriod(o.keepAlive)
+}
+
+// isTemporaryAcceptErr returns true if Accept may succeed later,
+// e.g. when process is temporarily out of file descriptors.
+func isTemporaryAcceptErr(err error) bool {
+	if errors.Is(err, syscall.EMFILE) || errors.Is(err, syscall.ENFILE) ||
+		errors.Is(err, syscall.EINTR) || errors.Is(err, syscall.ECONNABORTED) {
+		return true
+	}
+	ne, ok := err.(net.Error)
+	return ok && ne.Temporary()
+}
+
+// runHooks calls hooks registered for the event's state.
+func (o *observer) runHooks(event StateEvent) error {
+	for _, fn := range o.hooks[event.State] {
+		if err := fn(event); err != nil {
+			return &HookError{State: event.State, Err: err}
+		}
+	}
+	return nil
+}
+
+// watchTimeout calls cancel once timeout passes without a notification on
+// reset. If once is true, watching stops after the first notification.
+// Before cancel is called err is passed to the returned channel.
+func (o *observer) watchTimeout(ctx context.Context, cancel context.CancelFunc,
+	timeout time.Duration, reset <-chan struct{}, once bool, err error) <-chan error {
+	expired := make(chan error, 1)
 	go func() {
-		defer close(syncChan)
-		defer ln.Close()
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
 
 		for {
 			select {
 			case <-ctx.Done():
-				glog.V(5).Infof("Context is done")
 				return
-			case conn := <-nextConn(ln):
-				if conn == nil {
-					glog.Errorf("Could not accept sync socket connection")
+			case <-reset:
+				if once {
 					return
 				}
-				state, err := readState(conn)
-				if err != nil {
-					glog.Errorf("Could not read state at %s: %v", socket, err)
-					return
+				if !timer.Stop() {
+					<-timer.C
 				}
-				glog.V(4).Infof("Received state %v at %s", state, socket)
-				syncChan <- state
-				if state == StateExited {
-					return
+				timer.Reset(timeout)
+			case <-timer.C:
+				o.log.Errorf("Stopping observation at %s: %v", o.socket, err)
+				expired <- err
+				cancel()
+				return
+			}
+		}
+	}()
+	return expired
+}
+
+// watchStateTimeouts calls cancel once container stays in a state
+// for longer than its timeout, see WithStateTimeout.
+func (o *observer) watchStateTimeouts(ctx context.Context, cancel context.CancelFunc) <-chan error {
+	expired := make(chan error, 1)
+	go func() {
+		timer := time.NewTimer(0)
+		defer timer.Stop()
+		<-timer.C
+
+		state := StateUnknown
+		timeout, ok := o.stateTimeout(state)
+		if ok {
+			timer.Reset(timeout)
+		}
+		// entered is when container has entered state
+		entered := o.now()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-o.transitions:
+				o.mu.Lock()
+				current := o.current
+				o.mu.Unlock()
+				if current == state {
+					continue
+				}
+				if ok && !timer.Stop() {
+					<-timer.C
+				}
+				state, entered = current, o.now()
+				if timeout, ok = o.stateTimeout(state); ok {
+					timer.Reset(timeout)
+				}
+			case <-o.reloadStates:
+				if ok && !timer.Stop() {
+					<-timer.C
+				}
+				// budget is still measured since state was entered
+				if timeout, ok = o.stateTimeout(state); ok {
+					timer.Reset(timeout - o.now().Sub(entered))
 				}
+			case <-timer.C:
+				err := &StateTimeoutError{State: state, Timeout: timeout}
+				o.log.Errorf("Stopping observation at %s: %v", o.socket, err)
+				expired <- err
+				cancel()
+				return
 			}
 		}
 	}()
-	return syncChan, nil
+	return expired
 }
 
-func readState(conn io.ReadCloser) (State, error) {
-	type statusInfo struct {
-		Status string `json:"status"`
+// notify notifies timeout watcher without blocking. Nil ch is ignored.
+func notify(ch chan struct{}) {
+	select {
+	case ch <- struct{}{}:
+	default:
 	}
+}
 
-	defer conn.Close()
-	dec := json.NewDecoder(conn)
-	var status statusInfo
-	err := dec.Decode(&status)
-	if err != nil {
-		return 0, fmt.Errorf("could not read state: %v", err)
+// send passes event to the observer's channel and records it in history.
+// It returns false if the event could not be passed before ctx is done.
+// Events filtered out with WithFilter are dropped and considered passed.
+func (o *observer) send(ctx context.Context, event StateEvent) bool {
+	if o.filter != nil && event.Err == nil && !o.filter(event.State) {
+		return true
+	}
+	if !o.deliver(ctx, event) {
+		o.deadLetter(event, ctx.Err())
+		return false
+	}
+	o.mu.Lock()
+	o.history.add(event)
+	o.durations.add(event)
+	o.mu.Unlock()
+	o.traceEvent(event)
+	o.mirrorEvent(event)
+	o.journalEvent(event)
+	o.forwardEvent(event)
+	return true
+}
+
+// sendFinal is the same as send except it gives up once terminal send timeout
+// passes, so that observation is over even if nobody reads the channel anymore.
+func (o *observer) sendFinal(ctx context.Context, event StateEvent) bool {
+	if event.Err != nil {
+		o.errReported = true
+	}
+	if o.terminalTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, o.terminalTimeout)
+		defer cancel()
 	}
+	if o.send(ctx, event) {
+		return true
+	}
+	if ctx.Err() == context.DeadlineExceeded {
+		o.log.Warningf("Dropping final state %v at %s: not received by consumer within %v",
+			event.State, o.socket, o.terminalTimeout)
+	}
+	return false
+}
 
-	state := StatusToState(status.Status)
-	if state == StateUnknown {
-		return 0, fmt.Errorf("received unknown status: %s", status.Status)
+// deliver passes event to the channel observer was asked for. Events carrying
+// an error are not passed to the states channel, which is simply closed.
+// Time spent waiting for the consumer is reported with reportBlocked.
+func (o *observer) deliver(ctx context.Context, event StateEvent) bool {
+	if o.states != nil && event.Err != nil {
+		return true
 	}
-	return state, nil
+	start := o.now()
+	ok := o.push(ctx, event)
+	o.reportBlocked(event, o.now().Sub(start))
+	return ok
 }
 
-func nextConn(ln net.Listener) <-chan net.Conn {
-	next := make(chan net.Conn)
+// push blocks until event is passed to the channel or ctx is done.
+// Channel with free space is tried first without checking ctx, which
+// is considerably cheaper for states sent back to back.
+func (o *observer) push(ctx context.Context, event StateEvent) bool {
+	if o.states != nil {
+		select {
+		case o.states <- event.State:
+			return true
+		default:
+		}
+		select {
+		case o.states <- event.State:
+			return true
+		case <-ctx.Done():
+			return false
+		}
+	}
+
+	select {
+	case o.events <- event:
+		return true
+	default:
+	}
+	select {
+	case o.events <- event:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// close records the reason observation is over and closes the channel.
+// Observation that is stopped without an error before container has
+// exited is over because context is done.
+func (o *observer) close(ctx context.Context, err error) {
+	if err == nil && !o.finished {
+		err = ctx.Err()
+	}
+	o.mu.Lock()
+	o.err = err
+	o.mu.Unlock()
+
+	o.endSpan(err)
+	o.stopMirror()
+	o.stopJournal()
+	o.stopForwarder()
+	o.reportLostLetters()
+	o.release()
+	if o.states != nil {
+		close(o.states)
+	}
+	if o.events != nil {
+		close(o.events)
+	}
+	close(o.done)
+}
+
+// syncOnConn reads statuses from the passed connection until it is closed
+// by the runtime. Connection closed or dropped by the runtime is not an error
+// since runtime may connect again to report further states. Once context is
+// done, reading continues for no longer than the drain timeout. Received states
+// are passed to the channel until sendCtx is done. Returned bool is true if
+// observation should be stopped, i.e. terminal status was received or nobody reads
+// from the channel anymore. In strict mode invalid transition is returned
+// as TransitionError.
+func (o *observer) syncOnConn(ctx, sendCtx context.Context, conn net.Conn) (bool, error) {
+	// reason is the reason connection is closed, nil if closed by the runtime
+	var reason error
+	// objects is the number of decoded status objects
+	var objects int64
+	counter := &countingReader{r: conn}
+	defer func() {
+		conn.Close()
+		o.reportConn(objects, counter.n)
+		if o.onDisconnect != nil {
+			o.onDisconnect(conn.RemoteAddr(), reason)
+		}
+	}()
+	if o.onConnect != nil {
+		o.onConnect(conn.RemoteAddr())
+	}
+
+	if err := o.checkPeer(conn); err != nil {
+		o.log.Warningf("Rejecting sync connection at %s: %v", o.socket, err)
+		reason = err
+		return false, nil
+	}
+	o.setKeepAlive(conn)
+	if err := handshakeTLS(ctx, conn); err != nil {
+		o.log.Warningf("Closing sync connection at %s: TLS handshake failed: %v", o.socket, err)
+		reason = err
+		return false, nil
+	}
+	o.setConn(conn)
+	defer o.unsetConn(conn)
 
+	// mu guards read deadline, so that idle deadline
+	// never overrides the drain one
+	var mu sync.Mutex
+	draining := false
+	resetIdle := func() {
+		timeout := o.connIdleTimeout.load()
+		if timeout <= 0 {
+			return
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		if !draining {
+			conn.SetReadDeadline(time.Now().Add(timeout))
+		}
+	}
+	resetIdle()
+
+	stop := make(chan struct{})
+	defer close(stop)
 	go func() {
-		defer close(next)
-		conn, err := ln.Accept()
+		select {
+		case <-ctx.Done():
+			mu.Lock()
+			draining = true
+			conn.SetReadDeadline(time.Now().Add(o.drainTimeout))
+			mu.Unlock()
+		case <-stop:
+		}
+	}()
+
+	if len(o.handshake) > 0 {
+		err := readHandshake(counter, o.handshake)
+		if err == io.EOF {
+			return o.inferExit(sendCtx, false), nil
+		}
+		if err != nil {
+			o.log.Warningf("Closing sync connection at %s: %v", o.socket, err)
+			reason = err
+			return false, nil
+		}
+	}
+	if !o.admitConn(conn) {
+		reason = errConnConflict
+		return false, nil
+	}
+	defer o.releaseConn(conn)
+
+	var r io.Reader = counter
+	limit := &statusLimitReader{r: counter, max: o.maxStatusSize}
+	if o.maxStatusSize > 0 {
+		r = limit
+	}
+
+	stream := o.newStatusStream(r, counter)
+	reader := &throttledReader{read: func() (syncStatus, error) {
+		limit.max = stream.offset() + o.maxStatusSize
+		return stream.next()
+	}}
+	for {
+		// context is only checked between batches of status objects
+		// runtime has written at once, send checks it when blocked
+		if !reader.buffered() && stream.drained() && sendCtx.Err() != nil {
+			return true, nil
+		}
+		status, err := reader.next()
+		// statuses decoded before connection is replaced are dropped
+		if o.isReplaced(conn) {
+			reason = errConnReplaced
+			return false, nil
+		}
+		if err == io.EOF {
+			return o.inferExit(sendCtx, false), nil
+		}
 		if err != nil {
-			glog.Errorf("Accept failed: %v", err)
+			reason = err
+		}
+		if err == errStatusTooLarge {
+			o.log.Warningf("Closing sync connection at %s: status object exceeds %d bytes", o.socket, o.maxStatusSize)
+			return false, nil
+		}
+		if err == io.ErrUnexpectedEOF {
+			o.log.Warningf("Sync connection at %s closed in the middle of status object, %d status objects decoded",
+				o.socket, objects)
+			return o.inferExit(sendCtx, true), nil
+		}
+		// runtime may reconnect to report next states
+		if errors.Is(err, syscall.ECONNRESET) {
+			o.log.Warningf("Sync connection at %s dropped: %v", o.socket, err)
+			return o.inferExit(sendCtx, false), nil
+		}
+		if errors.Is(err, os.ErrDeadlineExceeded) && ctx.Err() != nil {
+			left := stream.discard()
+			o.log.Warningf("Drain timeout exceeded at %s, %d bytes left undecoded", o.socket, left)
+			return false, nil
+		}
+		if errors.Is(err, os.ErrDeadlineExceeded) {
+			o.log.Warningf("Closing sync connection at %s: no status received within %v", o.socket, o.connIdleTimeout.load())
+			return false, nil
+		}
+		if err != nil {
+			return false, &observeError{kind: ErrDecode, err: err}
+		}
+		objects++
+		resetIdle()
+
+		if err := checkVersion(status); err != nil {
+			o.log.Warningf("Closing sync connection at %s: %v", o.socket, err)
+			reason = err
+			return false, nil
+		}
+
+		if o.token != "" && subtle.ConstantTimeCompare([]byte(status.Token), []byte(o.token)) != 1 {
+			o.log.Warningf("Closing sync connection at %s: invalid token", o.socket)
+			reason = errInvalidToken
+			return false, nil
+		}
+		notify(o.activity)
+		if status.ID != 0 {
+			o.reply(status)
+			continue
+		}
+
+		if o.throttle != nil {
+			o.throttleStatus(sendCtx, reader, status)
+		}
+		handle := o.handle
+		if o.route != nil {
+			handle = o.route
+		}
+		over, err := handle(sendCtx, status)
+		if err != nil {
+			reason = err
+		}
+		if over {
+			return true, err
+		}
+	}
+}
+
+// readHandshake reads len(prefix) bytes from r and checks they match prefix.
+// It returns io.EOF if r is closed before any byte is read.
+func readHandshake(r io.Reader, prefix []byte) error {
+	buf := make([]byte, len(prefix))
+	n, err := io.ReadFull(r, buf)
+	if err == io.EOF {
+		return err
+	}
+	if err != nil && err != io.ErrUnexpectedEOF {
+		return fmt.Errorf("could not read handshake: %w", err)
+	}
+	if !bytes.Equal(buf[:n], prefix) {
+		return fmt.Errorf("%w %q", errBadHandshake, buf[:n])
+	}
+	return nil
+}
+
+// handle passes received status to the channel. Returned bool is true if
+// observation should be stopped. Statuses received over concurrent connections,
+// see WithConnWorkers, are handled one at a time and once terminal status is
+// handled, further ones are dropped.
+func (o *observer) handle(sendCtx context.Context, status syncStatus) (bool, error) {
+	o.handleMu.Lock()
+	defer o.handleMu.Unlock()
+	if o.finished {
+		return true, nil
+	}
+	return o.handleEvent(sendCtx, o.event(status))
+}
+
+// handleEvent passes event to the channel the same way handle does,
+// handleMu must be held.
+func (o *observer) handleEvent(sendCtx context.Context, event StateEvent) (bool, error) {
+	if event.State == StateUnknown && o.strictStatuses {
+		err := &observeError{kind: ErrDecode, err: fmt.Errorf("%w %q", ErrUnknownStatus, event.Status)}
+		o.log.Errorf("Received unknown status %q at %s", event.Status, o.socket)
+		event.Err = err
+		o.sendFinal(sendCtx, event)
+		return true, err
+	}
+	// repeated state still counts as activity, see WithInactivityTimeout
+	if o.coalesce && event.State != StateUnknown && event.State == o.last {
+		return false, nil
+	}
+	if event.State == StateUnknown {
+		o.log.Warningf("Received unknown status %q at %s", event.Status, o.socket)
+	} else if event.Snapshot {
+		o.log.Debugf("Received snapshot of state %v at %s", event.State, o.socket)
+	} else {
+		o.log.Debugf("Received state %v at %s", event.State, o.socket)
+	}
+	if o.strict && !event.Snapshot && !validTransition(o.last, event.State) {
+		event.Err = &TransitionError{From: o.last, To: event.State}
+		o.sendFinal(sendCtx, event)
+		return true, event.Err
+	}
+	if event.State == StateCreating && !event.Snapshot && o.last != StateUnknown && o.last != StatePreparing {
+		o.log.Warningf("Received %v state after %v at %s, container is not expected to be created again",
+			event.State, o.last, o.socket)
+	}
+	if err := o.runHooks(event); err != nil {
+		event.Err = err
+		o.sendFinal(sendCtx, event)
+		return true, err
+	}
+	event.HookErr = o.pauseResume(event)
+	if err := o.runCommands(event); err != nil && event.HookErr == nil {
+		event.HookErr = err
+	}
+	if event.State == StateExited && !event.Snapshot && (o.last == StatePreparing || o.last == StateCreating || o.last == StateCreated) {
+		event.StartErr = &StartError{Last: o.last}
+		o.log.Warningf("Container at %s exited while %v, it has failed to start", o.socket, o.last)
+	}
+	send := o.send
+	if o.isTerminal(event) {
+		send = o.sendFinal
+	}
+	if !send(sendCtx, event) {
+		if sendCtx.Err() != nil {
+			o.log.Debugf("Dropping state %v at %s: context is done", event.State, o.socket)
+		}
+		return true, nil
+	}
+	o.passed(event)
+	if o.isTerminal(event) {
+		o.finished = true
+		return true, nil
+	}
+	return false, nil
+}
+
+// passed updates observer once event is passed to the channel.
+func (o *observer) passed(event StateEvent) {
+	o.reportMetrics(event)
+	if event.StartErr != nil {
+		o.mu.Lock()
+		o.startErr = event.StartErr
+		o.mu.Unlock()
+	}
+	o.setCurrent(event.State)
+	notify(o.transitions)
+	if event.State != StateUnknown && event.State != o.last {
+		for _, fn := range o.onTransition {
+			fn(o.last, event.State, event.Time)
+		}
+		if reason := EventReason(event); reason != "" {
+			for _, fn := range o.onCRIEvent {
+				fn(reason, event)
+			}
+		}
+	}
+	if event.State != StateUnknown {
+		o.last = event.State
+	}
+}
+
+// inferExit passes inferred StateExited to the channel if enabled with
+// WithInferredExit and connection is closed while container is running,
+// truncated is true if it is closed in the middle of a status object.
+// It returns true if observation should be stopped.
+func (o *observer) inferExit(ctx context.Context, truncated bool) bool {
+	if !o.inferExitOnClose {
+		return false
+	}
+	o.handleMu.Lock()
+	defer o.handleMu.Unlock()
+	if o.finished {
+		return true
+	}
+	switch o.last {
+	case StateRunning, StatePaused, StateResumed:
+	default:
+		return false
+	}
+
+	o.log.Warningf("Sync connection at %s closed while container is %v, assuming it has exited", o.socket, o.last)
+	event := StateEvent{
+		State:     StateExited,
+		Time:      o.now(),
+		Inferred:  true,
+		Truncated: truncated,
+	}
+	if !o.sendFinal(ctx, event) {
+		return true
+	}
+	o.passed(event)
+	o.finished = true
+	return true
+}
+
+// isTerminal returns true if event should stop observation.
+func (o *observer) isTerminal(event StateEvent) bool {
+	if o.terminal == nil {
+		return event.State == StateExited
+	}
+	return o.terminal[event.Status]
+}
+
+// statusLimitReader reads from r until max bytes are read, after that
+// errStatusTooLarge is returned. It is used to limit size of each status
+// by moving max forward once status is decoded.
+type statusLimitReader struct {
+	r    io.Reader
+	read int64
+	max  int64
+}
+
+func (l *statusLimitReader) Read(p []byte) (int, error) {
+	if l.read >= l.max {
+		return 0, errStatusTooLarge
+	}
+	if left := l.max - l.read; int64(len(p)) > left {
+		p = p[:left]
+	}
+	n, err := l.r.Read(p)
+	l.read += int64(n)
+	return n, err
+}
+
+// countingReader counts bytes read from r.
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// syncStatus is a status object sent by the runtime over sync socket.
+// Statuses are framed as a stream of JSON objects that may be separated
+// by any whitespace, so newline-delimited compact objects, pretty-printed
+// multi-line objects and blank lines in between are all accepted.
+//
+// Each object may carry protocol version in the "v" field, objects without
+// it are assumed to be v1, which is what older runtimes send. Objects of
+// unknown versions are rejected and connection is closed. Version 1 schema:
+//
+//	{
+//	  "v":           1,         // optional, protocol version
+//	  "status":      "running", // required, one of Status* constants, e.g.
+//	                            // creating, created, running, stopped
+//	  "pid":         1234,      // optional, pid of the container process
+//	  "exitCode":    0,         // optional, exit code once stopped
+//	  "signal":      0,         // optional, signal that stopped the container
+//	  "token":       "...",     // required if observer is set up WithToken
+//	  "id":          1,         // set only in reply to request, see syncRequest
+//	  "containerId": "...",     // required if states are multiplexed, see ObserveMux
+//	  "snapshot":    true       // optional, set if status is the current state
+//	}
+//
+// Runtime may send a snapshot of the current state as the first object once
+// it connects, e.g. when observer attaches to a running container, so that
+// the state is known without waiting for the next transition. Snapshot is
+// passed to the channel as the state container is in and is never rejected
+// as an invalid transition, since states before it may have been missed.
+//
+// Unknown fields are ignored, so optional fields may be
+// added within a version without breaking older observers.
+type syncStatus struct {
+	Version  int    `json:"v,omitempty"`
+	Status   string `json:"status"`
+	Pid      int    `json:"pid,omitempty"`
+	ExitCode int    `json:"exitCode,omitempty"`
+	Signal   int    `json:"signal,omitempty"`
+	Token    string `json:"token,omitempty"`
+	ID       uint64 `json:"id,omitempty"`
+	// ContainerID is only set when states
+	// are multiplexed, see ObserveMux.
+	ContainerID string `json:"containerId,omitempty"`
+	Snapshot    bool   `json:"snapshot,omitempty"`
+	// Backend is only set when status objects
+	// are wrapped in envelopes, see WithEnvelope.
+	Backend string `json:"-"`
+	// Raw is the whole status object, kept with WithRawStatus.
+	Raw json.RawMessage `json:"-"`
+}
+
+// checkVersion checks that status object is of the protocol version observer
+// understands. Objects of future versions that change meaning of existing
+// fields should be handled here once they are introduced.
+func checkVersion(status syncStatus) error {
+	switch status.Version {
+	case 0, syncVersion1:
+		return nil
+	default:
+		return fmt.Errorf("%w %d", errUnsupportedVersion, status.Version)
+	}
+}
+
+// readStatus reads the next status object from dec. Status object is
+// decoded directly unless status is read from the fields set with
+// WithStatusFields or status object is kept, see WithRawStatus.
+func (o *observer) readStatus(dec *json.Decoder) (syncStatus, error) {
+	if o.statusFields == nil && !o.rawStatus && !o.envelope {
+		var status syncStatus
+		err := dec.Decode(&status)
+		return status, err
+	}
+
+	var raw json.RawMessage
+	if err := dec.Decode(&raw); err != nil {
+		return syncStatus{}, err
+	}
+	return o.decodeStatus(raw)
+}
+
+// drained returns true if dec has no buffered data left, i.e. all
+// status objects written by runtime at once are already decoded.
+func drained(dec *json.Decoder) bool {
+	buf, ok := dec.Buffered().(interface{ Len() int })
+	return !ok || buf.Len() == 0
+}
+
+// decodeStatus decodes status object, reading status from
+// the fields set with WithStatusFields, if any.
+func (o *observer) decodeStatus(raw json.RawMessage) (syncStatus, error) {
+	if o.envelope {
+		return o.openEnvelope(raw)
+	}
+	return o.decodeObject(raw)
+}
+
+// decodeObject decodes status object that is not wrapped in envelope.
+func (o *observer) decodeObject(raw json.RawMessage) (syncStatus, error) {
+	var status syncStatus
+	if err := json.Unmarshal(raw, &status); err != nil {
+		return status, err
+	}
+	if o.rawStatus {
+		status.Raw = raw
+	}
+	if o.statusFields == nil {
+		return status, nil
+	}
+
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(raw, &fields); err != nil {
+		return status, err
+	}
+	status.Status = ""
+	for _, name := range o.statusFields {
+		field, ok := fields[name]
+		if !ok {
+			continue
+		}
+		if err := json.Unmarshal(field, &status.Status); err != nil {
+			return status, fmt.Errorf("invalid %s field: %v", name, err)
+		}
+		break
+	}
+	return status, nil
+}
+
+// event converts status to StateEvent.
+func (o *observer) event(status syncStatus) StateEvent {
+	state := o.toState(status.Status)
+	if o.preparing[status.Status] {
+		state = StatePreparing
+	}
+	return StateEvent{
+		State:    state,
+		Status:   status.Status,
+		Time:     o.now(),
+		Pid:      status.Pid,
+		ExitCode: status.ExitCode,
+		Signal:   status.Signal,
+		Snapshot: status.Snapshot,
+		Raw:      status.Raw,
+	}
+}
+
+// validTransition checks whether container may move from prev to next state.
+// Unknown states are not validated.
+func validTransition(prev, next State) bool {
+	order := func(s State) int {
+		switch s {
+		case StatePreparing:
+			return 1
+		case StateCreating:
+			return 2
+		case StateCreated:
+			return 3
+		case StateRunning, StatePaused, StateResumed:
+			return 4
+		case StateExited:
+			return 5
+		}
+		return 0
+	}
+
+	if prev == StateUnknown || next == StateUnknown {
+		return true
+	}
+	// container is created only once, so StateCreating may only come
+	// first or right after StatePreparing that may only come first itself
+	if next == StateCreating && prev != StatePreparing {
+		return false
+	}
+	if next == StatePreparing && prev != StatePreparing {
+		return false
+	}
+	paused := prev == StatePaused || prev == StateResumed
+	if next == StatePaused && prev != StateRunning && !paused {
+		return false
+	}
+	if next == StateResumed && !paused {
+		return false
+	}
+	return order(next) >= order(prev)
+}
+
+// withDelay returns a copy of the parent context that is done
+// only after delay passes since the parent is done.
+func withDelay(parent context.Context, delay time.Duration) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		select {
+		case <-parent.Done():
+		case <-ctx.Done():
 			return
 		}
-		next <- conn
+
+		timer := time.NewTimer(delay)
+		defer timer.Stop()
+		select {
+		case <-timer.C:
+			cancel()
+		case <-ctx.Done():
+		}
 	}()
-	return next
+	return ctx, cancel
 }
 
+// Statuses runtime reports states with over the sync socket,
+// see syncStatus. Note that StateExited is reported as StatusStopped.
+const (
+	StatusPreparing = "preparing"
+	StatusCreating  = "creating"
+	StatusCreated   = "created"
+	StatusRunning   = "running"
+	StatusStopped   = "stopped"
+	StatusPaused    = "paused"
+	StatusResumed   = "resumed"
+)
+
 // StatusToState is a helper func to convert container OCI status to State.
 func StatusToState(status string) State {
-	var state State
+	state, _ := ParseStatus(status)
+	return state
+}
+
+// ParseStatus converts status reported by the runtime to State. It returns
+// StateUnknown and false if status is not one of the known ones.
+func ParseStatus(status string) (State, bool) {
 	switch status {
-	case "creating":
-		state = StateCreating
-	case "created":
-		state = StateCreated
-	case "running":
-		state = StateRunning
-	case "stopped":
-		state = StateExited
+	case StatusPreparing:
+		return StatePreparing, true
+	case StatusCreating:
+		return StateCreating, true
+	case StatusCreated:
+		return StateCreated, true
+	case StatusRunning:
+		return StateRunning, true
+	case StatusStopped:
+		return StateExited, true
+	case StatusPaused:
+		return StatePaused, true
+	case StatusResumed:
+		return StateResumed, true
 	}
-	return state
+	return StateUnknown, false
+}
+
+// StatusString returns the status runtime reports state with, so that
+// ParseStatus converts it back to state. Empty string is returned for
+// states that have no corresponding status, e.g. StateUnknown and StateError.
+func StatusString(state State) string {
+	switch state {
+	case StatePreparing:
+		return StatusPreparing
+	case StateCreating:
+		return StatusCreating
+	case StateCreated:
+		return StatusCreated
+	case StateRunning:
+		return StatusRunning
+	case StateExited:
+		return StatusStopped
+	case StatePaused:
+		return StatusPaused
+	case StateResumed:
+		return StatusResumed
+	}
+	return ""
 }
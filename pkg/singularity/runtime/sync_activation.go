@@ -0,0 +1,123 @@
+// Copyright (c) 2018-2019 Sylabs, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package runtime
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+)
+
+// listenFDsStart is the first file descriptor passed
+// by systemd socket activation, i.e. SD_LISTEN_FDS_START.
+const listenFDsStart = 3
+
+// activated holds listeners passed by systemd socket activation that
+// are not used yet, keyed by their addresses. They are loaded once,
+// the first time a socket is listened on.
+var activated = struct {
+	once sync.Once
+	sync.Mutex
+	listeners map[string]net.Listener
+}{
+	listeners: make(map[string]net.Listener),
+}
+
+// takeActivated returns listener passed by systemd socket activation for
+// the socket at address, if any. Listener is returned at most once, so
+// the socket is listened on as usual once the observation is over.
+func takeActivated(address string, log Logger) net.Listener {
+	activated.once.Do(func() {
+		lns, err := listenFDs(os.Getenv("LISTEN_PID"), os.Getenv("LISTEN_FDS"), listenFDsStart)
+		if err != nil {
+			log.Warningf("Ignoring sockets passed by systemd: %v", err)
+		}
+		// make sure sockets are not inherited by child processes
+		os.Unsetenv("LISTEN_PID")
+		os.Unsetenv("LISTEN_FDS")
+		os.Unsetenv("LISTEN_FDNAMES")
+		for _, ln := range lns {
+			addActivated(ln)
+		}
+	})
+
+	activated.Lock()
+	defer activated.Unlock()
+	key := activatedKey(address)
+	ln, ok := activated.listeners[key]
+	if !ok {
+		return nil
+	}
+	delete(activated.listeners, key)
+	log.Debugf("Using socket %s passed by systemd", address)
+	return ln
+}
+
+// addActivated makes listener available to takeActivated.
+func addActivated(ln net.Listener) {
+	addActivatedAt(ln.Addr().String(), ln)
+}
+
+// addActivatedAt is the same as addActivated except listener
+// is kept for the passed address rather than the bound one.
+func addActivatedAt(address string, ln net.Listener) {
+	activated.Lock()
+	activated.listeners[activatedKey(address)] = ln
+	activated.Unlock()
+}
+
+// activatedKey returns the key listener for the address is kept by.
+func activatedKey(address string) string {
+	if filepath.IsAbs(address) {
+		return filepath.Clean(address)
+	}
+	return address
+}
+
+// listenFDs returns listeners for the file descriptors passed by systemd
+// socket activation according to the LISTEN_PID and LISTEN_FDS variables.
+// No listeners are returned if sockets are passed to another process.
+func listenFDs(pid, fds string, start int) ([]net.Listener, error) {
+	if pid == "" || fds == "" {
+		return nil, nil
+	}
+	p, err := strconv.Atoi(pid)
+	if err != nil {
+		return nil, fmt.Errorf("invalid LISTEN_PID %q", pid)
+	}
+	if p != os.Getpid() {
+		return nil, nil
+	}
+	n, err := strconv.Atoi(fds)
+	if err != nil || n < 0 {
+		return nil, fmt.Errorf("invalid LISTEN_FDS %q", fds)
+	}
+
+	var lns []net.Listener
+	for fd := start; fd < start+n; fd++ {
+		f := os.NewFile(uintptr(fd), fmt.Sprintf("LISTEN_FD_%d", fd))
+		ln, err := net.FileListener(f)
+		f.Close()
+		if err != nil {
+			// e.g. datagram socket or fifo meant for someone else
+			continue
+		}
+		lns = append(lns, ln)
+	}
+	return lns, nil
+}
@@ -0,0 +1,105 @@
+// Copyright (c) 2018-2019 Sylabs, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package runtime
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/sys/unix"
+)
+
+// passSocket returns descriptor of the listening socket at path
+// as if it was passed by systemd. It is closed on cleanup.
+func passSocket(t *testing.T, path string) int {
+	ln, err := net.Listen("unix", path)
+	require.NoError(t, err)
+	defer ln.Close()
+	ln.(*net.UnixListener).SetUnlinkOnClose(false)
+
+	f, err := ln.(*net.UnixListener).File()
+	require.NoError(t, err)
+	defer f.Close()
+	fd, err := unix.Dup(int(f.Fd()))
+	require.NoError(t, err)
+	return fd
+}
+
+func TestListenFDs(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cri-test-activation-")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "sync.sock")
+	fd := passSocket(t, path)
+	pid := strconv.Itoa(os.Getpid())
+
+	lns, err := listenFDs("", "", fd)
+	require.NoError(t, err)
+	require.Empty(t, lns, "no sockets should be used without activation")
+
+	lns, err = listenFDs(strconv.Itoa(os.Getpid()+1), "1", fd)
+	require.NoError(t, err)
+	require.Empty(t, lns, "sockets passed to other process should not be used")
+
+	_, err = listenFDs(pid, "many", fd)
+	require.Error(t, err)
+
+	lns, err = listenFDs(pid, "1", fd)
+	require.NoError(t, err)
+	require.Len(t, lns, 1)
+	require.Equal(t, path, lns[0].Addr().String())
+	require.NoError(t, lns[0].Close())
+}
+
+func TestObserveState_SocketActivation(t *testing.T) {
+	defer checkLeaks(t)()
+
+	dir, err := ioutil.TempDir("", "cri-test-activation-")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "sync.sock")
+
+	// load environment first, so that it does not override passed socket
+	takeActivated(path, glogLogger{})
+	lns, err := listenFDs(strconv.Itoa(os.Getpid()), "1", passSocket(t, path))
+	require.NoError(t, err)
+	require.Len(t, lns, 1)
+	addActivated(lns[0])
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	state, err := ObserveState(ctx, "unix://"+path)
+	require.NoError(t, err)
+	require.Nil(t, takeActivated(path, glogLogger{}), "passed socket should be used once")
+	require.NoError(t, PushState(ctx, path, StateRunning, StateExited))
+
+	var actual []State
+	for s := range state {
+		actual = append(actual, s)
+	}
+	require.Equal(t, []State{StateRunning, StateExited}, actual)
+
+	// socket file is owned by systemd, it is never removed
+	fi, err := os.Lstat(path)
+	require.NoError(t, err)
+	require.True(t, fi.Mode()&os.ModeSocket != 0, fmt.Sprintf("unexpected mode %v", fi.Mode()))
+}
@@ -0,0 +1,238 @@
+// Copyright (c) 2018-2019 Sylabs, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package runtime
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sylabs/singularity/pkg/util/unix"
+)
+
+// ReadState connects to the passed socket as a client and reads a single
+// status object from it. This is useful to poll state from a runtime that
+// listens on the socket instead of observing it continuously. Socket may
+// be specified in the same forms ObserveState accepts. Unrecognized status
+// is returned as StateUnknown along with an error.
+func ReadState(ctx context.Context, socket string) (State, error) {
+	conn, err := dialSocket(ctx, socket)
+	if err != nil {
+		return StateUnknown, fmt.Errorf("could not connect to sync socket: %v", err)
+	}
+	defer conn.Close()
+
+	stop := closeOnDone(ctx, conn)
+	defer close(stop)
+
+	var status syncStatus
+	dec := json.NewDecoder(io.LimitReader(conn, DefaultMaxStatusSize))
+	if err := dec.Decode(&status); err != nil {
+		if ctx.Err() != nil {
+			return StateUnknown, ctx.Err()
+		}
+		return StateUnknown, &observeError{kind: ErrDecode, err: err}
+	}
+	if err := checkVersion(status); err != nil {
+		return StateUnknown, err
+	}
+
+	state := StatusToState(status.Status)
+	if state == StateUnknown {
+		return state, fmt.Errorf("received unknown status %q", status.Status)
+	}
+	return state, nil
+}
+
+// readStatesParallelism is the number of sockets ReadStates reads at once.
+const readStatesParallelism = 16
+
+// ReadStatesError is returned by ReadStates when state
+// could not be read from some of the sockets.
+type ReadStatesError struct {
+	// Errs holds the reason state could not be read keyed by socket.
+	Errs map[string]error
+}
+
+// Error implements error interface.
+func (e *ReadStatesError) Error() string {
+	sockets := make([]string, 0, len(e.Errs))
+	for socket := range e.Errs {
+		sockets = append(sockets, socket)
+	}
+	sort.Strings(sockets)
+
+	reasons := make([]string, len(sockets))
+	for i, socket := range sockets {
+		reasons[i] = fmt.Sprintf("%s: %v", socket, e.Errs[socket])
+	}
+	return fmt.Sprintf("could not read state from %d sockets: %s", len(sockets), strings.Join(reasons, "; "))
+}
+
+// ReadStates is the same as ReadState except it reads states from all passed
+// sockets concurrently, e.g. to take a snapshot of every container on the node.
+// At most readStatesParallelism sockets are read at once. Returned map holds
+// states read successfully keyed by socket. If state could not be read from
+// some of the sockets, e.g. because ctx is done before that, those states are
+// still returned along with ReadStatesError listing the failed sockets.
+func ReadStates(ctx context.Context, sockets []string) (map[string]State, error) {
+	var mu sync.Mutex
+	states := make(map[string]State, len(sockets))
+	errs := make(map[string]error)
+
+	var wg sync.WaitGroup
+	slots := make(chan struct{}, readStatesParallelism)
+	seen := make(map[string]bool, len(sockets))
+	for _, socket := range sockets {
+		if seen[socket] {
+			continue
+		}
+		seen[socket] = true
+
+		wg.Add(1)
+		slots <- struct{}{}
+		go func(socket string) {
+			defer wg.Done()
+			defer func() { <-slots }()
+
+			state, err := ReadState(ctx, socket)
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				errs[socket] = err
+				return
+			}
+			states[socket] = state
+		}(socket)
+	}
+	wg.Wait()
+
+	if len(errs) != 0 {
+		return states, &ReadStatesError{Errs: errs}
+	}
+	return states, nil
+}
+
+// PushState connects to the passed socket as a client and reports states
+// to it the same way runtime does, i.e. each state is written as a status
+// object followed by a newline. This is useful to simulate runtime in tests
+// and tooling. Socket may be specified in the same forms ObserveState
+// accepts. StateUnknown cannot be reported, since it has no status.
+func PushState(ctx context.Context, socket string, states ...State) error {
+	steps := make([]PushStep, len(states))
+	for i, state := range states {
+		steps[i].State = state
+	}
+	return PushStateSequence(ctx, socket, steps)
+}
+
+// PushStep is a state reported by PushStateSequence after Delay.
+type PushStep struct {
+	State State
+	Delay time.Duration
+}
+
+// PushStateSequence is the same as PushState except each state is reported
+// once its step delay passes since the previous state is reported, e.g. to
+// simulate realistic runtime timing in tests. All states are reported over
+// the same connection. If ctx is done while waiting, ctx error is returned.
+func PushStateSequence(ctx context.Context, socket string, steps []PushStep) error {
+	statuses := make([]syncStatus, len(steps))
+	for i, step := range steps {
+		status := StatusString(step.State)
+		if status == "" {
+			return fmt.Errorf("could not push state %v: no corresponding status", step.State)
+		}
+		statuses[i].Status = status
+	}
+
+	conn, err := dialSocket(ctx, socket)
+	if err != nil {
+		return fmt.Errorf("could not connect to sync socket: %v", err)
+	}
+	defer conn.Close()
+
+	stop := closeOnDone(ctx, conn)
+	defer close(stop)
+
+	enc := json.NewEncoder(conn)
+	for i, status := range statuses {
+		if err := sleep(ctx, steps[i].Delay); err != nil {
+			return err
+		}
+		if err := enc.Encode(status); err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			return fmt.Errorf("could not write state: %v", err)
+		}
+	}
+	return nil
+}
+
+// sleep waits for d to pass or ctx to be done, in which case ctx error is returned.
+func sleep(ctx context.Context, d time.Duration) error {
+	if d <= 0 {
+		return ctx.Err()
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// dialSocket connects to the passed socket. Socket may be passed in
+// the same forms listenSocket accepts.
+func dialSocket(ctx context.Context, socket string) (net.Conn, error) {
+	scheme, address := splitSocket(socket)
+	switch scheme {
+	case "unix":
+		if address == "" || strings.HasPrefix(address, "@") {
+			var d net.Dialer
+			return d.DialContext(ctx, "unix", address)
+		}
+		return unix.Dial(address)
+	case "tcp":
+		var d net.Dialer
+		return d.DialContext(ctx, "tcp", address)
+	case "vsock":
+		return dialVsock(ctx, address)
+	}
+	return nil, fmt.Errorf("unsupported sync socket scheme %q", scheme)
+}
+
+// closeOnDone closes conn once ctx is done. Returned
+// channel should be closed to stop waiting for ctx.
+func closeOnDone(ctx context.Context, conn io.Closer) chan<- struct{} {
+	stop := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-stop:
+		}
+	}()
+	return stop
+}
@@ -0,0 +1,241 @@
+// Copyright (c) 2018-2019 Sylabs, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package runtime
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestReadState(t *testing.T) {
+	tt := []struct {
+		name        string
+		data        string
+		expectState State
+		expectError string
+	}{
+		{
+			name:        "running",
+			data:        `{"status": "running"}`,
+			expectState: StateRunning,
+		},
+		{
+			name:        "unknown status",
+			data:        `{"status": "bogus"}`,
+			expectState: StateUnknown,
+			expectError: `received unknown status "bogus"`,
+		},
+		{
+			name:        "v1",
+			data:        `{"v": 1, "status": "running"}`,
+			expectState: StateRunning,
+		},
+		{
+			name:        "unsupported version",
+			data:        `{"v": 2, "status": "running"}`,
+			expectState: StateUnknown,
+			expectError: "unsupported sync protocol version 2",
+		},
+		{
+			name:        "invalid json",
+			data:        `{"status": running}`,
+			expectState: StateUnknown,
+			expectError: "could not read state: invalid character 'r' looking for beginning of value",
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			ln, err := net.Listen("unix", "")
+			require.NoError(t, err)
+			defer ln.Close()
+			go func() {
+				c, err := ln.Accept()
+				if err != nil {
+					return
+				}
+				c.Write([]byte(tc.data))
+				c.Close()
+			}()
+
+			state, err := ReadState(context.Background(), ln.Addr().String())
+			if tc.expectError != "" {
+				require.EqualError(t, err, tc.expectError)
+			} else {
+				require.NoError(t, err)
+			}
+			require.Equal(t, tc.expectState, state)
+		})
+	}
+}
+
+func TestReadState_Cancel(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer ln.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*20)
+	defer cancel()
+	_, err = ReadState(ctx, "tcp://"+ln.Addr().String())
+	require.Equal(t, context.DeadlineExceeded, err)
+}
+
+func TestReadStates(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	// runtime that reports state once a client connects
+	serve := func(t *testing.T, status string) string {
+		ln, err := net.Listen("unix", "")
+		require.NoError(t, err)
+		go func() {
+			defer ln.Close()
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			defer c.Close()
+			if status != "" {
+				c.Write([]byte(status))
+			} else {
+				<-ctx.Done()
+			}
+		}()
+		return ln.Addr().String()
+	}
+
+	expect := make(map[string]State)
+	var sockets []string
+	for i := 0; i < 2*readStatesParallelism; i++ {
+		socket := serve(t, `{"status": "running"}`)
+		sockets = append(sockets, socket)
+		expect[socket] = StateRunning
+	}
+	bogus := serve(t, `{"status": "bogus"}`)
+	sockets = append(sockets, bogus, sockets[0])
+
+	states, err := ReadStates(ctx, sockets)
+	require.Equal(t, expect, states)
+	require.IsType(t, &ReadStatesError{}, err)
+	errs := err.(*ReadStatesError).Errs
+	require.Len(t, errs, 1)
+	require.EqualError(t, errs[bogus], `received unknown status "bogus"`)
+	require.EqualError(t, err, fmt.Sprintf(`could not read state from 1 sockets: %s: received unknown status "bogus"`, bogus))
+
+	// partial results are returned once timeout passes
+	running := serve(t, `{"status": "running"}`)
+	stuck := serve(t, "")
+	timeoutCtx, timeoutCancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer timeoutCancel()
+	states, err = ReadStates(timeoutCtx, []string{running, stuck})
+	require.Equal(t, map[string]State{running: StateRunning}, states)
+	require.IsType(t, &ReadStatesError{}, err)
+	require.Equal(t, map[string]error{stuck: context.DeadlineExceeded}, err.(*ReadStatesError).Errs)
+
+	states, err = ReadStates(ctx, nil)
+	require.NoError(t, err)
+	require.Empty(t, states)
+}
+
+func TestPushState(t *testing.T) {
+	ln, err := net.Listen("unix", "")
+	require.NoError(t, err)
+	defer ln.Close()
+
+	received := make(chan string, 1)
+	go func() {
+		c, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		data, _ := ioutil.ReadAll(c)
+		received <- string(data)
+	}()
+
+	err = PushState(context.Background(), ln.Addr().String(), StateCreated, StateRunning, StateExited)
+	require.NoError(t, err)
+	require.Equal(t, "{\"status\":\"created\"}\n{\"status\":\"running\"}\n{\"status\":\"stopped\"}\n", <-received)
+}
+
+func TestPushState_Observe(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	pushed := []State{StateCreating, StateCreated, StateRunning, StatePaused, StateResumed, StateExited}
+	state, addr, err := ObserveStateOn(ctx, "", WithStrictTransitions())
+	require.NoError(t, err, "could not listen on socket")
+	require.NoError(t, PushState(ctx, addr.String(), pushed...))
+
+	var actual []State
+	for s := range state {
+		actual = append(actual, s)
+	}
+	require.Equal(t, pushed, actual)
+}
+
+func TestPushState_Unknown(t *testing.T) {
+	err := PushState(context.Background(), "@never-dialed", StateRunning, StateUnknown)
+	require.EqualError(t, err, "could not push state unknown: no corresponding status")
+}
+
+func TestPushStateSequence(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	events, err := ObserveStateEvents(ctx, "@"+t.Name())
+	require.NoError(t, err, "could not listen on socket")
+	steps := []PushStep{
+		{State: StateCreated, Delay: 10 * time.Millisecond},
+		{State: StateRunning, Delay: 50 * time.Millisecond},
+		{State: StateExited, Delay: 100 * time.Millisecond},
+	}
+	start := time.Now()
+	require.NoError(t, PushStateSequence(ctx, "@"+t.Name(), steps))
+
+	var elapsed time.Duration
+	for _, step := range steps {
+		event := <-events
+		require.Equal(t, step.State, event.State)
+		elapsed += step.Delay
+		require.True(t, event.Time.Sub(start) >= elapsed,
+			"%v is reported after %v, expected at least %v", event.State, event.Time.Sub(start), elapsed)
+	}
+	_, ok := <-events
+	require.False(t, ok)
+}
+
+func TestPushStateSequence_Cancel(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	state, err := ObserveState(ctx, "@"+t.Name())
+	require.NoError(t, err, "could not listen on socket")
+
+	pushCtx, pushCancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer pushCancel()
+	err = PushStateSequence(pushCtx, "@"+t.Name(), []PushStep{
+		{State: StateRunning},
+		{State: StateExited, Delay: time.Minute},
+	})
+	require.Equal(t, context.DeadlineExceeded, err)
+	require.Equal(t, StateRunning, <-state)
+}
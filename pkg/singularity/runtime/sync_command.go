@@ -0,0 +1,140 @@
+// Copyright (c) 2018-2019 Sylabs, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package runtime
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"time"
+)
+
+// CommandHook is a command observer runs once container
+// reaches a state, see OnStateCommand.
+type CommandHook struct {
+	// Path and Args are the command to run, Args do not include
+	// the command name, see exec.Command.
+	Path string
+	Args []string
+	// Env is added to the environment command is run with.
+	Env []string
+	// Timeout bounds the time command may run for, once it passes
+	// command is killed and reported failed. Zero means no limit.
+	Timeout time.Duration
+	// Veto makes failed command veto the transition the same way
+	// OnState hook does. Otherwise the failure is reported along
+	// with the state, which is passed to the channel as usual.
+	Veto bool
+}
+
+// CommandError is reported when command run by CommandHook fails.
+type CommandError struct {
+	Path string
+	// Output is what command has written to stdout and stderr.
+	Output []byte
+	Err    error
+}
+
+// Error implements error interface.
+func (e *CommandError) Error() string {
+	output := bytes.TrimSpace(e.Output)
+	if len(output) == 0 {
+		return fmt.Sprintf("command %s failed: %v", e.Path, e.Err)
+	}
+	return fmt.Sprintf("command %s failed: %v: %s", e.Path, e.Err, output)
+}
+
+// Unwrap returns the reason command failed.
+func (e *CommandError) Unwrap() error {
+	return e.Err
+}
+
+// OnStateCommand registers command to be run once target state is received,
+// e.g. prestart-like script on StateCreated or poststop one on StateExited,
+// ordered by the states observer receives regardless of the runtime's own
+// hooks. Command is run with the environment of the current process along
+// with SYCRI_CONTAINER_ID, SYCRI_STATE, SYCRI_STATUS and SYCRI_PID variables
+// describing the transition, followed by the hook's Env.
+//
+// Commands are run synchronously before the state is passed to the channel,
+// so further states are not read until command completes, e.g. StateRunning
+// is never passed before a command hook on StateCreated is done. Commands with
+// Veto set are run as OnState hooks in the order all hooks are registered,
+// the rest are run after every OnState hook in the order they are registered.
+//
+// Failed command, i.e. one that exits with non-zero code or cannot be run, is
+// reported as CommandError holding its output. Without Veto the error is passed
+// in StateEvent.HookErr and observation continues. With Veto the transition is
+// vetoed, see OnState. Output of commands that succeed is logged at debug level.
+func OnStateCommand(target State, hook CommandHook) ObserveOption {
+	return func(o *observer) {
+		if hook.Veto {
+			OnState(target, func(event StateEvent) error {
+				return o.runCommand(hook, event)
+			})(o)
+			return
+		}
+		if o.commands == nil {
+			o.commands = make(map[State][]CommandHook)
+		}
+		o.commands[target] = append(o.commands[target], hook)
+	}
+}
+
+// runCommands runs command hooks registered for the event's state without
+// Veto set. All of them are run, the first failure is returned.
+func (o *observer) runCommands(event StateEvent) error {
+	var first error
+	for _, hook := range o.commands[event.State] {
+		if err := o.runCommand(hook, event); err != nil {
+			o.log.Warningf("%v state command failed at %s: %v", event.State, o.socket, err)
+			if first == nil {
+				first = err
+			}
+		}
+	}
+	return first
+}
+
+// runCommand runs hook's command for the event and waits for it to complete.
+func (o *observer) runCommand(hook CommandHook, event StateEvent) error {
+	ctx := context.Background()
+	if hook.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, hook.Timeout)
+		defer cancel()
+	}
+
+	cmd := exec.CommandContext(ctx, hook.Path, hook.Args...)
+	cmd.Env = append(os.Environ(),
+		"SYCRI_CONTAINER_ID="+o.containerID,
+		"SYCRI_STATE="+event.State.String(),
+		"SYCRI_STATUS="+event.Status,
+		"SYCRI_PID="+strconv.Itoa(event.Pid),
+	)
+	cmd.Env = append(cmd.Env, hook.Env...)
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		if ctx.Err() == context.DeadlineExceeded {
+			err = fmt.Errorf("timeout of %v exceeded: %w", hook.Timeout, err)
+		}
+		return &CommandError{Path: hook.Path, Output: output, Err: err}
+	}
+	o.log.Debugf("%v state command %s succeeded at %s: %s", event.State, hook.Path, o.socket, bytes.TrimSpace(output))
+	return nil
+}
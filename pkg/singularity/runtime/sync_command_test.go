@@ -0,0 +1,125 @@
+// Copyright (c) 2018-2019 Sylabs, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package runtime
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// observeCommands observes states written at once with the passed options.
+func observeCommands(t *testing.T, input string, opts ...ObserveOption) []StateEvent {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	o := newObserver("", opts...)
+	o.events = make(chan StateEvent, 4)
+	require.NoError(t, o.start(ctx), "could not listen on socket")
+	c, err := net.Dial(o.addr.Network(), o.addr.String())
+	require.NoError(t, err)
+	defer c.Close()
+	_, err = c.Write([]byte(input))
+	require.NoError(t, err)
+
+	var events []StateEvent
+	for event := range o.events {
+		events = append(events, event)
+	}
+	return events
+}
+
+func TestOnStateCommand(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cri-test-command-")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	out := filepath.Join(dir, "out")
+
+	// slow prestart command still completes before the exited one is run
+	record := CommandHook{
+		Path: "/bin/sh",
+		Args: []string{"-c", `sleep 0.05; echo "$SYCRI_CONTAINER_ID $SYCRI_STATE $SYCRI_STATUS $SYCRI_PID $EXTRA" >> ` + out},
+		Env:  []string{"EXTRA=extra"},
+	}
+	events := observeCommands(t, `{"status": "created", "pid": 42} {"status": "running"} {"status": "stopped"}`,
+		WithContainerID("container"),
+		OnStateCommand(StateCreated, record),
+		OnStateCommand(StateExited, record),
+	)
+	require.Len(t, events, 3)
+	for _, event := range events {
+		require.NoError(t, event.HookErr)
+	}
+
+	data, err := ioutil.ReadFile(out)
+	require.NoError(t, err)
+	require.Equal(t, "container created created 42 extra\ncontainer exited stopped 0 extra\n", string(data))
+}
+
+func TestOnStateCommand_Failure(t *testing.T) {
+	failing := CommandHook{
+		Path: "/bin/sh",
+		Args: []string{"-c", "echo no network >&2; exit 3"},
+	}
+
+	events := observeCommands(t, `{"status": "created"} {"status": "running"} {"status": "stopped"}`,
+		OnStateCommand(StateCreated, failing),
+	)
+	require.Len(t, events, 3)
+	require.NoError(t, events[0].Err)
+	var cmdErr *CommandError
+	require.True(t, errors.As(events[0].HookErr, &cmdErr), "unexpected error %v", events[0].HookErr)
+	require.Equal(t, "no network\n", string(cmdErr.Output))
+	var exitErr *exec.ExitError
+	require.True(t, errors.As(cmdErr, &exitErr))
+	require.Equal(t, 3, exitErr.ExitCode())
+	require.EqualError(t, cmdErr, "command /bin/sh failed: exit status 3: no network")
+
+	failing.Veto = true
+	events = observeCommands(t, `{"status": "created"} {"status": "running"} {"status": "stopped"}`,
+		OnStateCommand(StateCreated, failing),
+	)
+	require.Len(t, events, 1)
+	var hookErr *HookError
+	require.True(t, errors.As(events[0].Err, &hookErr), "unexpected error %v", events[0].Err)
+	require.Equal(t, StateCreated, hookErr.State)
+	require.True(t, errors.As(hookErr, &cmdErr))
+}
+
+func TestOnStateCommand_Timeout(t *testing.T) {
+	stuck := CommandHook{
+		Path:    "/bin/sleep",
+		Args:    []string{"10"},
+		Timeout: 20 * time.Millisecond,
+	}
+
+	start := time.Now()
+	events := observeCommands(t, `{"status": "running"} {"status": "stopped"}`,
+		OnStateCommand(StateRunning, stuck),
+	)
+	require.True(t, time.Since(start) < 5*time.Second, "command is not killed")
+	require.Len(t, events, 2)
+	require.Error(t, events[0].HookErr)
+	require.Contains(t, events[0].HookErr.Error(), "timeout of 20ms exceeded")
+	require.NoError(t, events[1].HookErr)
+}
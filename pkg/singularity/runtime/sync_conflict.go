@@ -0,0 +1,115 @@
+// Copyright (c) 2018-2019 Sylabs, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package runtime
+
+import (
+	"fmt"
+	"net"
+)
+
+// ConnConflictPolicy tells what observer does when runtime connects to the
+// socket while another connection is active, see WithConnConflictPolicy.
+type ConnConflictPolicy int
+
+const (
+	// ConnConflictAllow handles all connections, it is the default.
+	ConnConflictAllow ConnConflictPolicy = iota
+	// ConnConflictReject closes the new connection and keeps the active one.
+	ConnConflictReject
+	// ConnConflictReplace closes the active connection and handles the new one,
+	// e.g. to prefer the runtime instance that was restarted over a stale one.
+	ConnConflictReplace
+)
+
+var (
+	// errConnConflict is returned when connection is rejected
+	// because another one is active.
+	errConnConflict = fmt.Errorf("another sync connection is active")
+	// errConnReplaced is returned when connection is closed
+	// because newer one is accepted.
+	errConnReplaced = fmt.Errorf("sync connection is replaced by a newer one")
+)
+
+// WithConnConflictPolicy sets what observer does when runtime connects while
+// another connection is active, e.g. when a stale runtime instance is still
+// connected after the runtime was restarted, so that states reported by two
+// instances are not interleaved. Conflict is logged as an error. The closed
+// connection is reported to OnDisconnect with the reason it is closed, states
+// it has reported before are kept and no exit is inferred once it is closed.
+// Any policy other than ConnConflictAllow makes observer handle connections
+// concurrently, as if WithConnWorkers(2) was set, to detect the conflict.
+// By default ConnConflictAllow is used and connections are handled as they
+// are accepted.
+func WithConnConflictPolicy(policy ConnConflictPolicy) ObserveOption {
+	return func(o *observer) {
+		o.connConflict = policy
+	}
+}
+
+// admitConn makes conn the active connection according to the conflict
+// policy. It returns false if conn should be closed instead.
+func (o *observer) admitConn(conn net.Conn) bool {
+	if o.connConflict == ConnConflictAllow {
+		return true
+	}
+
+	o.activeMu.Lock()
+	defer o.activeMu.Unlock()
+	active := o.activeConn
+	if active == nil {
+		o.activeConn = conn
+		return true
+	}
+
+	if o.connConflict == ConnConflictReject {
+		o.log.Errorf("Rejecting sync connection at %s from %v: connection from %v is active, is another runtime instance running?",
+			o.socket, conn.RemoteAddr(), active.RemoteAddr())
+		return false
+	}
+	o.log.Errorf("Replacing sync connection at %s from %v with connection from %v, is another runtime instance running?",
+		o.socket, active.RemoteAddr(), conn.RemoteAddr())
+	if o.replaced == nil {
+		o.replaced = make(map[net.Conn]bool)
+	}
+	o.replaced[active] = true
+	o.activeConn = conn
+	active.Close()
+	return true
+}
+
+// releaseConn removes conn that is closed from active connections.
+func (o *observer) releaseConn(conn net.Conn) {
+	if o.connConflict == ConnConflictAllow {
+		return
+	}
+
+	o.activeMu.Lock()
+	defer o.activeMu.Unlock()
+	if o.activeConn == conn {
+		o.activeConn = nil
+	}
+	delete(o.replaced, conn)
+}
+
+// isReplaced returns true if conn is closed because newer one is accepted.
+func (o *observer) isReplaced(conn net.Conn) bool {
+	if o.connConflict == ConnConflictAllow {
+		return false
+	}
+
+	o.activeMu.Lock()
+	defer o.activeMu.Unlock()
+	return o.replaced[conn]
+}
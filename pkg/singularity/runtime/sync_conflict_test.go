@@ -0,0 +1,92 @@
+// Copyright (c) 2018-2019 Sylabs, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package runtime
+
+import (
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestObserveState_ConnConflictPolicy(t *testing.T) {
+	defer checkLeaks(t)()
+
+	tt := []struct {
+		name         string
+		policy       ConnConflictPolicy
+		expectReason error
+		expect       []State
+	}{
+		{
+			name:         "reject",
+			policy:       ConnConflictReject,
+			expectReason: errConnConflict,
+			expect:       []State{StateRunning, StateExited},
+		},
+		{
+			name:         "replace",
+			policy:       ConnConflictReplace,
+			expectReason: errConnReplaced,
+			expect:       []State{StateRunning, StatePaused, StateExited},
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+			defer cancel()
+
+			disconnected := make(chan error, 2)
+			o, err := Observe(ctx, "", WithConnConflictPolicy(tc.policy), OnDisconnect(func(_ net.Addr, err error) {
+				disconnected <- err
+			}))
+			require.NoError(t, err, "could not listen on socket")
+			addr := o.Addr()
+
+			stale, err := net.Dial(addr.Network(), addr.String())
+			require.NoError(t, err)
+			defer stale.Close()
+			_, err = stale.Write([]byte(`{"status": "running"}`))
+			require.NoError(t, err)
+			actual := []State{<-o.States()}
+
+			fresh, err := net.Dial(addr.Network(), addr.String())
+			require.NoError(t, err)
+			defer fresh.Close()
+			require.Equal(t, tc.expectReason, <-disconnected)
+
+			closed, survivor := fresh, stale
+			if tc.policy == ConnConflictReplace {
+				closed, survivor = stale, fresh
+				_, err = survivor.Write([]byte(`{"status": "paused"}`))
+				require.NoError(t, err)
+			}
+			_, err = closed.Read(make([]byte, 1))
+			require.Equal(t, io.EOF, err, "connection is not closed")
+			_, err = survivor.Write([]byte(`{"status": "stopped"}`))
+			require.NoError(t, err)
+
+			for state := range o.States() {
+				actual = append(actual, state)
+			}
+			require.Equal(t, tc.expect, actual)
+			require.NoError(t, o.Err())
+		})
+	}
+}
@@ -0,0 +1,60 @@
+// Copyright (c) 2018-2019 Sylabs, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package runtime
+
+import (
+	"context"
+	"net"
+)
+
+// ObserveConn is the same as ObserveState except states are read from conn
+// that is already established, e.g. passed over a unix socket or multiplexed
+// over a channel managed by the caller, instead of accepting connections on
+// a socket. The channel is closed once conn is closed, terminal status is
+// received or ctx is done. Conn is closed once observation is over. Options
+// related to listening and accepting connections are ignored.
+func ObserveConn(ctx context.Context, conn net.Conn, opts ...ObserveOption) <-chan State {
+	o := newObserver(connName(conn), opts...)
+	o.states = make(chan State, o.bufferSize)
+	o.release = func() {}
+	o.startSpan(ctx)
+	go o.runConn(ctx, conn)
+	return o.states
+}
+
+// runConn passes states read from conn to the channel
+// until observation is over.
+func (o *observer) runConn(ctx context.Context, conn net.Conn) {
+	var err error
+	defer func() {
+		o.close(ctx, err)
+	}()
+
+	// states are still passed to the channel while draining
+	sendCtx, cancel := withDelay(ctx, o.drainTimeout)
+	defer cancel()
+
+	_, err = o.syncOnConn(ctx, sendCtx, conn)
+}
+
+// connName returns name of conn used in log messages in place of socket.
+func connName(conn net.Conn) string {
+	for _, addr := range []net.Addr{conn.RemoteAddr(), conn.LocalAddr()} {
+		if addr != nil && addr.String() != "" {
+			return addr.String()
+		}
+	}
+	return "connection"
+}
@@ -0,0 +1,92 @@
+// Copyright (c) 2018-2019 Sylabs, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package runtime
+
+import (
+	"context"
+	"net"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestObserveConn(t *testing.T) {
+	tt := []struct {
+		name   string
+		stream string
+		expect []State
+	}{
+		{
+			name:   "exited",
+			stream: `{"status": "created"}{"status": "running"}{"status": "stopped"}{"status": "running"}`,
+			expect: []State{StateCreated, StateRunning, StateExited},
+		},
+		{
+			name:   "closed by runtime",
+			stream: `{"status": "running"}`,
+			expect: []State{StateRunning},
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			runtime, observed := net.Pipe()
+			state := ObserveConn(ctx, observed)
+			go func() {
+				runtime.Write([]byte(tc.stream))
+				runtime.Close()
+			}()
+
+			var actual []State
+			for s := range state {
+				actual = append(actual, s)
+			}
+			require.Equal(t, tc.expect, actual)
+		})
+	}
+}
+
+func TestObserveConn_Socketpair(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_STREAM, 0)
+	require.NoError(t, err)
+	runtime := os.NewFile(uintptr(fds[0]), "runtime")
+	defer runtime.Close()
+	f := os.NewFile(uintptr(fds[1]), "observed")
+	conn, err := net.FileConn(f)
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	state := ObserveConn(ctx, conn)
+	_, err = runtime.Write([]byte(`{"status": "running"}`))
+	require.NoError(t, err)
+	require.Equal(t, StateRunning, <-state)
+
+	cancel()
+	select {
+	case _, ok := <-state:
+		require.False(t, ok)
+	case <-time.After(time.Second):
+		t.Fatalf("channel is not closed once context is done")
+	}
+}
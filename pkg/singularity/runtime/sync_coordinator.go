@@ -0,0 +1,246 @@
+// Copyright (c) 2018-2019 Sylabs, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package runtime
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// ErrShuttingDown is returned when observation is requested
+// from Coordinator that is being shut down.
+var ErrShuttingDown = fmt.Errorf("coordinator is shutting down")
+
+// LimitError is returned when observation is requested from Coordinator
+// that already tracks the maximum number of observations, see
+// WithMaxObservations. Caller may retry once some of them are over.
+type LimitError struct {
+	Current int
+	Max     int
+}
+
+// Error implements error interface.
+func (e *LimitError) Error() string {
+	return fmt.Sprintf("too many observations: %d of at most %d are running", e.Current, e.Max)
+}
+
+// Coordinator keeps track of all observations started with it so that
+// they may be gracefully stopped on shutdown. Once Shutdown is called,
+// observations are no longer stopped when their contexts are done, instead
+// they are given a chance to receive the final states of their containers.
+// Observations log as usual while they are waited for, but once Shutdown
+// returns they no longer log anything, so that goroutines which are still
+// running do not write to the log that is being torn down.
+type Coordinator struct {
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+	logs   *logGate
+	// less orders observations stopped on shutdown, see WithShutdownOrder.
+	less func(a, b State) bool
+	// max is the maximum number of tracked observations, zero means
+	// the number is not limited.
+	max int
+
+	mu       sync.Mutex
+	closing  bool
+	observed []*coordinated
+	// starting is the number of observations that are being started,
+	// they count towards max but are not tracked yet.
+	starting int
+}
+
+// coordinated is the observation tracked by Coordinator.
+type coordinated struct {
+	o      *observer
+	cancel context.CancelFunc
+}
+
+// CoordinatorOption is an option of Coordinator.
+type CoordinatorOption func(*Coordinator)
+
+// WithShutdownOrder sets the order observations remaining once Shutdown
+// deadline is exceeded are stopped in. Observations are sorted by current
+// states of their containers with less, observations of equal states are
+// stopped in the order they are started, and each one is over before the
+// next one is stopped. By default ExitedFirst is used.
+func WithShutdownOrder(less func(a, b State) bool) CoordinatorOption {
+	return func(c *Coordinator) {
+		c.less = less
+	}
+}
+
+// WithMaxObservations limits the number of observations tracked at once to
+// max, so that a burst of containers started at the same time does not
+// exhaust file descriptors and goroutines. Once the limit is reached
+// ObserveState returns LimitError until some of the observations are over.
+// Non-positive max means the number is not limited, which is the default.
+func WithMaxObservations(max int) CoordinatorOption {
+	return func(c *Coordinator) {
+		c.max = max
+	}
+}
+
+// ExitedFirst reports whether a is stopped before b on shutdown, i.e.
+// observations of exited containers are stopped before the active ones.
+func ExitedFirst(a, b State) bool {
+	return a == StateExited && b != StateExited
+}
+
+// NewCoordinator returns new Coordinator ready to use.
+func NewCoordinator(opts ...CoordinatorOption) *Coordinator {
+	ctx, cancel := context.WithCancel(context.Background())
+	c := &Coordinator{
+		ctx:    ctx,
+		cancel: cancel,
+		logs:   &logGate{},
+		less:   ExitedFirst,
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	return c
+}
+
+// ObserveState is the same as package level ObserveState except observation
+// is tracked by the coordinator. Observation is stopped once ctx is done,
+// unless Shutdown was called before that. When coordinator is shutting down
+// ErrShuttingDown is returned, LimitError when too many observations are
+// tracked already.
+func (c *Coordinator) ObserveState(ctx context.Context, socket string, opts ...ObserveOption) (<-chan State, error) {
+	// only the slot is reserved under the lock, since starting
+	// observation may take a while to bind the socket
+	c.mu.Lock()
+	if c.closing {
+		c.mu.Unlock()
+		return nil, ErrShuttingDown
+	}
+	if n := len(c.observed) + c.starting; c.max > 0 && n >= c.max {
+		c.mu.Unlock()
+		return nil, &LimitError{Current: n, Max: c.max}
+	}
+	c.starting++
+	c.wg.Add(1)
+	c.mu.Unlock()
+
+	observeCtx, cancel := context.WithCancel(c.ctx)
+	o := newObserver(socket, opts...)
+	o.log = gatedLogger{Logger: o.log, gate: c.logs}
+	o.listenConfig.log = o.log
+	o.states = make(chan State, o.bufferSize)
+	err := o.start(observeCtx)
+
+	c.mu.Lock()
+	c.starting--
+	tracked := &coordinated{o: o, cancel: cancel}
+	if err == nil {
+		c.observed = append(c.observed, tracked)
+	}
+	c.mu.Unlock()
+	if err != nil {
+		cancel()
+		c.wg.Done()
+		return nil, err
+	}
+
+	go func() {
+		defer c.wg.Done()
+		defer c.untrack(tracked)
+		defer cancel()
+
+		select {
+		case <-o.done:
+		case <-ctx.Done():
+			if !c.isClosing() {
+				cancel()
+			}
+			<-o.done
+		}
+	}()
+	return o.states, nil
+}
+
+// Shutdown waits for all tracked observations to be over, i.e. for containers
+// to exit, or until ctx is done. In the latter case remaining observations are
+// stopped one by one in the order set with WithShutdownOrder and ctx error is
+// returned. New observations are not accepted after
+// Shutdown is called. Shutdown should be called before contexts passed to
+// ObserveState are canceled, otherwise observations are stopped as usual.
+// Once Shutdown returns tracked observations no longer log anything.
+func (c *Coordinator) Shutdown(ctx context.Context) error {
+	c.mu.Lock()
+	c.closing = true
+	c.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		c.wg.Wait()
+		close(done)
+	}()
+
+	defer c.logs.quiesce()
+	defer c.cancel()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		c.stopOrdered()
+		c.cancel()
+		<-done
+		return ctx.Err()
+	}
+}
+
+// stopOrdered stops tracked observations sorted with c.less,
+// waiting for each one to be over before stopping the next one.
+func (c *Coordinator) stopOrdered() {
+	c.mu.Lock()
+	observed := append([]*coordinated(nil), c.observed...)
+	c.mu.Unlock()
+
+	states := make(map[*coordinated]State, len(observed))
+	for _, tracked := range observed {
+		tracked.o.mu.Lock()
+		states[tracked] = tracked.o.current
+		tracked.o.mu.Unlock()
+	}
+	sort.SliceStable(observed, func(i, j int) bool {
+		return c.less(states[observed[i]], states[observed[j]])
+	})
+	for _, tracked := range observed {
+		tracked.cancel()
+		<-tracked.o.done
+	}
+}
+
+// untrack removes observation that is over.
+func (c *Coordinator) untrack(tracked *coordinated) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for i, t := range c.observed {
+		if t == tracked {
+			c.observed = append(c.observed[:i], c.observed[i+1:]...)
+			return
+		}
+	}
+}
+
+func (c *Coordinator) isClosing() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.closing
+}
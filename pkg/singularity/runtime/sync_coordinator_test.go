@@ -0,0 +1,245 @@
+// Copyright (c) 2018-2019 Sylabs, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package runtime
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/sylabs/singularity/pkg/util/unix"
+)
+
+func TestCoordinator_Shutdown(t *testing.T) {
+	c := NewCoordinator()
+	ctx, cancel := context.WithCancel(context.Background())
+	socket := filepath.Join(os.TempDir(), fmt.Sprintf("cri-test-%s.sock", t.Name()))
+
+	state, err := c.ObserveState(ctx, socket)
+	require.NoError(t, err, "could not listen on socket")
+
+	shutdown := make(chan error)
+	go func() {
+		shutdown <- c.Shutdown(context.Background())
+	}()
+	for !c.isClosing() {
+		time.Sleep(time.Millisecond)
+	}
+	// observation must outlive its context once shutdown is started
+	cancel()
+	_, err = c.ObserveState(context.Background(), socket+".new")
+	require.Equal(t, ErrShuttingDown, err)
+
+	conn, err := unix.Dial(socket)
+	require.NoError(t, err)
+	_, err = conn.Write([]byte(`{"status": "running"}{"status": "stopped"}`))
+	require.NoError(t, err)
+	require.NoError(t, conn.Close())
+
+	assert.Equal(t, StateRunning, <-state)
+	assert.Equal(t, StateExited, <-state)
+	require.NoError(t, <-shutdown)
+	_, ok := <-state
+	assert.False(t, ok)
+}
+
+func TestCoordinator_ShutdownDeadline(t *testing.T) {
+	c := NewCoordinator()
+	socket := filepath.Join(os.TempDir(), fmt.Sprintf("cri-test-%s.sock", t.Name()))
+
+	state, err := c.ObserveState(context.Background(), socket)
+	require.NoError(t, err, "could not listen on socket")
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*50)
+	defer cancel()
+	require.Equal(t, context.DeadlineExceeded, c.Shutdown(ctx))
+	_, ok := <-state
+	assert.False(t, ok)
+	assert.True(t, os.IsNotExist(os.Remove(socket)))
+}
+
+func TestCoordinator_Cancel(t *testing.T) {
+	c := NewCoordinator()
+	ctx, cancel := context.WithCancel(context.Background())
+	socket := filepath.Join(os.TempDir(), fmt.Sprintf("cri-test-%s.sock", t.Name()))
+
+	state, err := c.ObserveState(ctx, socket)
+	require.NoError(t, err, "could not listen on socket")
+	cancel()
+	_, ok := <-state
+	assert.False(t, ok)
+	require.NoError(t, c.Shutdown(context.Background()))
+}
+
+func TestCoordinator_ShutdownLogs(t *testing.T) {
+	c := NewCoordinator()
+	socket := filepath.Join(os.TempDir(), fmt.Sprintf("cri-test-%s.sock", t.Name()))
+	log := &testLogger{}
+
+	state, err := c.ObserveState(context.Background(), socket, WithLogger(log))
+	require.NoError(t, err, "could not listen on socket")
+	require.NoError(t, PushState(context.Background(), socket, StateRunning))
+	assert.Equal(t, StateRunning, <-state)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*50)
+	defer cancel()
+	require.Equal(t, context.DeadlineExceeded, c.Shutdown(ctx))
+	messages := log.Messages()
+	require.NotEmpty(t, messages, "observation is not logged before shutdown")
+
+	// observer goroutines that outlive Shutdown log nothing
+	late := gatedLogger{Logger: log, gate: c.logs}
+	late.Warningf("late message")
+	require.Equal(t, messages, log.Messages())
+}
+
+func TestCoordinator_ShutdownOrder(t *testing.T) {
+	runningFirst := func(a, b State) bool {
+		return a == StateRunning && b != StateRunning
+	}
+
+	tt := []struct {
+		name   string
+		opts   []CoordinatorOption
+		expect []string
+	}{
+		{
+			name:   "exited first",
+			expect: []string{"exited", "running", "created"},
+		},
+		{
+			name:   "custom",
+			opts:   []CoordinatorOption{WithShutdownOrder(runningFirst)},
+			expect: []string{"running", "exited", "created"},
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			c := NewCoordinator(tc.opts...)
+
+			var (
+				mu      sync.Mutex
+				stopped []string
+			)
+			for _, status := range []string{"running", "exited", "created"} {
+				status := status
+				disconnected := OnDisconnect(func(net.Addr, error) {
+					mu.Lock()
+					stopped = append(stopped, status)
+					mu.Unlock()
+				})
+				state, err := c.ObserveState(context.Background(), "", WithTerminalStatuses("deleted"), disconnected)
+				require.NoError(t, err, "could not listen on socket")
+				o := c.observed[len(c.observed)-1].o
+
+				conn, err := net.Dial(o.addr.Network(), o.addr.String())
+				require.NoError(t, err)
+				defer conn.Close()
+				sent := status
+				if status == "exited" {
+					sent = "stopped"
+				}
+				_, err = fmt.Fprintf(conn, `{"status": %q}`, sent)
+				require.NoError(t, err)
+				<-state
+			}
+
+			ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*50)
+			defer cancel()
+			require.Equal(t, context.DeadlineExceeded, c.Shutdown(ctx))
+			require.Equal(t, tc.expect, stopped)
+			require.Empty(t, c.observed)
+		})
+	}
+}
+
+func TestCoordinator_MaxObservations(t *testing.T) {
+	c := NewCoordinator(WithMaxObservations(2))
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	first, err := c.ObserveState(ctx, "")
+	require.NoError(t, err, "could not listen on socket")
+	_, err = c.ObserveState(ctx, "")
+	require.NoError(t, err, "could not listen on socket")
+	_, err = c.ObserveState(ctx, "")
+	require.Equal(t, &LimitError{Current: 2, Max: 2}, err)
+	require.EqualError(t, err, "too many observations: 2 of at most 2 are running")
+
+	o := c.observed[0].o
+	require.NoError(t, PushState(ctx, o.addr.String(), StateExited))
+	require.Equal(t, StateExited, <-first)
+	<-o.done
+	for {
+		_, err = c.ObserveState(ctx, "")
+		if _, ok := err.(*LimitError); !ok {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	require.NoError(t, err, "observation that is over is still tracked")
+
+	shutdownCtx, shutdownCancel := context.WithTimeout(ctx, time.Millisecond*50)
+	defer shutdownCancel()
+	require.Equal(t, context.DeadlineExceeded, c.Shutdown(shutdownCtx))
+}
+
+func TestCoordinator_StartUnlocked(t *testing.T) {
+	c := NewCoordinator(WithMaxObservations(2))
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// the first observation keeps retrying to listen in a missing directory
+	dir, err := ioutil.TempDir("", "sync-coordinator-")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	socket := filepath.Join(dir, "missing", "sync.sock")
+	slow := make(chan error, 1)
+	go func() {
+		_, err := c.ObserveState(ctx, socket, WithSocketDirPermissions(0), WithListenRetry(100, 10*time.Millisecond))
+		slow <- err
+	}()
+	for {
+		c.mu.Lock()
+		starting := c.starting
+		c.mu.Unlock()
+		if starting == 1 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	// others are not blocked meanwhile, but the slot is reserved
+	_, err = c.ObserveState(ctx, "")
+	require.NoError(t, err, "could not listen on socket")
+	_, err = c.ObserveState(ctx, "")
+	require.Equal(t, &LimitError{Current: 2, Max: 2}, err)
+
+	require.NoError(t, os.Mkdir(filepath.Dir(socket), 0755))
+	require.NoError(t, <-slow)
+
+	shutdownCtx, stop := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer stop()
+	require.Equal(t, context.DeadlineExceeded, c.Shutdown(shutdownCtx))
+}
@@ -0,0 +1,120 @@
+// Copyright (c) 2018-2019 Sylabs, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package runtime
+
+import (
+	k8s "k8s.io/kubernetes/pkg/kubelet/apis/cri/runtime/v1alpha2"
+)
+
+// Reasons of container events reported by OnCRIEvent,
+// they follow the ones k8s uses for container events and states.
+const (
+	ReasonCreated    = "Created"
+	ReasonStarted    = "Started"
+	ReasonCompleted  = "Completed"
+	ReasonError      = "Error"
+	ReasonStartError = "StartError"
+	ReasonPulling    = "Pulling"
+)
+
+// OnCRIEvent registers fn to be called each time container moves to another
+// state that is meaningful for CRI, once the state is passed to the channel,
+// with the reason of the event, see EventReason, e.g. to publish k8s events
+// right where states are observed. Transitions are the same as OnTransition
+// reports. It is called synchronously, so it should not block.
+func OnCRIEvent(fn func(reason string, event StateEvent)) ObserveOption {
+	return func(o *observer) {
+		o.onCRIEvent = append(o.onCRIEvent, fn)
+	}
+}
+
+// EventReason returns the reason of CRI event for the container that has
+// moved to the state of the passed event, or an empty string if the state
+// is not reported to CRI. Reason of StateExited depends on exit code, it is
+// ReasonCompleted for zero code and ReasonError otherwise, unless container
+// has exited without ever running, see StateEvent.StartErr.
+func EventReason(event StateEvent) string {
+	switch event.State {
+	case StatePreparing:
+		return ReasonPulling
+	case StateCreated:
+		return ReasonCreated
+	case StateRunning:
+		return ReasonStarted
+	case StateExited:
+		switch {
+		case event.StartErr != nil:
+			return ReasonStartError
+		case event.ExitCode == 0:
+			return ReasonCompleted
+		default:
+			return ReasonError
+		}
+	}
+	return ""
+}
+
+// ContainerState converts State to the container state understood by k8s.
+// Paused and resumed containers are reported as running. StatePreparing and
+// StateCreating, that have no k8s counterpart, are converted to CONTAINER_UNKNOWN.
+func ContainerState(s State) k8s.ContainerState {
+	switch s {
+	case StateCreated:
+		return k8s.ContainerState_CONTAINER_CREATED
+	case StateRunning, StatePaused, StateResumed:
+		// k8s has no notion of paused containers
+		return k8s.ContainerState_CONTAINER_RUNNING
+	case StateExited:
+		return k8s.ContainerState_CONTAINER_EXITED
+	}
+	return k8s.ContainerState_CONTAINER_UNKNOWN
+}
+
+// ContainerStatus builds partial k8s container status out of the observed
+// events. Status holds the last known container state, creation, start and
+// finish timestamps taken from the first StateCreated, StateRunning and
+// StateExited events respectively, and exit code reported with StateExited.
+// While container is in StatePreparing reason is set to ReasonPulling.
+// Other fields are left for the caller to fill in.
+func ContainerStatus(events ...StateEvent) *k8s.ContainerStatus {
+	status := &k8s.ContainerStatus{
+		State: k8s.ContainerState_CONTAINER_UNKNOWN,
+	}
+	for _, event := range events {
+		if event.State == StateUnknown || event.Err != nil {
+			continue
+		}
+		status.State = ContainerState(event.State)
+		status.Reason = ""
+		switch event.State {
+		case StatePreparing:
+			status.Reason = ReasonPulling
+		case StateCreated:
+			if status.CreatedAt == 0 {
+				status.CreatedAt = event.Time.UnixNano()
+			}
+		case StateRunning:
+			if status.StartedAt == 0 {
+				status.StartedAt = event.Time.UnixNano()
+			}
+		case StateExited:
+			if status.FinishedAt == 0 {
+				status.FinishedAt = event.Time.UnixNano()
+				status.ExitCode = int32(event.ExitCode)
+			}
+		}
+	}
+	return status
+}
@@ -0,0 +1,201 @@
+// Copyright (c) 2018-2019 Sylabs, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package runtime
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	k8s "k8s.io/kubernetes/pkg/kubelet/apis/cri/runtime/v1alpha2"
+)
+
+func TestContainerState(t *testing.T) {
+	tt := []struct {
+		state  State
+		expect k8s.ContainerState
+	}{
+		{state: StateUnknown, expect: k8s.ContainerState_CONTAINER_UNKNOWN},
+		{state: StatePreparing, expect: k8s.ContainerState_CONTAINER_UNKNOWN},
+		{state: StateCreating, expect: k8s.ContainerState_CONTAINER_UNKNOWN},
+		{state: StateCreated, expect: k8s.ContainerState_CONTAINER_CREATED},
+		{state: StateRunning, expect: k8s.ContainerState_CONTAINER_RUNNING},
+		{state: StateExited, expect: k8s.ContainerState_CONTAINER_EXITED},
+		{state: StatePaused, expect: k8s.ContainerState_CONTAINER_RUNNING},
+		{state: StateResumed, expect: k8s.ContainerState_CONTAINER_RUNNING},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.state.String(), func(t *testing.T) {
+			require.Equal(t, tc.expect, ContainerState(tc.state))
+		})
+	}
+}
+
+func TestContainerStatus(t *testing.T) {
+	now := time.Now()
+	at := func(d time.Duration) time.Time {
+		return now.Add(d)
+	}
+
+	tt := []struct {
+		name   string
+		events []StateEvent
+		expect *k8s.ContainerStatus
+	}{
+		{
+			name: "no events",
+			expect: &k8s.ContainerStatus{
+				State: k8s.ContainerState_CONTAINER_UNKNOWN,
+			},
+		},
+		{
+			name: "preparing",
+			events: []StateEvent{
+				{State: StatePreparing, Time: at(0)},
+				{State: StatePreparing, Time: at(time.Second)},
+			},
+			expect: &k8s.ContainerStatus{
+				State:  k8s.ContainerState_CONTAINER_UNKNOWN,
+				Reason: ReasonPulling,
+			},
+		},
+		{
+			name: "running",
+			events: []StateEvent{
+				{State: StatePreparing, Time: at(0)},
+				{State: StateCreating, Time: at(0)},
+				{State: StateCreated, Time: at(time.Second)},
+				{State: StateRunning, Time: at(2 * time.Second)},
+				{State: StateUnknown, Time: at(3 * time.Second)},
+			},
+			expect: &k8s.ContainerStatus{
+				State:     k8s.ContainerState_CONTAINER_RUNNING,
+				CreatedAt: at(time.Second).UnixNano(),
+				StartedAt: at(2 * time.Second).UnixNano(),
+			},
+		},
+		{
+			name: "exited",
+			events: []StateEvent{
+				{State: StateCreated, Time: at(0)},
+				{State: StateRunning, Time: at(time.Second)},
+				{State: StateRunning, Time: at(2 * time.Second)},
+				{State: StateExited, Time: at(3 * time.Second), ExitCode: 2},
+			},
+			expect: &k8s.ContainerStatus{
+				State:      k8s.ContainerState_CONTAINER_EXITED,
+				CreatedAt:  at(0).UnixNano(),
+				StartedAt:  at(time.Second).UnixNano(),
+				FinishedAt: at(3 * time.Second).UnixNano(),
+				ExitCode:   2,
+			},
+		},
+		{
+			name: "invalid transition",
+			events: []StateEvent{
+				{State: StateRunning, Time: at(0)},
+				{State: StateCreated, Time: at(time.Second), Err: &TransitionError{From: StateRunning, To: StateCreated}},
+			},
+			expect: &k8s.ContainerStatus{
+				State:     k8s.ContainerState_CONTAINER_RUNNING,
+				StartedAt: at(0).UnixNano(),
+			},
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			require.Equal(t, tc.expect, ContainerStatus(tc.events...))
+		})
+	}
+}
+
+func TestEventReason(t *testing.T) {
+	tt := []struct {
+		name   string
+		event  StateEvent
+		expect string
+	}{
+		{name: "preparing", event: StateEvent{State: StatePreparing}, expect: ReasonPulling},
+		{name: "creating", event: StateEvent{State: StateCreating}},
+		{name: "created", event: StateEvent{State: StateCreated}, expect: ReasonCreated},
+		{name: "running", event: StateEvent{State: StateRunning}, expect: ReasonStarted},
+		{name: "paused", event: StateEvent{State: StatePaused}},
+		{name: "completed", event: StateEvent{State: StateExited}, expect: ReasonCompleted},
+		{name: "error", event: StateEvent{State: StateExited, ExitCode: 137}, expect: ReasonError},
+		{
+			name:   "start error",
+			event:  StateEvent{State: StateExited, StartErr: &StartError{Last: StateCreated}},
+			expect: ReasonStartError,
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			require.Equal(t, tc.expect, EventReason(tc.event))
+		})
+	}
+}
+
+func TestObserveState_OnCRIEvent(t *testing.T) {
+	defer checkLeaks(t)()
+
+	tt := []struct {
+		name   string
+		write  string
+		expect []string
+	}{
+		{
+			name:   "error",
+			write:  `{"status":"created"}{"status":"running"}{"status":"running"}{"status":"stopped","exitCode":2}`,
+			expect: []string{ReasonCreated, ReasonStarted, ReasonError},
+		},
+		{
+			name:   "completed",
+			write:  `{"status":"creating"}{"status":"created"}{"status":"running"}{"status":"stopped"}`,
+			expect: []string{ReasonCreated, ReasonStarted, ReasonCompleted},
+		},
+		{
+			name:   "start error",
+			write:  `{"status":"creating"}{"status":"created"}{"status":"stopped","exitCode":1}`,
+			expect: []string{ReasonCreated, ReasonStartError},
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			var reasons []string
+			o, err := Observe(ctx, "", OnCRIEvent(func(reason string, _ StateEvent) {
+				reasons = append(reasons, reason)
+			}))
+			require.NoError(t, err, "could not listen on socket")
+			c, err := net.Dial(o.Addr().Network(), o.Addr().String())
+			require.NoError(t, err)
+			defer c.Close()
+			_, err = c.Write([]byte(tc.write))
+			require.NoError(t, err)
+
+			for range o.States() {
+			}
+			require.Equal(t, tc.expect, reasons)
+		})
+	}
+}
@@ -0,0 +1,64 @@
+// Copyright (c) 2018-2019 Sylabs, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package runtime
+
+// DeadLetter holds event observer could not pass to the channel,
+// see WithDeadLetters.
+type DeadLetter struct {
+	Event StateEvent
+	// Reason is why event was not delivered: context.DeadlineExceeded
+	// when consumer did not receive the final state within terminal send
+	// timeout, see WithTerminalSendTimeout, or context.Canceled when
+	// observation was stopped while consumer was not reading the channel.
+	Reason error
+}
+
+// WithDeadLetters makes observer pass events it failed to deliver to the
+// primary consumer to ch, so that no transition is lost silently even if
+// consumer misbehaves. Observer never blocks on ch, so its capacity bounds
+// the number of dead letters kept until they are read; ones that do not fit
+// are dropped and counted in a warning once observation is over. Observer
+// never closes ch. By default undelivered events are only logged.
+func WithDeadLetters(ch chan<- DeadLetter) ObserveOption {
+	return func(o *observer) {
+		o.deadLetters = ch
+	}
+}
+
+// deadLetter passes event that could not be delivered to the dead letter
+// channel, if any, without blocking.
+func (o *observer) deadLetter(event StateEvent, reason error) {
+	if o.deadLetters == nil {
+		return
+	}
+	select {
+	case o.deadLetters <- DeadLetter{Event: event, Reason: reason}:
+		o.log.Debugf("State %v at %s is passed to dead letters: %v", event.State, o.socket, reason)
+	default:
+		o.mu.Lock()
+		o.lostLetters++
+		o.mu.Unlock()
+	}
+}
+
+// reportLostLetters warns about dead letters that did not fit the channel.
+func (o *observer) reportLostLetters() {
+	o.mu.Lock()
+	lost := o.lostLetters
+	o.mu.Unlock()
+	if lost > 0 {
+		o.log.Warningf("Dead letter channel at %s was full, %d undelivered states dropped", o.socket, lost)
+	}
+}
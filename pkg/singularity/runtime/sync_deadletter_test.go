@@ -0,0 +1,103 @@
+// Copyright (c) 2018-2019 Sylabs, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package runtime
+
+import (
+	"context"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestObserveState_DeadLetters(t *testing.T) {
+	defer checkLeaks(t)()
+
+	tt := []struct {
+		name      string
+		timeout   time.Duration
+		cancel    bool
+		capacity  int
+		expect    []DeadLetter
+		lostCount string
+	}{
+		{
+			name:     "terminal send timeout",
+			timeout:  20 * time.Millisecond,
+			capacity: 1,
+			expect: []DeadLetter{
+				{Event: StateEvent{State: StateExited, Status: "stopped"}, Reason: context.DeadlineExceeded},
+			},
+		},
+		{
+			name:     "canceled",
+			cancel:   true,
+			capacity: 1,
+			expect: []DeadLetter{
+				{Event: StateEvent{State: StateExited, Status: "stopped"}, Reason: context.Canceled},
+			},
+		},
+		{
+			name:      "full",
+			timeout:   20 * time.Millisecond,
+			lostCount: "1 undelivered states dropped",
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			log := &testLogger{}
+			letters := make(chan DeadLetter, tc.capacity)
+			o := newObserver("", WithLogger(log), WithTerminalSendTimeout(tc.timeout), WithDeadLetters(letters))
+			o.states = make(chan State, 1)
+			require.NoError(t, o.start(ctx), "could not listen on socket")
+			c, err := net.Dial(o.addr.Network(), o.addr.String())
+			require.NoError(t, err)
+			defer c.Close()
+			_, err = c.Write([]byte(`{"status": "running"} {"status": "stopped"}`))
+			require.NoError(t, err)
+
+			// consumer is gone after running state, which fills the channel
+			if tc.cancel {
+				time.Sleep(20 * time.Millisecond)
+				cancel()
+			}
+			select {
+			case <-o.done:
+			case <-time.After(time.Second):
+				t.Fatalf("observation is not over")
+			}
+
+			close(letters)
+			var actual []DeadLetter
+			for letter := range letters {
+				letter.Event.Time = time.Time{}
+				actual = append(actual, letter)
+			}
+			require.Equal(t, tc.expect, actual)
+			var warned bool
+			for _, msg := range log.Messages() {
+				warned = warned || tc.lostCount != "" && strings.Contains(msg, tc.lostCount)
+			}
+			assert.Equal(t, tc.lostCount != "", warned)
+		})
+	}
+}
@@ -0,0 +1,123 @@
+// Copyright (c) 2018-2019 Sylabs, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package runtime
+
+import (
+	"encoding/json"
+	"io"
+	"io/ioutil"
+)
+
+// StatusDecoder reads status objects from a sync connection, so that
+// runtime may frame and encode them differently than as a stream of JSON
+// objects, e.g. as length prefixed protobuf or msgpack messages.
+type StatusDecoder interface {
+	// Decode reads the next status object from r and returns it converted
+	// to the JSON object described by syncStatus. Decode should return
+	// io.EOF if connection is closed between status objects and
+	// io.ErrUnexpectedEOF if it is closed in the middle of one. Decode is
+	// called with the same r for all status objects of a connection, so
+	// decoder may buffer data read from it.
+	Decode(r io.Reader) (json.RawMessage, error)
+}
+
+// WithStatusDecoder sets the function that creates StatusDecoder for every
+// accepted sync connection. By default status objects are decoded as a
+// stream of JSON objects. Since decoder may read ahead of the status object
+// it returns, status size limit, see WithMaxStatusSize, is applied to the
+// number of bytes read so far by the decoder and any status objects already
+// read when context is done are dropped rather than handled.
+func WithStatusDecoder(newDecoder func() StatusDecoder) ObserveOption {
+	return func(o *observer) {
+		o.newDecoder = newDecoder
+	}
+}
+
+// statusStream reads status objects from a single sync connection.
+type statusStream interface {
+	// next reads the next status object.
+	next() (syncStatus, error)
+	// drained returns true if all status objects
+	// runtime has written at once are already read.
+	drained() bool
+	// offset returns the number of bytes consumed so far.
+	offset() int64
+	// discard drops data that is read but not yet
+	// decoded and returns its size.
+	discard() int64
+}
+
+// newStatusStream returns stream of status objects read from r, which
+// reads from counter after the optional handshake.
+func (o *observer) newStatusStream(r io.Reader, counter *countingReader) statusStream {
+	if o.newDecoder == nil {
+		return &jsonStream{o: o, dec: json.NewDecoder(r)}
+	}
+	return &decoderStream{o: o, dec: o.newDecoder(), r: r, counter: counter}
+}
+
+// jsonStream is the default status stream which reads JSON objects.
+type jsonStream struct {
+	o   *observer
+	dec *json.Decoder
+}
+
+func (s *jsonStream) next() (syncStatus, error) {
+	return s.o.readStatus(s.dec)
+}
+
+func (s *jsonStream) drained() bool {
+	return drained(s.dec)
+}
+
+func (s *jsonStream) offset() int64 {
+	return s.dec.InputOffset()
+}
+
+func (s *jsonStream) discard() int64 {
+	left, _ := io.Copy(ioutil.Discard, s.dec.Buffered())
+	return left
+}
+
+// decoderStream reads status objects with
+// the decoder set with WithStatusDecoder.
+type decoderStream struct {
+	o       *observer
+	dec     StatusDecoder
+	r       io.Reader
+	counter *countingReader
+}
+
+func (s *decoderStream) next() (syncStatus, error) {
+	raw, err := s.dec.Decode(s.r)
+	if err != nil {
+		return syncStatus{}, err
+	}
+	return s.o.decodeStatus(raw)
+}
+
+// drained always returns true since data buffered
+// by the decoder is not known to the stream.
+func (s *decoderStream) drained() bool {
+	return true
+}
+
+func (s *decoderStream) offset() int64 {
+	return s.counter.n
+}
+
+func (s *decoderStream) discard() int64 {
+	return 0
+}
@@ -0,0 +1,112 @@
+// Copyright (c) 2018-2019 Sylabs, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package runtime
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// prefixDecoder decodes status objects prefixed with their size.
+type prefixDecoder struct{}
+
+func (prefixDecoder) Decode(r io.Reader) (json.RawMessage, error) {
+	var size uint32
+	if err := binary.Read(r, binary.BigEndian, &size); err != nil {
+		return nil, err
+	}
+	raw := make(json.RawMessage, size)
+	if _, err := io.ReadFull(r, raw); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	return raw, nil
+}
+
+func writePrefixed(t *testing.T, w io.Writer, status string) {
+	require.NoError(t, binary.Write(w, binary.BigEndian, uint32(len(status))))
+	_, err := io.WriteString(w, status)
+	require.NoError(t, err)
+}
+
+func TestObserveState_StatusDecoder(t *testing.T) {
+	defer checkLeaks(t)()
+
+	tt := []struct {
+		name   string
+		opts   []ObserveOption
+		write  []string
+		expect []State
+		err    error
+	}{
+		{
+			name:   "prefixed statuses",
+			write:  []string{`{"status":"creating"}`, `{"status":"running"}`, `{"status":"stopped"}`},
+			expect: []State{StateCreating, StateRunning, StateExited},
+		},
+		{
+			name:   "status fields",
+			opts:   []ObserveOption{WithStatusFields("phase")},
+			write:  []string{`{"phase":"running"}`, `{"phase":"stopped"}`},
+			expect: []State{StateRunning, StateExited},
+		},
+		{
+			name:   "invalid status object",
+			write:  []string{`{"status":"running"}`, `{status`},
+			expect: []State{StateRunning},
+			err:    ErrDecode,
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			opts := append([]ObserveOption{WithStatusDecoder(func() StatusDecoder {
+				return prefixDecoder{}
+			})}, tc.opts...)
+			o, err := Observe(ctx, "", opts...)
+			require.NoError(t, err)
+
+			conn, err := net.Dial(o.Addr().Network(), o.Addr().String())
+			require.NoError(t, err)
+			defer conn.Close()
+			for _, status := range tc.write {
+				writePrefixed(t, conn, status)
+			}
+
+			var states []State
+			for state := range o.States() {
+				states = append(states, state)
+			}
+			require.Equal(t, tc.expect, states)
+			if tc.err == nil {
+				require.NoError(t, o.Err())
+			} else {
+				require.True(t, errors.Is(o.Err(), tc.err), "unexpected error %v", o.Err())
+			}
+		})
+	}
+}
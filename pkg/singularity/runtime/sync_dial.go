@@ -0,0 +1,109 @@
+// Copyright (c) 2018-2019 Sylabs, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package runtime
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"syscall"
+	"time"
+)
+
+// ErrDial is reported when sync socket bound by the runtime
+// cannot be dialed, see DialObserveState.
+var ErrDial = fmt.Errorf("could not dial sync socket")
+
+// DialObserveState is the same as ObserveState except the socket is bound
+// by the runtime and states are read by connecting to it. Until runtime binds
+// the socket dialing is retried with backoff. Connection closed by the runtime
+// is not an error, socket is dialed again since runtime may report further
+// states. The channel is closed once terminal status is received or ctx is done.
+// Error is returned if socket cannot be dialed for other reason than it is not
+// bound yet. Options related to listening and accepting connections are ignored.
+func DialObserveState(ctx context.Context, socket string, opts ...ObserveOption) (<-chan State, error) {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "unix", socket)
+	if err != nil && !isNotBound(err) {
+		return nil, &observeError{kind: ErrDial, err: err}
+	}
+	o := newObserver(socket, opts...)
+	o.states = make(chan State, o.bufferSize)
+	o.release = func() {}
+	o.startSpan(ctx)
+	go o.runDial(ctx, conn)
+	return o.states, nil
+}
+
+// runDial passes states read from the socket bound by the runtime
+// to the channel until observation is over. Passed conn is the result
+// of the first attempt to dial the socket, it is nil if attempt failed.
+func (o *observer) runDial(ctx context.Context, conn net.Conn) {
+	var err error
+	defer func() {
+		o.close(ctx, err)
+	}()
+
+	// states are still passed to the channel while draining
+	sendCtx, cancel := withDelay(ctx, o.drainTimeout)
+	defer cancel()
+
+	var d net.Dialer
+	var dialDelay time.Duration
+	for {
+		if conn != nil {
+			dialDelay = 0
+			var over bool
+			over, err = o.syncOnConn(ctx, sendCtx, conn)
+			if over || err != nil {
+				return
+			}
+		}
+		if dialDelay == 0 {
+			dialDelay = minAcceptDelay
+		} else if dialDelay *= 2; dialDelay > maxAcceptDelay {
+			dialDelay = maxAcceptDelay
+		}
+		select {
+		case <-ctx.Done():
+			o.log.Debugf("Context is done, stopping observation at %s", o.socket)
+			return
+		case <-time.After(dialDelay):
+		}
+
+		conn, err = d.DialContext(ctx, "unix", o.socket)
+		if err != nil {
+			if ctx.Err() != nil {
+				o.log.Debugf("Context is done, stopping observation at %s", o.socket)
+				err = nil
+				return
+			}
+			if !isNotBound(err) {
+				err = &observeError{kind: ErrDial, err: err}
+				o.log.Errorf("Stopping observation at %s: %v", o.socket, err)
+				return
+			}
+			o.log.Debugf("Sync socket %s is not bound yet, retrying: %v", o.socket, err)
+			conn, err = nil, nil
+		}
+	}
+}
+
+// isNotBound reports whether dial error means nobody listens
+// on the socket yet, so that dialing may be retried.
+func isNotBound(err error) bool {
+	return errors.Is(err, syscall.ENOENT) || errors.Is(err, syscall.ECONNREFUSED)
+}
@@ -0,0 +1,109 @@
+// Copyright (c) 2018-2019 Sylabs, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package runtime
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestDialObserveState(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	socket := filepath.Join(os.TempDir(), fmt.Sprintf("cri-test-%s.sock", t.Name()))
+	os.Remove(socket)
+
+	state, err := DialObserveState(ctx, socket)
+	require.NoError(t, err)
+
+	// runtime binds socket later and reports states over two connections
+	time.Sleep(20 * time.Millisecond)
+	ln, err := net.Listen("unix", socket)
+	require.NoError(t, err)
+	defer ln.Close()
+	go func() {
+		for _, data := range []string{
+			`{"status": "created"}`,
+			`{"status": "running"} {"status": "stopped"}`,
+		} {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			c.Write([]byte(data))
+			c.Close()
+		}
+	}()
+
+	var actual []State
+	for s := range state {
+		actual = append(actual, s)
+	}
+	require.Equal(t, []State{StateCreated, StateRunning, StateExited}, actual)
+}
+
+func TestDialObserveState_Cancel(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	socket := filepath.Join(os.TempDir(), fmt.Sprintf("cri-test-%s.sock", t.Name()))
+	os.Remove(socket)
+
+	state, err := DialObserveState(ctx, socket)
+	require.NoError(t, err)
+	time.Sleep(20 * time.Millisecond)
+	cancel()
+
+	select {
+	case _, ok := <-state:
+		require.False(t, ok)
+	case <-time.After(time.Second):
+		t.Fatal("channel is not closed")
+	}
+}
+
+func TestDialObserveState_Error(t *testing.T) {
+	socket := filepath.Join(os.TempDir(), strings.Repeat("a", 200))
+
+	_, err := DialObserveState(context.Background(), socket)
+	require.Error(t, err)
+	require.True(t, errors.Is(err, ErrDial), "unexpected error %v", err)
+}
+
+func TestIsNotBound(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cri-test-dial-")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	_, err = net.Dial("unix", filepath.Join(dir, "missing.sock"))
+	require.True(t, isNotBound(err), "unexpected error %v", err)
+
+	// socket file is left, but nobody listens on it anymore
+	socket := filepath.Join(dir, "stale.sock")
+	ln, err := net.Listen("unix", socket)
+	require.NoError(t, err)
+	ln.(*net.UnixListener).SetUnlinkOnClose(false)
+	ln.Close()
+	_, err = net.Dial("unix", socket)
+	require.True(t, isNotBound(err), "unexpected error %v", err)
+}
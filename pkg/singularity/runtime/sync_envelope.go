@@ -0,0 +1,71 @@
+// Copyright (c) 2018-2019 Sylabs, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package runtime
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// WithEnvelope makes observer read status objects wrapped in envelopes that
+// identify the runtime backend and the container they describe, e.g. when a
+// relay aggregates states of several runtimes and re-exposes them on a single
+// socket. It is meant to be used with ObserveMux, which then routes states
+// by both backend and container ID, see MuxObserver.BackendStates. Envelope
+// schema:
+//
+//	{
+//	  "backend":     "runc",  // optional, ID of the runtime backend
+//	  "containerId": "...",   // required if states are multiplexed
+//	  "status":      {...}    // required, status object, see syncStatus
+//	}
+//
+// Options that affect reading status objects, e.g. WithStatusFields or
+// WithRawStatus, apply to the wrapped status object. Container ID set in
+// the envelope takes precedence over one set in the status object. By
+// default status objects are read as is.
+func WithEnvelope() ObserveOption {
+	return func(o *observer) {
+		o.envelope = true
+	}
+}
+
+// statusEnvelope wraps status object sent by a relay, see WithEnvelope.
+type statusEnvelope struct {
+	Backend     string          `json:"backend,omitempty"`
+	ContainerID string          `json:"containerId,omitempty"`
+	Status      json.RawMessage `json:"status"`
+}
+
+// openEnvelope decodes envelope and the status object it wraps.
+func (o *observer) openEnvelope(raw json.RawMessage) (syncStatus, error) {
+	var env statusEnvelope
+	if err := json.Unmarshal(raw, &env); err != nil {
+		return syncStatus{}, err
+	}
+	if len(env.Status) == 0 {
+		return syncStatus{}, fmt.Errorf("envelope has no status object")
+	}
+
+	status, err := o.decodeObject(env.Status)
+	if err != nil {
+		return status, err
+	}
+	status.Backend = env.Backend
+	if env.ContainerID != "" {
+		status.ContainerID = env.ContainerID
+	}
+	return status, nil
+}
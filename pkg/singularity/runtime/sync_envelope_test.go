@@ -0,0 +1,122 @@
+// Copyright (c) 2018-2019 Sylabs, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package runtime
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestObserver_OpenEnvelope(t *testing.T) {
+	tt := []struct {
+		name        string
+		opts        []ObserveOption
+		envelope    string
+		expect      syncStatus
+		expectError string
+	}{
+		{
+			name:     "backend and container",
+			envelope: `{"backend": "runc", "containerId": "a", "status": {"status": "running", "pid": 10}}`,
+			expect:   syncStatus{Status: "running", Pid: 10, ContainerID: "a", Backend: "runc"},
+		},
+		{
+			name:     "container in status",
+			envelope: `{"status": {"status": "running", "containerId": "a"}}`,
+			expect:   syncStatus{Status: "running", ContainerID: "a"},
+		},
+		{
+			name:     "envelope container takes precedence",
+			envelope: `{"containerId": "a", "status": {"status": "running", "containerId": "b"}}`,
+			expect:   syncStatus{Status: "running", ContainerID: "a"},
+		},
+		{
+			name:     "status fields",
+			opts:     []ObserveOption{WithStatusFields("state")},
+			envelope: `{"backend": "runc", "status": {"state": "running"}}`,
+			expect:   syncStatus{Status: "running", Backend: "runc"},
+		},
+		{
+			name:        "no status",
+			envelope:    `{"backend": "runc", "containerId": "a"}`,
+			expectError: "envelope has no status object",
+		},
+		{
+			name:        "invalid status",
+			envelope:    `{"status": "running"}`,
+			expectError: "json: cannot unmarshal string into Go value of type runtime.syncStatus",
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			o := newObserver("", append(tc.opts, WithEnvelope())...)
+			status, err := o.decodeStatus(json.RawMessage(tc.envelope))
+			if tc.expectError != "" {
+				require.EqualError(t, err, tc.expectError)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tc.expect, status)
+		})
+	}
+}
+
+func TestObserveMux_Envelope(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	m, err := ObserveMux(ctx, "", WithEnvelope())
+	require.NoError(t, err)
+	runc, err := m.BackendStates("runc", "a")
+	require.NoError(t, err)
+	crun, err := m.BackendStates("crun", "a")
+	require.NoError(t, err)
+	plain, err := m.States("a")
+	require.NoError(t, err)
+	_, err = m.BackendStates("runc", "a")
+	require.EqualError(t, err, "container runc/a is already observed")
+
+	conn, err := net.Dial(m.Addr().Network(), m.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+	for _, s := range []struct{ backend, status string }{
+		{"runc", "creating"},
+		{"crun", "creating"},
+		{"", "creating"},
+		{"other", "creating"},
+		{"runc", "running"},
+		{"crun", "running"},
+		{"runc", "stopped"},
+		{"", "stopped"},
+	} {
+		_, err := fmt.Fprintf(conn, `{"backend":%q,"containerId":"a","status":{"status":%q}}`, s.backend, s.status)
+		require.NoError(t, err)
+	}
+
+	require.Equal(t, []State{StateCreating, StateRunning, StateExited}, readAll(t, runc))
+	require.Equal(t, []State{StateCreating, StateExited}, readAll(t, plain))
+	require.Equal(t, StateCreating, <-crun)
+	require.Equal(t, StateRunning, <-crun)
+
+	cancel()
+	require.Empty(t, readAll(t, crun))
+	<-m.Done()
+}
@@ -0,0 +1,138 @@
+// Copyright (c) 2018-2019 Sylabs, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package runtime
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// ObserveStateFile is the same as ObserveState except states are read from
+// the state file runtime keeps on disk, e.g. state.json of a Singularity
+// instance, instead of the sync socket. This is useful when runtime is not
+// configured to report states over a socket. File is expected to hold a single
+// status object and is re-read each time it is written or replaced, only
+// status changes are passed to the channel. If file does not exist yet,
+// observer waits for it to appear, but its directory must exist. Options
+// related to sockets and connections are ignored.
+func ObserveStateFile(ctx context.Context, path string, opts ...ObserveOption) (<-chan State, error) {
+	path = filepath.Clean(path)
+	o := newObserver(path, opts...)
+
+	w, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, fmt.Errorf("could not create file watcher: %v", err)
+	}
+	if err := w.Add(filepath.Dir(path)); err != nil {
+		w.Close()
+		return nil, fmt.Errorf("could not watch state file directory: %v", err)
+	}
+
+	o.states = make(chan State, o.bufferSize)
+	o.release = func() {}
+	o.startSpan(ctx)
+	go o.watchFile(ctx, w, path)
+	return o.states, nil
+}
+
+// watchFile passes states read from the file at path to the channel
+// until terminal status is read or ctx is done.
+func (o *observer) watchFile(ctx context.Context, w *fsnotify.Watcher, path string) {
+	defer func() {
+		w.Close()
+		o.close(ctx, nil)
+	}()
+
+	var last *syncStatus
+	// update reads the file and returns true if observation should be stopped
+	update := func() bool {
+		status, ok := o.readStateFile(path)
+		if !ok || (last != nil && last.Status == status.Status) {
+			return false
+		}
+		last = &status
+
+		event := o.event(status)
+		o.log.Debugf("Read state %v from %s", event.State, path)
+		send := o.send
+		if o.isTerminal(event) {
+			send = o.sendFinal
+		}
+		if !send(ctx, event) {
+			return true
+		}
+		o.setCurrent(event.State)
+		if o.isTerminal(event) {
+			o.finished = true
+			return true
+		}
+		return false
+	}
+
+	// file may be written before the watch was set up
+	if update() {
+		return
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case event, ok := <-w.Events:
+			if !ok {
+				return
+			}
+			if event.Name != path || event.Op&(fsnotify.Create|fsnotify.Write) == 0 {
+				continue
+			}
+			if update() {
+				return
+			}
+		case werr, ok := <-w.Errors:
+			if !ok {
+				return
+			}
+			// events may be lost, e.g. on queue overflow, so re-read the file
+			o.log.Warningf("File watcher error at %s: %v", path, werr)
+			if update() {
+				return
+			}
+		}
+	}
+}
+
+// readStateFile reads status from the file at path. It returns false if file
+// does not exist yet or does not hold a complete status object, e.g. runtime
+// is in the middle of writing it.
+func (o *observer) readStateFile(path string) (syncStatus, bool) {
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return syncStatus{}, false
+	}
+	if err != nil {
+		o.log.Warningf("Could not read state file %s: %v", path, err)
+		return syncStatus{}, false
+	}
+	status, err := o.decodeStatus(data)
+	if err != nil {
+		o.log.Debugf("Could not decode state file %s: %v", path, err)
+		return syncStatus{}, false
+	}
+	return status, true
+}
@@ -0,0 +1,88 @@
+// Copyright (c) 2018-2019 Sylabs, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package runtime
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func writeStateFile(t *testing.T, path, status string) {
+	// replace file atomically the way runtime does
+	tmp := path + ".tmp"
+	require.NoError(t, ioutil.WriteFile(tmp, []byte(`{"ociVersion": "1.0.0", "status": "`+status+`", "pid": 42}`), 0644))
+	require.NoError(t, os.Rename(tmp, path))
+}
+
+func TestObserveStateFile(t *testing.T) {
+	defer checkLeaks(t)()
+
+	dir, err := ioutil.TempDir("", "state-file-")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "state.json")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	state, err := ObserveStateFile(ctx, path)
+	require.NoError(t, err)
+
+	// file does not exist yet
+	time.Sleep(time.Millisecond * 10)
+	writeStateFile(t, path, "created")
+	require.Equal(t, StateCreated, <-state)
+	// rewriting the same status is not a transition
+	writeStateFile(t, path, "created")
+	writeStateFile(t, path, "running")
+	require.Equal(t, StateRunning, <-state)
+	// partial write is skipped
+	require.NoError(t, ioutil.WriteFile(path, []byte(`{"status": "sto`), 0644))
+	require.NoError(t, ioutil.WriteFile(path, []byte(`{"status": "stopped"}`), 0644))
+	require.Equal(t, StateExited, <-state)
+	_, ok := <-state
+	require.False(t, ok)
+}
+
+func TestObserveStateFile_Existing(t *testing.T) {
+	defer checkLeaks(t)()
+
+	dir, err := ioutil.TempDir("", "state-file-")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "state.json")
+	writeStateFile(t, path, "running")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	state, err := ObserveStateFile(ctx, path)
+	require.NoError(t, err)
+	require.Equal(t, StateRunning, <-state)
+
+	cancel()
+	_, ok := <-state
+	require.False(t, ok)
+}
+
+func TestObserveStateFile_NoDir(t *testing.T) {
+	defer checkLeaks(t)()
+
+	_, err := ObserveStateFile(context.Background(), "/non/existent/dir/state.json")
+	require.Error(t, err)
+}
@@ -0,0 +1,189 @@
+// Copyright (c) 2018-2019 Sylabs, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package runtime
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"io"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultForwardBatchSize is the default number of events
+	// forwarder flushes at once, see WithForwarder.
+	DefaultForwardBatchSize = 100
+	// DefaultForwardInterval is the default maximum time events
+	// are buffered by forwarder before they are flushed.
+	DefaultForwardInterval = 10 * time.Second
+
+	// forwardQueueSize is the number of events that may
+	// wait for forwarder before new ones are dropped.
+	forwardQueueSize = 256
+)
+
+// WithForwarder makes observer forward states passed to the channel to w in
+// gzip compressed batches of newline separated MirrorEvent objects, each
+// written as a separate gzip member. Batch is flushed once it holds batchSize
+// events or interval passes since its first event, and the rest is flushed
+// once observation is over. Slow w never blocks observation, events are
+// dropped once too many of them wait to be batched. Non-positive batchSize
+// and interval mean DefaultForwardBatchSize and DefaultForwardInterval. It is
+// only available for observations on sockets the observer listens on. By
+// default states are not forwarded.
+func WithForwarder(w io.Writer, batchSize int, interval time.Duration) ObserveOption {
+	return func(o *observer) {
+		if batchSize <= 0 {
+			batchSize = DefaultForwardBatchSize
+		}
+		if interval <= 0 {
+			interval = DefaultForwardInterval
+		}
+		o.forwardTo = w
+		o.forwardBatch = batchSize
+		o.forwardInterval = interval
+	}
+}
+
+// forwarder writes events to w in compressed batches.
+type forwarder struct {
+	w         io.Writer
+	batchSize int
+	interval  time.Duration
+	log       Logger
+
+	mu     sync.Mutex
+	closed bool
+	events chan MirrorEvent
+	// done is closed once the last batch is flushed.
+	done chan struct{}
+}
+
+// startForwarder starts forwarding events if forwarder is set.
+func (o *observer) startForwarder() {
+	if o.forwardTo == nil {
+		return
+	}
+	f := &forwarder{
+		w:         o.forwardTo,
+		batchSize: o.forwardBatch,
+		interval:  o.forwardInterval,
+		log:       o.log,
+		events:    make(chan MirrorEvent, forwardQueueSize),
+		done:      make(chan struct{}),
+	}
+	go f.run()
+	o.forwarder = f
+}
+
+// forwardEvent passes event that was passed to the channel to the
+// forwarder. Events carrying an error are not forwarded.
+func (o *observer) forwardEvent(event StateEvent) {
+	if o.forwarder == nil || event.Err != nil {
+		return
+	}
+	o.forwarder.publish(newMirrorEvent(o.containerID, event))
+}
+
+// stopForwarder flushes the remaining events
+// and stops forwarder if it is started.
+func (o *observer) stopForwarder() {
+	if o.forwarder == nil {
+		return
+	}
+	o.forwarder.close()
+}
+
+// publish queues e to be forwarded or drops it if the queue is full.
+func (f *forwarder) publish(e MirrorEvent) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.closed {
+		return
+	}
+	select {
+	case f.events <- e:
+	default:
+		f.log.Warningf("Dropping forwarded state %v: too many states are waiting to be forwarded", e.State)
+	}
+}
+
+func (f *forwarder) close() {
+	f.mu.Lock()
+	if !f.closed {
+		f.closed = true
+		close(f.events)
+	}
+	f.mu.Unlock()
+	<-f.done
+}
+
+// run batches queued events until the queue is closed.
+func (f *forwarder) run() {
+	defer close(f.done)
+
+	var (
+		batch []MirrorEvent
+		timer *time.Timer
+		flush <-chan time.Time
+	)
+	for {
+		select {
+		case e, ok := <-f.events:
+			if !ok {
+				f.flush(batch)
+				return
+			}
+			batch = append(batch, e)
+			if len(batch) == 1 {
+				timer = time.NewTimer(f.interval)
+				flush = timer.C
+			}
+			if len(batch) < f.batchSize {
+				continue
+			}
+			timer.Stop()
+		case <-flush:
+		}
+		f.flush(batch)
+		batch, flush = nil, nil
+	}
+}
+
+// flush writes batch to w as a single gzip member.
+func (f *forwarder) flush(batch []MirrorEvent) {
+	if len(batch) == 0 {
+		return
+	}
+
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	enc := json.NewEncoder(zw)
+	for _, e := range batch {
+		if err := enc.Encode(e); err != nil {
+			f.log.Warningf("Could not forward %d states: %v", len(batch), err)
+			return
+		}
+	}
+	if err := zw.Close(); err != nil {
+		f.log.Warningf("Could not forward %d states: %v", len(batch), err)
+		return
+	}
+	if _, err := f.w.Write(buf.Bytes()); err != nil {
+		f.log.Warningf("Could not forward %d states: %v", len(batch), err)
+	}
+}
@@ -0,0 +1,139 @@
+// Copyright (c) 2018-2019 Sylabs, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package runtime
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// batchWriter records each write as a separate batch.
+type batchWriter struct {
+	mu      sync.Mutex
+	batches [][]byte
+}
+
+func (w *batchWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.batches = append(w.batches, append([]byte(nil), p...))
+	return len(p), nil
+}
+
+// states returns states of each forwarded batch.
+func (w *batchWriter) states(t *testing.T) [][]State {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	var states [][]State
+	for _, batch := range w.batches {
+		zr, err := gzip.NewReader(bytes.NewReader(batch))
+		require.NoError(t, err)
+		dec := json.NewDecoder(zr)
+		var batchStates []State
+		for {
+			var e MirrorEvent
+			err := dec.Decode(&e)
+			if err == io.EOF {
+				break
+			}
+			require.NoError(t, err)
+			batchStates = append(batchStates, e.State)
+		}
+		states = append(states, batchStates)
+	}
+	return states
+}
+
+func TestObserveState_Forwarder(t *testing.T) {
+	defer checkLeaks(t)()
+
+	tt := []struct {
+		name      string
+		batchSize int
+		expect    [][]State
+	}{
+		{
+			name:      "batches",
+			batchSize: 2,
+			expect: [][]State{
+				{StateCreating, StateCreated},
+				{StateRunning, StatePaused},
+				{StateExited},
+			},
+		},
+		{
+			name: "final flush",
+			expect: [][]State{
+				{StateCreating, StateCreated, StateRunning, StatePaused, StateExited},
+			},
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			w := &batchWriter{}
+			o, err := Observe(ctx, "", WithForwarder(w, tc.batchSize, time.Hour))
+			require.NoError(t, err, "could not listen on socket")
+			require.NoError(t, PushState(ctx, o.Addr().String(),
+				StateCreating, StateCreated, StateRunning, StatePaused, StateExited))
+			for range o.States() {
+			}
+			require.Equal(t, tc.expect, w.states(t))
+
+			// the whole stream is readable at once
+			var stream bytes.Buffer
+			for _, batch := range w.batches {
+				stream.Write(batch)
+			}
+			zr, err := gzip.NewReader(&stream)
+			require.NoError(t, err)
+			data, err := ioutil.ReadAll(zr)
+			require.NoError(t, err)
+			require.Equal(t, 5, bytes.Count(data, []byte("\n")))
+		})
+	}
+}
+
+func TestObserveState_ForwarderInterval(t *testing.T) {
+	defer checkLeaks(t)()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	w := &batchWriter{}
+	o, err := Observe(ctx, "", WithForwarder(w, 0, time.Millisecond*20))
+	require.NoError(t, err, "could not listen on socket")
+	defer o.Close()
+	require.NoError(t, PushState(ctx, o.Addr().String(), StateRunning))
+	require.Equal(t, StateRunning, <-o.States())
+
+	require.Eventually(t, func() bool {
+		return len(w.states(t)) == 1
+	}, time.Second, time.Millisecond*5)
+	require.Equal(t, [][]State{{StateRunning}}, w.states(t))
+}
@@ -0,0 +1,124 @@
+// Copyright (c) 2018-2019 Sylabs, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package runtime
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// ErrNotConfirmed is returned by Observer.Pause and Observer.Resume when
+// runtime does not report the requested state within the timeout.
+var ErrNotConfirmed = fmt.Errorf("state change is not confirmed")
+
+// Freezer pauses and resumes containers, it is implemented by CLIClient.
+type Freezer interface {
+	Pause(id string) error
+	Resume(id string) error
+}
+
+// stateWaiter is notified once one of states is passed to the channel.
+type stateWaiter struct {
+	states []State
+	done   chan struct{}
+}
+
+// Pause asks f to pause container with id and waits until runtime reports
+// StatePaused, so that caller may rely on container being frozen once Pause
+// returns, e.g. to checkpoint it. If StatePaused is not reported within
+// timeout, error wrapping ErrNotConfirmed is returned.
+func (o *Observer) Pause(ctx context.Context, f Freezer, id string, timeout time.Duration) error {
+	return o.observer().confirm(ctx, timeout, func() error {
+		return f.Pause(id)
+	}, StatePaused)
+}
+
+// Resume is the same as Pause except it asks f to resume container and waits
+// until runtime reports StateResumed or StateRunning.
+func (o *Observer) Resume(ctx context.Context, f Freezer, id string, timeout time.Duration) error {
+	return o.observer().confirm(ctx, timeout, func() error {
+		return f.Resume(id)
+	}, StateResumed, StateRunning)
+}
+
+// confirm calls fn and waits until one of states is passed to the channel.
+// Waiting starts before fn is called, so that state reported by runtime
+// before fn returns is not missed.
+func (o *observer) confirm(ctx context.Context, timeout time.Duration, fn func() error, states ...State) error {
+	w := &stateWaiter{
+		states: states,
+		done:   make(chan struct{}),
+	}
+	o.mu.Lock()
+	o.waiters = append(o.waiters, w)
+	o.mu.Unlock()
+	defer o.removeWaiter(w)
+
+	if err := fn(); err != nil {
+		return err
+	}
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-w.done:
+		return nil
+	case <-timer.C:
+		return fmt.Errorf("%w: %v state is not reported within %v", ErrNotConfirmed, states[0], timeout)
+	case <-o.done:
+		return fmt.Errorf("%w: observation is over", ErrNotConfirmed)
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// setCurrent records state passed to the channel
+// and notifies those who wait for it.
+func (o *observer) setCurrent(state State) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	o.current = state
+	waiters := o.waiters[:0]
+	for _, w := range o.waiters {
+		if !w.wants(state) {
+			waiters = append(waiters, w)
+			continue
+		}
+		close(w.done)
+	}
+	o.waiters = waiters
+}
+
+func (o *observer) removeWaiter(w *stateWaiter) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	for i := range o.waiters {
+		if o.waiters[i] == w {
+			o.waiters = append(o.waiters[:i], o.waiters[i+1:]...)
+			return
+		}
+	}
+}
+
+func (w *stateWaiter) wants(state State) bool {
+	for _, s := range w.states {
+		if s == state {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,109 @@
+// Copyright (c) 2018-2019 Sylabs, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package runtime
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// testFreezer reports states over the socket the same way runtime does.
+type testFreezer struct {
+	socket string
+	paused []State
+	err    error
+}
+
+func (f *testFreezer) Pause(id string) error {
+	if f.err != nil {
+		return f.err
+	}
+	return PushState(context.Background(), f.socket, f.paused...)
+}
+
+func (f *testFreezer) Resume(id string) error {
+	if f.err != nil {
+		return f.err
+	}
+	return PushState(context.Background(), f.socket, StateResumed)
+}
+
+func TestObserver_Pause(t *testing.T) {
+	tt := []struct {
+		name        string
+		paused      []State
+		freezeErr   error
+		expectError string
+	}{
+		{
+			name:   "confirmed",
+			paused: []State{StatePaused},
+		},
+		{
+			name:        "not reported",
+			paused:      []State{StateRunning},
+			expectError: "state change is not confirmed: paused state is not reported within 100ms",
+		},
+		{
+			name:        "freeze failed",
+			freezeErr:   fmt.Errorf("could not execute: exit status 255"),
+			expectError: "could not execute: exit status 255",
+		},
+		{
+			name:        "observation is over",
+			paused:      []State{StateExited},
+			expectError: "state change is not confirmed: observation is over",
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			o, err := Observe(ctx, "", WithBufferSize(8))
+			require.NoError(t, err, "could not listen on socket")
+			f := &testFreezer{
+				socket: o.Addr().String(),
+				paused: tc.paused,
+				err:    tc.freezeErr,
+			}
+			require.NoError(t, PushState(ctx, f.socket, StateRunning))
+			require.Equal(t, StateRunning, <-o.States())
+
+			err = o.Pause(ctx, f, "test-id", 100*time.Millisecond)
+			if tc.expectError != "" {
+				require.EqualError(t, err, tc.expectError)
+				if tc.freezeErr == nil {
+					require.True(t, errors.Is(err, ErrNotConfirmed))
+				}
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, StatePaused, o.Current())
+
+			require.NoError(t, o.Resume(ctx, f, "test-id", 100*time.Millisecond))
+			require.Equal(t, StateResumed, o.Current())
+			require.Equal(t, StatePaused, <-o.States())
+			require.Equal(t, StateResumed, <-o.States())
+			require.Empty(t, o.observer().waiters)
+		})
+	}
+}
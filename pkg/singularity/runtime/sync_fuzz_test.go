@@ -0,0 +1,101 @@
+// Copyright (c) 2018-2019 Sylabs, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package runtime
+
+import (
+	"context"
+	"errors"
+	"net"
+	"runtime"
+	"testing"
+	"time"
+)
+
+// FuzzSyncOnConn feeds arbitrary data to a sync connection and checks every
+// event carries either a known state or an error and that nothing is left
+// running once the connection is handled. Run with
+//
+//	go test -run XXX -fuzz FuzzSyncOnConn ./pkg/singularity/runtime
+func FuzzSyncOnConn(f *testing.F) {
+	for _, seed := range []string{
+		`{"status":"creating"}`,
+		`{"status":"created"}{"status":"running","pid":42}`,
+		`{"status":"running"}{"status":"stopped","exitCode":1,"signal":9}`,
+		`{"status":"paused"}{"status":"resumed"}`,
+		`{"version":1,"status":"running","token":"secret"}`,
+		`{"status":"running","id":7}`,
+		`{"status":"running","containerId":"abc"}`,
+		`{"status":"unknown"}`,
+		`{"status":`,
+		`{"status":42}`,
+		`{"pid":"42"}`,
+		`{"version":99,"status":"running"}`,
+		`[{"status":"running"}]`,
+		`}{`,
+		"\x00\xff",
+		``,
+	} {
+		f.Add([]byte(seed))
+	}
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		goroutines := runtime.NumGoroutine()
+
+		o := newObserver("", WithMaxStatusSize(1<<10))
+		o.log = &testLogger{}
+		o.events = make(chan StateEvent, 1)
+		received := make(chan []StateEvent)
+		go func() {
+			var events []StateEvent
+			for event := range o.events {
+				events = append(events, event)
+			}
+			received <- events
+		}()
+
+		server, client := net.Pipe()
+		go func() {
+			client.Write(data)
+			client.Close()
+		}()
+
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		_, err := o.syncOnConn(ctx, ctx, server)
+		close(o.events)
+		events := <-received
+		if ctx.Err() != nil {
+			t.Fatalf("connection is not handled before timeout")
+		}
+
+		for _, event := range events {
+			if event.Err == nil && event.State > StatePreparing {
+				t.Fatalf("unexpected state %v", event.State)
+			}
+		}
+		if err != nil && !errors.Is(err, ErrDecode) {
+			t.Fatalf("unexpected error %v", err)
+		}
+
+		// writer may be blocked until pipe is closed
+		deadline := time.Now().Add(time.Second)
+		for runtime.NumGoroutine() > goroutines && time.Now().Before(deadline) {
+			time.Sleep(time.Millisecond)
+		}
+		if n := runtime.NumGoroutine(); n > goroutines {
+			t.Fatalf("%d goroutines leaked", n-goroutines)
+		}
+	})
+}
@@ -0,0 +1,79 @@
+// Copyright (c) 2018-2019 Sylabs, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package runtime
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strings"
+)
+
+// Handoff stops observation without removing the socket and returns the
+// file of the listening socket, so that observation may be taken over by
+// another process, e.g. during upgrade, without rebinding the socket. The
+// returned file is a duplicate that should be closed by the caller once
+// passed along. Handoff sequence is:
+//
+//  1. The old process calls Handoff, so it stops accepting connections.
+//     Connections that are already accepted are drained as usual, see
+//     WithDrainTimeout, while new ones wait in the socket backlog.
+//  2. The file is passed to the new process, e.g. over a unix socket
+//     with syscall.UnixRights, or inherited by a child process.
+//  3. The new process calls AdoptListener with the socket and the file
+//     and starts observing the socket as usual, e.g. with Observe.
+//
+// Accepting must be stopped on the old process first, otherwise both
+// processes accept connections and states are split between them. Only
+// unix and tcp sockets may be handed off. Once Handoff returns the states
+// channel is closed as if Close is called.
+func (o *Observer) Handoff() (*os.File, error) {
+	obs := o.observer()
+	l, ok := obs.ln.(interface {
+		File() (*os.File, error)
+	})
+	if !ok {
+		return nil, fmt.Errorf("%s socket cannot be handed off", obs.addr.Network())
+	}
+	f, err := l.File()
+	if err != nil {
+		return nil, fmt.Errorf("could not get socket file: %v", err)
+	}
+	if ul, ok := obs.ln.(*unixListener); ok {
+		ul.keepSocket()
+	}
+	o.Close()
+	return f, nil
+}
+
+// AdoptListener makes the listening socket from f, e.g. passed by the process
+// that called Handoff, available for the next observation of socket in this
+// process, so that socket is not listened on again. Socket should be the same
+// one the socket was observed on. The listener is used at most once, after
+// that socket is listened on as usual. AdoptListener does not take ownership
+// of f, so the caller should close it.
+func AdoptListener(socket string, f *os.File) error {
+	ln, err := net.FileListener(f)
+	if err != nil {
+		return fmt.Errorf("could not adopt socket %s: %v", socket, err)
+	}
+	scheme, address := splitSocket(socket)
+	if scheme == "unix" && !strings.HasPrefix(address, "@") {
+		// socket file should be removed once observation is over
+		ln = &unixListener{Listener: ln, path: address}
+	}
+	addActivatedAt(address, ln)
+	return nil
+}
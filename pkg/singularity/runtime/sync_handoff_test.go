@@ -0,0 +1,85 @@
+// Copyright (c) 2018-2019 Sylabs, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package runtime
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestObserver_Handoff(t *testing.T) {
+	tt := []struct {
+		name   string
+		socket string
+	}{
+		{
+			name:   "unix",
+			socket: filepath.Join(os.TempDir(), fmt.Sprintf("cri-test-%d.sock", os.Getpid())),
+		},
+		{
+			name:   "tcp",
+			socket: "tcp://127.0.0.1:0",
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			old, err := Observe(ctx, tc.socket)
+			require.NoError(t, err, "could not listen on socket")
+			addr := old.Addr()
+			socket := tc.socket
+			if addr.Network() == "tcp" {
+				socket = "tcp://" + addr.String()
+			}
+			require.NoError(t, PushState(ctx, socket, StateRunning))
+			require.Equal(t, StateRunning, <-old.States())
+
+			f, err := old.Handoff()
+			require.NoError(t, err)
+			defer f.Close()
+			_, ok := <-old.States()
+			require.False(t, ok, "old observation is not stopped")
+
+			// runtime connects while socket is handed off
+			c, err := net.Dial(addr.Network(), addr.String())
+			require.NoError(t, err)
+			defer c.Close()
+			_, err = c.Write([]byte(`{"status":"paused"}`))
+			require.NoError(t, err)
+
+			require.NoError(t, AdoptListener(socket, f))
+			o, err := Observe(ctx, socket)
+			require.NoError(t, err, "could not observe adopted socket")
+			require.Equal(t, StatePaused, <-o.States())
+			require.NoError(t, c.Close())
+			require.NoError(t, PushState(ctx, socket, StateExited))
+			require.Equal(t, StateExited, <-o.States())
+
+			if addr.Network() == "unix" {
+				_, err = os.Stat(socket)
+				require.True(t, os.IsNotExist(err), "socket is not removed")
+			}
+		})
+	}
+}
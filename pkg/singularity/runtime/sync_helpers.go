@@ -0,0 +1,242 @@
+// Copyright (c) 2018-2019 Sylabs, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package runtime
+
+import (
+	"context"
+	"fmt"
+)
+
+var (
+	// ErrExitedEarly is returned when container reaches StateExited
+	// before the state that was waited for.
+	ErrExitedEarly = fmt.Errorf("container exited before reaching expected state")
+	// ErrObservationOver is returned when state channel is closed
+	// before the state that was waited for.
+	ErrObservationOver = fmt.Errorf("state observation is over")
+	// ErrExitCodeUnknown is returned by Supervise when container exit
+	// is inferred, see WithInferredExit, so there is no exit code.
+	ErrExitCodeUnknown = fmt.Errorf("container exit is inferred, exit code is unknown")
+)
+
+// WaitForState reads states from the passed channel until target state
+// is received and returns the last received state. If StateExited is
+// received before target, ErrExitedEarly is returned. If channel is closed
+// before target is received, ErrObservationOver is returned. WaitForState
+// returns context's error in case it is done before target is received.
+func WaitForState(ctx context.Context, ch <-chan State, target State) (State, error) {
+	last := StateUnknown
+	for {
+		select {
+		case <-ctx.Done():
+			return last, ctx.Err()
+		case state, ok := <-ch:
+			if !ok {
+				return last, ErrObservationOver
+			}
+			last = state
+			if state == target {
+				return state, nil
+			}
+			if state == StateExited {
+				return state, ErrExitedEarly
+			}
+		}
+	}
+}
+
+// DrainTo calls fn for each state received from the passed channel until
+// StateExited is received, channel is closed, context is done or fn returns
+// an error. StateExited is passed to fn too. DrainTo returns fn's error,
+// context's error in case it is done first, or nil otherwise.
+func DrainTo(ctx context.Context, ch <-chan State, fn func(State) error) error {
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case state, ok := <-ch:
+			if !ok {
+				return nil
+			}
+			if err := fn(state); err != nil {
+				return err
+			}
+			if state == StateExited {
+				return nil
+			}
+		}
+	}
+}
+
+// CollectStates observes socket until container reaches its terminal state
+// and returns all received states in order, which is handy for batch
+// workloads that only inspect states once container is finished. Socket
+// and options are the same as ObserveState accepts. If observation is over
+// before the terminal state, e.g. because ctx is done, the states collected
+// so far are returned along with the reason, see Observer.Err.
+func CollectStates(ctx context.Context, socket string, opts ...ObserveOption) ([]State, error) {
+	o, err := Observe(ctx, socket, opts...)
+	if err != nil {
+		return nil, err
+	}
+	defer o.Close()
+
+	var states []State
+	for state := range o.States() {
+		states = append(states, state)
+	}
+	return states, o.Err()
+}
+
+// Supervise observes socket until container exits and returns the exit code
+// it has reported along with StateExited. Socket and options are the same as
+// ObserveState accepts. If observation is stopped by an error, e.g. because
+// of a timeout, the error is returned, see StateEvent.Err. ErrObservationOver
+// is returned if observation is over without StateExited, e.g. on another
+// terminal status, ErrExitCodeUnknown if exit is inferred and context's
+// error if it is done first. Socket is no longer observed once Supervise
+// returns.
+func Supervise(ctx context.Context, socket string, opts ...ObserveOption) (int, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	events, err := ObserveStateEvents(ctx, socket, opts...)
+	if err != nil {
+		cancel()
+		return 0, err
+	}
+	defer func() {
+		cancel()
+		for range events {
+		}
+	}()
+
+	for event := range events {
+		switch {
+		case event.Err != nil:
+			return 0, event.Err
+		case event.State != StateExited:
+		case event.Inferred:
+			return 0, ErrExitCodeUnknown
+		default:
+			return event.ExitCode, nil
+		}
+	}
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	return 0, ErrObservationOver
+}
+
+// ExitContext returns context derived from parent that is cancelled once
+// StateExited is received from the passed channel or the channel is closed.
+// This allows to tie any operation to the container's lifetime. Passed
+// channel is consumed by ExitContext so it should not be read elsewhere,
+// use Broadcast to share it. Channel is no longer read after parent is done.
+func ExitContext(parent context.Context, ch <-chan State) context.Context {
+	ctx, cancel := context.WithCancel(parent)
+	go watchExit(ctx, ch, cancel)
+	return ctx
+}
+
+// watchExit calls cancel once StateExited is read from ch or ch is closed.
+// It returns as soon as ctx is done.
+func watchExit(ctx context.Context, ch <-chan State, cancel context.CancelFunc) {
+	defer cancel()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case state, ok := <-ch:
+			if !ok || state == StateExited {
+				return
+			}
+		}
+	}
+}
+
+// Broadcast passes every state received from in to each of n returned
+// channels. Each returned channel has its own queue of pending states,
+// so a slow subscriber blocks neither the other subscribers nor
+// the reader of in. The queue is not bounded: states are kept until they
+// are read or ctx is done so every subscriber receives every transition.
+// Returned channels are closed when in is closed and all pending states are
+// read, or when ctx is done.
+func Broadcast(ctx context.Context, in <-chan State, n int) []<-chan State {
+	outs := make([]<-chan State, n)
+	queues := make([]chan State, n)
+	for i := range queues {
+		queues[i] = make(chan State)
+		out := make(chan State)
+		outs[i] = out
+		go forwardQueued(ctx, queues[i], out)
+	}
+
+	go func() {
+		defer func() {
+			for _, q := range queues {
+				close(q)
+			}
+		}()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case state, ok := <-in:
+				if !ok {
+					return
+				}
+				for _, q := range queues {
+					select {
+					case q <- state:
+					case <-ctx.Done():
+						return
+					}
+				}
+			}
+		}
+	}()
+	return outs
+}
+
+// forwardQueued passes states from in to out keeping them in an unbounded
+// queue so that in is always read from promptly.
+func forwardQueued(ctx context.Context, in <-chan State, out chan<- State) {
+	defer close(out)
+
+	var queue []State
+	for in != nil || len(queue) > 0 {
+		var (
+			send chan<- State
+			next State
+		)
+		if len(queue) > 0 {
+			send = out
+			next = queue[0]
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case state, ok := <-in:
+			if !ok {
+				in = nil
+				continue
+			}
+			queue = append(queue, state)
+		case send <- next:
+			queue = queue[1:]
+		}
+	}
+}
@@ -0,0 +1,424 @@
+// Copyright (c) 2018-2019 Sylabs, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package runtime
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestWaitForState(t *testing.T) {
+	tt := []struct {
+		name        string
+		states      []State
+		close       bool
+		target      State
+		expectState State
+		expectError error
+	}{
+		{
+			name:        "target reached",
+			states:      []State{StateCreating, StateCreated, StateRunning},
+			target:      StateRunning,
+			expectState: StateRunning,
+		},
+		{
+			name:        "exited early",
+			states:      []State{StateCreating, StateExited},
+			target:      StateRunning,
+			expectState: StateExited,
+			expectError: ErrExitedEarly,
+		},
+		{
+			name:        "wait for exit",
+			states:      []State{StateRunning, StateExited},
+			target:      StateExited,
+			expectState: StateExited,
+		},
+		{
+			name:        "channel closed",
+			states:      []State{StateCreating},
+			close:       true,
+			target:      StateRunning,
+			expectState: StateCreating,
+			expectError: ErrObservationOver,
+		},
+		{
+			name:        "context done",
+			states:      []State{StateCreating},
+			target:      StateRunning,
+			expectState: StateCreating,
+			expectError: context.DeadlineExceeded,
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			ch := make(chan State, len(tc.states))
+			for _, s := range tc.states {
+				ch <- s
+			}
+			if tc.close {
+				close(ch)
+			}
+
+			ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*50)
+			defer cancel()
+			state, err := WaitForState(ctx, ch, tc.target)
+			require.Equal(t, tc.expectError, err)
+			require.Equal(t, tc.expectState, state)
+		})
+	}
+}
+
+func TestBroadcast(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	states := []State{StateCreating, StateCreated, StateRunning, StateExited}
+	in := make(chan State)
+	outs := Broadcast(ctx, in, 2)
+	require.Len(t, outs, 2)
+
+	// nobody reads from the second channel yet, this must not block
+	for _, s := range states {
+		in <- s
+	}
+	close(in)
+
+	for _, out := range outs {
+		var actual []State
+		for s := range out {
+			actual = append(actual, s)
+		}
+		require.Equal(t, states, actual)
+	}
+}
+
+func TestBroadcast_Cancel(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	in := make(chan State)
+	outs := Broadcast(ctx, in, 1)
+	in <- StateRunning
+	cancel()
+
+	for range outs[0] {
+	}
+}
+
+func TestExitContext(t *testing.T) {
+	tt := []struct {
+		name string
+		feed func(ch chan State)
+	}{
+		{
+			name: "exited",
+			feed: func(ch chan State) {
+				ch <- StateCreated
+				ch <- StateRunning
+				ch <- StateExited
+			},
+		},
+		{
+			name: "closed",
+			feed: func(ch chan State) {
+				ch <- StateRunning
+				close(ch)
+			},
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			ch := make(chan State)
+			ctx := ExitContext(context.Background(), ch)
+			tc.feed(ch)
+
+			select {
+			case <-ctx.Done():
+			case <-time.After(time.Second):
+				t.Fatal("context is not cancelled")
+			}
+			require.Equal(t, context.Canceled, ctx.Err())
+		})
+	}
+}
+
+func TestExitContext_ParentDone(t *testing.T) {
+	parent, cancel := context.WithCancel(context.Background())
+	ch := make(chan State)
+	ctx := ExitContext(parent, ch)
+	ch <- StateRunning
+	require.NoError(t, ctx.Err())
+	cancel()
+	<-ctx.Done()
+
+	// watcher must return even though channel is neither closed nor exited
+	done := make(chan struct{})
+	go func() {
+		watchExit(ctx, ch, func() {})
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("watcher is still running")
+	}
+}
+
+func TestDrainTo(t *testing.T) {
+	errStop := fmt.Errorf("stop")
+	tt := []struct {
+		name   string
+		states []State
+		close  bool
+		stopAt State
+		expect []State
+		err    error
+	}{
+		{
+			name:   "exited",
+			states: []State{StateCreated, StateRunning, StateExited, StateRunning},
+			expect: []State{StateCreated, StateRunning, StateExited},
+		},
+		{
+			name:   "closed",
+			states: []State{StateCreated, StateRunning},
+			close:  true,
+			expect: []State{StateCreated, StateRunning},
+		},
+		{
+			name:   "callback error",
+			states: []State{StateCreated, StateRunning, StateExited},
+			stopAt: StateRunning,
+			expect: []State{StateCreated, StateRunning},
+			err:    errStop,
+		},
+		{
+			name:   "context done",
+			states: []State{StateCreated},
+			expect: []State{StateCreated},
+			err:    context.DeadlineExceeded,
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+			defer cancel()
+
+			ch := make(chan State, len(tc.states))
+			for _, s := range tc.states {
+				ch <- s
+			}
+			if tc.close {
+				close(ch)
+			}
+
+			var actual []State
+			err := DrainTo(ctx, ch, func(s State) error {
+				actual = append(actual, s)
+				if s == tc.stopAt {
+					return errStop
+				}
+				return nil
+			})
+			require.Equal(t, tc.err, err)
+			require.Equal(t, tc.expect, actual)
+		})
+	}
+}
+
+func ExampleDrainTo() {
+	ch := make(chan State, 3)
+	ch <- StateCreated
+	ch <- StateRunning
+	ch <- StateExited
+
+	err := DrainTo(context.Background(), ch, func(s State) error {
+		fmt.Println(s)
+		return nil
+	})
+	fmt.Println(err)
+	// Output:
+	// created
+	// running
+	// exited
+	// <nil>
+}
+
+func ExampleDrainTo_error() {
+	ch := make(chan State, 2)
+	ch <- StateCreated
+	ch <- StateExited
+
+	err := DrainTo(context.Background(), ch, func(s State) error {
+		if s != StateRunning {
+			return fmt.Errorf("container is %v", s)
+		}
+		return nil
+	})
+	fmt.Println(err)
+	// Output:
+	// container is created
+}
+
+func TestCollectStates(t *testing.T) {
+	tt := []struct {
+		name   string
+		push   []State
+		cancel bool
+		expect []State
+		err    error
+	}{
+		{
+			name:   "terminal state",
+			push:   []State{StateCreated, StateRunning, StateExited},
+			expect: []State{StateCreated, StateRunning, StateExited},
+		},
+		{
+			name:   "context done",
+			push:   []State{StateCreated, StateRunning},
+			cancel: true,
+			expect: []State{StateCreated, StateRunning},
+			err:    context.Canceled,
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			socket := filepath.Join(os.TempDir(), fmt.Sprintf("cri-test-%s.sock", strings.Replace(t.Name(), "/", "-", -1)))
+			type result struct {
+				states []State
+				err    error
+			}
+			done := make(chan result)
+			// all pushed states are handled once runtime disconnects
+			disconnected := make(chan struct{}, 1)
+			go func() {
+				states, err := CollectStates(ctx, socket, OnDisconnect(func(net.Addr, error) {
+					disconnected <- struct{}{}
+				}))
+				done <- result{states, err}
+			}()
+
+			require.Eventually(t, func() bool {
+				return PushState(ctx, socket, tc.push...) == nil
+			}, time.Second, 10*time.Millisecond)
+			if tc.cancel {
+				<-disconnected
+				cancel()
+			}
+
+			res := <-done
+			require.Equal(t, tc.err, res.err)
+			require.Equal(t, tc.expect, res.states)
+		})
+	}
+}
+
+func TestSupervise(t *testing.T) {
+	tt := []struct {
+		name    string
+		opts    []ObserveOption
+		write   string
+		timeout time.Duration
+		expect  int
+		err     error
+	}{
+		{
+			name:   "exited",
+			write:  `{"status":"running"}{"status":"stopped","exitCode":3}`,
+			expect: 3,
+		},
+		{
+			name:  "inferred exit",
+			opts:  []ObserveOption{WithInferredExit()},
+			write: `{"status":"running"}`,
+			err:   ErrExitCodeUnknown,
+		},
+		{
+			name:  "other terminal status",
+			opts:  []ObserveOption{WithTerminalStatuses("failed")},
+			write: `{"status":"running"}{"status":"failed"}`,
+			err:   ErrObservationOver,
+		},
+		{
+			name:  "inactive",
+			opts:  []ObserveOption{WithInactivityTimeout(50 * time.Millisecond)},
+			write: `{"status":"running"}`,
+			err:   ErrInactive,
+		},
+		{
+			name:    "context done",
+			write:   `{"status":"running"}`,
+			timeout: 100 * time.Millisecond,
+			err:     context.DeadlineExceeded,
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			timeout := tc.timeout
+			if timeout == 0 {
+				timeout = 5 * time.Second
+			}
+			ctx, cancel := context.WithTimeout(context.Background(), timeout)
+			defer cancel()
+
+			socket := filepath.Join(os.TempDir(), fmt.Sprintf("cri-test-%s.sock", strings.Replace(t.Name(), "/", "-", -1)))
+			type result struct {
+				code int
+				err  error
+			}
+			done := make(chan result)
+			go func() {
+				code, err := Supervise(ctx, socket, tc.opts...)
+				done <- result{code, err}
+			}()
+
+			var c net.Conn
+			require.Eventually(t, func() bool {
+				var err error
+				c, err = net.Dial("unix", socket)
+				return err == nil
+			}, time.Second, 10*time.Millisecond)
+			_, err := c.Write([]byte(tc.write))
+			require.NoError(t, err)
+			if tc.err == ErrExitCodeUnknown {
+				c.Close()
+			}
+			defer c.Close()
+
+			res := <-done
+			require.Equal(t, tc.err, res.err)
+			require.Equal(t, tc.expect, res.code)
+			_, err = os.Stat(socket)
+			require.True(t, os.IsNotExist(err), "socket is not removed")
+		})
+	}
+}
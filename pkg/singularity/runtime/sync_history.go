@@ -0,0 +1,160 @@
+// Copyright (c) 2018-2019 Sylabs, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package runtime
+
+import (
+	"time"
+)
+
+// DefaultHistorySize is the default number of events retained by observer.
+const DefaultHistorySize = 32
+
+// WithHistorySize sets how many of the most recent events are retained
+// by observer to be returned with Observer.History. By default
+// DefaultHistorySize is used, non-positive size disables history.
+func WithHistorySize(n int) ObserveOption {
+	return func(o *observer) {
+		if n < 0 {
+			n = 0
+		}
+		o.history = newEventRing(n)
+	}
+}
+
+// History returns events passed to the channel so far in the order they
+// were received, including the one that stopped observation, if any. Only
+// the most recent events are retained, see WithHistorySize. Events are
+// recorded regardless of whether they are already read from the channel.
+// History is preserved when Observer is reset, so it spans all container
+// restarts. It is safe to call concurrently and after observation is over.
+func (o *Observer) History() []StateEvent {
+	obs := o.observer()
+	obs.mu.Lock()
+	defer obs.mu.Unlock()
+	return obs.history.list()
+}
+
+// Durations returns how long container has stayed in each state so far,
+// measured between timestamps of the events passed to the channel, e.g. to
+// find out whether slow start is spent creating or in the created state.
+// Time spent in a state that is entered several times is summed. States
+// that were never entered are absent, i.e. zero is reported for them, and so
+// is the state container is currently in, including the terminal one, until
+// the next state is received. Unlike History, durations are kept for the
+// current observation only and start over once Observer is reset.
+func (o *Observer) Durations() map[State]time.Duration {
+	obs := o.observer()
+	obs.mu.Lock()
+	defer obs.mu.Unlock()
+	return obs.durations.list()
+}
+
+// Lifetime returns wall-clock time container has lived, i.e. time between
+// timestamps of the first state passed to the channel and of StateExited,
+// and true once container has exited. Unlike the sum of Durations, it does
+// not depend on which states are passed to the channel in between. Until
+// container exits, time since the first state is returned along with false.
+// Zero is returned before any state is passed. Like Durations, lifetime is
+// measured for the current observation only.
+func (o *Observer) Lifetime() (time.Duration, bool) {
+	obs := o.observer()
+	obs.mu.Lock()
+	defer obs.mu.Unlock()
+	d := obs.durations
+	switch {
+	case d.first.IsZero():
+		return 0, false
+	case !d.exited.IsZero():
+		return d.exited.Sub(d.first), true
+	}
+	return obs.now().Sub(d.first), false
+}
+
+// stateDurations sums time spent in each state.
+type stateDurations struct {
+	total map[State]time.Duration
+	// last is the state received the last along with its timestamp.
+	last State
+	at   time.Time
+	// first and exited are timestamps of the first state and StateExited.
+	first  time.Time
+	exited time.Time
+}
+
+// add accounts the time since the previous state to that
+// state. Events carrying an error report no state and are skipped.
+func (d *stateDurations) add(event StateEvent) {
+	if event.Err != nil {
+		return
+	}
+	if !d.at.IsZero() {
+		if d.total == nil {
+			d.total = make(map[State]time.Duration)
+		}
+		d.total[d.last] += event.Time.Sub(d.at)
+	}
+	if d.first.IsZero() {
+		d.first = event.Time
+	}
+	if event.State == StateExited && d.exited.IsZero() {
+		d.exited = event.Time
+	}
+	d.last, d.at = event.State, event.Time
+}
+
+// list returns copy of the durations.
+func (d *stateDurations) list() map[State]time.Duration {
+	durations := make(map[State]time.Duration, len(d.total))
+	for state, total := range d.total {
+		durations[state] = total
+	}
+	return durations
+}
+
+// eventRing is a fixed size ring buffer of events.
+type eventRing struct {
+	events []StateEvent
+	// next is the index the next event is written at.
+	next int
+	full bool
+}
+
+func newEventRing(size int) *eventRing {
+	return &eventRing{
+		events: make([]StateEvent, size),
+	}
+}
+
+// add appends event to the ring, overwriting the oldest one if ring is full.
+func (r *eventRing) add(event StateEvent) {
+	if len(r.events) == 0 {
+		return
+	}
+	r.events[r.next] = event
+	r.next = (r.next + 1) % len(r.events)
+	if r.next == 0 {
+		r.full = true
+	}
+}
+
+// list returns copy of the events from the oldest to the newest one.
+func (r *eventRing) list() []StateEvent {
+	if !r.full {
+		return append([]StateEvent(nil), r.events[:r.next]...)
+	}
+	events := make([]StateEvent, 0, len(r.events))
+	events = append(events, r.events[r.next:]...)
+	return append(events, r.events[:r.next]...)
+}
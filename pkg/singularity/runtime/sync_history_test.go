@@ -0,0 +1,203 @@
+// Copyright (c) 2018-2019 Sylabs, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package runtime
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestEventRing(t *testing.T) {
+	tt := []struct {
+		name   string
+		size   int
+		add    []State
+		expect []State
+	}{
+		{
+			name:   "disabled",
+			size:   0,
+			add:    []State{StateCreated, StateRunning},
+			expect: nil,
+		},
+		{
+			name:   "not full",
+			size:   3,
+			add:    []State{StateCreated, StateRunning},
+			expect: []State{StateCreated, StateRunning},
+		},
+		{
+			name:   "exactly full",
+			size:   2,
+			add:    []State{StateCreated, StateRunning},
+			expect: []State{StateCreated, StateRunning},
+		},
+		{
+			name:   "overwritten",
+			size:   3,
+			add:    []State{StateCreating, StateCreated, StateRunning, StatePaused, StateResumed},
+			expect: []State{StateRunning, StatePaused, StateResumed},
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			r := newEventRing(tc.size)
+			for _, s := range tc.add {
+				r.add(StateEvent{State: s})
+			}
+			var actual []State
+			for _, e := range r.list() {
+				actual = append(actual, e.State)
+			}
+			require.Equal(t, tc.expect, actual)
+		})
+	}
+}
+
+func TestObserver_History(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	o, err := Observe(ctx, "", WithHistorySize(2), WithStrictTransitions())
+	require.NoError(t, err, "could not listen on socket")
+	require.Empty(t, o.History())
+
+	c, err := net.Dial(o.Addr().Network(), o.Addr().String())
+	require.NoError(t, err)
+	defer c.Close()
+	_, err = c.Write([]byte(`{"status": "created"}{"status": "running", "pid": 42}{"status": "created"}`))
+	require.NoError(t, err)
+
+	for range o.States() {
+	}
+	history := o.History()
+	require.Len(t, history, 2)
+	require.Equal(t, StateRunning, history[0].State)
+	require.Equal(t, 42, history[0].Pid)
+	require.False(t, history[0].Time.IsZero())
+	require.Equal(t, StateCreated, history[1].State)
+	require.Equal(t, &TransitionError{From: StateRunning, To: StateCreated}, history[1].Err)
+
+	// history is a copy
+	history[0].State = StateExited
+	require.Equal(t, StateRunning, o.History()[0].State)
+}
+
+func TestObserver_Durations(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// each state lasts as long as its hook advances the clock
+	clock := &testClock{now: time.Date(2019, 1, 1, 0, 0, 0, 0, time.UTC)}
+	advance := func(d time.Duration) func(StateEvent) error {
+		return func(StateEvent) error {
+			clock.Advance(d)
+			return nil
+		}
+	}
+	o, err := Observe(ctx, "",
+		WithClock(clock.Now),
+		OnState(StatePreparing, advance(5*time.Second)),
+		OnState(StateCreating, advance(time.Second)),
+		OnState(StateCreated, advance(2*time.Second)),
+		OnState(StateRunning, advance(3*time.Second)),
+		OnState(StatePaused, advance(4*time.Second)),
+	)
+	require.NoError(t, err, "could not listen on socket")
+	require.Empty(t, o.Durations())
+
+	require.NoError(t, PushState(ctx, o.Addr().String(),
+		StatePreparing, StateCreating, StateCreated, StateRunning, StatePaused, StateRunning, StateExited))
+	for range o.States() {
+	}
+
+	durations := o.Durations()
+	require.Equal(t, map[State]time.Duration{
+		StatePreparing: 5 * time.Second,
+		StateCreating:  time.Second,
+		StateCreated:   2 * time.Second,
+		// running is entered twice
+		StateRunning: 6 * time.Second,
+		StatePaused:  4 * time.Second,
+	}, durations)
+	require.Zero(t, durations[StateResumed])
+	require.Zero(t, durations[StateExited])
+}
+
+func TestObserver_Lifetime(t *testing.T) {
+	tt := []struct {
+		name       string
+		states     []State
+		expect     time.Duration
+		expectDone bool
+	}{
+		{
+			name:       "exited",
+			states:     []State{StateCreating, StateCreated, StateRunning, StateExited},
+			expect:     6 * time.Second,
+			expectDone: true,
+		},
+		{
+			name:   "still running",
+			states: []State{StateCreating, StateCreated, StateRunning},
+			// time since creating, including the time spent running so far
+			expect: 10 * time.Second,
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			clock := &testClock{now: time.Date(2019, 1, 1, 0, 0, 0, 0, time.UTC)}
+			advance := func(d time.Duration) func(StateEvent) error {
+				return func(StateEvent) error {
+					clock.Advance(d)
+					return nil
+				}
+			}
+			o, err := Observe(ctx, "",
+				WithClock(clock.Now),
+				OnState(StateCreating, advance(time.Second)),
+				OnState(StateCreated, advance(2*time.Second)),
+				OnState(StateRunning, advance(3*time.Second)),
+			)
+			require.NoError(t, err, "could not listen on socket")
+			lifetime, done := o.Lifetime()
+			require.Zero(t, lifetime)
+			require.False(t, done)
+
+			require.NoError(t, PushState(ctx, o.Addr().String(), tc.states...))
+			for range tc.states {
+				<-o.States()
+			}
+			if tc.expectDone {
+				// exited state is accounted once it is passed
+				<-o.Done()
+			} else {
+				clock.Advance(4 * time.Second)
+			}
+			lifetime, done = o.Lifetime()
+			require.Equal(t, tc.expect, lifetime)
+			require.Equal(t, tc.expectDone, done)
+		})
+	}
+}
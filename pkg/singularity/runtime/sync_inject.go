@@ -0,0 +1,124 @@
+// Copyright (c) 2018-2019 Sylabs, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package runtime
+
+import (
+	"context"
+	"fmt"
+)
+
+// ErrInjectionDisabled is returned by Inject unless
+// state injection is enabled with WithStateInjection.
+var ErrInjectionDisabled = fmt.Errorf("state injection is disabled")
+
+// WithStateInjection enables Observer.Inject, e.g. for admin tools that need
+// to force the container out of a state a dead runtime has left it in.
+// State injection is disabled by default.
+func WithStateInjection() ObserveOption {
+	return func(o *observer) {
+		o.inject = make(chan injection)
+	}
+}
+
+// injection is the state passed with Observer.Inject.
+type injection struct {
+	state State
+	// done receives the error the state is handled with.
+	done chan error
+}
+
+// Inject passes state to the channel as if it was reported by the runtime,
+// e.g. to make CRI believe a wedged container has exited so that it is
+// rescheduled, without waiting for the runtime. The event is flagged with
+// StateEvent.Injected and a warning is logged for audit. Injected state is
+// handled the same way as the reported one, i.e. it is validated, passed to
+// hooks and may stop observation, in which case the error observation is
+// stopped with, if any, is returned.
+//
+// Inject overrides what the runtime reports, so the container may still be
+// running after StateExited is injected, with its resources left behind, and
+// states runtime reports later are handled as usual or dropped once
+// observation is over. It is meant for incident response only.
+//
+// ErrInjectionDisabled is returned unless injection is enabled with
+// WithStateInjection, ErrObservationOver if observation is over.
+func (o *Observer) Inject(state State) error {
+	return o.observer().injectState(state)
+}
+
+func (o *observer) injectState(state State) error {
+	if o.inject == nil {
+		return ErrInjectionDisabled
+	}
+	if state == StateUnknown {
+		return fmt.Errorf("could not inject %v state", state)
+	}
+	req := injection{state: state, done: make(chan error, 1)}
+	select {
+	case o.inject <- req:
+	case <-o.done:
+		return ErrObservationOver
+	}
+	return <-req.done
+}
+
+// serveInjections handles injected states until ctx is done or injected
+// state stops observation, in which case stop is called. Once it is over
+// the error observation is stopped with, if any, is passed to the returned
+// channel.
+func (o *observer) serveInjections(ctx, sendCtx context.Context, stop context.CancelFunc) <-chan error {
+	errc := make(chan error, 1)
+	go func() {
+		var err error
+		defer func() {
+			errc <- err
+		}()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case req := <-o.inject:
+				over, herr := o.handleInjection(sendCtx, req.state)
+				req.done <- herr
+				if over {
+					if herr != ErrObservationOver {
+						err = herr
+					}
+					stop()
+					return
+				}
+			}
+		}
+	}()
+	return errc
+}
+
+// handleInjection passes injected state to the channel.
+func (o *observer) handleInjection(sendCtx context.Context, state State) (bool, error) {
+	o.handleMu.Lock()
+	defer o.handleMu.Unlock()
+	if o.finished {
+		return true, ErrObservationOver
+	}
+
+	o.log.Warningf("Injecting %v state at %s manually", state, o.socket)
+	status := StatusString(state)
+	return o.handleEvent(sendCtx, StateEvent{
+		State:    state,
+		Status:   status,
+		Time:     o.now(),
+		Injected: true,
+	})
+}
@@ -0,0 +1,112 @@
+// Copyright (c) 2018-2019 Sylabs, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package runtime
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestObserver_Inject(t *testing.T) {
+	tt := []struct {
+		name      string
+		opts      []ObserveOption
+		inject    State
+		expect    []State
+		expectErr error
+	}{
+		{
+			name:      "disabled",
+			inject:    StateExited,
+			expect:    []State{StateRunning},
+			expectErr: ErrInjectionDisabled,
+		},
+		{
+			name:   "exited",
+			opts:   []ObserveOption{WithStateInjection()},
+			inject: StateExited,
+			expect: []State{StateRunning, StateExited},
+		},
+		{
+			name:   "paused",
+			opts:   []ObserveOption{WithStateInjection()},
+			inject: StatePaused,
+			expect: []State{StateRunning, StatePaused},
+		},
+		{
+			name:      "invalid transition",
+			opts:      []ObserveOption{WithStateInjection(), WithStrictTransitions()},
+			inject:    StateCreating,
+			expect:    []State{StateRunning},
+			expectErr: &TransitionError{From: StateRunning, To: StateCreating},
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			o, err := Observe(ctx, "", tc.opts...)
+			require.NoError(t, err, "could not listen on socket")
+			defer o.Close()
+			require.NoError(t, PushState(ctx, o.Addr().String(), StateRunning))
+			require.Equal(t, StateRunning, <-o.States())
+
+			require.Equal(t, tc.expectErr, o.Inject(tc.inject))
+			actual := []State{StateRunning}
+			if tc.expectErr == nil {
+				actual = append(actual, <-o.States())
+			}
+			require.Equal(t, tc.expect, actual)
+
+			history := o.History()
+			last := history[len(history)-1]
+			// event of rejected injected state is flagged as well
+			require.Equal(t, tc.expectErr != ErrInjectionDisabled, last.Injected)
+			if tc.expectErr == nil {
+				require.Equal(t, tc.inject, last.State)
+			}
+		})
+	}
+}
+
+func TestObserver_InjectOver(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	o, err := Observe(ctx, "", WithStateInjection())
+	require.NoError(t, err, "could not listen on socket")
+	require.Error(t, o.Inject(StateUnknown))
+	require.NoError(t, o.Inject(StateExited))
+	_, ok := <-o.States()
+	require.True(t, ok)
+	_, ok = <-o.States()
+	require.False(t, ok, "channel is not closed")
+	require.NoError(t, o.Err())
+	require.Equal(t, ErrObservationOver, o.Inject(StateRunning))
+
+	o, err = Observe(ctx, "", WithStateInjection(), WithStrictTransitions())
+	require.NoError(t, err, "could not listen on socket")
+	require.NoError(t, PushState(ctx, o.Addr().String(), StateRunning))
+	require.Equal(t, StateRunning, <-o.States())
+	err = o.Inject(StateCreating)
+	require.Equal(t, &TransitionError{From: StateRunning, To: StateCreating}, err)
+	for range o.States() {
+	}
+	require.Equal(t, err, o.Err())
+}
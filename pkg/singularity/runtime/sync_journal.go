@@ -0,0 +1,205 @@
+// Copyright (c) 2018-2019 Sylabs, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package runtime
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+)
+
+// DefaultJournalSize is the default size in bytes journal
+// file may grow to before it is rotated, see WithJournal.
+const DefaultJournalSize = 1 << 20
+
+// WithJournal makes observer append each state passed to the channel to
+// the file at path as MirrorEvent followed by a newline, so that the last
+// known state of the container survives restart of the process and may be
+// read back with LoadHistory. Journal is opened once observation is started
+// and is appended to, so observations of the same container, e.g. after
+// Observer is reset, share it. Once file would grow beyond maxSize bytes it
+// is renamed to path with ".1" suffix, replacing the previous one, and a new
+// file is started. Non-positive maxSize means DefaultJournalSize is used.
+// Failure to write the journal is logged and does not stop observation.
+// It is only available for observations on sockets the observer listens
+// on. By default states are not journaled.
+func WithJournal(path string, maxSize int64) ObserveOption {
+	return func(o *observer) {
+		if maxSize <= 0 {
+			maxSize = DefaultJournalSize
+		}
+		o.journalPath = path
+		o.journalSize = maxSize
+	}
+}
+
+// LoadHistory reads events journaled at path, see WithJournal, in the order
+// they were received, starting with the rotated file if present. Since
+// process may be killed in the middle of writing an event, incomplete last
+// line of the journal is ignored. Error satisfying os.IsNotExist is returned
+// if nothing is journaled at path.
+func LoadHistory(path string) ([]StateEvent, error) {
+	old, err := loadJournal(path + journalRotatedSuffix)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	events, err := loadJournal(path)
+	if os.IsNotExist(err) && old != nil {
+		return old, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return append(old, events...), nil
+}
+
+// journalRotatedSuffix is appended to the path of the rotated journal.
+const journalRotatedSuffix = ".1"
+
+// loadJournal reads events from a single journal file.
+func loadJournal(path string) ([]StateEvent, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	events := []StateEvent{}
+	r := bufio.NewReader(f)
+	for line := 1; ; line++ {
+		data, err := r.ReadBytes('\n')
+		if len(data) > 0 && data[len(data)-1] != '\n' {
+			// incomplete last event
+			return events, nil
+		}
+		if err != nil {
+			return events, nil
+		}
+		var e MirrorEvent
+		if err := json.Unmarshal(data, &e); err != nil {
+			return nil, fmt.Errorf("invalid journal %s line %d: %v", path, line, err)
+		}
+		events = append(events, e.event())
+	}
+}
+
+// journal appends events to the journal file rotating it when necessary.
+type journal struct {
+	path    string
+	maxSize int64
+
+	mu   sync.Mutex
+	f    *os.File
+	size int64
+}
+
+// openJournal opens the journal file at path for appending.
+func openJournal(path string, maxSize int64) (*journal, error) {
+	j := &journal{path: path, maxSize: maxSize}
+	if err := j.open(); err != nil {
+		return nil, err
+	}
+	return j, nil
+}
+
+func (j *journal) open() error {
+	f, err := os.OpenFile(j.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	j.f, j.size = f, fi.Size()
+	return nil
+}
+
+// write appends event to the journal.
+func (j *journal) write(e MirrorEvent) error {
+	data, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	data = append(data, '\n')
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if j.f == nil {
+		return fmt.Errorf("journal is closed")
+	}
+	if j.size > 0 && j.size+int64(len(data)) > j.maxSize {
+		if err := j.rotate(); err != nil {
+			return fmt.Errorf("could not rotate journal: %v", err)
+		}
+	}
+	n, err := j.f.Write(data)
+	j.size += int64(n)
+	return err
+}
+
+// rotate moves the journal file aside and starts a new one.
+func (j *journal) rotate() error {
+	j.f.Close()
+	j.f = nil
+	if err := os.Rename(j.path, j.path+journalRotatedSuffix); err != nil {
+		return err
+	}
+	return j.open()
+}
+
+func (j *journal) close() {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if j.f != nil {
+		j.f.Close()
+		j.f = nil
+	}
+}
+
+// startJournal opens the journal if it is set.
+func (o *observer) startJournal() error {
+	if o.journalPath == "" {
+		return nil
+	}
+	j, err := openJournal(o.journalPath, o.journalSize)
+	if err != nil {
+		return fmt.Errorf("could not open journal: %v", err)
+	}
+	o.journal = j
+	return nil
+}
+
+// journalEvent appends event that was passed to the channel to
+// the journal. Events carrying an error are not journaled.
+func (o *observer) journalEvent(event StateEvent) {
+	if o.journal == nil || event.Err != nil {
+		return
+	}
+	if err := o.journal.write(newMirrorEvent(o.containerID, event)); err != nil {
+		o.log.Warningf("Could not journal state %v at %s: %v", event.State, o.journalPath, err)
+	}
+}
+
+// stopJournal closes the journal if it is opened.
+func (o *observer) stopJournal() {
+	if o.journal == nil {
+		return
+	}
+	o.journal.close()
+}
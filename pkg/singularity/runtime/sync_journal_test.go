@@ -0,0 +1,167 @@
+// Copyright (c) 2018-2019 Sylabs, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package runtime
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestObserveState_Journal(t *testing.T) {
+	defer checkLeaks(t)()
+
+	dir, err := ioutil.TempDir("", "journal-")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "journal")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// journal is appended to by the next observation, e.g. after restart
+	for _, states := range [][]State{
+		{StateCreated, StateRunning},
+		{StateExited},
+	} {
+		o, err := Observe(ctx, "", WithJournal(path, 0), WithContainerID("test"))
+		require.NoError(t, err, "could not listen on socket")
+		require.NoError(t, PushState(ctx, o.Addr().String(), states...))
+		for _, state := range states {
+			require.Equal(t, state, <-o.States())
+		}
+		require.NoError(t, o.Close())
+	}
+
+	events, err := LoadHistory(path)
+	require.NoError(t, err)
+	var states []State
+	for _, event := range events {
+		require.False(t, event.Time.IsZero())
+		states = append(states, event.State)
+	}
+	require.Equal(t, []State{StateCreated, StateRunning, StateExited}, states)
+	require.Equal(t, "stopped", events[2].Status)
+}
+
+func TestJournal_Rotate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "journal-")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "journal")
+
+	at := time.Date(2019, 1, 1, 0, 0, 0, 0, time.UTC)
+	line, err := json.Marshal(MirrorEvent{State: StateRunning, Time: at, Pid: 1})
+	require.NoError(t, err)
+
+	// each file fits a single event
+	j, err := openJournal(path, int64(2*len(line)))
+	require.NoError(t, err)
+	for pid := 1; pid <= 3; pid++ {
+		require.NoError(t, j.write(MirrorEvent{State: StateRunning, Time: at, Pid: pid}))
+	}
+	j.close()
+	require.Error(t, j.write(MirrorEvent{State: StateExited}))
+
+	events, err := LoadHistory(path)
+	require.NoError(t, err)
+	require.Equal(t, []StateEvent{
+		{State: StateRunning, Time: at, Pid: 2},
+		{State: StateRunning, Time: at, Pid: 3},
+	}, events)
+}
+
+func TestLoadHistory(t *testing.T) {
+	at := time.Date(2019, 1, 1, 0, 0, 0, 0, time.UTC)
+	running := `{"state":"running","time":"2019-01-01T00:00:00Z","pid":42}` + "\n"
+	exited := `{"state":"exited","status":"stopped","time":"2019-01-01T00:00:00Z","exitCode":1}` + "\n"
+
+	tt := []struct {
+		name    string
+		rotated string
+		current string
+		expect  []StateEvent
+		err     bool
+	}{
+		{
+			name:    "current only",
+			current: running + exited,
+			expect: []StateEvent{
+				{State: StateRunning, Time: at, Pid: 42},
+				{State: StateExited, Status: "stopped", Time: at, ExitCode: 1},
+			},
+		},
+		{
+			name:    "rotated",
+			rotated: running,
+			current: exited,
+			expect: []StateEvent{
+				{State: StateRunning, Time: at, Pid: 42},
+				{State: StateExited, Status: "stopped", Time: at, ExitCode: 1},
+			},
+		},
+		{
+			name:    "rotated only",
+			rotated: running,
+			expect: []StateEvent{
+				{State: StateRunning, Time: at, Pid: 42},
+			},
+		},
+		{
+			name:    "incomplete last line",
+			current: running + `{"state":"exi`,
+			expect: []StateEvent{
+				{State: StateRunning, Time: at, Pid: 42},
+			},
+		},
+		{
+			name:    "invalid line",
+			current: "{}{\n" + running,
+			err:     true,
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "journal-")
+			require.NoError(t, err)
+			defer os.RemoveAll(dir)
+			path := filepath.Join(dir, "journal")
+
+			if tc.rotated != "" {
+				require.NoError(t, ioutil.WriteFile(path+journalRotatedSuffix, []byte(tc.rotated), 0600))
+			}
+			if tc.current != "" {
+				require.NoError(t, ioutil.WriteFile(path, []byte(tc.current), 0600))
+			}
+			events, err := LoadHistory(path)
+			if tc.err {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tc.expect, events)
+		})
+	}
+
+	_, err := LoadHistory(filepath.Join(os.TempDir(), "no-such-journal"))
+	require.True(t, os.IsNotExist(err))
+}
@@ -0,0 +1,105 @@
+// Copyright (c) 2018-2019 Sylabs, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package runtime
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// leakSettle is how long leak checks wait for goroutines to exit
+// and file descriptors to be closed once test is over.
+const leakSettle = time.Second
+
+// openFDs returns number of file descriptors currently open by the process.
+func openFDs(t *testing.T) int {
+	fds, ok := countFDs()
+	if !ok {
+		t.Skipf("could not count open file descriptors")
+	}
+	return fds
+}
+
+// countFDs returns number of file descriptors currently open by the process
+// and false if they could not be counted. Log files glog opens on the first
+// message of each severity are kept open until the process exits, so they
+// are not counted.
+func countFDs() (int, bool) {
+	fds, err := ioutil.ReadDir("/proc/self/fd")
+	if err != nil {
+		return 0, false
+	}
+	logPrefix := filepath.Base(os.Args[0]) + "."
+	n := 0
+	for _, fd := range fds {
+		path, _ := os.Readlink(filepath.Join("/proc/self/fd", fd.Name()))
+		name := filepath.Base(path)
+		if strings.HasPrefix(name, logPrefix) && strings.Contains(name, ".log.") {
+			continue
+		}
+		n++
+	}
+	return n, true
+}
+
+// requireNoLeaks waits for goroutines to exit and file descriptors to be
+// closed and fails if there are more of them than there were initially.
+// Negative fds means file descriptors are not checked.
+func requireNoLeaks(t *testing.T, goroutines, fds int) {
+	leaked := func() (int, int) {
+		open, ok := countFDs()
+		if !ok || fds < 0 {
+			open = fds
+		}
+		return runtime.NumGoroutine(), open
+	}
+	deadline := time.Now().Add(leakSettle)
+	n, open := leaked()
+	for (n > goroutines || open > fds) && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+		n, open = leaked()
+	}
+	require.True(t, n <= goroutines,
+		"goroutines leaked: %d running, %d expected", n, goroutines)
+	require.True(t, open <= fds,
+		"file descriptors leaked: %d open, %d expected", open, fds)
+}
+
+// checkLeaks records number of goroutines and open file descriptors and
+// returns func that fails the test unless they are back to the recorded
+// numbers shortly after, i.e. once observation is over. It should be
+// deferred first, so that the check runs once test's own cleanup is done:
+//
+//	defer checkLeaks(t)()
+func checkLeaks(t *testing.T) func() {
+	goroutines := runtime.NumGoroutine()
+	fds, ok := countFDs()
+	if !ok {
+		fds = -1
+	}
+	return func() {
+		if t.Failed() {
+			return
+		}
+		requireNoLeaks(t, goroutines, fds)
+	}
+}
@@ -0,0 +1,138 @@
+// Copyright (c) 2018-2019 Sylabs, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package runtime
+
+import (
+	"sync"
+
+	"github.com/golang/glog"
+)
+
+// Logger is used by state observer to report what is going on.
+type Logger interface {
+	// Debugf logs per event details useful for troubleshooting.
+	Debugf(format string, args ...interface{})
+	// Warningf logs unexpected but recoverable situations.
+	Warningf(format string, args ...interface{})
+	// Errorf logs errors that stop observation.
+	Errorf(format string, args ...interface{})
+}
+
+// WithLogger sets logger that is used by observer. By default
+// messages are logged with glog and debug messages, which are emitted
+// for every received state, are only logged with -v=4 or higher.
+func WithLogger(log Logger) ObserveOption {
+	return func(o *observer) {
+		o.log = log
+	}
+}
+
+// WithContainerID sets ID of the observed container. If set,
+// every logged message is prefixed with this ID.
+func WithContainerID(id string) ObserveOption {
+	return func(o *observer) {
+		o.containerID = id
+	}
+}
+
+// QuiescentLogger passes messages to the underlying Logger until it is
+// quiesced, e.g. once shutdown begins, so that observer goroutines that are
+// still running do not write to the log that is being torn down.
+type QuiescentLogger struct {
+	gatedLogger
+}
+
+// NewQuiescentLogger returns QuiescentLogger that passes messages to log.
+func NewQuiescentLogger(log Logger) *QuiescentLogger {
+	return &QuiescentLogger{gatedLogger{Logger: log, gate: &logGate{}}}
+}
+
+// Quiesce stops passing messages to the underlying logger. Once Quiesce
+// returns no message is being written and no further one will be.
+func (l *QuiescentLogger) Quiesce() {
+	l.gate.quiesce()
+}
+
+// logGate stops logging of all loggers gated by it at once.
+type logGate struct {
+	mu    sync.RWMutex
+	quiet bool
+}
+
+// do calls fn unless gate is quiesced.
+func (g *logGate) do(fn func()) {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+	if !g.quiet {
+		fn()
+	}
+}
+
+// quiesce waits for messages being written and stops further ones.
+func (g *logGate) quiesce() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.quiet = true
+}
+
+// gatedLogger passes messages to Logger until gate is quiesced.
+type gatedLogger struct {
+	Logger
+	gate *logGate
+}
+
+func (l gatedLogger) Debugf(format string, args ...interface{}) {
+	l.gate.do(func() { l.Logger.Debugf(format, args...) })
+}
+
+func (l gatedLogger) Warningf(format string, args ...interface{}) {
+	l.gate.do(func() { l.Logger.Warningf(format, args...) })
+}
+
+func (l gatedLogger) Errorf(format string, args ...interface{}) {
+	l.gate.do(func() { l.Logger.Errorf(format, args...) })
+}
+
+type glogLogger struct{}
+
+func (glogLogger) Debugf(format string, args ...interface{}) {
+	glog.V(4).Infof(format, args...)
+}
+
+func (glogLogger) Warningf(format string, args ...interface{}) {
+	glog.Warningf(format, args...)
+}
+
+func (glogLogger) Errorf(format string, args ...interface{}) {
+	glog.Errorf(format, args...)
+}
+
+// taggedLogger prefixes every message with a tag.
+type taggedLogger struct {
+	Logger
+	tag string
+}
+
+func (l taggedLogger) Debugf(format string, args ...interface{}) {
+	l.Logger.Debugf("%s: "+format, append([]interface{}{l.tag}, args...)...)
+}
+
+func (l taggedLogger) Warningf(format string, args ...interface{}) {
+	l.Logger.Warningf("%s: "+format, append([]interface{}{l.tag}, args...)...)
+}
+
+func (l taggedLogger) Errorf(format string, args ...interface{}) {
+	l.Logger.Errorf("%s: "+format, append([]interface{}{l.tag}, args...)...)
+}
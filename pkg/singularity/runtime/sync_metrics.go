@@ -0,0 +1,107 @@
+// Copyright (c) 2018-2019 Sylabs, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package runtime
+
+import (
+	"time"
+)
+
+// Metrics is used by observer to report state transitions of the observed
+// container. It is intended to be implemented by adapters to monitoring
+// systems, e.g. Prometheus counters and histograms labeled by container ID.
+type Metrics interface {
+	// StateObserved is called for each state passed to the channel.
+	StateObserved(containerID string, state State)
+	// StartupLatency is called when container moves from
+	// StateCreated to StateRunning with the time it took.
+	StartupLatency(containerID string, latency time.Duration)
+}
+
+// DefaultSlowSendThreshold is the default time passing a state
+// to the channel may block before a warning is logged.
+const DefaultSlowSendThreshold = time.Second
+
+// BackpressureMetrics may be additionally implemented by Metrics
+// to learn how long observer was blocked by a slow consumer. Reading
+// from the socket is stalled while observer waits for the consumer.
+type BackpressureMetrics interface {
+	// SendBlocked is called for each state passed to the channel
+	// with the time it took the consumer to receive it.
+	SendBlocked(containerID string, blocked time.Duration)
+}
+
+// ConnMetrics may be additionally implemented by Metrics to learn how much
+// data was received over each sync connection, e.g. to find a runtime that
+// floods the socket.
+type ConnMetrics interface {
+	// ConnClosed is called once sync connection is closed with
+	// the number of decoded status objects and bytes read.
+	ConnClosed(containerID string, objects, bytes int64)
+}
+
+// WithMetrics sets metrics observer reports to. By default
+// nothing is reported. Container ID reported along with metrics
+// is the one set with WithContainerID.
+func WithMetrics(m Metrics) ObserveOption {
+	return func(o *observer) {
+		o.metrics = m
+	}
+}
+
+// WithSlowSendThreshold sets how long passing a state to the channel may
+// block waiting for the consumer before a warning is logged. Zero or negative
+// value disables the warning. Default is DefaultSlowSendThreshold.
+func WithSlowSendThreshold(d time.Duration) ObserveOption {
+	return func(o *observer) {
+		o.slowSend = d
+	}
+}
+
+// reportBlocked reports how long passing event to the channel was blocked.
+func (o *observer) reportBlocked(event StateEvent, blocked time.Duration) {
+	if o.slowSend > 0 && blocked > o.slowSend {
+		o.log.Warningf("Consumer blocked %v state for %v, socket %s is not read meanwhile",
+			event.State, blocked, o.socket)
+	}
+	if m, ok := o.metrics.(BackpressureMetrics); ok {
+		m.SendBlocked(o.containerID, blocked)
+	}
+}
+
+// reportConn reports how much data was received over closed connection.
+func (o *observer) reportConn(objects, bytes int64) {
+	o.log.Debugf("Sync connection at %s closed: %d status objects decoded, %d bytes read", o.socket, objects, bytes)
+	if m, ok := o.metrics.(ConnMetrics); ok {
+		m.ConnClosed(o.containerID, objects, bytes)
+	}
+}
+
+// reportMetrics reports event that was passed to the channel.
+func (o *observer) reportMetrics(event StateEvent) {
+	if o.metrics == nil {
+		return
+	}
+
+	o.metrics.StateObserved(o.containerID, event.State)
+	switch event.State {
+	case StateCreated:
+		o.createdAt = event.Time
+	case StateRunning:
+		if !o.createdAt.IsZero() {
+			o.metrics.StartupLatency(o.containerID, event.Time.Sub(o.createdAt))
+			o.createdAt = time.Time{}
+		}
+	}
+}
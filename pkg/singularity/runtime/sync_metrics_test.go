@@ -0,0 +1,190 @@
+// Copyright (c) 2018-2019 Sylabs, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package runtime
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/sylabs/singularity/pkg/util/unix"
+)
+
+type testMetrics struct {
+	mu          sync.Mutex
+	states      []State
+	latency     []time.Duration
+	blocked     []time.Duration
+	conns       [][2]int64
+	containerID string
+}
+
+func (m *testMetrics) StateObserved(containerID string, state State) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.containerID = containerID
+	m.states = append(m.states, state)
+}
+
+func (m *testMetrics) StartupLatency(containerID string, latency time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.latency = append(m.latency, latency)
+}
+
+func (m *testMetrics) SendBlocked(containerID string, blocked time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.blocked = append(m.blocked, blocked)
+}
+
+func (m *testMetrics) ConnClosed(containerID string, objects, bytes int64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.conns = append(m.conns, [2]int64{objects, bytes})
+}
+
+func TestObserveState_Metrics(t *testing.T) {
+	defer checkLeaks(t)()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	socket := filepath.Join(os.TempDir(), fmt.Sprintf("cri-test-%s.sock", t.Name()))
+
+	m := &testMetrics{}
+	state, err := ObserveState(ctx, socket, WithMetrics(m), WithContainerID("test-id"))
+	require.NoError(t, err, "could not listen on socket")
+	go func(t *testing.T) {
+		for _, status := range []string{"creating", "created", "running", "stopped"} {
+			c, err := unix.Dial(socket)
+			require.NoError(t, err)
+			_, err = c.Write([]byte(fmt.Sprintf(`{"status": %q}`, status)))
+			assert.NoError(t, err)
+			assert.NoError(t, c.Close())
+			time.Sleep(time.Millisecond)
+		}
+	}(t)
+
+	for range state {
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	assert.Equal(t, "test-id", m.containerID)
+	assert.Equal(t, []State{StateCreating, StateCreated, StateRunning, StateExited}, m.states)
+	require.Len(t, m.latency, 1)
+	assert.True(t, m.latency[0] > 0)
+	assert.Equal(t, [][2]int64{{1, 22}, {1, 21}, {1, 21}, {1, 21}}, m.conns)
+}
+
+func TestObserveState_Backpressure(t *testing.T) {
+	defer checkLeaks(t)()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	socket := filepath.Join(os.TempDir(), fmt.Sprintf("cri-test-%s.sock", t.Name()))
+
+	m := &testMetrics{}
+	log := &testLogger{}
+	state, err := ObserveState(ctx, socket,
+		WithMetrics(m),
+		WithLogger(log),
+		WithContainerID("test-id"),
+		WithBufferSize(0),
+		WithSlowSendThreshold(10*time.Millisecond),
+	)
+	require.NoError(t, err, "could not listen on socket")
+	go func(t *testing.T) {
+		c, err := unix.Dial(socket)
+		require.NoError(t, err)
+		_, err = c.Write([]byte(`{"status": "running"} {"status": "stopped"}`))
+		assert.NoError(t, err)
+		assert.NoError(t, c.Close())
+	}(t)
+
+	time.Sleep(50 * time.Millisecond)
+	require.Equal(t, StateRunning, <-state)
+	require.Equal(t, StateExited, <-state)
+	_, ok := <-state
+	require.False(t, ok)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	require.Len(t, m.blocked, 2)
+	assert.True(t, m.blocked[0] >= 30*time.Millisecond, "blocked for %v", m.blocked[0])
+
+	var warnings int
+	for _, msg := range log.Messages() {
+		if strings.HasPrefix(msg, "W test-id: Consumer blocked running state") {
+			warnings++
+		}
+	}
+	assert.Equal(t, 1, warnings, "unexpected messages %q", log.Messages())
+}
+
+// testClock is a clock that only moves when advanced.
+type testClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func (c *testClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *testClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+}
+
+func TestObserveStateEvents_Clock(t *testing.T) {
+	defer checkLeaks(t)()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	clock := &testClock{now: time.Date(2019, 1, 1, 0, 0, 0, 0, time.UTC)}
+	advance := func(StateEvent) error {
+		clock.Advance(250 * time.Millisecond)
+		return nil
+	}
+	m := &testMetrics{}
+	o := newObserver("", WithClock(clock.Now), WithMetrics(m), OnState(StateCreated, advance))
+	o.events = make(chan StateEvent, o.bufferSize)
+	require.NoError(t, o.start(ctx), "could not listen on socket")
+	require.NoError(t, PushState(ctx, o.addr.String(), StateCreated, StateRunning, StateExited))
+
+	var times []time.Time
+	for event := range o.events {
+		times = append(times, event.Time)
+	}
+	start := time.Date(2019, 1, 1, 0, 0, 0, 0, time.UTC)
+	require.Equal(t, []time.Time{start, start.Add(250 * time.Millisecond), start.Add(250 * time.Millisecond)}, times)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	require.Equal(t, []time.Duration{250 * time.Millisecond}, m.latency)
+	require.Equal(t, []time.Duration{0, 0, 0}, m.blocked)
+}
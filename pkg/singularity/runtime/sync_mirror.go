@@ -0,0 +1,235 @@
+// Copyright (c) 2018-2019 Sylabs, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package runtime
+
+import (
+	"encoding/json"
+	"errors"
+	"net"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	// mirrorBufferSize is the number of states queued for each mirror
+	// client, states sent to a client with a full queue are dropped.
+	mirrorBufferSize = 64
+	// mirrorFlushTimeout bounds the time states queued for a mirror
+	// client are written once observation is over.
+	mirrorFlushTimeout = time.Second
+)
+
+// MirrorEvent is the JSON object written to mirror clients
+// for each state passed to the channel, see WithMirror.
+type MirrorEvent struct {
+	ContainerID string    `json:"containerId,omitempty"`
+	State       State     `json:"state"`
+	Status      string    `json:"status,omitempty"`
+	Time        time.Time `json:"time"`
+	Pid         int       `json:"pid,omitempty"`
+	ExitCode    int       `json:"exitCode,omitempty"`
+	Signal      int       `json:"signal,omitempty"`
+	Inferred    bool      `json:"inferred,omitempty"`
+	Injected    bool      `json:"injected,omitempty"`
+	Snapshot    bool      `json:"snapshot,omitempty"`
+}
+
+// WithMirror makes observer listen on the passed socket and write each state
+// passed to the channel to every connected client as MirrorEvent followed by a
+// newline, e.g. for node exporters that do not embed this package. Socket may
+// be specified in the same forms ObserveState accepts. Slow clients never block
+// observation, states are dropped once client's queue is full. Mirror is closed
+// once observation is over. It is only available for observations on sockets
+// the observer listens on. By default states are not mirrored.
+func WithMirror(socket string) ObserveOption {
+	return func(o *observer) {
+		o.mirrorSocket = socket
+	}
+}
+
+// mirror passes events to its clients.
+type mirror struct {
+	ln  net.Listener
+	log Logger
+
+	mu      sync.Mutex
+	closed  bool
+	clients map[*mirrorClient]struct{}
+}
+
+// mirrorClient is a single connection to the mirror.
+type mirrorClient struct {
+	conn    net.Conn
+	events  chan MirrorEvent
+	dropped int
+}
+
+// startMirror starts listening on the mirror socket if it is set.
+func (o *observer) startMirror() error {
+	if o.mirrorSocket == "" {
+		return nil
+	}
+	ln, err := listenSocket(o.mirrorSocket, o.listenConfig)
+	if err != nil {
+		return err
+	}
+	m := &mirror{
+		ln:      ln,
+		log:     o.log,
+		clients: make(map[*mirrorClient]struct{}),
+	}
+	go m.accept()
+	o.mirror = m
+	return nil
+}
+
+// mirrorEvent passes event that was passed to the channel to the mirror
+// clients. Events carrying an error are not mirrored.
+func (o *observer) mirrorEvent(event StateEvent) {
+	if o.mirror == nil || event.Err != nil {
+		return
+	}
+	o.mirror.publish(newMirrorEvent(o.containerID, event))
+}
+
+// newMirrorEvent converts event of the container to MirrorEvent.
+func newMirrorEvent(containerID string, event StateEvent) MirrorEvent {
+	return MirrorEvent{
+		ContainerID: containerID,
+		State:       event.State,
+		Status:      event.Status,
+		Time:        event.Time,
+		Pid:         event.Pid,
+		ExitCode:    event.ExitCode,
+		Signal:      event.Signal,
+		Inferred:    event.Inferred,
+		Injected:    event.Injected,
+		Snapshot:    event.Snapshot,
+	}
+}
+
+// event converts e back to StateEvent.
+func (e MirrorEvent) event() StateEvent {
+	return StateEvent{
+		State:    e.State,
+		Status:   e.Status,
+		Time:     e.Time,
+		Pid:      e.Pid,
+		ExitCode: e.ExitCode,
+		Signal:   e.Signal,
+		Inferred: e.Inferred,
+		Injected: e.Injected,
+		Snapshot: e.Snapshot,
+	}
+}
+
+// stopMirror closes the mirror if it is started.
+func (o *observer) stopMirror() {
+	if o.mirror == nil {
+		return
+	}
+	o.mirror.close()
+}
+
+// accept accepts mirror clients until listener is closed.
+func (m *mirror) accept() {
+	for {
+		conn, err := m.ln.Accept()
+		if err != nil {
+			return
+		}
+		c := &mirrorClient{
+			conn:   conn,
+			events: make(chan MirrorEvent, mirrorBufferSize),
+		}
+
+		m.mu.Lock()
+		if m.closed {
+			m.mu.Unlock()
+			conn.Close()
+			return
+		}
+		m.clients[c] = struct{}{}
+		m.mu.Unlock()
+		go m.write(c)
+	}
+}
+
+// write writes events queued for the client until the queue is closed
+// or the client cannot be written to. Client that has disconnected is
+// dropped quietly, it never affects observation.
+func (m *mirror) write(c *mirrorClient) {
+	defer c.conn.Close()
+
+	enc := json.NewEncoder(c.conn)
+	for event := range c.events {
+		err := enc.Encode(event)
+		if isDisconnect(err) {
+			m.log.Debugf("Mirror client at %s has disconnected: %v", m.ln.Addr(), err)
+			break
+		}
+		if err != nil {
+			m.log.Debugf("Closing mirror connection at %s: %v", m.ln.Addr(), err)
+			break
+		}
+	}
+
+	m.mu.Lock()
+	delete(m.clients, c)
+	dropped := c.dropped
+	m.mu.Unlock()
+	if dropped > 0 {
+		m.log.Warningf("Mirror client at %s was too slow, %d states dropped", m.ln.Addr(), dropped)
+	}
+}
+
+// isDisconnect returns true if err tells that the peer has closed
+// connection, i.e. writing to it raises EPIPE or ECONNRESET.
+func isDisconnect(err error) bool {
+	return errors.Is(err, syscall.EPIPE) || errors.Is(err, syscall.ECONNRESET)
+}
+
+// publish queues event for each client without blocking.
+func (m *mirror) publish(event MirrorEvent) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.closed {
+		return
+	}
+	for c := range m.clients {
+		select {
+		case c.events <- event:
+		default:
+			c.dropped++
+		}
+	}
+}
+
+// close stops accepting clients. Events already queued are still written
+// to the connected clients for no longer than mirrorFlushTimeout.
+func (m *mirror) close() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.closed {
+		return
+	}
+	m.closed = true
+	m.ln.Close()
+	for c := range m.clients {
+		c.conn.SetWriteDeadline(time.Now().Add(mirrorFlushTimeout))
+		close(c.events)
+	}
+}
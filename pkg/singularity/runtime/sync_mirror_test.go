@@ -0,0 +1,190 @@
+// Copyright (c) 2018-2019 Sylabs, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package runtime
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// mirrorClients returns number of clients connected to the mirror.
+func mirrorClients(m *mirror) int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return len(m.clients)
+}
+
+func TestObserveState_Mirror(t *testing.T) {
+	defer checkLeaks(t)()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	socket := filepath.Join(os.TempDir(), fmt.Sprintf("cri-test-%s.sock", t.Name()))
+
+	o := newObserver("", WithMirror(socket), WithContainerID("container"))
+	o.states = make(chan State, o.bufferSize)
+	require.NoError(t, o.start(ctx), "could not listen on socket")
+	require.NotNil(t, o.mirror)
+
+	var clients []net.Conn
+	for i := 0; i < 2; i++ {
+		c, err := net.Dial("unix", socket)
+		require.NoError(t, err)
+		defer c.Close()
+		clients = append(clients, c)
+	}
+	for i := 0; i < 100 && mirrorClients(o.mirror) < len(clients); i++ {
+		time.Sleep(time.Millisecond)
+	}
+	require.Equal(t, len(clients), mirrorClients(o.mirror))
+
+	c, err := net.Dial(o.addr.Network(), o.addr.String())
+	require.NoError(t, err)
+	_, err = c.Write([]byte(`{"status": "running", "pid": 42} {"status": "stopped", "exitCode": 3}`))
+	require.NoError(t, err)
+	require.NoError(t, c.Close())
+	for range o.states {
+	}
+
+	for _, c := range clients {
+		r := bufio.NewReader(c)
+		line, err := r.ReadString('\n')
+		require.NoError(t, err)
+		var event MirrorEvent
+		require.NoError(t, json.Unmarshal([]byte(line), &event))
+		require.Equal(t, "container", event.ContainerID)
+		require.Equal(t, StateRunning, event.State)
+		require.Equal(t, "running", event.Status)
+		require.Equal(t, 42, event.Pid)
+		require.False(t, event.Time.IsZero())
+
+		require.NoError(t, json.NewDecoder(r).Decode(&event))
+		require.Equal(t, StateExited, event.State)
+		require.Equal(t, 3, event.ExitCode)
+
+		// mirror is closed once observation is over
+		_, err = r.ReadString('\n')
+		require.Equal(t, io.EOF, err)
+	}
+	require.True(t, os.IsNotExist(os.Remove(socket)), "mirror socket is left")
+}
+
+func TestObserveState_MirrorClientDisconnects(t *testing.T) {
+	defer checkLeaks(t)()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	socket := filepath.Join(os.TempDir(), fmt.Sprintf("cri-test-%s.sock", t.Name()))
+	log := &testLogger{}
+
+	o, err := Observe(ctx, "", WithMirror(socket), WithLogger(log))
+	require.NoError(t, err, "could not listen on socket")
+	m := o.observer().mirror
+	client, err := net.Dial("unix", socket)
+	require.NoError(t, err)
+	for i := 0; i < 100 && mirrorClients(m) < 1; i++ {
+		time.Sleep(time.Millisecond)
+	}
+	require.Equal(t, 1, mirrorClients(m))
+
+	c, err := net.Dial(o.Addr().Network(), o.Addr().String())
+	require.NoError(t, err)
+	defer c.Close()
+	_, err = c.Write([]byte(`{"status": "running"}`))
+	require.NoError(t, err)
+	require.Equal(t, StateRunning, <-o.States())
+	var event MirrorEvent
+	require.NoError(t, json.NewDecoder(client).Decode(&event))
+	require.Equal(t, StateRunning, event.State)
+
+	// consumer goes away, writing to it fails with EPIPE
+	require.NoError(t, client.Close())
+	expect := []State{StatePaused, StateResumed, StatePaused, StateResumed, StateExited}
+	for _, state := range expect {
+		_, err = c.Write([]byte(fmt.Sprintf(`{"status": %q}`, StatusString(state))))
+		require.NoError(t, err)
+		require.Equal(t, state, <-o.States())
+	}
+	_, ok := <-o.States()
+	require.False(t, ok)
+	require.NoError(t, o.Err())
+	for i := 0; i < 100 && mirrorClients(m) > 0; i++ {
+		time.Sleep(time.Millisecond)
+	}
+	require.Zero(t, mirrorClients(m))
+
+	var disconnected bool
+	for _, msg := range log.Messages() {
+		require.False(t, strings.HasPrefix(msg, "W ") || strings.HasPrefix(msg, "E "), "unexpected message: %s", msg)
+		if strings.HasPrefix(msg, "D Mirror client at "+socket+" has disconnected") {
+			disconnected = true
+		}
+	}
+	require.True(t, disconnected, "disconnect is not logged: %v", log.Messages())
+}
+
+func TestMirror_SlowClient(t *testing.T) {
+	log := &testLogger{}
+	server, client := net.Pipe()
+	defer client.Close()
+
+	m := &mirror{clients: make(map[*mirrorClient]struct{}), log: log}
+	c := &mirrorClient{conn: server, events: make(chan MirrorEvent, mirrorBufferSize)}
+	m.clients[c] = struct{}{}
+
+	// nobody writes queued events, publish must not block anyway
+	for i := 0; i < 2*mirrorBufferSize; i++ {
+		m.publish(MirrorEvent{State: StateRunning})
+	}
+	require.Equal(t, mirrorBufferSize, c.dropped)
+}
+
+func TestObserveState_NoMirror(t *testing.T) {
+	defer checkLeaks(t)()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	o := newObserver("")
+	o.states = make(chan State, o.bufferSize)
+	require.NoError(t, o.start(ctx), "could not listen on socket")
+	require.Nil(t, o.mirror)
+}
+
+func TestMirrorEvent_JSON(t *testing.T) {
+	event := MirrorEvent{
+		ContainerID: "container",
+		State:       StateExited,
+		Status:      "stopped",
+		Time:        time.Date(2019, 1, 1, 0, 0, 0, 0, time.UTC),
+		ExitCode:    137,
+		Signal:      9,
+	}
+	data, err := json.Marshal(event)
+	require.NoError(t, err)
+	require.JSONEq(t, `{"containerId": "container", "state": "exited", "status": "stopped",
+		"time": "2019-01-01T00:00:00Z", "exitCode": 137, "signal": 9}`, string(data))
+}
@@ -0,0 +1,226 @@
+// Copyright (c) 2018-2019 Sylabs, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package runtime
+
+import (
+	"context"
+	"fmt"
+	"sync"
+)
+
+// ErrMultiClosed is returned when source is added to MultiObserver
+// that is already closed.
+var ErrMultiClosed = fmt.Errorf("multi observer is closed")
+
+// SourcedState is a state received from the particular source of MultiObserver.
+type SourcedState struct {
+	// ID is the key source was added with, e.g. container ID.
+	ID    string
+	State State
+}
+
+// MultiObserver observes many sync sockets at once and passes their states
+// to a single channel. Each source is identified by the key it was added
+// with. The channel is closed once context is done, Close is called or the
+// last observed source is over, i.e. every source has reached its terminal
+// state, failed or was removed. Sources cannot be added after that.
+type MultiObserver struct {
+	ctx    context.Context
+	cancel context.CancelFunc
+	opts   []ObserveOption
+	states chan SourcedState
+	done   chan struct{}
+	wg     sync.WaitGroup
+
+	mu      sync.Mutex
+	closed  bool
+	sources map[string]context.CancelFunc
+	// current holds the last state of every source,
+	// counts is the distribution of current states
+	current map[string]State
+	counts  map[State]int
+}
+
+// MultiObserve starts observing sockets, which maps source IDs to sockets
+// in the forms ObserveState accepts. Options are applied to every source
+// along with WithContainerID set to the source ID. If any of the sockets
+// cannot be observed, observation of all of them is stopped and the error
+// is returned. When sockets is empty the channel is kept open until the
+// first added source is over.
+func MultiObserve(ctx context.Context, sockets map[string]string, opts ...ObserveOption) (*MultiObserver, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	m := &MultiObserver{
+		ctx:     ctx,
+		cancel:  cancel,
+		opts:    opts,
+		states:  make(chan SourcedState, DefaultBufferSize),
+		done:    make(chan struct{}),
+		sources: make(map[string]context.CancelFunc),
+		current: make(map[string]State),
+		counts:  make(map[State]int),
+	}
+	go m.wait()
+
+	// sources started first must not close the channel
+	// before the rest of them are added
+	m.mu.Lock()
+	for id, socket := range sockets {
+		if err := m.add(id, socket); err != nil {
+			m.mu.Unlock()
+			m.Close()
+			return nil, fmt.Errorf("could not observe %s: %v", id, err)
+		}
+	}
+	m.mu.Unlock()
+	return m, nil
+}
+
+// States returns the channel states of all sources are passed to.
+func (m *MultiObserver) States() <-chan SourcedState {
+	return m.states
+}
+
+// Add starts observing socket identified by id. Source may be
+// added again with the same id once its observation is over.
+func (m *MultiObserver) Add(id, socket string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.add(id, socket)
+}
+
+// add is the same as Add except m.mu should be held by the caller.
+func (m *MultiObserver) add(id, socket string) error {
+	if m.closed {
+		return ErrMultiClosed
+	}
+	if _, ok := m.sources[id]; ok {
+		return fmt.Errorf("source %s is already observed", id)
+	}
+
+	ctx, cancel := context.WithCancel(m.ctx)
+	opts := append([]ObserveOption{WithContainerID(id)}, m.opts...)
+	states, err := ObserveState(ctx, socket, opts...)
+	if err != nil {
+		cancel()
+		return err
+	}
+	m.sources[id] = cancel
+
+	m.wg.Add(1)
+	go m.forward(ctx, id, states)
+	return nil
+}
+
+// Remove stops observing source identified by id. States of the source
+// that are not yet passed to the channel are dropped. Removing the
+// last source closes the channel.
+func (m *MultiObserver) Remove(id string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if cancel, ok := m.sources[id]; ok {
+		cancel()
+	}
+}
+
+// Snapshot returns the number of observed sources in each state, with
+// the last state received from a source counted as its current state.
+// Sources that have not reported any state yet or whose observation is
+// over are not counted. Counts are maintained as states are received,
+// so Snapshot is cheap enough to be called e.g. on every metrics scrape.
+func (m *MultiObserver) Snapshot() map[State]int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	snapshot := make(map[State]int, len(m.counts))
+	for state, n := range m.counts {
+		snapshot[state] = n
+	}
+	return snapshot
+}
+
+// setCurrent records state as the current state of the source.
+func (m *MultiObserver) setCurrent(id string, state State) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.uncount(id)
+	m.current[id] = state
+	m.counts[state]++
+}
+
+// uncount removes the current state of the source from
+// counts. It should be called with m.mu held.
+func (m *MultiObserver) uncount(id string) {
+	prev, ok := m.current[id]
+	if !ok {
+		return
+	}
+	delete(m.current, id)
+	if m.counts[prev]--; m.counts[prev] == 0 {
+		delete(m.counts, prev)
+	}
+}
+
+// Close stops observing all sources and waits for them to be over.
+// The channel is closed once Close returns. It is safe to call
+// Close several times.
+func (m *MultiObserver) Close() {
+	m.cancel()
+	<-m.done
+}
+
+// forward passes states of the source to the channel until source
+// observation is over. Once the last source is over the whole
+// observation is stopped.
+func (m *MultiObserver) forward(ctx context.Context, id string, states <-chan State) {
+	defer m.wg.Done()
+	defer func() {
+		m.mu.Lock()
+		m.sources[id]()
+		delete(m.sources, id)
+		m.uncount(id)
+		if len(m.sources) == 0 {
+			m.closed = true
+			m.cancel()
+		}
+		m.mu.Unlock()
+	}()
+
+	for state := range states {
+		m.setCurrent(id, state)
+		select {
+		case m.states <- SourcedState{ID: id, State: state}:
+		case <-ctx.Done():
+			for range states {
+			}
+			return
+		}
+	}
+}
+
+// wait closes the channel once observation is stopped
+// and all per source goroutines are over.
+func (m *MultiObserver) wait() {
+	<-m.ctx.Done()
+
+	m.mu.Lock()
+	m.closed = true
+	m.mu.Unlock()
+
+	m.wg.Wait()
+	close(m.states)
+	close(m.done)
+}
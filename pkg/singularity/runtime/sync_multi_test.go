@@ -0,0 +1,154 @@
+// Copyright (c) 2018-2019 Sylabs, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package runtime
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/sylabs/singularity/pkg/util/unix"
+)
+
+func multiSocket(t *testing.T, id string) string {
+	return filepath.Join(os.TempDir(), fmt.Sprintf("cri-test-%s-%s.sock", t.Name(), id))
+}
+
+func TestMultiObserve(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	m, err := MultiObserve(ctx, map[string]string{
+		"first":  multiSocket(t, "first"),
+		"second": multiSocket(t, "second"),
+	})
+	require.NoError(t, err)
+	require.Error(t, m.Add("first", multiSocket(t, "other")), "source is observed twice")
+	require.NoError(t, m.Add("third", multiSocket(t, "third")))
+
+	for _, id := range []string{"first", "second", "third"} {
+		require.NoError(t, PushState(ctx, multiSocket(t, id), StateRunning, StateExited))
+		assert.Equal(t, SourcedState{ID: id, State: StateRunning}, <-m.States())
+		assert.Equal(t, SourcedState{ID: id, State: StateExited}, <-m.States())
+	}
+
+	// channel is closed once all sources reach terminal state
+	_, ok := <-m.States()
+	assert.False(t, ok)
+	assert.Equal(t, ErrMultiClosed, m.Add("fourth", multiSocket(t, "fourth")))
+}
+
+func TestMultiObserver_Remove(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	m, err := MultiObserve(ctx, nil)
+	require.NoError(t, err)
+	require.NoError(t, m.Add("first", multiSocket(t, "first")))
+	require.NoError(t, m.Add("second", multiSocket(t, "second")))
+
+	m.Remove("first")
+	m.Remove("unknown")
+	require.NoError(t, PushState(ctx, multiSocket(t, "second"), StateRunning))
+	assert.Equal(t, SourcedState{ID: "second", State: StateRunning}, <-m.States())
+	for {
+		if _, err := os.Stat(multiSocket(t, "first")); os.IsNotExist(err) {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	// removing the last source closes the channel
+	m.Remove("second")
+	for range m.States() {
+	}
+	assert.True(t, os.IsNotExist(os.Remove(multiSocket(t, "second"))))
+}
+
+func TestMultiObserve_Error(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	_, err := MultiObserve(ctx, map[string]string{
+		"good": multiSocket(t, "good"),
+		"bad":  "bogus://socket",
+	})
+	require.Error(t, err)
+	assert.True(t, os.IsNotExist(os.Remove(multiSocket(t, "good"))))
+}
+
+func TestMultiObserver_Close(t *testing.T) {
+	m, err := MultiObserve(context.Background(), map[string]string{"first": multiSocket(t, "first")})
+	require.NoError(t, err)
+
+	conn, err := unix.Dial(multiSocket(t, "first"))
+	require.NoError(t, err)
+	defer conn.Close()
+
+	m.Close()
+	m.Close()
+	_, ok := <-m.States()
+	assert.False(t, ok)
+	assert.True(t, os.IsNotExist(os.Remove(multiSocket(t, "first"))))
+}
+
+func TestMultiObserver_Snapshot(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	pushed := map[string][]State{
+		"creating": {StateCreating},
+		"created":  {StateCreating, StateCreated},
+		"running1": {StateCreating, StateCreated, StateRunning},
+		"running2": {StateCreated, StateRunning},
+		"exited":   {StateRunning, StateExited},
+	}
+	sockets := make(map[string]string, len(pushed)+1)
+	for id := range pushed {
+		sockets[id] = multiSocket(t, id)
+	}
+	sockets["silent"] = multiSocket(t, "silent")
+	m, err := MultiObserve(ctx, sockets)
+	require.NoError(t, err)
+	assert.Empty(t, m.Snapshot())
+
+	for id, states := range pushed {
+		require.NoError(t, PushState(ctx, sockets[id], states...))
+		for _, state := range states {
+			assert.Equal(t, SourcedState{ID: id, State: state}, <-m.States())
+		}
+	}
+
+	// exited source is uncounted once its observation is over
+	expect := map[State]int{
+		StateCreating: 1,
+		StateCreated:  1,
+		StateRunning:  2,
+	}
+	require.Eventually(t, func() bool {
+		return assert.ObjectsAreEqual(expect, m.Snapshot())
+	}, time.Second, time.Millisecond)
+
+	m.Remove("running1")
+	expect[StateRunning] = 1
+	require.Eventually(t, func() bool {
+		return assert.ObjectsAreEqual(expect, m.Snapshot())
+	}, time.Second, time.Millisecond)
+}
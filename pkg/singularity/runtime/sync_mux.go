@@ -0,0 +1,196 @@
+// Copyright (c) 2018-2019 Sylabs, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package runtime
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync"
+)
+
+// ErrMuxClosed is returned when container is subscribed
+// to MuxObserver that is already closed.
+var ErrMuxClosed = fmt.Errorf("mux observer is closed")
+
+// MuxObserver observes states of many containers the runtime multiplexes
+// over connections to a single socket, e.g. to avoid a socket per container
+// on nodes running hundreds of them. Each status object carries ID of the
+// container it describes in the "containerId" field, see syncStatus, and is
+// passed to the channel of that container only, see WithEnvelope for states
+// of several runtimes aggregated by a relay. Container's channel is closed
+// once its own terminal status is received, so connections are kept open for
+// the rest of the containers. Once observation of the socket is over, the
+// channels of all containers are closed.
+type MuxObserver struct {
+	ctx  context.Context
+	o    *observer
+	opts []ObserveOption
+	done chan struct{}
+
+	mu     sync.Mutex
+	closed bool
+	subs   map[muxKey]*observer
+}
+
+// muxKey identifies container observed by MuxObserver. Backend
+// is only set when status objects are wrapped in envelopes.
+type muxKey struct {
+	backend     string
+	containerID string
+}
+
+// ObserveMux starts observing multiplexed states on socket. Options related
+// to listening, accepting and reading connections are applied to the socket,
+// the rest of them, e.g. hooks or strict transitions, are applied to each
+// container along with WithContainerID set to its ID. Socket is observed
+// until ctx is done or an error occurs, see Err.
+//
+// Statuses received over a connection are routed one at a time, so once the
+// channel of a container is full, statuses of other containers sent over the
+// same connection wait until its consumer receives the state or, for the final
+// state, until terminal send timeout expires, see WithTerminalSendTimeout.
+// Consumers should keep reading their channels, otherwise runtime needs to
+// report states of such containers over separate connections.
+func ObserveMux(ctx context.Context, socket string, opts ...ObserveOption) (*MuxObserver, error) {
+	m := &MuxObserver{
+		ctx:  ctx,
+		opts: opts,
+		subs: make(map[muxKey]*observer),
+		done: make(chan struct{}),
+	}
+	m.o = newObserver(socket, opts...)
+	m.o.route = m.route
+	m.o.inferExitOnClose = false
+	// socket level events, e.g. decode errors, are not routed to
+	// any container, they are only drained so that they never block
+	m.o.events = make(chan StateEvent, 1)
+	if err := m.o.start(ctx); err != nil {
+		return nil, err
+	}
+	go m.wait()
+	return m, nil
+}
+
+// States returns the channel states of the container with the passed ID are
+// passed to. Container should be subscribed before runtime reports its states,
+// states of containers nobody is subscribed to are dropped. Container may be
+// subscribed again once its channel is closed, e.g. after it is recreated.
+func (m *MuxObserver) States(containerID string) (<-chan State, error) {
+	return m.BackendStates("", containerID)
+}
+
+// BackendStates is the same as States except it returns the channel of the
+// container of the passed runtime backend, for status objects wrapped in
+// envelopes, see WithEnvelope. Containers of different backends may have
+// the same ID. States of statuses without backend are passed to the channel
+// returned by States.
+func (m *MuxObserver) BackendStates(backend, containerID string) (<-chan State, error) {
+	key := muxKey{backend: backend, containerID: containerID}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.closed {
+		return nil, ErrMuxClosed
+	}
+	if _, ok := m.subs[key]; ok {
+		return nil, fmt.Errorf("container %s is already observed", key)
+	}
+
+	opts := append(append([]ObserveOption{}, m.opts...), WithContainerID(key.String()))
+	sub := newObserver(m.o.socket, opts...)
+	sub.states = make(chan State, sub.bufferSize)
+	sub.release = func() {}
+	sub.startSpan(m.ctx)
+	m.subs[key] = sub
+	return sub.states, nil
+}
+
+// String returns container ID prefixed with backend, if any.
+func (k muxKey) String() string {
+	if k.backend == "" {
+		return k.containerID
+	}
+	return k.backend + "/" + k.containerID
+}
+
+// Addr returns the address the socket is listened on.
+func (m *MuxObserver) Addr() net.Addr {
+	return m.o.addr
+}
+
+// Done returns a channel that is closed once observation of the
+// socket is over and channels of all containers are closed.
+func (m *MuxObserver) Done() <-chan struct{} {
+	return m.done
+}
+
+// Err returns the reason observation of the socket is over, see Observer.Err.
+// Err should be called once Done is closed, before that it returns nil.
+func (m *MuxObserver) Err() error {
+	m.o.mu.Lock()
+	defer m.o.mu.Unlock()
+	return m.o.err
+}
+
+// route passes status to the observer of the container it describes.
+// Observation of the socket is never stopped because of a single container.
+func (m *MuxObserver) route(sendCtx context.Context, status syncStatus) (bool, error) {
+	key := muxKey{backend: status.Backend, containerID: status.ContainerID}
+	m.mu.Lock()
+	sub, ok := m.subs[key]
+	m.mu.Unlock()
+	if !ok {
+		m.o.log.Warningf("Dropping status %q of unknown container %q at %s",
+			status.Status, key, m.o.socket)
+		return false, nil
+	}
+
+	over, err := sub.handle(sendCtx, status)
+	if !over {
+		return false, nil
+	}
+	// statuses of the same container may be handled concurrently,
+	// see WithConnWorkers, only the one that removes it closes it
+	m.mu.Lock()
+	last := m.subs[key] == sub
+	if last {
+		delete(m.subs, key)
+	}
+	m.mu.Unlock()
+	if last {
+		sub.close(m.ctx, err)
+	}
+	return false, nil
+}
+
+// wait closes channels of all containers once observation of the socket
+// is over. No status is routed by then, since connections are closed.
+func (m *MuxObserver) wait() {
+	for range m.o.events {
+	}
+	<-m.o.done
+	err := m.Err()
+
+	m.mu.Lock()
+	m.closed = true
+	subs := m.subs
+	m.subs = nil
+	m.mu.Unlock()
+	for _, sub := range subs {
+		sub.close(m.ctx, err)
+	}
+	close(m.done)
+}
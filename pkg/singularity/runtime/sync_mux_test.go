@@ -0,0 +1,118 @@
+// Copyright (c) 2018-2019 Sylabs, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package runtime
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func readAll(t *testing.T, ch <-chan State) []State {
+	var states []State
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case state, ok := <-ch:
+			if !ok {
+				return states
+			}
+			states = append(states, state)
+		case <-timeout:
+			t.Fatalf("channel is not closed, received %v", states)
+		}
+	}
+}
+
+func TestObserveMux_SlowConsumer(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	const timeout = 200 * time.Millisecond
+	m, err := ObserveMux(ctx, "", WithBufferSize(0), WithTerminalSendTimeout(timeout))
+	require.NoError(t, err)
+	slow, err := m.States("slow")
+	require.NoError(t, err)
+	fast, err := m.States("fast")
+	require.NoError(t, err)
+
+	conn, err := net.Dial(m.Addr().Network(), m.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+	start := time.Now()
+	_, err = fmt.Fprint(conn, `{"status":"stopped","containerId":"slow"}`,
+		`{"status":"running","containerId":"fast"}`)
+	require.NoError(t, err)
+
+	// final state of slow is dropped once nobody receives it in time,
+	// only then status of fast is routed
+	require.Equal(t, StateRunning, <-fast)
+	require.True(t, time.Since(start) >= timeout, "fast consumer is not blocked")
+	require.Empty(t, readAll(t, slow))
+}
+
+func TestObserveMux(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	m, err := ObserveMux(ctx, "", WithContainerID("ignored"))
+	require.NoError(t, err)
+	a, err := m.States("a")
+	require.NoError(t, err)
+	b, err := m.States("b")
+	require.NoError(t, err)
+	_, err = m.States("a")
+	require.Error(t, err)
+
+	conn, err := net.Dial(m.Addr().Network(), m.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+	for _, s := range []struct{ id, status string }{
+		{"a", "creating"},
+		{"b", "creating"},
+		{"c", "creating"},
+		{"a", "running"},
+		{"b", "running"},
+		{"a", "stopped"},
+		{"b", "paused"},
+	} {
+		_, err := fmt.Fprintf(conn, `{"status":%q,"containerId":%q}`, s.status, s.id)
+		require.NoError(t, err)
+	}
+
+	require.Equal(t, []State{StateCreating, StateRunning, StateExited}, readAll(t, a))
+	require.Equal(t, StateCreating, <-b)
+	require.Equal(t, StateRunning, <-b)
+	require.Equal(t, StatePaused, <-b)
+
+	// a is recreated on the same connection
+	a, err = m.States("a")
+	require.NoError(t, err)
+	_, err = fmt.Fprintf(conn, `{"status":"creating","containerId":"a"}`)
+	require.NoError(t, err)
+	require.Equal(t, StateCreating, <-a)
+
+	cancel()
+	require.Empty(t, readAll(t, a))
+	require.Empty(t, readAll(t, b))
+	<-m.Done()
+	require.Equal(t, context.Canceled, m.Err())
+	_, err = m.States("d")
+	require.Equal(t, ErrMuxClosed, err)
+}
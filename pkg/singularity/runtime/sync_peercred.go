@@ -0,0 +1,85 @@
+// Copyright (c) 2018-2019 Sylabs, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package runtime
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"syscall"
+)
+
+// errPeerCred is returned when sync connection comes from unexpected peer.
+var errPeerCred = fmt.Errorf("unexpected peer credentials")
+
+// WithPeerCred makes observer accept only connections made by the process
+// with the passed credentials, e.g. the runtime process of the container,
+// which is stricter than WithToken since credentials are checked by the
+// kernel. Credentials are read with SO_PEERCRED once connection is accepted,
+// negative value matches any uid, gid or pid respectively. Connections
+// over transports other than unix sockets are rejected, as their peer
+// cannot be verified. By default connections from any peer are accepted.
+func WithPeerCred(uid, gid, pid int) ObserveOption {
+	return func(o *observer) {
+		o.peerCred = &syscall.Ucred{
+			Uid: uint32(uid),
+			Gid: uint32(gid),
+			Pid: int32(pid),
+		}
+		o.anyUID, o.anyGID, o.anyPID = uid < 0, gid < 0, pid < 0
+	}
+}
+
+// checkPeer checks that conn is made by the expected peer, see WithPeerCred.
+func (o *observer) checkPeer(conn net.Conn) error {
+	if o.peerCred == nil {
+		return nil
+	}
+	cred, err := peerCred(conn)
+	if err != nil {
+		return fmt.Errorf("%w: %v", errPeerCred, err)
+	}
+	if (!o.anyUID && cred.Uid != o.peerCred.Uid) ||
+		(!o.anyGID && cred.Gid != o.peerCred.Gid) ||
+		(!o.anyPID && cred.Pid != o.peerCred.Pid) {
+		return fmt.Errorf("%w uid=%d gid=%d pid=%d", errPeerCred, cred.Uid, cred.Gid, cred.Pid)
+	}
+	return nil
+}
+
+// peerCred reads credentials of the process that made unix socket conn.
+func peerCred(conn net.Conn) (*syscall.Ucred, error) {
+	if tc, ok := conn.(*tls.Conn); ok {
+		conn = tc.NetConn()
+	}
+	uc, ok := conn.(*net.UnixConn)
+	if !ok {
+		return nil, fmt.Errorf("%s connection has no peer credentials", conn.LocalAddr().Network())
+	}
+	raw, err := uc.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+
+	var cred *syscall.Ucred
+	var credErr error
+	err = raw.Control(func(fd uintptr) {
+		cred, credErr = syscall.GetsockoptUcred(int(fd), syscall.SOL_SOCKET, syscall.SO_PEERCRED)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return cred, credErr
+}
@@ -0,0 +1,135 @@
+// Copyright (c) 2018-2019 Sylabs, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package runtime
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os"
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// socketPair returns connected unix socket connections.
+func socketPair(t *testing.T) (net.Conn, net.Conn) {
+	fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_STREAM, 0)
+	require.NoError(t, err)
+	conns := make([]net.Conn, 2)
+	for i, fd := range fds {
+		f := os.NewFile(uintptr(fd), "socketpair")
+		conns[i], err = net.FileConn(f)
+		f.Close()
+		require.NoError(t, err)
+	}
+	return conns[0], conns[1]
+}
+
+func TestCheckPeer(t *testing.T) {
+	uid, gid, pid := os.Getuid(), os.Getgid(), os.Getpid()
+	tt := []struct {
+		name   string
+		opts   []ObserveOption
+		pipe   bool
+		reject bool
+	}{
+		{
+			name: "not checked",
+		},
+		{
+			name: "matching",
+			opts: []ObserveOption{WithPeerCred(uid, gid, pid)},
+		},
+		{
+			name: "any pid",
+			opts: []ObserveOption{WithPeerCred(uid, gid, -1)},
+		},
+		{
+			name:   "uid mismatch",
+			opts:   []ObserveOption{WithPeerCred(uid+1, -1, -1)},
+			reject: true,
+		},
+		{
+			name:   "gid mismatch",
+			opts:   []ObserveOption{WithPeerCred(-1, gid+1, -1)},
+			reject: true,
+		},
+		{
+			name:   "pid mismatch",
+			opts:   []ObserveOption{WithPeerCred(-1, -1, pid+1)},
+			reject: true,
+		},
+		{
+			name:   "no credentials",
+			opts:   []ObserveOption{WithPeerCred(-1, -1, -1)},
+			pipe:   true,
+			reject: true,
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			var c1, c2 net.Conn
+			if tc.pipe {
+				c1, c2 = net.Pipe()
+			} else {
+				c1, c2 = socketPair(t)
+			}
+			defer c1.Close()
+			defer c2.Close()
+
+			o := newObserver("", tc.opts...)
+			err := o.checkPeer(c1)
+			if tc.reject {
+				require.True(t, errors.Is(err, errPeerCred), "unexpected error %v", err)
+			} else {
+				require.NoError(t, err)
+			}
+		})
+	}
+}
+
+func TestObserveState_PeerCred(t *testing.T) {
+	defer checkLeaks(t)()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	rejected := make(chan error, 1)
+	o, err := Observe(ctx, "",
+		WithPeerCred(os.Getuid(), -1, os.Getpid()+1),
+		OnDisconnect(func(_ net.Addr, err error) {
+			rejected <- err
+		}),
+	)
+	require.NoError(t, err, "could not listen on socket")
+	require.NoError(t, PushState(ctx, o.Addr().String(), StateRunning))
+	require.True(t, errors.Is(<-rejected, errPeerCred))
+	select {
+	case <-o.Done():
+		t.Fatal("observation is stopped by rejected connection")
+	default:
+	}
+	require.NoError(t, o.Close())
+
+	// expected peer is accepted
+	o, err = Observe(ctx, "", WithPeerCred(os.Getuid(), os.Getgid(), os.Getpid()))
+	require.NoError(t, err, "could not listen on socket")
+	require.NoError(t, PushState(ctx, o.Addr().String(), StateRunning, StateExited))
+	require.Equal(t, StateRunning, <-o.States())
+	require.Equal(t, StateExited, <-o.States())
+}
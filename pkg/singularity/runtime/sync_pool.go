@@ -0,0 +1,93 @@
+// Copyright (c) 2018-2019 Sylabs, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package runtime
+
+import (
+	"context"
+	"net"
+	"sync"
+)
+
+// WithConnWorkers makes observer handle up to n connections concurrently,
+// so that a slow connection does not hold up accepting the next ones, e.g.
+// when runtime reconnects to report each state of rapidly cycling containers.
+// States are still passed to the channel one at a time in the order they are
+// decoded, but states sent over different connections at about the same time
+// may be passed in any order. Once terminal status is received, other
+// connections are drained and states received over them are dropped.
+// WithInferredExit should not be used along with it. By default connections
+// are handled one by one in the order they are accepted.
+func WithConnWorkers(n int) ObserveOption {
+	return func(o *observer) {
+		o.connWorkers = n
+	}
+}
+
+// connPool handles accepted connections with a bounded number of workers.
+type connPool struct {
+	o     *observer
+	slots chan struct{}
+	stop  context.CancelFunc
+	wg    sync.WaitGroup
+
+	once sync.Once
+	err  error
+}
+
+// newConnPool returns pool of n workers. Stop is called once
+// any of the connections reports observation should be stopped.
+func newConnPool(o *observer, n int, stop context.CancelFunc) *connPool {
+	return &connPool{
+		o:     o,
+		slots: make(chan struct{}, n),
+		stop:  stop,
+	}
+}
+
+// dispatch handles conn once a worker is free. Conn is closed
+// without being handled if ctx is done before that.
+func (p *connPool) dispatch(ctx, sendCtx context.Context, conn net.Conn) {
+	select {
+	case p.slots <- struct{}{}:
+	case <-ctx.Done():
+		conn.Close()
+		return
+	}
+
+	p.wg.Add(1)
+	go func() {
+		defer func() {
+			<-p.slots
+			p.wg.Done()
+		}()
+		over, err := p.o.syncOnConn(ctx, sendCtx, conn)
+		if err != nil {
+			p.o.log.Errorf("Stopping observation at %s: %v", p.o.socket, err)
+		}
+		if over || err != nil {
+			p.once.Do(func() {
+				p.err = err
+				p.stop()
+			})
+		}
+	}()
+}
+
+// wait waits for all dispatched connections to be handled and returns
+// the error that stopped observation, if any.
+func (p *connPool) wait() error {
+	p.wg.Wait()
+	return p.err
+}
@@ -0,0 +1,145 @@
+// Copyright (c) 2018-2019 Sylabs, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package runtime
+
+import (
+	"context"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// burst dials n connections at once, each reporting status and closing.
+func burst(t testing.TB, addr net.Addr, n int, status string) {
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			c, err := net.Dial(addr.Network(), addr.String())
+			if err != nil {
+				t.Errorf("could not dial: %v", err)
+				return
+			}
+			defer c.Close()
+			c.Write([]byte(`{"status": "` + status + `"}`))
+		}()
+	}
+	wg.Wait()
+}
+
+// observeBurst reports running over a connection that is held open for
+// hold and meanwhile reports exited over n other connections. It returns
+// once all states are received.
+func observeBurst(t testing.TB, workers, n int, hold time.Duration) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	o, err := Observe(ctx, "",
+		WithConnWorkers(workers),
+		WithTerminalStatuses("deleted"),
+		WithBufferSize(n),
+	)
+	require.NoError(t, err, "could not listen on socket")
+
+	c, err := net.Dial(o.Addr().Network(), o.Addr().String())
+	require.NoError(t, err)
+	_, err = c.Write([]byte(`{"status": "running"}`))
+	require.NoError(t, err)
+	require.Equal(t, StateRunning, <-o.States())
+	time.AfterFunc(hold, func() { c.Close() })
+
+	burst(t, o.Addr(), n, "stopped")
+	for i := 0; i < n; i++ {
+		require.Equal(t, StateExited, <-o.States())
+	}
+
+	burst(t, o.Addr(), 1, "deleted")
+	for range o.States() {
+	}
+	require.NoError(t, o.Err())
+}
+
+func TestObserve_ConnWorkers(t *testing.T) {
+	tt := []struct {
+		name       string
+		workers    int
+		expectSlow bool
+	}{
+		{
+			name:       "serial",
+			workers:    1,
+			expectSlow: true,
+		},
+		{
+			name:    "concurrent",
+			workers: 4,
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			const hold = 500 * time.Millisecond
+			start := time.Now()
+			observeBurst(t, tc.workers, 16, hold)
+			require.Equal(t, tc.expectSlow, time.Since(start) >= hold)
+		})
+	}
+}
+
+func TestObserve_ConnWorkersTerminal(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	o, err := Observe(ctx, "", WithConnWorkers(4))
+	require.NoError(t, err, "could not listen on socket")
+
+	// connection left hanging is drained once terminal status is received
+	hanging, err := net.Dial(o.Addr().Network(), o.Addr().String())
+	require.NoError(t, err)
+	defer hanging.Close()
+	_, err = hanging.Write([]byte(`{"status": "running"}`))
+	require.NoError(t, err)
+	require.Equal(t, StateRunning, <-o.States())
+
+	require.NoError(t, PushState(ctx, o.Addr().String(), StateExited, StateRunning))
+	require.Equal(t, StateExited, <-o.States())
+	select {
+	case _, ok := <-o.States():
+		require.False(t, ok)
+	case <-time.After(time.Second):
+		t.Fatalf("channel is not closed once terminal status is received")
+	}
+	require.NoError(t, o.Err())
+}
+
+func BenchmarkObserve_Burst(b *testing.B) {
+	for _, bc := range []struct {
+		name    string
+		workers int
+	}{
+		{name: "serial", workers: 1},
+		{name: "8 workers", workers: 8},
+	} {
+		b.Run(bc.name, func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				observeBurst(b, bc.workers, 100, 5*time.Millisecond)
+			}
+		})
+	}
+}
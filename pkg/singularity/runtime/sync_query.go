@@ -0,0 +1,135 @@
+// Copyright (c) 2018-2019 Sylabs, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package runtime
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"time"
+)
+
+// ErrNotConnected is returned by Query when
+// runtime is not connected to the sync socket.
+var ErrNotConnected = fmt.Errorf("runtime is not connected")
+
+// syncRequest is a request observer sends to the runtime over the sync
+// connection the runtime has opened. Requests are written as compact JSON
+// objects followed by a newline:
+//
+//	{"cmd": "status", "id": 1}
+//
+// Runtime replies with a status object, see syncStatus, that carries the
+// same "id", in the same stream it reports states with. Such replies are
+// not treated as state transitions. Runtime that never receives a request
+// keeps streaming states as usual, so the protocol is backward compatible.
+type syncRequest struct {
+	Cmd string `json:"cmd"`
+	ID  uint64 `json:"id"`
+}
+
+// cmdStatus requests the current state of the container.
+const cmdStatus = "status"
+
+// Query asks runtime for the current state of the container over the most
+// recent sync connection and waits for the reply. Received state is returned
+// as is and is not passed to the channel. ErrNotConnected is returned if
+// runtime is not connected, ErrObservationOver if observation is over before
+// the reply is received. Query is safe to call concurrently.
+func (o *Observer) Query(ctx context.Context) (StateEvent, error) {
+	return o.observer().query(ctx)
+}
+
+func (o *observer) query(ctx context.Context) (StateEvent, error) {
+	o.connMu.Lock()
+	conn := o.conn
+	if conn == nil {
+		o.connMu.Unlock()
+		return StateEvent{}, ErrNotConnected
+	}
+	o.lastID++
+	id := o.lastID
+	reply := make(chan syncStatus, 1)
+	if o.pending == nil {
+		o.pending = make(map[uint64]chan syncStatus)
+	}
+	o.pending[id] = reply
+	o.connMu.Unlock()
+
+	defer func() {
+		o.connMu.Lock()
+		delete(o.pending, id)
+		o.connMu.Unlock()
+	}()
+
+	data, err := json.Marshal(syncRequest{Cmd: cmdStatus, ID: id})
+	if err != nil {
+		return StateEvent{}, err
+	}
+	o.writeMu.Lock()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetWriteDeadline(deadline)
+	}
+	_, err = conn.Write(append(data, '\n'))
+	// deadline must not outlive request, later ones may have none
+	conn.SetWriteDeadline(time.Time{})
+	o.writeMu.Unlock()
+	if err != nil {
+		return StateEvent{}, fmt.Errorf("could not send request: %w", err)
+	}
+
+	select {
+	case status := <-reply:
+		return o.event(status), nil
+	case <-ctx.Done():
+		return StateEvent{}, ctx.Err()
+	case <-o.done:
+		return StateEvent{}, ErrObservationOver
+	}
+}
+
+// setConn makes conn the one requests are sent over.
+func (o *observer) setConn(conn net.Conn) {
+	o.connMu.Lock()
+	o.conn = conn
+	o.connMu.Unlock()
+}
+
+// unsetConn stops sending requests over conn once it is closed.
+func (o *observer) unsetConn(conn net.Conn) {
+	o.connMu.Lock()
+	if o.conn == conn {
+		o.conn = nil
+	}
+	o.connMu.Unlock()
+}
+
+// reply passes status runtime replied with to the pending request.
+// Replies to unknown requests, e.g. ones that timed out, are dropped.
+func (o *observer) reply(status syncStatus) {
+	o.connMu.Lock()
+	reply, ok := o.pending[status.ID]
+	o.connMu.Unlock()
+	if !ok {
+		o.log.Debugf("Dropping reply %d at %s: no such request", status.ID, o.socket)
+		return
+	}
+	select {
+	case reply <- status:
+	default:
+		o.log.Debugf("Dropping reply %d at %s: already replied", status.ID, o.socket)
+	}
+}
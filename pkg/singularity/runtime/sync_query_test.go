@@ -0,0 +1,146 @@
+// Copyright (c) 2018-2019 Sylabs, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package runtime
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// serveStatus replies to status requests received over c as runtime does.
+func serveStatus(c net.Conn, status string) {
+	scanner := bufio.NewScanner(c)
+	for scanner.Scan() {
+		var req syncRequest
+		if err := json.Unmarshal(scanner.Bytes(), &req); err != nil || req.Cmd != cmdStatus {
+			return
+		}
+		fmt.Fprintf(c, `{"id": %d, "status": %q, "pid": 42}`+"\n", req.ID, status)
+	}
+}
+
+func TestObserver_Query(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	o, err := Observe(ctx, "")
+	require.NoError(t, err, "could not listen on socket")
+
+	_, err = o.Query(ctx)
+	require.Equal(t, ErrNotConnected, err)
+
+	c, err := net.Dial(o.Addr().Network(), o.Addr().String())
+	require.NoError(t, err)
+	defer c.Close()
+	_, err = c.Write([]byte(`{"status": "running"}`))
+	require.NoError(t, err)
+	require.Equal(t, StateRunning, <-o.States())
+	go serveStatus(c, "running")
+
+	for i := 0; i < 3; i++ {
+		event, err := o.Query(ctx)
+		require.NoError(t, err)
+		require.Equal(t, StateRunning, event.State)
+		require.Equal(t, 42, event.Pid)
+	}
+
+	// replies are not state transitions
+	_, err = c.Write([]byte(`{"status": "stopped"}`))
+	require.NoError(t, err)
+	require.Equal(t, StateExited, <-o.States())
+	_, ok := <-o.States()
+	require.False(t, ok)
+
+	_, err = o.Query(ctx)
+	require.Equal(t, ErrNotConnected, err)
+}
+
+func TestObserver_QueryTimeout(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	o, err := Observe(ctx, "")
+	require.NoError(t, err, "could not listen on socket")
+	c, err := net.Dial(o.Addr().Network(), o.Addr().String())
+	require.NoError(t, err)
+	defer c.Close()
+	_, err = c.Write([]byte(`{"status": "running"}`))
+	require.NoError(t, err)
+	require.Equal(t, StateRunning, <-o.States())
+
+	// runtime that does not support requests never replies
+	queryCtx, queryCancel := context.WithTimeout(ctx, 20*time.Millisecond)
+	defer queryCancel()
+	_, err = o.Query(queryCtx)
+	require.Equal(t, context.DeadlineExceeded, err)
+
+	// late reply is dropped
+	_, err = c.Write([]byte(`{"id": 1, "status": "running"} {"status": "stopped"}`))
+	require.NoError(t, err)
+	require.Equal(t, StateExited, <-o.States())
+}
+
+func TestObserver_QueryAfterTimeout(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	o, err := Observe(ctx, "")
+	require.NoError(t, err, "could not listen on socket")
+	c, err := net.Dial(o.Addr().Network(), o.Addr().String())
+	require.NoError(t, err)
+	defer c.Close()
+	_, err = c.Write([]byte(`{"status": "running"}`))
+	require.NoError(t, err)
+	require.Equal(t, StateRunning, <-o.States())
+	go serveStatus(c, "running")
+
+	queryCtx, queryCancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer queryCancel()
+	_, err = o.Query(queryCtx)
+	require.NoError(t, err)
+
+	// deadline of the previous request has passed by now
+	time.Sleep(100 * time.Millisecond)
+	event, err := o.Query(context.Background())
+	require.NoError(t, err)
+	require.Equal(t, StateRunning, event.State)
+}
+
+func TestObserver_QueryObservationOver(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	o, err := Observe(ctx, "")
+	require.NoError(t, err, "could not listen on socket")
+	c, err := net.Dial(o.Addr().Network(), o.Addr().String())
+	require.NoError(t, err)
+	defer c.Close()
+	_, err = c.Write([]byte(`{"status": "running"}`))
+	require.NoError(t, err)
+	require.Equal(t, StateRunning, <-o.States())
+
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		cancel()
+	}()
+	_, err = o.Query(context.Background())
+	require.Equal(t, ErrObservationOver, err)
+}
@@ -0,0 +1,68 @@
+// Copyright (c) 2018-2019 Sylabs, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package runtime
+
+import (
+	"time"
+)
+
+// WithAcceptRate limits the rate sync connections are accepted at to rate
+// connections per second on average with bursts of up to burst connections,
+// so that a misbehaving runtime that floods the socket with connections does
+// not exhaust file descriptors. Connections beyond the limit are closed as
+// soon as they are accepted and a warning is logged. Non-positive rate
+// disables the limit, which is the default.
+func WithAcceptRate(rate float64, burst int) ObserveOption {
+	return func(o *observer) {
+		if rate <= 0 {
+			o.acceptLimit = nil
+			return
+		}
+		if burst < 1 {
+			burst = 1
+		}
+		o.acceptLimit = &tokenBucket{
+			rate:   rate,
+			burst:  float64(burst),
+			tokens: float64(burst),
+		}
+	}
+}
+
+// tokenBucket is a token bucket rate limiter. It is not safe
+// for concurrent use, connections are accepted one at a time.
+type tokenBucket struct {
+	rate   float64
+	burst  float64
+	tokens float64
+	// last is the time tokens were last refilled at.
+	last time.Time
+}
+
+// allow takes a token from the bucket if there is one left at now.
+func (b *tokenBucket) allow(now time.Time) bool {
+	if !b.last.IsZero() {
+		b.tokens += now.Sub(b.last).Seconds() * b.rate
+		if b.tokens > b.burst {
+			b.tokens = b.burst
+		}
+	}
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
@@ -0,0 +1,96 @@
+// Copyright (c) 2018-2019 Sylabs, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package runtime
+
+import (
+	"context"
+	"net"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestTokenBucket(t *testing.T) {
+	start := time.Date(2019, 1, 1, 0, 0, 0, 0, time.UTC)
+	b := &tokenBucket{rate: 2, burst: 3, tokens: 3}
+
+	for i := 0; i < 3; i++ {
+		require.True(t, b.allow(start), "burst is not allowed")
+	}
+	require.False(t, b.allow(start))
+	require.False(t, b.allow(start.Add(400*time.Millisecond)))
+	require.True(t, b.allow(start.Add(500*time.Millisecond)))
+	require.False(t, b.allow(start.Add(500*time.Millisecond)))
+
+	// bucket never holds more than burst
+	later := start.Add(time.Hour)
+	for i := 0; i < 3; i++ {
+		require.True(t, b.allow(later))
+	}
+	require.False(t, b.allow(later))
+}
+
+func TestObserveState_AcceptRate(t *testing.T) {
+	defer checkLeaks(t)()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	const n = 20
+	clock := &testClock{now: time.Date(2019, 1, 1, 0, 0, 0, 0, time.UTC)}
+	log := &testLogger{}
+	var accepted int32
+	o, err := Observe(ctx, "",
+		WithClock(clock.Now),
+		WithLogger(log),
+		WithAcceptRate(1, 5),
+		WithTerminalStatuses("deleted"),
+		WithBufferSize(n),
+		OnConnect(func(net.Addr) {
+			atomic.AddInt32(&accepted, 1)
+		}),
+	)
+	require.NoError(t, err, "could not listen on socket")
+
+	rejected := func() int {
+		var n int
+		for _, m := range log.Messages() {
+			if strings.Contains(m, "accept rate limit exceeded") {
+				n++
+			}
+		}
+		return n
+	}
+	burst(t, o.Addr(), n, "running")
+	require.Eventually(t, func() bool {
+		return int(atomic.LoadInt32(&accepted))+rejected() == n
+	}, 5*time.Second, 10*time.Millisecond)
+	require.EqualValues(t, 5, atomic.LoadInt32(&accepted))
+
+	// bucket is refilled as time passes
+	clock.Advance(2 * time.Second)
+	burst(t, o.Addr(), n, "running")
+	require.Eventually(t, func() bool {
+		return int(atomic.LoadInt32(&accepted))+rejected() == 2*n
+	}, 5*time.Second, 10*time.Millisecond)
+	require.EqualValues(t, 7, atomic.LoadInt32(&accepted))
+
+	for i := 0; i < 7; i++ {
+		require.Equal(t, StateRunning, <-o.States())
+	}
+}
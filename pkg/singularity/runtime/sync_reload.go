@@ -0,0 +1,139 @@
+// Copyright (c) 2018-2019 Sylabs, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package runtime
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+)
+
+// Timeouts set with WithInactivityTimeout, WithStateTimeout and
+// WithConnIdleTimeout are hot-reloadable, i.e. they may be changed with
+// corresponding Observer methods while observation is running. Other
+// options are fixed once observation is started.
+
+// atomicDuration is time.Duration that is safe to load and store
+// concurrently.
+type atomicDuration struct {
+	v int64
+}
+
+func (d *atomicDuration) load() time.Duration {
+	return time.Duration(atomic.LoadInt64(&d.v))
+}
+
+func (d *atomicDuration) store(v time.Duration) {
+	atomic.StoreInt64(&d.v, int64(v))
+}
+
+// SetInactivityTimeout changes inactivity timeout of the running observation,
+// see WithInactivityTimeout. Timeout is measured since the last status is
+// received, so if it is already exceeded observation stops immediately.
+// Non-positive timeout disables it. New timeout is preserved by Reset.
+func (o *Observer) SetInactivityTimeout(timeout time.Duration) {
+	o.reload(WithInactivityTimeout(timeout), func(obs *observer) {
+		notify(obs.reloadActivity)
+	})
+}
+
+// SetConnIdleTimeout changes connection idle timeout of the running
+// observation, see WithConnIdleTimeout. New timeout takes effect on the next
+// read deadline, i.e. once the next status is received on the connection.
+// Non-positive timeout disables it. New timeout is preserved by Reset.
+func (o *Observer) SetConnIdleTimeout(timeout time.Duration) {
+	o.reload(WithConnIdleTimeout(timeout), nil)
+}
+
+// SetStateTimeout changes timeout of state of the running observation, see
+// WithStateTimeout. Timeout is measured since container has entered state,
+// so if it is already exceeded observation stops immediately. Non-positive
+// timeout removes the budget. New timeout is preserved by Reset.
+func (o *Observer) SetStateTimeout(state State, timeout time.Duration) {
+	opt := WithStateTimeout(state, timeout)
+	o.reload(func(obs *observer) {
+		obs.mu.Lock()
+		defer obs.mu.Unlock()
+		opt(obs)
+	}, func(obs *observer) {
+		notify(obs.reloadStates)
+	})
+}
+
+// reload applies opt to the current observation and notifies its watchers.
+// Option is recorded so that next observation started by Reset keeps it.
+func (o *Observer) reload(opt ObserveOption, notify func(*observer)) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	obs := o.o
+	opt(obs)
+	// options may share the slice passed to Observe by caller
+	obs.opts = append(obs.opts[:len(obs.opts):len(obs.opts)], opt)
+	if notify != nil {
+		notify(obs)
+	}
+}
+
+// stateTimeout returns timeout of state, if any.
+func (o *observer) stateTimeout(state State) (time.Duration, bool) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	timeout, ok := o.stateTimeouts[state]
+	return timeout, ok
+}
+
+// watchInactivity calls cancel once no status is received for longer
+// than inactivity timeout, see WithInactivityTimeout. Timeout is reloaded
+// on notification, see SetInactivityTimeout.
+func (o *observer) watchInactivity(ctx context.Context, cancel context.CancelFunc) <-chan error {
+	expired := make(chan error, 1)
+	go func() {
+		timer := time.NewTimer(0)
+		defer timer.Stop()
+		<-timer.C
+
+		// last is when the last status is received
+		last := o.now()
+		armed := false
+		arm := func() {
+			if armed && !timer.Stop() {
+				<-timer.C
+			}
+			timeout := o.inactivityTimeout.load()
+			if armed = timeout > 0; armed {
+				timer.Reset(timeout - o.now().Sub(last))
+			}
+		}
+		arm()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-o.activity:
+				last = o.now()
+				arm()
+			case <-o.reloadActivity:
+				arm()
+			case <-timer.C:
+				o.log.Errorf("Stopping observation at %s: %v", o.socket, ErrInactive)
+				expired <- ErrInactive
+				cancel()
+				return
+			}
+		}
+	}()
+	return expired
+}
@@ -0,0 +1,125 @@
+// Copyright (c) 2018-2019 Sylabs, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package runtime
+
+import (
+	"context"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestObserver_SetInactivityTimeout(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	o, err := Observe(ctx, "")
+	require.NoError(t, err, "could not listen on socket")
+	defer o.Close()
+
+	time.Sleep(time.Millisecond * 50)
+	o.SetInactivityTimeout(time.Millisecond * 50)
+	select {
+	case _, ok := <-o.States():
+		require.False(t, ok, "unexpected state")
+	case <-time.After(time.Second):
+		t.Fatalf("observation is not stopped after timeout is set")
+	}
+	require.Equal(t, ErrInactive, o.Err())
+}
+
+func TestObserver_SetInactivityTimeoutDisable(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	o, err := Observe(ctx, "", WithInactivityTimeout(time.Millisecond*100))
+	require.NoError(t, err, "could not listen on socket")
+	defer o.Close()
+
+	o.SetInactivityTimeout(0)
+	select {
+	case state, ok := <-o.States():
+		t.Fatalf("unexpected state %v, open %t", state, ok)
+	case <-time.After(time.Millisecond * 300):
+	}
+	require.NoError(t, o.Err())
+}
+
+func TestObserver_SetStateTimeout(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	o, err := Observe(ctx, "")
+	require.NoError(t, err, "could not listen on socket")
+	defer o.Close()
+
+	c, err := net.Dial(o.Addr().Network(), o.Addr().String())
+	require.NoError(t, err)
+	defer c.Close()
+	_, err = c.Write([]byte(`{"status": "creating"}`))
+	require.NoError(t, err)
+	require.Equal(t, StateCreating, <-o.States())
+
+	o.SetStateTimeout(StateRunning, time.Millisecond*10)
+	o.SetStateTimeout(StateCreating, time.Millisecond*50)
+	_, ok := <-o.States()
+	require.False(t, ok)
+	require.Equal(t, &StateTimeoutError{State: StateCreating, Timeout: time.Millisecond * 50}, o.Err())
+}
+
+func TestObserver_SetConnIdleTimeout(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	log := &testLogger{}
+	o, err := Observe(ctx, "", WithLogger(log))
+	require.NoError(t, err, "could not listen on socket")
+	defer o.Close()
+
+	o.SetConnIdleTimeout(time.Millisecond * 50)
+	c, err := net.Dial(o.Addr().Network(), o.Addr().String())
+	require.NoError(t, err)
+	defer c.Close()
+	_, err = c.Write([]byte(`{"status": "creating"}`))
+	require.NoError(t, err)
+	require.Equal(t, StateCreating, <-o.States())
+
+	// connection is closed by observer once it is idle
+	c.SetReadDeadline(time.Now().Add(time.Second))
+	_, err = c.Read(make([]byte, 1))
+	require.Error(t, err)
+	var warned bool
+	for _, msg := range log.Messages() {
+		warned = warned || strings.HasSuffix(msg, "no status received within 50ms")
+	}
+	assert.True(t, warned, "idle connection is not reported")
+}
+
+func TestObserver_SetTimeoutReset(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	o, err := Observe(ctx, "")
+	require.NoError(t, err, "could not listen on socket")
+	defer o.Close()
+
+	o.SetInactivityTimeout(time.Hour)
+	require.NoError(t, o.Reset(ctx))
+	assert.Equal(t, time.Hour, o.observer().inactivityTimeout.load())
+}
@@ -0,0 +1,101 @@
+// Copyright (c) 2018-2019 Sylabs, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package runtime
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+
+	"github.com/golang/glog"
+)
+
+// ReplayStates returns channel with the same contract ObserveState has, but
+// instead of listening on a socket it passes the given states in order. The
+// channel is closed once StateExited is passed, states after it are ignored.
+// If there is no StateExited among states the channel stays open until ctx is
+// done, just like when runtime stops reporting states. ReplayStates is meant
+// for testing code that consumes state channel without any networking.
+func ReplayStates(ctx context.Context, states ...State) <-chan State {
+	out := make(chan State, DefaultBufferSize)
+	go func() {
+		defer close(out)
+		for _, state := range states {
+			select {
+			case out <- state:
+			case <-ctx.Done():
+				return
+			}
+			if state == StateExited {
+				return
+			}
+		}
+		<-ctx.Done()
+	}()
+	return out
+}
+
+// RecordStates passes every state received from in to the returned channel
+// and writes it to w as a JSON string, one state per line. Recorded states
+// may be read with LoadStates and replayed with ReplayStates. If writing to w
+// fails recording is stopped but states are still passed. The returned channel
+// is closed when in is closed or ctx is done.
+func RecordStates(ctx context.Context, in <-chan State, w io.Writer) <-chan State {
+	out := make(chan State, DefaultBufferSize)
+	go func() {
+		defer close(out)
+		enc := json.NewEncoder(w)
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case state, ok := <-in:
+				if !ok {
+					return
+				}
+				if enc != nil {
+					if err := enc.Encode(state); err != nil {
+						glog.Errorf("Could not record state %v: %v", state, err)
+						enc = nil
+					}
+				}
+				select {
+				case out <- state:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}
+	}()
+	return out
+}
+
+// LoadStates reads states recorded with RecordStates.
+func LoadStates(r io.Reader) ([]State, error) {
+	var states []State
+	dec := json.NewDecoder(r)
+	for {
+		var state State
+		err := dec.Decode(&state)
+		if err == io.EOF {
+			return states, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("could not decode state: %v", err)
+		}
+		states = append(states, state)
+	}
+}
@@ -0,0 +1,93 @@
+// Copyright (c) 2018-2019 Sylabs, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package runtime
+
+import (
+	"bytes"
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestReplayStates(t *testing.T) {
+	tt := []struct {
+		name         string
+		states       []State
+		expectStates []State
+		expectOpen   bool
+	}{
+		{
+			name:         "exited",
+			states:       []State{StateCreating, StateCreated, StateRunning, StateExited, StateRunning},
+			expectStates: []State{StateCreating, StateCreated, StateRunning, StateExited},
+		},
+		{
+			name:         "not exited",
+			states:       []State{StateCreated, StateRunning},
+			expectStates: []State{StateCreated, StateRunning},
+			expectOpen:   true,
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			ch := ReplayStates(ctx, tc.states...)
+			var states []State
+			for range tc.expectStates {
+				states = append(states, <-ch)
+			}
+			require.Equal(t, tc.expectStates, states)
+
+			select {
+			case _, ok := <-ch:
+				require.False(t, tc.expectOpen, "channel is closed")
+				require.False(t, ok, "unexpected state")
+			case <-time.After(time.Millisecond * 50):
+				require.True(t, tc.expectOpen, "channel is not closed")
+			}
+			cancel()
+			_, ok := <-ch
+			require.False(t, ok)
+		})
+	}
+}
+
+func TestRecordStates(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var buf bytes.Buffer
+	expect := []State{StateCreating, StateCreated, StateRunning, StateExited}
+	ch := RecordStates(ctx, ReplayStates(ctx, expect...), &buf)
+
+	var states []State
+	for state := range ch {
+		states = append(states, state)
+	}
+	require.Equal(t, expect, states)
+	require.Equal(t, "\"creating\"\n\"created\"\n\"running\"\n\"exited\"\n", buf.String())
+
+	loaded, err := LoadStates(&buf)
+	require.NoError(t, err)
+	require.Equal(t, expect, loaded)
+
+	_, err = LoadStates(bytes.NewBufferString(`"running" "flying"`))
+	require.EqualError(t, err, `could not decode state: unknown state "flying"`)
+}
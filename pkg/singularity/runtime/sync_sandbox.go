@@ -0,0 +1,212 @@
+// Copyright (c) 2018-2019 Sylabs, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package runtime
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// ErrSandboxClosed is returned when container is registered
+// with SandboxObserver that is already closed.
+var ErrSandboxClosed = fmt.Errorf("sandbox observer is closed")
+
+// ErrFlapping is returned when container is registered with SandboxObserver
+// again while it is cooling down after too many observations, see WithFlapLimit.
+var ErrFlapping = fmt.Errorf("container is restarting too often")
+
+// SandboxEvent is a state received from the particular container of the sandbox.
+type SandboxEvent struct {
+	ContainerID string
+	State       State
+}
+
+// SandboxObserver observes states of all containers of a pod sandbox and
+// merges them into a single channel. Observations are stopped and the
+// channel is closed once Close is called or sandbox context is done.
+type SandboxObserver struct {
+	ctx    context.Context
+	cancel context.CancelFunc
+	events chan SandboxEvent
+	done   chan struct{}
+	wg     sync.WaitGroup
+
+	now        func() time.Time
+	flapMax    int
+	flapWindow time.Duration
+	cooldown   time.Duration
+
+	mu         sync.Mutex
+	closed     bool
+	containers map[string]struct{}
+	// cycles holds moments observations of each container were over
+	cycles map[string][]time.Time
+	// refused holds moments containers may be observed again after
+	refused map[string]time.Time
+}
+
+// SandboxOption configures SandboxObserver.
+type SandboxOption func(s *SandboxObserver)
+
+// WithFlapLimit makes sandbox observer refuse to observe container once its
+// observation was over max times within window, e.g. because container is
+// crash looping. Observe returns ErrFlapping for such container until cooldown
+// passes, so that caller backs off instead of recreating the socket over
+// and over. By default containers may be observed again at any rate.
+func WithFlapLimit(max int, window, cooldown time.Duration) SandboxOption {
+	return func(s *SandboxObserver) {
+		s.flapMax = max
+		s.flapWindow = window
+		s.cooldown = cooldown
+	}
+}
+
+// NewSandboxObserver returns SandboxObserver bound to ctx.
+func NewSandboxObserver(ctx context.Context, opts ...SandboxOption) *SandboxObserver {
+	ctx, cancel := context.WithCancel(ctx)
+	s := &SandboxObserver{
+		ctx:        ctx,
+		cancel:     cancel,
+		events:     make(chan SandboxEvent, DefaultBufferSize),
+		done:       make(chan struct{}),
+		now:        time.Now,
+		containers: make(map[string]struct{}),
+		cycles:     make(map[string][]time.Time),
+		refused:    make(map[string]time.Time),
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	go s.wait()
+	return s
+}
+
+// Observe starts observing container with the passed ID on socket. Received
+// states are passed to the Events channel. Container ID is passed to the
+// observer with WithContainerID, other options are the same as for ObserveState.
+// Container may be registered again once its observation is over, unless
+// it is refused with ErrFlapping, see WithFlapLimit.
+func (s *SandboxObserver) Observe(containerID, socket string, opts ...ObserveOption) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return ErrSandboxClosed
+	}
+	if _, ok := s.containers[containerID]; ok {
+		return fmt.Errorf("container %s is already observed", containerID)
+	}
+	if err := s.checkFlapping(containerID); err != nil {
+		return err
+	}
+
+	opts = append([]ObserveOption{WithContainerID(containerID)}, opts...)
+	states, err := ObserveState(s.ctx, socket, opts...)
+	if err != nil {
+		return err
+	}
+	s.containers[containerID] = struct{}{}
+
+	s.wg.Add(1)
+	go s.forward(containerID, states)
+	return nil
+}
+
+// Events returns the channel states of all observed containers are passed to.
+func (s *SandboxObserver) Events() <-chan SandboxEvent {
+	return s.events
+}
+
+// Close stops all observations and waits for them to be over. Events
+// channel is closed once Close returns. It is safe to call Close
+// several times.
+func (s *SandboxObserver) Close() {
+	s.cancel()
+	<-s.done
+}
+
+// forward passes states of the container to the events channel
+// until the container's observation is over.
+func (s *SandboxObserver) forward(containerID string, states <-chan State) {
+	defer s.wg.Done()
+	defer func() {
+		s.mu.Lock()
+		delete(s.containers, containerID)
+		if s.flapMax > 0 {
+			s.cycles[containerID] = append(s.cycles[containerID], s.now())
+		}
+		s.mu.Unlock()
+	}()
+
+	for state := range states {
+		select {
+		case s.events <- SandboxEvent{ContainerID: containerID, State: state}:
+		case <-s.ctx.Done():
+			for range states {
+			}
+			return
+		}
+	}
+}
+
+// checkFlapping returns ErrFlapping if container's observation was over
+// too many times recently or container is still cooling down because of that.
+// It should be called with mu held.
+func (s *SandboxObserver) checkFlapping(containerID string) error {
+	if s.flapMax <= 0 {
+		return nil
+	}
+
+	now := s.now()
+	if until, ok := s.refused[containerID]; ok {
+		if now.Before(until) {
+			return fmt.Errorf("container %s: %w, retry in %v", containerID, ErrFlapping, until.Sub(now))
+		}
+		delete(s.refused, containerID)
+	}
+
+	cycles := s.cycles[containerID]
+	for len(cycles) > 0 && now.Sub(cycles[0]) > s.flapWindow {
+		cycles = cycles[1:]
+	}
+	if len(cycles) < s.flapMax {
+		if len(cycles) == 0 {
+			delete(s.cycles, containerID)
+		} else {
+			s.cycles[containerID] = cycles
+		}
+		return nil
+	}
+
+	delete(s.cycles, containerID)
+	s.refused[containerID] = now.Add(s.cooldown)
+	return fmt.Errorf("container %s: %w, retry in %v", containerID, ErrFlapping, s.cooldown)
+}
+
+// wait closes the events channel once sandbox context is
+// done and all per container goroutines are over.
+func (s *SandboxObserver) wait() {
+	<-s.ctx.Done()
+
+	s.mu.Lock()
+	s.closed = true
+	s.mu.Unlock()
+
+	s.wg.Wait()
+	close(s.events)
+	close(s.done)
+}
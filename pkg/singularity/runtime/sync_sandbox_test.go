@@ -0,0 +1,147 @@
+// Copyright (c) 2018-2019 Sylabs, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package runtime
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/sylabs/singularity/pkg/util/unix"
+)
+
+func TestSandboxObserver(t *testing.T) {
+	s := NewSandboxObserver(context.Background())
+	defer s.Close()
+
+	sockets := make(map[string]string)
+	for _, id := range []string{"first", "second"} {
+		sockets[id] = filepath.Join(os.TempDir(), fmt.Sprintf("cri-test-%s-%s.sock", t.Name(), id))
+		require.NoError(t, s.Observe(id, sockets[id]), "could not observe %s", id)
+	}
+	require.Error(t, s.Observe("first", sockets["first"]+".new"), "container is observed twice")
+
+	for _, id := range []string{"first", "second"} {
+		conn, err := unix.Dial(sockets[id])
+		require.NoError(t, err)
+		_, err = conn.Write([]byte(`{"status": "running"}{"status": "stopped"}`))
+		require.NoError(t, err)
+		require.NoError(t, conn.Close())
+
+		assert.Equal(t, SandboxEvent{ContainerID: id, State: StateRunning}, <-s.Events())
+		assert.Equal(t, SandboxEvent{ContainerID: id, State: StateExited}, <-s.Events())
+	}
+}
+
+func TestSandboxObserver_Close(t *testing.T) {
+	s := NewSandboxObserver(context.Background())
+	socket := filepath.Join(os.TempDir(), fmt.Sprintf("cri-test-%s.sock", t.Name()))
+	require.NoError(t, s.Observe("container", socket))
+
+	s.Close()
+	s.Close()
+	_, ok := <-s.Events()
+	assert.False(t, ok)
+	assert.True(t, os.IsNotExist(os.Remove(socket)))
+	assert.Equal(t, ErrSandboxClosed, s.Observe("container", socket))
+}
+
+func TestSandboxObserver_Cancel(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	s := NewSandboxObserver(ctx)
+	socket := filepath.Join(os.TempDir(), fmt.Sprintf("cri-test-%s.sock", t.Name()))
+	require.NoError(t, s.Observe("container", socket))
+
+	conn, err := unix.Dial(socket)
+	require.NoError(t, err)
+	defer conn.Close()
+	_, err = conn.Write([]byte(`{"status": "running"}`))
+	require.NoError(t, err)
+	assert.Equal(t, SandboxEvent{ContainerID: "container", State: StateRunning}, <-s.Events())
+
+	cancel()
+	for range s.Events() {
+	}
+	assert.True(t, os.IsNotExist(os.Remove(socket)))
+}
+
+// cycleContainer observes container until it exits.
+func cycleContainer(t *testing.T, s *SandboxObserver, id, socket string) {
+	require.NoError(t, s.Observe(id, socket))
+	conn, err := unix.Dial(socket)
+	require.NoError(t, err)
+	_, err = conn.Write([]byte(`{"status": "stopped"}`))
+	require.NoError(t, err)
+	require.NoError(t, conn.Close())
+	require.Equal(t, SandboxEvent{ContainerID: id, State: StateExited}, <-s.Events())
+
+	// container is released right after its last state is passed
+	for i := 0; i < 100; i++ {
+		s.mu.Lock()
+		_, ok := s.containers[id]
+		s.mu.Unlock()
+		if !ok {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+	t.Fatalf("container %s is not released", id)
+}
+
+func TestSandboxObserver_FlapLimit(t *testing.T) {
+	clock := &testClock{now: time.Date(2019, 1, 1, 0, 0, 0, 0, time.UTC)}
+	s := NewSandboxObserver(context.Background(), WithFlapLimit(2, time.Minute, 5*time.Minute))
+	s.now = clock.Now
+	defer s.Close()
+	socket := filepath.Join(os.TempDir(), fmt.Sprintf("cri-test-%s.sock", t.Name()))
+
+	// cycles outside of the window are not counted
+	cycleContainer(t, s, "container", socket)
+	clock.Advance(2 * time.Minute)
+	cycleContainer(t, s, "container", socket)
+	clock.Advance(10 * time.Second)
+	cycleContainer(t, s, "container", socket)
+
+	err := s.Observe("container", socket)
+	require.True(t, errors.Is(err, ErrFlapping), "unexpected error %v", err)
+	require.EqualError(t, err, "container container: container is restarting too often, retry in 5m0s")
+	assert.True(t, os.IsNotExist(os.Remove(socket)), "refused container is observed")
+
+	// other containers are not affected
+	cycleContainer(t, s, "other", socket)
+
+	clock.Advance(4 * time.Minute)
+	err = s.Observe("container", socket)
+	require.EqualError(t, err, "container container: container is restarting too often, retry in 1m0s")
+
+	clock.Advance(time.Minute)
+	cycleContainer(t, s, "container", socket)
+}
+
+func TestSandboxObserver_NoFlapLimit(t *testing.T) {
+	s := NewSandboxObserver(context.Background())
+	defer s.Close()
+	socket := filepath.Join(os.TempDir(), fmt.Sprintf("cri-test-%s.sock", t.Name()))
+
+	for i := 0; i < 10; i++ {
+		cycleContainer(t, s, "container", socket)
+	}
+}
@@ -0,0 +1,91 @@
+// Copyright (c) 2018-2019 Sylabs, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package runtime
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// churnIterations returns number of iterations soak tests run.
+func churnIterations() int {
+	if testing.Short() {
+		return 100
+	}
+	return 2000
+}
+
+func TestObserveState_Churn(t *testing.T) {
+	socket := filepath.Join(os.TempDir(), fmt.Sprintf("cri-test-%s.sock", t.Name()))
+	goroutines, fds := runtime.NumGoroutine(), openFDs(t)
+
+	// the same socket is reused by each container, stale one must never be left
+	for i := 0; i < churnIterations(); i++ {
+		ctx, cancel := context.WithCancel(context.Background())
+		state, err := ObserveState(ctx, socket)
+		require.NoError(t, err, "could not listen on socket at iteration %d", i)
+		require.NoError(t, PushState(ctx, socket, StateCreating, StateCreated, StateRunning, StateExited))
+
+		var actual []State
+		for s := range state {
+			actual = append(actual, s)
+		}
+		cancel()
+		require.Equal(t, []State{StateCreating, StateCreated, StateRunning, StateExited}, actual,
+			"unexpected states at iteration %d", i)
+	}
+
+	requireNoLeaks(t, goroutines, fds)
+	require.True(t, os.IsNotExist(os.Remove(socket)), "socket is left")
+}
+
+func TestObserveState_ConnectionChurn(t *testing.T) {
+	goroutines, fds := runtime.NumGoroutine(), openFDs(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	o, err := Observe(ctx, "")
+	require.NoError(t, err, "could not listen on socket")
+	socket := o.Addr().String()
+
+	n := churnIterations()
+	go func() {
+		for i := 0; i < n; i++ {
+			if err := PushState(ctx, socket, StateCreated, StateRunning); err != nil {
+				t.Errorf("could not push states at iteration %d: %v", i, err)
+				return
+			}
+		}
+		if err := PushState(ctx, socket, StateExited); err != nil {
+			t.Errorf("could not push exit state: %v", err)
+		}
+	}()
+
+	received := 0
+	for range o.States() {
+		received++
+	}
+	require.Equal(t, 2*n+1, received)
+	require.NoError(t, o.Err())
+
+	cancel()
+	requireNoLeaks(t, goroutines, fds)
+}
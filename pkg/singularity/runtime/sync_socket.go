@@ -0,0 +1,442 @@
+// Copyright (c) 2018-2019 Sylabs, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package runtime
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/sylabs/singularity/pkg/util/unix"
+)
+
+// DefaultSocketPermissions is the default file mode of the created unix socket.
+const DefaultSocketPermissions os.FileMode = 0600
+
+// DefaultSocketDirPermissions is the default file mode of the directories
+// created for unix socket when they do not exist.
+const DefaultSocketDirPermissions os.FileMode = 0755
+
+// maxSocketNameLen is the size of sun_path field of sockaddr_un on Linux.
+const maxSocketNameLen = 108
+
+// ErrAlreadyObserving is returned when the socket is already
+// being observed by another observer in this process.
+var ErrAlreadyObserving = fmt.Errorf("already observing socket")
+
+// observed holds sockets that are currently being observed.
+var observed = struct {
+	sync.Mutex
+	sockets map[string]struct{}
+}{
+	sockets: make(map[string]struct{}),
+}
+
+// claimSocket makes sure socket is observed only once at a time. Returned
+// release func should be called once observation is over. Sockets that make
+// kernel pick the actual address, e.g. tcp://host:0, are never tracked.
+func claimSocket(socket string) (func(), error) {
+	key := socketKey(socket)
+	if key == "" {
+		return func() {}, nil
+	}
+
+	observed.Lock()
+	defer observed.Unlock()
+	if _, ok := observed.sockets[key]; ok {
+		return nil, ErrAlreadyObserving
+	}
+	observed.sockets[key] = struct{}{}
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			observed.Lock()
+			delete(observed.sockets, key)
+			observed.Unlock()
+		})
+	}, nil
+}
+
+// socketKey returns the key socket is tracked by, or an empty
+// string if socket address is picked by the kernel.
+func socketKey(socket string) string {
+	scheme, address := splitSocket(socket)
+	switch {
+	case address == "":
+		return ""
+	case scheme == "tcp" && strings.HasSuffix(address, ":0"):
+		return ""
+	case scheme == "unix" && !strings.HasPrefix(address, "@"):
+		if abs, err := filepath.Abs(address); err == nil {
+			address = abs
+		}
+	}
+	return scheme + "://" + address
+}
+
+// listenConfig holds parameters of the socket being listened on.
+type listenConfig struct {
+	// mode, uid and gid are applied to unix socket file.
+	mode os.FileMode
+	uid  int
+	gid  int
+	// dirMode, dirUID and dirGID are applied to the created socket
+	// directories, zero dirMode means directories are not created.
+	// Existing directory is checked against dirMode only if
+	// checkDirMode is set, and against owner unless it is -1.
+	dirMode      os.FileMode
+	dirUID       int
+	dirGID       int
+	checkDirMode bool
+
+	// attempts and retryDelay control retrying
+	// listening after a transient failure.
+	attempts   int
+	retryDelay time.Duration
+
+	// fallbackDir is where unix socket is created
+	// if its directory is read-only.
+	fallbackDir string
+	// removeDir is true if empty socket directory
+	// should be removed along with socket file.
+	removeDir bool
+
+	log Logger
+}
+
+// listenFunc creates every sync listener except vsock ones, i.e. tcp, abstract
+// unix and filesystem unix ones. Tests may replace it to observe states over
+// in-memory connections. Note that filesystem sockets are still bound in a
+// temporary directory next to the requested path, whose permissions and link
+// are set on the filesystem, so only tcp and abstract sockets need no
+// filesystem at all.
+var listenFunc = listen
+
+// listen is the default listenFunc. Unix socket files are bound with
+// unix.Listen, which handles paths longer than sockaddr_un allows.
+func listen(network, address string) (net.Listener, error) {
+	if network == "unix" && address != "" && !strings.HasPrefix(address, "@") {
+		return unix.Listen(address)
+	}
+	return net.Listen(network, address)
+}
+
+// listenSocket starts listening on the passed socket. Socket may be passed
+// in URL form, i.e. unix:///path/to/socket, tcp://host:port or
+// vsock://cid:port, bare socket name is treated as a unix one.
+// Socket passed by systemd socket activation is used instead, if any.
+func listenSocket(socket string, cfg listenConfig) (net.Listener, error) {
+	scheme, address := splitSocket(socket)
+	if ln := takeActivated(address, cfg.log); ln != nil {
+		return ln, nil
+	}
+	switch scheme {
+	case "unix":
+		return listenUnixFallback(address, cfg)
+	case "tcp":
+		return listenFunc("tcp", address)
+	case "vsock":
+		return listenVsock(address)
+	}
+	return nil, fmt.Errorf("unsupported sync socket scheme %q", scheme)
+}
+
+// listenRetry is the same as listenSocket except it retries listening with
+// exponential backoff while the error is transient and attempts are left.
+func listenRetry(ctx context.Context, socket string, cfg listenConfig) (net.Listener, error) {
+	delay := cfg.retryDelay
+	for attempt := 1; ; attempt++ {
+		ln, err := listenSocket(socket, cfg)
+		if err == nil || attempt >= cfg.attempts || !isTransientListenErr(err) {
+			return ln, err
+		}
+
+		cfg.log.Warningf("Could not listen sync socket %s, attempt %d of %d: %v", socket, attempt, cfg.attempts, err)
+		select {
+		case <-ctx.Done():
+			return nil, err
+		case <-time.After(delay):
+		}
+		delay *= 2
+	}
+}
+
+// isTransientListenErr returns true if listening may succeed later,
+// i.e. socket directory is not created or is not accessible yet.
+func isTransientListenErr(err error) bool {
+	return errors.Is(err, syscall.ENOENT) || errors.Is(err, syscall.EACCES)
+}
+
+// splitSocket splits socket into scheme and address.
+func splitSocket(socket string) (string, string) {
+	i := strings.Index(socket, "://")
+	if i < 0 {
+		return "unix", socket
+	}
+	return socket[:i], socket[i+len("://"):]
+}
+
+// listenUnixFallback is the same as listenUnix except it tells when socket
+// directory is read-only and listens in the fallback directory, if any.
+func listenUnixFallback(socket string, cfg listenConfig) (net.Listener, error) {
+	ln, err := listenUnix(socket, cfg)
+	if !errors.Is(err, syscall.EROFS) {
+		return ln, err
+	}
+	dir := filepath.Dir(socket)
+	if cfg.fallbackDir == "" {
+		return nil, fmt.Errorf("socket directory %s is on a read-only filesystem: %w", dir, err)
+	}
+
+	fallback := filepath.Join(cfg.fallbackDir, filepath.Base(socket))
+	cfg.log.Warningf("Socket directory %s is on a read-only filesystem, listening on %s instead", dir, fallback)
+	ln, err = listenUnix(fallback, cfg)
+	if errors.Is(err, syscall.EROFS) {
+		return nil, fmt.Errorf("fallback socket directory %s is on a read-only filesystem: %w", cfg.fallbackDir, err)
+	}
+	return ln, err
+}
+
+// listenUnix starts listening on the passed unix socket. Socket names
+// starting with @ are treated as Linux abstract sockets, empty name makes
+// kernel pick a unique abstract socket name. If the socket file
+// is left from a previous run and nobody listens on it anymore, it
+// is removed before listening.
+//
+// To make sure nobody connects before socket permissions are set, socket
+// is created in a private temporary directory first and only then
+// is linked to the requested path.
+func listenUnix(socket string, cfg listenConfig) (net.Listener, error) {
+	if err := checkSocketLen(socket); err != nil {
+		return nil, err
+	}
+	if socket == "" || strings.HasPrefix(socket, "@") {
+		return listenFunc("unix", socket)
+	}
+
+	if err := createSocketDir(filepath.Dir(socket), cfg); err != nil {
+		return nil, err
+	}
+	if err := removeStaleSocket(socket, cfg.log); err != nil {
+		return nil, err
+	}
+
+	dir, err := ioutil.TempDir(filepath.Dir(socket), ".sync-")
+	if err != nil {
+		return nil, fmt.Errorf("could not create temporary directory: %w", err)
+	}
+	defer os.RemoveAll(dir)
+
+	tmpSocket := filepath.Join(dir, "sock")
+	ln, err := listenFunc("unix", tmpSocket)
+	if err != nil {
+		return nil, err
+	}
+	if ul, ok := ln.(*net.UnixListener); ok {
+		ul.SetUnlinkOnClose(false)
+	}
+
+	if err := os.Chmod(tmpSocket, cfg.mode); err != nil {
+		ln.Close()
+		return nil, fmt.Errorf("could not change socket permissions: %v", err)
+	}
+	if cfg.uid != -1 || cfg.gid != -1 {
+		if err := os.Chown(tmpSocket, cfg.uid, cfg.gid); err != nil {
+			ln.Close()
+			return nil, fmt.Errorf("could not change socket owner: %v", err)
+		}
+	}
+	if err := os.Link(tmpSocket, socket); err != nil {
+		ln.Close()
+		return nil, fmt.Errorf("could not bind socket: %v", err)
+	}
+	return &unixListener{Listener: ln, path: socket, removeDir: cfg.removeDir}, nil
+}
+
+// createSocketDir creates socket directory along with its missing parents
+// applying permissions and owner of cfg to each created one. If directory
+// exists already, a warning is logged when its permissions or owner differ
+// from the requested ones.
+func createSocketDir(dir string, cfg listenConfig) error {
+	if cfg.dirMode == 0 {
+		return nil
+	}
+
+	fi, err := os.Stat(dir)
+	if err == nil {
+		if !fi.IsDir() {
+			return fmt.Errorf("socket directory %s is not a directory", dir)
+		}
+		checkSocketDir(dir, fi, cfg)
+		return nil
+	}
+	if !os.IsNotExist(err) {
+		return err
+	}
+	return mkdirAll(dir, cfg)
+}
+
+// mkdirAll is the same as os.MkdirAll except permissions and owner
+// of cfg are applied to each created directory regardless of umask.
+func mkdirAll(dir string, cfg listenConfig) error {
+	if fi, err := os.Stat(dir); err == nil {
+		if !fi.IsDir() {
+			return fmt.Errorf("%s is not a directory", dir)
+		}
+		return nil
+	}
+	if parent := filepath.Dir(dir); parent != dir {
+		if err := mkdirAll(parent, cfg); err != nil {
+			return err
+		}
+	}
+	if err := os.Mkdir(dir, cfg.dirMode); err != nil {
+		if os.IsExist(err) {
+			return nil
+		}
+		return fmt.Errorf("could not create socket directory: %w", err)
+	}
+	cfg.log.Debugf("Created socket directory %s", dir)
+	// mode passed to mkdir is masked with umask
+	if err := os.Chmod(dir, cfg.dirMode); err != nil {
+		return fmt.Errorf("could not change socket directory permissions: %v", err)
+	}
+	if cfg.dirUID != -1 || cfg.dirGID != -1 {
+		if err := os.Chown(dir, cfg.dirUID, cfg.dirGID); err != nil {
+			return fmt.Errorf("could not change socket directory owner: %v", err)
+		}
+	}
+	return nil
+}
+
+// checkSocketDir logs a warning if existing socket directory
+// has permissions or owner other than the requested ones.
+func checkSocketDir(dir string, fi os.FileInfo, cfg listenConfig) {
+	if cfg.checkDirMode && fi.Mode().Perm() != cfg.dirMode.Perm() {
+		cfg.log.Warningf("Socket directory %s has permissions %v, expected %v",
+			dir, fi.Mode().Perm(), cfg.dirMode.Perm())
+	}
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok {
+		return
+	}
+	if (cfg.dirUID != -1 && int(st.Uid) != cfg.dirUID) || (cfg.dirGID != -1 && int(st.Gid) != cfg.dirGID) {
+		cfg.log.Warningf("Socket directory %s is owned by %d:%d, expected %d:%d",
+			dir, st.Uid, st.Gid, cfg.dirUID, cfg.dirGID)
+	}
+}
+
+// checkSocketLen makes sure socket name fits into sun_path. Abstract socket
+// names may occupy the whole sun_path. Socket file paths are limited by
+// the length of the file name only, since both listening and dialing
+// are done relative to the socket directory when the path is too long.
+func checkSocketLen(socket string) error {
+	if strings.HasPrefix(socket, "@") {
+		if len(socket) > maxSocketNameLen {
+			return fmt.Errorf("abstract socket name is %d bytes long, but at most %d bytes are allowed",
+				len(socket), maxSocketNameLen)
+		}
+		return nil
+	}
+	if name := filepath.Base(socket); len(name) >= maxSocketNameLen {
+		return fmt.Errorf("socket file name is %d bytes long, but at most %d bytes are allowed",
+			len(name), maxSocketNameLen-1)
+	}
+	return nil
+}
+
+// removeStaleSocket removes socket file if nobody listens on it.
+func removeStaleSocket(socket string, log Logger) error {
+	fi, err := os.Lstat(socket)
+	if err != nil || fi.Mode()&os.ModeSocket == 0 {
+		return nil
+	}
+
+	conn, err := unix.Dial(socket)
+	if err == nil {
+		conn.Close()
+		return fmt.Errorf("socket %s is in use", socket)
+	}
+	if !errors.Is(err, syscall.ECONNREFUSED) {
+		return nil
+	}
+
+	log.Debugf("Removing stale socket %s", socket)
+	if err := os.Remove(socket); err != nil {
+		return fmt.Errorf("could not remove stale socket: %v", err)
+	}
+	return nil
+}
+
+// unixListener removes socket file once closed.
+type unixListener struct {
+	net.Listener
+	path      string
+	removeDir bool
+	// keep is set once socket is handed off, see Observer.Handoff.
+	keep int32
+
+	once     sync.Once
+	closeErr error
+}
+
+// Addr returns the listener's network address.
+func (l *unixListener) Addr() net.Addr {
+	return &net.UnixAddr{Name: l.path, Net: "unix"}
+}
+
+// File returns a duplicate of the listening socket file.
+func (l *unixListener) File() (*os.File, error) {
+	ul, ok := l.Listener.(*net.UnixListener)
+	if !ok {
+		return nil, fmt.Errorf("unexpected listener %T", l.Listener)
+	}
+	return ul.File()
+}
+
+// keepSocket makes Close keep the socket file.
+func (l *unixListener) keepSocket() {
+	atomic.StoreInt32(&l.keep, 1)
+}
+
+// Close closes the listener and removes socket file along with its directory
+// if asked to and it is empty. Concurrent calls wait for the first one to
+// complete, socket is removed only once.
+func (l *unixListener) Close() error {
+	l.once.Do(func() {
+		l.closeErr = l.Listener.Close()
+		if atomic.LoadInt32(&l.keep) == 1 {
+			return
+		}
+		if err := os.Remove(l.path); err != nil && !os.IsNotExist(err) && l.closeErr == nil {
+			l.closeErr = err
+		}
+		if l.removeDir {
+			// directory that is not empty is still used by someone
+			os.Remove(filepath.Dir(l.path))
+		}
+	})
+	return l.closeErr
+}
@@ -0,0 +1,562 @@
+// Copyright (c) 2018-2019 Sylabs, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package runtime
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// pipeListener is an in-memory listener that serves net.Pipe connections.
+type pipeListener struct {
+	address string
+	conns   chan net.Conn
+
+	once   sync.Once
+	closed chan struct{}
+}
+
+func newPipeListener(address string) *pipeListener {
+	return &pipeListener{
+		address: address,
+		conns:   make(chan net.Conn),
+		closed:  make(chan struct{}),
+	}
+}
+
+func (l *pipeListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.closed:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *pipeListener) Close() error {
+	l.once.Do(func() {
+		close(l.closed)
+	})
+	return nil
+}
+
+func (l *pipeListener) Addr() net.Addr {
+	return pipeAddr(l.address)
+}
+
+// dial returns client end of a new connection to the listener.
+func (l *pipeListener) dial() (net.Conn, error) {
+	client, server := net.Pipe()
+	select {
+	case l.conns <- server:
+		return client, nil
+	case <-l.closed:
+		return nil, net.ErrClosed
+	}
+}
+
+type pipeAddr string
+
+func (a pipeAddr) Network() string { return "pipe" }
+func (a pipeAddr) String() string  { return string(a) }
+
+// withPipeListener makes listenFunc return ln until returned func is called.
+func withPipeListener(t *testing.T, ln *pipeListener) func() {
+	orig := listenFunc
+	listenFunc = func(network, address string) (net.Listener, error) {
+		require.Equal(t, "unix", network)
+		require.Equal(t, ln.address, address)
+		return ln, nil
+	}
+	return func() {
+		listenFunc = orig
+	}
+}
+
+func TestObserveState_PipeListener(t *testing.T) {
+	defer checkLeaks(t)()
+
+	ln := newPipeListener("@pipe:1")
+	defer withPipeListener(t, ln)()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	state, addr, err := ObserveStateOn(ctx, "@pipe:1")
+	require.NoError(t, err)
+	require.Equal(t, pipeAddr("@pipe:1"), addr)
+
+	// runtime reconnects between states
+	for _, status := range []string{"created", "running"} {
+		c, err := ln.dial()
+		require.NoError(t, err)
+		_, err = c.Write([]byte(`{"status": "` + status + `"}`))
+		require.NoError(t, err)
+		require.NoError(t, c.Close())
+	}
+	c, err := ln.dial()
+	require.NoError(t, err)
+	defer c.Close()
+	_, err = c.Write([]byte(`{"status": "stopped"}`))
+	require.NoError(t, err)
+
+	assert.Equal(t, StateCreated, <-state)
+	assert.Equal(t, StateRunning, <-state)
+	assert.Equal(t, StateExited, <-state)
+	_, ok := <-state
+	assert.False(t, ok)
+}
+
+func TestObserveState_PipeListenerCancel(t *testing.T) {
+	defer checkLeaks(t)()
+
+	ln := newPipeListener("@pipe:2")
+	defer withPipeListener(t, ln)()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	o, err := Observe(ctx, "@pipe:2")
+	require.NoError(t, err)
+
+	cancel()
+	for range o.States() {
+	}
+	require.Equal(t, context.Canceled, o.Err())
+	_, err = ln.dial()
+	require.Equal(t, net.ErrClosed, err, "listener is not closed")
+}
+
+// withFailingListen makes listenFunc fail with err n times before
+// listening on ln. Returned counter holds the number of listen calls.
+func withFailingListen(ln net.Listener, n int, err error) (*int, func()) {
+	orig := listenFunc
+	calls := 0
+	listenFunc = func(network, address string) (net.Listener, error) {
+		calls++
+		if calls <= n {
+			return nil, &net.OpError{Op: "listen", Net: network, Err: err}
+		}
+		return ln, nil
+	}
+	return &calls, func() {
+		listenFunc = orig
+	}
+}
+
+func TestListenRetry(t *testing.T) {
+	tt := []struct {
+		name        string
+		attempts    int
+		failures    int
+		err         error
+		expectCalls int
+		expectErr   bool
+	}{
+		{
+			name:        "no retry by default",
+			failures:    1,
+			err:         syscall.ENOENT,
+			expectCalls: 1,
+			expectErr:   true,
+		},
+		{
+			name:        "fails twice then succeeds",
+			attempts:    3,
+			failures:    2,
+			err:         syscall.ENOENT,
+			expectCalls: 3,
+		},
+		{
+			name:        "permission denied",
+			attempts:    5,
+			failures:    1,
+			err:         syscall.EACCES,
+			expectCalls: 2,
+		},
+		{
+			name:        "attempts exhausted",
+			attempts:    2,
+			failures:    2,
+			err:         syscall.ENOENT,
+			expectCalls: 2,
+			expectErr:   true,
+		},
+		{
+			name:        "permanent error",
+			attempts:    5,
+			failures:    1,
+			err:         syscall.EADDRINUSE,
+			expectCalls: 1,
+			expectErr:   true,
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			ln := newPipeListener("@pipe:retry")
+			calls, restore := withFailingListen(ln, tc.failures, tc.err)
+			defer restore()
+
+			cfg := listenConfig{
+				attempts:   tc.attempts,
+				retryDelay: time.Millisecond,
+				log:        glogLogger{},
+			}
+			actual, err := listenRetry(context.Background(), "@pipe:retry", cfg)
+			require.Equal(t, tc.expectCalls, *calls)
+			if tc.expectErr {
+				require.True(t, errors.Is(err, tc.err), "unexpected error: %v", err)
+				require.Nil(t, actual)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, ln, actual)
+		})
+	}
+}
+
+func TestListenRetry_Cancel(t *testing.T) {
+	_, restore := withFailingListen(newPipeListener("@pipe:cancel"), 1, syscall.ENOENT)
+	defer restore()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	cfg := listenConfig{
+		attempts:   2,
+		retryDelay: time.Hour,
+		log:        glogLogger{},
+	}
+	_, err := listenRetry(ctx, "@pipe:cancel", cfg)
+	require.True(t, errors.Is(err, syscall.ENOENT), "unexpected error: %v", err)
+}
+
+func TestObserveState_ListenRetry(t *testing.T) {
+	defer checkLeaks(t)()
+
+	ln := newPipeListener("@pipe:3")
+	calls, restore := withFailingListen(ln, 2, syscall.ENOENT)
+	defer restore()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	state, err := ObserveState(ctx, "@pipe:3", WithListenRetry(3, time.Millisecond))
+	require.NoError(t, err)
+	require.Equal(t, 3, *calls)
+
+	c, err := ln.dial()
+	require.NoError(t, err)
+	defer c.Close()
+	_, err = c.Write([]byte(`{"status": "stopped"}`))
+	require.NoError(t, err)
+	require.Equal(t, StateExited, <-state)
+}
+
+func TestObserveState_ListenFuncFile(t *testing.T) {
+	defer checkLeaks(t)()
+
+	dir, err := ioutil.TempDir("", "sync-listen-")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	socket := filepath.Join(dir, "sync.sock")
+
+	// filesystem socket is bound in a temporary directory next to it
+	var bound []string
+	orig := listenFunc
+	listenFunc = func(network, address string) (net.Listener, error) {
+		require.Equal(t, "unix", network)
+		bound = append(bound, address)
+		return orig(network, address)
+	}
+	defer func() {
+		listenFunc = orig
+	}()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	state, err := ObserveState(ctx, socket)
+	require.NoError(t, err)
+	require.Len(t, bound, 1)
+	require.Equal(t, dir, filepath.Dir(filepath.Dir(bound[0])))
+
+	require.NoError(t, PushState(ctx, socket, StateExited))
+	require.Equal(t, StateExited, <-state)
+}
+
+func TestListenRetry_MissingDir(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sync-retry-")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	runDir := filepath.Join(dir, "run")
+
+	cfg := listenConfig{
+		mode:       DefaultSocketPermissions,
+		uid:        -1,
+		gid:        -1,
+		attempts:   10,
+		retryDelay: 10 * time.Millisecond,
+		log:        glogLogger{},
+	}
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		os.Mkdir(runDir, 0755)
+	}()
+	ln, err := listenRetry(context.Background(), filepath.Join(runDir, "sync.sock"), cfg)
+	require.NoError(t, err)
+	require.NoError(t, ln.Close())
+}
+
+func TestObserve_ReadOnlyDir(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sync-ro-")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	roDir := filepath.Join(dir, "ro")
+	require.NoError(t, os.Mkdir(roDir, 0755))
+	if err := syscall.Mount("tmpfs", roDir, "tmpfs", syscall.MS_RDONLY, ""); err != nil {
+		t.Skipf("could not mount read-only filesystem: %v", err)
+	}
+	defer syscall.Unmount(roDir, 0)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	socket := filepath.Join(roDir, "sync.sock")
+
+	_, err = Observe(ctx, socket)
+	require.Error(t, err)
+	require.True(t, errors.Is(err, ErrListen))
+	require.True(t, errors.Is(err, syscall.EROFS))
+	require.Contains(t, err.Error(), "socket directory "+roDir+" is on a read-only filesystem")
+
+	o, err := Observe(ctx, socket, WithFallbackSocketDir(dir))
+	require.NoError(t, err)
+	require.Equal(t, filepath.Join(dir, "sync.sock"), o.Addr().String())
+	require.NoError(t, PushState(ctx, o.Addr().String(), StateExited))
+	require.Equal(t, StateExited, <-o.States())
+	require.NoError(t, o.Close())
+}
+
+// flakyListener fails Accept with errs before accepting connections.
+type flakyListener struct {
+	*pipeListener
+
+	mu   sync.Mutex
+	errs []error
+}
+
+func (l *flakyListener) Accept() (net.Conn, error) {
+	l.mu.Lock()
+	if len(l.errs) != 0 {
+		err := l.errs[0]
+		l.errs = l.errs[1:]
+		l.mu.Unlock()
+		return nil, err
+	}
+	l.mu.Unlock()
+	return l.pipeListener.Accept()
+}
+
+func TestObserveState_TemporaryAcceptError(t *testing.T) {
+	defer checkLeaks(t)()
+
+	tt := []struct {
+		name        string
+		errs        []error
+		expectState []State
+		expectErr   bool
+	}{
+		{
+			name: "out of file descriptors",
+			errs: []error{
+				&net.OpError{Op: "accept", Net: "tcp", Err: os.NewSyscallError("accept4", syscall.EMFILE)},
+				&net.OpError{Op: "accept", Net: "tcp", Err: os.NewSyscallError("accept4", syscall.EINTR)},
+			},
+			expectState: []State{StateRunning, StateExited},
+		},
+		{
+			name:      "fatal error",
+			errs:      []error{&net.OpError{Op: "accept", Net: "tcp", Err: os.NewSyscallError("accept4", syscall.EINVAL)}},
+			expectErr: true,
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			ln := &flakyListener{pipeListener: newPipeListener("@pipe:flaky"), errs: tc.errs}
+			orig := listenFunc
+			listenFunc = func(network, address string) (net.Listener, error) {
+				return ln, nil
+			}
+			defer func() {
+				listenFunc = orig
+			}()
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			o, err := Observe(ctx, "@pipe:flaky")
+			require.NoError(t, err)
+
+			if !tc.expectErr {
+				go func() {
+					c, err := ln.dial()
+					if err != nil {
+						return
+					}
+					defer c.Close()
+					c.Write([]byte(`{"status": "running"}{"status": "stopped"}`))
+				}()
+			}
+
+			var actual []State
+			for s := range o.States() {
+				actual = append(actual, s)
+			}
+			require.Equal(t, tc.expectState, actual)
+			require.Equal(t, tc.expectErr, o.Err() != nil, "unexpected error: %v", o.Err())
+			if tc.expectErr {
+				require.True(t, errors.Is(o.Err(), ErrAccept), "unexpected error: %v", o.Err())
+				require.True(t, errors.Is(o.Err(), syscall.EINVAL), "underlying error is lost")
+			}
+		})
+	}
+}
+
+func TestObserveState_SocketDirCleanup(t *testing.T) {
+	defer checkLeaks(t)()
+
+	tt := []struct {
+		name      string
+		cleanup   bool
+		busy      bool
+		expectDir bool
+	}{
+		{
+			name:      "no cleanup",
+			expectDir: true,
+		},
+		{
+			name:    "empty dir",
+			cleanup: true,
+		},
+		{
+			name:      "dir is not empty",
+			cleanup:   true,
+			busy:      true,
+			expectDir: true,
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "sync-cleanup-")
+			require.NoError(t, err)
+			defer os.RemoveAll(dir)
+			socket := filepath.Join(dir, "sync.sock")
+			if tc.busy {
+				require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "config.json"), nil, 0644))
+			}
+
+			var opts []ObserveOption
+			if tc.cleanup {
+				opts = append(opts, WithSocketDirCleanup())
+			}
+			state, err := ObserveState(context.Background(), socket, opts...)
+			require.NoError(t, err, "could not listen on socket")
+			require.NoError(t, PushState(context.Background(), socket, StateRunning, StateExited))
+			for range state {
+			}
+
+			_, err = os.Stat(socket)
+			require.True(t, os.IsNotExist(err), "socket is not removed once channel is closed")
+			_, err = os.Stat(dir)
+			require.Equal(t, tc.expectDir, err == nil, "unexpected socket dir stat error %v", err)
+		})
+	}
+}
+
+func TestObserveState_CreateSocketDir(t *testing.T) {
+	defer checkLeaks(t)()
+
+	dir, err := ioutil.TempDir("", "sync-mkdir-")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	tt := []struct {
+		name       string
+		opts       []ObserveOption
+		socket     string
+		expectMode os.FileMode
+		expectWarn bool
+	}{
+		{
+			name:       "default",
+			socket:     filepath.Join(dir, "default", "run", "sync.sock"),
+			expectMode: DefaultSocketDirPermissions,
+		},
+		{
+			name:       "permissions",
+			opts:       []ObserveOption{WithSocketDirPermissions(0711), WithSocketDirOwner(os.Getuid(), os.Getgid())},
+			socket:     filepath.Join(dir, "permissions", "run", "sync.sock"),
+			expectMode: 0711,
+		},
+		{
+			name:       "existing dir",
+			opts:       []ObserveOption{WithSocketDirPermissions(0711)},
+			socket:     filepath.Join(dir, "sync.sock"),
+			expectMode: 0700,
+			expectWarn: true,
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			log := &testLogger{}
+			state, err := ObserveState(ctx, tc.socket, append(tc.opts, WithLogger(log))...)
+			require.NoError(t, err, "could not listen on socket")
+			require.NoError(t, PushState(ctx, tc.socket, StateExited))
+			require.Equal(t, StateExited, <-state)
+
+			for d := filepath.Dir(tc.socket); d != dir; d = filepath.Dir(d) {
+				fi, err := os.Stat(d)
+				require.NoError(t, err)
+				require.Equal(t, tc.expectMode, fi.Mode().Perm(), "unexpected permissions of %s", d)
+			}
+			fi, err := os.Stat(dir)
+			require.NoError(t, err)
+			require.Equal(t, os.FileMode(0700), fi.Mode().Perm())
+
+			var warned bool
+			for _, msg := range log.Messages() {
+				if msg == fmt.Sprintf("W Socket directory %s has permissions -rwx------, expected -rwx--x--x", dir) {
+					warned = true
+				}
+			}
+			require.Equal(t, tc.expectWarn, warned, "unexpected messages: %v", log.Messages())
+		})
+	}
+}
@@ -15,10 +15,18 @@
 package runtime
 
 import (
+	"bytes"
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"net"
 	"os"
 	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
@@ -28,6 +36,8 @@ import (
 )
 
 func TestObserveState_Cancel(t *testing.T) {
+	defer checkLeaks(t)()
+
 	ctx, cancel := context.WithCancel(context.Background())
 	socket := filepath.Join(os.TempDir(), fmt.Sprintf("cri-test-%s.sock", t.Name()))
 
@@ -38,7 +48,43 @@ func TestObserveState_Cancel(t *testing.T) {
 	assert.True(t, os.IsNotExist(os.Remove(socket)))
 }
 
+func TestObserveState_CancelNoClient(t *testing.T) {
+	defer checkLeaks(t)()
+
+	tt := []struct {
+		name   string
+		socket string
+	}{
+		{
+			name:   "unix",
+			socket: filepath.Join(os.TempDir(), "cri-test-cancel-no-client.sock"),
+		},
+		{
+			name:   "tcp",
+			socket: "tcp://127.0.0.1:0",
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			state, err := ObserveState(ctx, tc.socket)
+			require.NoError(t, err, "could not listen on socket")
+
+			cancel()
+			select {
+			case _, ok := <-state:
+				require.False(t, ok, "unexpected state")
+			case <-time.After(time.Second):
+				t.Fatal("channel was not closed after cancel")
+			}
+		})
+	}
+}
+
 func TestObserveState_InvalidJSON(t *testing.T) {
+	defer checkLeaks(t)()
+
 	ctx, cancel := context.WithCancel(context.Background())
 	socket := filepath.Join(os.TempDir(), fmt.Sprintf("cri-test-%s.sock", t.Name()))
 
@@ -58,6 +104,8 @@ func TestObserveState_InvalidJSON(t *testing.T) {
 }
 
 func TestObserveState_AllWithDelay(t *testing.T) {
+	defer checkLeaks(t)()
+
 	ctx, cancel := context.WithCancel(context.Background())
 	socket := filepath.Join(os.TempDir(), fmt.Sprintf("cri-test-%s.sock", t.Name()))
 
@@ -105,3 +153,2602 @@ func TestObserveState_AllWithDelay(t *testing.T) {
 	cancel()
 	assert.True(t, os.IsNotExist(os.Remove(socket)))
 }
+
+func TestObserveStateEvents_UnknownStatus(t *testing.T) {
+	defer checkLeaks(t)()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	socket := filepath.Join(os.TempDir(), fmt.Sprintf("cri-test-%s.sock", t.Name()))
+
+	events, err := ObserveStateEvents(ctx, socket)
+	require.NoError(t, err, "could not listen on socket")
+	go func(t *testing.T) {
+		for _, status := range []string{"bogus", "stopped"} {
+			c, err := unix.Dial(socket)
+			require.NoError(t, err)
+			_, err = c.Write([]byte(fmt.Sprintf(`{"status": %q}`, status)))
+			assert.NoError(t, err)
+			assert.NoError(t, c.Close())
+		}
+	}(t)
+
+	event := <-events
+	assert.Equal(t, StateUnknown, event.State)
+	assert.Equal(t, "bogus", event.Status)
+	event = <-events
+	assert.Equal(t, StateExited, event.State)
+	assert.Equal(t, "stopped", event.Status)
+	_, ok := <-events
+	assert.False(t, ok)
+	assert.True(t, os.IsNotExist(os.Remove(socket)))
+}
+
+func TestObserveStateEvents_Pid(t *testing.T) {
+	defer checkLeaks(t)()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	socket := filepath.Join(os.TempDir(), fmt.Sprintf("cri-test-%s.sock", t.Name()))
+
+	before := time.Now()
+	events, err := ObserveStateEvents(ctx, socket)
+	require.NoError(t, err, "could not listen on socket")
+	go func(t *testing.T) {
+		c, err := unix.Dial(socket)
+		require.NoError(t, err)
+		_, err = c.Write([]byte(`{"status": "running", "pid": 42}`))
+		assert.NoError(t, err)
+		assert.NoError(t, c.Close())
+	}(t)
+
+	event := <-events
+	assert.Equal(t, StateRunning, event.State)
+	assert.Equal(t, 42, event.Pid)
+	assert.False(t, event.Time.Before(before))
+	cancel()
+	_, ok := <-events
+	assert.False(t, ok)
+}
+
+func TestObserveStateEvents_RawStatus(t *testing.T) {
+	defer checkLeaks(t)()
+
+	tt := []struct {
+		name   string
+		opts   []ObserveOption
+		expect []string
+	}{
+		{
+			name:   "not kept",
+			expect: []string{"", ""},
+		},
+		{
+			name: "kept",
+			opts: []ObserveOption{WithRawStatus()},
+			expect: []string{
+				`{"status": "running", "annotations": {"restart": "1"}}`,
+				`{"status": "stopped"}`,
+			},
+		},
+		{
+			name: "kept with status fields",
+			opts: []ObserveOption{WithRawStatus(), WithStatusFields("status")},
+			expect: []string{
+				`{"status": "running", "annotations": {"restart": "1"}}`,
+				`{"status": "stopped"}`,
+			},
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			o := newObserver("", tc.opts...)
+			o.events = make(chan StateEvent, 2)
+			require.NoError(t, o.start(ctx), "could not listen on socket")
+			c, err := net.Dial(o.addr.Network(), o.addr.String())
+			require.NoError(t, err)
+			_, err = c.Write([]byte(`{"status": "running", "annotations": {"restart": "1"}} {"status": "stopped"}`))
+			require.NoError(t, err)
+			require.NoError(t, c.Close())
+
+			var actual []string
+			for event := range o.events {
+				actual = append(actual, string(event.Raw))
+			}
+			require.Equal(t, tc.expect, actual)
+		})
+	}
+}
+
+func TestObserveStateEvents_ExitCode(t *testing.T) {
+	defer checkLeaks(t)()
+
+	tt := []struct {
+		name         string
+		status       string
+		expectCode   int
+		expectSignal int
+	}{
+		{
+			name:   "not reported",
+			status: `{"status": "stopped"}`,
+		},
+		{
+			name:       "exit code",
+			status:     `{"status": "stopped", "exitCode": 3}`,
+			expectCode: 3,
+		},
+		{
+			name:         "signal",
+			status:       `{"status": "stopped", "exitCode": 137, "signal": 9}`,
+			expectCode:   137,
+			expectSignal: 9,
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			socket := filepath.Join(os.TempDir(), fmt.Sprintf("cri-test-exit-code-%d.sock", time.Now().UnixNano()))
+
+			events, err := ObserveStateEvents(ctx, socket)
+			require.NoError(t, err, "could not listen on socket")
+			c, err := unix.Dial(socket)
+			require.NoError(t, err)
+			defer c.Close()
+			_, err = c.Write([]byte(tc.status))
+			require.NoError(t, err)
+
+			event := <-events
+			assert.Equal(t, StateExited, event.State)
+			assert.Equal(t, tc.expectCode, event.ExitCode)
+			assert.Equal(t, tc.expectSignal, event.Signal)
+		})
+	}
+}
+
+func TestObserveState_StaleSocket(t *testing.T) {
+	defer checkLeaks(t)()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	socket := filepath.Join(os.TempDir(), fmt.Sprintf("cri-test-%s.sock", t.Name()))
+
+	ln, err := net.Listen("unix", socket)
+	require.NoError(t, err, "could not create stale socket")
+	ln.(*net.UnixListener).SetUnlinkOnClose(false)
+	require.NoError(t, ln.Close())
+	_, err = os.Stat(socket)
+	require.NoError(t, err, "stale socket is missing")
+
+	state, err := ObserveState(ctx, socket)
+	require.NoError(t, err, "could not listen on stale socket")
+	go func(t *testing.T) {
+		c, err := unix.Dial(socket)
+		require.NoError(t, err)
+		_, err = c.Write([]byte(`{"status": "stopped"}`))
+		assert.NoError(t, err)
+		assert.NoError(t, c.Close())
+	}(t)
+
+	assert.Equal(t, StateExited, <-state)
+	assert.Equal(t, StateUnknown, <-state)
+	cancel()
+	assert.True(t, os.IsNotExist(os.Remove(socket)))
+}
+
+func TestObserveState_AbstractSocket(t *testing.T) {
+	defer checkLeaks(t)()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	socket := fmt.Sprintf("@cri-test-%s.sock", t.Name())
+
+	state, err := ObserveState(ctx, socket)
+	require.NoError(t, err, "could not listen on socket")
+	go func(t *testing.T) {
+		c, err := net.Dial("unix", socket)
+		require.NoError(t, err)
+		_, err = c.Write([]byte(`{"status": "stopped"}`))
+		assert.NoError(t, err)
+		assert.NoError(t, c.Close())
+	}(t)
+
+	assert.Equal(t, StateExited, <-state)
+}
+
+func TestObserveState_DrainTimeout(t *testing.T) {
+	defer checkLeaks(t)()
+
+	tt := []struct {
+		name         string
+		drainTimeout time.Duration
+		expectExited bool
+	}{
+		{
+			name:         "no drain",
+			expectExited: false,
+		},
+		{
+			name:         "drain",
+			drainTimeout: time.Second,
+			expectExited: true,
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			socket := filepath.Join(os.TempDir(), fmt.Sprintf("cri-test-%d.sock", time.Now().UnixNano()))
+
+			state, err := ObserveState(ctx, socket, WithDrainTimeout(tc.drainTimeout))
+			require.NoError(t, err, "could not listen on socket")
+
+			c, err := unix.Dial(socket)
+			require.NoError(t, err)
+			_, err = c.Write([]byte(`{"status": "running"}`))
+			require.NoError(t, err)
+			require.Equal(t, StateRunning, <-state)
+
+			cancel()
+			time.Sleep(time.Millisecond * 10)
+			c.Write([]byte(`{"status": "stopped"}`))
+			c.Close()
+
+			s, ok := <-state
+			assert.Equal(t, tc.expectExited, ok)
+			if ok {
+				assert.Equal(t, StateExited, s)
+				_, ok = <-state
+				assert.False(t, ok)
+			}
+			assert.True(t, os.IsNotExist(os.Remove(socket)))
+		})
+	}
+}
+
+func TestObserveStateOn(t *testing.T) {
+	defer checkLeaks(t)()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	state, addr, err := ObserveStateOn(ctx, "")
+	require.NoError(t, err, "could not listen on socket")
+	require.NotEmpty(t, addr.String())
+	go func(t *testing.T) {
+		c, err := net.Dial(addr.Network(), addr.String())
+		require.NoError(t, err)
+		_, err = c.Write([]byte(`{"status": "stopped"}`))
+		assert.NoError(t, err)
+		assert.NoError(t, c.Close())
+	}(t)
+
+	assert.Equal(t, StateExited, <-state)
+}
+
+func TestObserveState_NoConsumer(t *testing.T) {
+	defer checkLeaks(t)()
+
+	baseline := runtime.NumGoroutine()
+	ctx, cancel := context.WithCancel(context.Background())
+	socket := filepath.Join(os.TempDir(), fmt.Sprintf("cri-test-%s.sock", t.Name()))
+
+	_, err := ObserveState(ctx, socket)
+	require.NoError(t, err, "could not listen on socket")
+
+	c, err := unix.Dial(socket)
+	require.NoError(t, err)
+	for i := 0; i < 8; i++ {
+		_, err = c.Write([]byte(`{"status": "running"}`))
+		require.NoError(t, err)
+	}
+	cancel()
+	require.NoError(t, c.Close())
+
+	for i := 0; i < 100 && runtime.NumGoroutine() > baseline; i++ {
+		time.Sleep(time.Millisecond * 10)
+	}
+	assert.True(t, runtime.NumGoroutine() <= baseline, "observer goroutines leaked")
+	assert.True(t, os.IsNotExist(os.Remove(socket)))
+}
+
+func TestObserveState_TerminalSendTimeout(t *testing.T) {
+	defer checkLeaks(t)()
+
+	tt := []struct {
+		name    string
+		timeout time.Duration
+		cancel  bool
+		warning bool
+	}{
+		{
+			name:    "timeout",
+			timeout: 20 * time.Millisecond,
+			warning: true,
+		},
+		{
+			name:   "no timeout",
+			cancel: true,
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			log := &testLogger{}
+			o := newObserver("", WithLogger(log), WithTerminalSendTimeout(tc.timeout))
+			o.states = make(chan State, 1)
+			require.NoError(t, o.start(ctx), "could not listen on socket")
+			c, err := net.Dial(o.addr.Network(), o.addr.String())
+			require.NoError(t, err)
+			defer c.Close()
+			_, err = c.Write([]byte(`{"status": "running"} {"status": "stopped"}`))
+			require.NoError(t, err)
+
+			// consumer is gone after running state, which fills the channel
+			if tc.cancel {
+				time.Sleep(20 * time.Millisecond)
+				cancel()
+			}
+			select {
+			case <-o.done:
+			case <-time.After(time.Second):
+				t.Fatal("observation is not over")
+			}
+
+			require.Equal(t, StateRunning, <-o.states)
+			_, ok := <-o.states
+			require.False(t, ok)
+			warning := fmt.Sprintf("W Dropping final state exited at %s: not received by consumer within %v",
+				o.socket, tc.timeout)
+			if tc.warning {
+				require.Contains(t, log.Messages(), warning)
+			} else {
+				require.NotContains(t, log.Messages(), warning)
+			}
+		})
+	}
+}
+
+func TestObserveState_Reconnect(t *testing.T) {
+	defer checkLeaks(t)()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	socket := filepath.Join(os.TempDir(), fmt.Sprintf("cri-test-%s.sock", t.Name()))
+
+	state, err := ObserveState(ctx, socket)
+	require.NoError(t, err, "could not listen on socket")
+	go func(t *testing.T) {
+		for _, data := range []string{
+			``,
+			`{"status": "running"} {"status": "stop`,
+			`{"status": "stopped"}`,
+		} {
+			c, err := unix.Dial(socket)
+			require.NoError(t, err)
+			_, err = c.Write([]byte(data))
+			assert.NoError(t, err)
+			assert.NoError(t, c.Close())
+		}
+	}(t)
+
+	assert.Equal(t, StateRunning, <-state)
+	assert.Equal(t, StateExited, <-state)
+	_, ok := <-state
+	assert.False(t, ok)
+	assert.True(t, os.IsNotExist(os.Remove(socket)))
+}
+
+func TestObserveState_StatusMapping(t *testing.T) {
+	defer checkLeaks(t)()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	socket := filepath.Join(os.TempDir(), fmt.Sprintf("cri-test-%s.sock", t.Name()))
+
+	state, err := ObserveState(ctx, socket, WithStatusMapping(map[string]State{
+		"created": StateCreated,
+		"running": StateRunning,
+		"paused":  StatePaused,
+		"stopped": StateExited,
+	}))
+	require.NoError(t, err, "could not listen on socket")
+	go func(t *testing.T) {
+		c, err := unix.Dial(socket)
+		require.NoError(t, err)
+		_, err = c.Write([]byte(`{"status": "creating"} {"status": "created"} {"status": "paused"} {"status": "stopped"}`))
+		assert.NoError(t, err)
+		assert.NoError(t, c.Close())
+	}(t)
+
+	assert.Equal(t, StateUnknown, <-state)
+	assert.Equal(t, StateCreated, <-state)
+	assert.Equal(t, StatePaused, <-state)
+	assert.Equal(t, StateExited, <-state)
+	_, ok := <-state
+	assert.False(t, ok)
+}
+
+func TestObserveState_PreparingStatuses(t *testing.T) {
+	defer checkLeaks(t)()
+
+	tt := []struct {
+		name   string
+		opts   []ObserveOption
+		status string
+		expect []State
+	}{
+		{
+			name:   "default",
+			status: `{"status": "preparing"} {"status": "pulling"} {"status": "creating"} {"status": "stopped"}`,
+			expect: []State{StatePreparing, StateUnknown, StateCreating, StateExited},
+		},
+		{
+			name:   "alias",
+			opts:   []ObserveOption{WithPreparingStatuses("pulling")},
+			status: `{"status": "preparing"} {"status": "pulling"} {"status": "creating"} {"status": "stopped"}`,
+			expect: []State{StatePreparing, StatePreparing, StateCreating, StateExited},
+		},
+		{
+			name:   "strict",
+			opts:   []ObserveOption{WithStrictTransitions()},
+			status: `{"status": "preparing"} {"status": "creating"} {"status": "created"} {"status": "stopped"}`,
+			expect: []State{StatePreparing, StateCreating, StateCreated, StateExited},
+		},
+		{
+			name:   "no preparing",
+			opts:   []ObserveOption{WithStrictTransitions()},
+			status: `{"status": "creating"} {"status": "created"} {"status": "stopped"}`,
+			expect: []State{StateCreating, StateCreated, StateExited},
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			o, err := Observe(ctx, "", tc.opts...)
+			require.NoError(t, err, "could not listen on socket")
+			c, err := net.Dial(o.Addr().Network(), o.Addr().String())
+			require.NoError(t, err)
+			_, err = c.Write([]byte(tc.status))
+			require.NoError(t, err)
+			require.NoError(t, c.Close())
+
+			var actual []State
+			for state := range o.States() {
+				actual = append(actual, state)
+			}
+			require.Equal(t, tc.expect, actual)
+			require.NoError(t, o.Err())
+		})
+	}
+}
+
+type testLogger struct {
+	mu       sync.Mutex
+	messages []string
+}
+
+func (l *testLogger) Debugf(format string, args ...interface{}) {
+	l.logf("D "+format, args...)
+}
+
+func (l *testLogger) Warningf(format string, args ...interface{}) {
+	l.logf("W "+format, args...)
+}
+
+func (l *testLogger) Errorf(format string, args ...interface{}) {
+	l.logf("E "+format, args...)
+}
+
+func (l *testLogger) logf(format string, args ...interface{}) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.messages = append(l.messages, fmt.Sprintf(format, args...))
+}
+
+func (l *testLogger) Messages() []string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return append([]string(nil), l.messages...)
+}
+
+func TestQuiescentLogger(t *testing.T) {
+	log := &testLogger{}
+	l := NewQuiescentLogger(log)
+	l.Debugf("debug %d", 1)
+	l.Warningf("warning %d", 2)
+	l.Errorf("error %d", 3)
+	l.Quiesce()
+	l.Warningf("after quiesce")
+	l.Quiesce()
+	require.Equal(t, []string{"D debug 1", "W warning 2", "E error 3"}, log.Messages())
+}
+
+func TestObserveState_Logger(t *testing.T) {
+	defer checkLeaks(t)()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	socket := filepath.Join(os.TempDir(), fmt.Sprintf("cri-test-%s.sock", t.Name()))
+
+	log := &testLogger{}
+	state, err := ObserveState(ctx, socket, WithLogger(log), WithContainerID("test-id"))
+	require.NoError(t, err, "could not listen on socket")
+	go func(t *testing.T) {
+		c, err := unix.Dial(socket)
+		require.NoError(t, err)
+		_, err = c.Write([]byte(`{"status": "bogus"} {"status": "stopped"}`))
+		assert.NoError(t, err)
+		assert.NoError(t, c.Close())
+	}(t)
+
+	assert.Equal(t, StateUnknown, <-state)
+	assert.Equal(t, StateExited, <-state)
+	_, ok := <-state
+	require.False(t, ok)
+	assert.Equal(t, []string{
+		fmt.Sprintf(`W test-id: Received unknown status "bogus" at %s`, socket),
+		fmt.Sprintf(`D test-id: Received state exited at %s`, socket),
+		fmt.Sprintf(`D test-id: Sync connection at %s closed: 2 status objects decoded, 41 bytes read`, socket),
+	}, log.Messages())
+}
+
+func TestObserveState_Transports(t *testing.T) {
+	defer checkLeaks(t)()
+
+	tt := []struct {
+		name        string
+		socket      string
+		expectError string
+	}{
+		{
+			name:   "unix scheme",
+			socket: "unix://" + filepath.Join(os.TempDir(), "cri-test-unix-scheme.sock"),
+		},
+		{
+			name:   "tcp",
+			socket: "tcp://127.0.0.1:0",
+		},
+		{
+			name:        "unsupported",
+			socket:      "udp://127.0.0.1:0",
+			expectError: `could not listen sync socket: unsupported sync socket scheme "udp"`,
+		},
+		{
+			name:        "invalid vsock",
+			socket:      "vsock://2",
+			expectError: `could not listen sync socket: missing port in vsock address "2"`,
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			state, addr, err := ObserveStateOn(ctx, tc.socket)
+			if tc.expectError != "" {
+				require.EqualError(t, err, tc.expectError)
+				return
+			}
+			require.NoError(t, err, "could not listen on socket")
+
+			c, err := net.Dial(addr.Network(), addr.String())
+			require.NoError(t, err)
+			_, err = c.Write([]byte(`{"status": "stopped"}`))
+			require.NoError(t, err)
+			require.NoError(t, c.Close())
+			require.Equal(t, StateExited, <-state)
+		})
+	}
+}
+
+func TestObserveState_MaxStatusSize(t *testing.T) {
+	defer checkLeaks(t)()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	socket := filepath.Join(os.TempDir(), fmt.Sprintf("cri-test-%s.sock", t.Name()))
+
+	state, err := ObserveState(ctx, socket)
+	require.NoError(t, err, "could not listen on socket")
+	go func(t *testing.T) {
+		c, err := unix.Dial(socket)
+		require.NoError(t, err)
+		_, err = c.Write([]byte(`{"status": "running"}`))
+		assert.NoError(t, err)
+		// observer closes connection so the write fails
+		c.Write([]byte(`{"status": "` + strings.Repeat("a", 1<<20) + `"}`))
+		c.Close()
+
+		c, err = unix.Dial(socket)
+		require.NoError(t, err)
+		_, err = c.Write([]byte(`{"status": "stopped"}`))
+		assert.NoError(t, err)
+		assert.NoError(t, c.Close())
+	}(t)
+
+	assert.Equal(t, StateRunning, <-state)
+	assert.Equal(t, StateExited, <-state)
+	_, ok := <-state
+	assert.False(t, ok)
+}
+
+func TestObserveState_Token(t *testing.T) {
+	defer checkLeaks(t)()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	socket := filepath.Join(os.TempDir(), fmt.Sprintf("cri-test-%s.sock", t.Name()))
+
+	state, err := ObserveState(ctx, socket, WithToken("secret"))
+	require.NoError(t, err, "could not listen on socket")
+	go func(t *testing.T) {
+		for _, data := range []string{
+			`{"status": "stopped"}`,
+			`{"status": "stopped", "token": "guess"}`,
+			`{"status": "running", "token": "secret"}`,
+			`{"status": "stopped", "token": "secret"}`,
+		} {
+			c, err := unix.Dial(socket)
+			require.NoError(t, err)
+			_, err = c.Write([]byte(data))
+			assert.NoError(t, err)
+			assert.NoError(t, c.Close())
+		}
+	}(t)
+
+	assert.Equal(t, StateRunning, <-state)
+	assert.Equal(t, StateExited, <-state)
+	_, ok := <-state
+	assert.False(t, ok)
+}
+
+func TestObserveState_Version(t *testing.T) {
+	defer checkLeaks(t)()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	socket := filepath.Join(os.TempDir(), fmt.Sprintf("cri-test-%s.sock", t.Name()))
+
+	log := &testLogger{}
+	var reasons []error
+	state, err := ObserveState(ctx, socket,
+		WithLogger(log),
+		OnDisconnect(func(_ net.Addr, err error) { reasons = append(reasons, err) }),
+	)
+	require.NoError(t, err, "could not listen on socket")
+	go func(t *testing.T) {
+		for _, data := range []string{
+			`{"status": "created"}`,
+			`{"v": 1, "status": "running"}`,
+			`{"v": 2, "status": "stopped"} {"status": "stopped"}`,
+			`{"v": 1, "status": "stopped"}`,
+		} {
+			c, err := unix.Dial(socket)
+			require.NoError(t, err)
+			_, err = c.Write([]byte(data))
+			assert.NoError(t, err)
+			assert.NoError(t, c.Close())
+			time.Sleep(time.Millisecond)
+		}
+	}(t)
+
+	assert.Equal(t, StateCreated, <-state)
+	assert.Equal(t, StateRunning, <-state)
+	assert.Equal(t, StateExited, <-state)
+	_, ok := <-state
+	require.False(t, ok)
+
+	require.Len(t, reasons, 4)
+	assert.True(t, errors.Is(reasons[2], errUnsupportedVersion), "unexpected reason %v", reasons[2])
+	assert.Contains(t, log.Messages(),
+		fmt.Sprintf("W Closing sync connection at %s: unsupported sync protocol version 2", socket))
+}
+
+func TestObserveState_Handshake(t *testing.T) {
+	defer checkLeaks(t)()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	socket := filepath.Join(os.TempDir(), fmt.Sprintf("cri-test-%s.sock", t.Name()))
+
+	log := &testLogger{}
+	var reasons []error
+	state, err := ObserveState(ctx, socket,
+		WithLogger(log),
+		WithHandshake("FORK/1\n"),
+		OnDisconnect(func(_ net.Addr, err error) { reasons = append(reasons, err) }),
+	)
+	require.NoError(t, err, "could not listen on socket")
+	go func(t *testing.T) {
+		for _, data := range []string{
+			"FORK/1\n{\"status\": \"created\"}",
+			`{"status": "running"}`,
+			"FORK/1\n{\"status\": \"running\"} {\"status\": \"stopped\"}",
+		} {
+			c, err := unix.Dial(socket)
+			require.NoError(t, err)
+			_, err = c.Write([]byte(data))
+			assert.NoError(t, err)
+			assert.NoError(t, c.Close())
+			time.Sleep(time.Millisecond)
+		}
+	}(t)
+
+	var actual []State
+	for s := range state {
+		actual = append(actual, s)
+	}
+	require.Equal(t, []State{StateCreated, StateRunning, StateExited}, actual)
+
+	require.Len(t, reasons, 3)
+	assert.True(t, errors.Is(reasons[1], errBadHandshake), "unexpected reason %v", reasons[1])
+	assert.Contains(t, log.Messages(),
+		fmt.Sprintf("W Closing sync connection at %s: unexpected handshake \"{\\\"statu\"", socket))
+}
+
+func TestReadHandshake(t *testing.T) {
+	tt := []struct {
+		name   string
+		input  string
+		expect error
+	}{
+		{name: "match", input: "FORK/1\n{}"},
+		{name: "mismatch", input: "FORK/2\n{}", expect: errBadHandshake},
+		{name: "short", input: "FORK", expect: errBadHandshake},
+		{name: "empty", input: "", expect: io.EOF},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			err := readHandshake(strings.NewReader(tc.input), []byte("FORK/1\n"))
+			require.True(t, errors.Is(err, tc.expect), "unexpected error %v", err)
+		})
+	}
+}
+
+func TestValidTransition(t *testing.T) {
+	tt := []struct {
+		prev   State
+		next   State
+		expect bool
+	}{
+		{prev: StateUnknown, next: StateRunning, expect: true},
+		{prev: StateCreating, next: StateCreated, expect: true},
+		{prev: StateCreated, next: StateRunning, expect: true},
+		{prev: StateRunning, next: StateRunning, expect: true},
+		{prev: StateRunning, next: StatePaused, expect: true},
+		{prev: StatePaused, next: StateRunning, expect: true},
+		{prev: StatePaused, next: StateExited, expect: true},
+		{prev: StateCreating, next: StateExited, expect: true},
+		{prev: StateRunning, next: StateUnknown, expect: true},
+		{prev: StateCreated, next: StatePaused, expect: false},
+		{prev: StateRunning, next: StateCreated, expect: false},
+		{prev: StateExited, next: StateRunning, expect: false},
+		{prev: StateExited, next: StatePaused, expect: false},
+		{prev: StatePaused, next: StateResumed, expect: true},
+		{prev: StateResumed, next: StatePaused, expect: true},
+		{prev: StateResumed, next: StateRunning, expect: true},
+		{prev: StateResumed, next: StateExited, expect: true},
+		{prev: StateRunning, next: StateResumed, expect: false},
+		{prev: StateCreated, next: StateResumed, expect: false},
+		{prev: StateUnknown, next: StateCreating, expect: true},
+		{prev: StateCreating, next: StateCreating, expect: false},
+		{prev: StateRunning, next: StateCreating, expect: false},
+		{prev: StateUnknown, next: StatePreparing, expect: true},
+		{prev: StatePreparing, next: StatePreparing, expect: true},
+		{prev: StatePreparing, next: StateCreating, expect: true},
+		{prev: StatePreparing, next: StateExited, expect: true},
+		{prev: StateCreating, next: StatePreparing, expect: false},
+		{prev: StateRunning, next: StatePreparing, expect: false},
+	}
+
+	for _, tc := range tt {
+		t.Run(fmt.Sprintf("%v to %v", tc.prev, tc.next), func(t *testing.T) {
+			require.Equal(t, tc.expect, validTransition(tc.prev, tc.next))
+		})
+	}
+}
+
+func TestObserveStateEvents_StrictTransitions(t *testing.T) {
+	defer checkLeaks(t)()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	socket := filepath.Join(os.TempDir(), fmt.Sprintf("cri-test-%s.sock", t.Name()))
+
+	events, err := ObserveStateEvents(ctx, socket, WithStrictTransitions())
+	require.NoError(t, err, "could not listen on socket")
+	go func(t *testing.T) {
+		c, err := unix.Dial(socket)
+		require.NoError(t, err)
+		_, err = c.Write([]byte(`{"status": "running"} {"status": "created"} {"status": "stopped"}`))
+		assert.NoError(t, err)
+		assert.NoError(t, c.Close())
+	}(t)
+
+	event := <-events
+	assert.Equal(t, StateRunning, event.State)
+	assert.NoError(t, event.Err)
+	event = <-events
+	assert.Equal(t, StateCreated, event.State)
+	assert.Equal(t, &TransitionError{From: StateRunning, To: StateCreated}, event.Err)
+	_, ok := <-events
+	assert.False(t, ok)
+}
+
+func TestObserveStateEvents_RepeatedCreating(t *testing.T) {
+	defer checkLeaks(t)()
+
+	tt := []struct {
+		name   string
+		opts   []ObserveOption
+		expect []State
+		err    error
+	}{
+		{
+			name:   "lenient",
+			expect: []State{StateRunning, StateCreating, StateExited},
+		},
+		{
+			name:   "strict",
+			opts:   []ObserveOption{WithStrictTransitions()},
+			expect: []State{StateRunning, StateCreating},
+			err:    &TransitionError{From: StateRunning, To: StateCreating},
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			log := &testLogger{}
+			o := newObserver("", append(tc.opts, WithLogger(log))...)
+			o.events = make(chan StateEvent, 1)
+			require.NoError(t, o.start(ctx))
+			c, err := net.Dial(o.addr.Network(), o.addr.String())
+			require.NoError(t, err)
+			_, err = c.Write([]byte(`{"status": "running"} {"status": "creating"} {"status": "stopped"}`))
+			require.NoError(t, err)
+			require.NoError(t, c.Close())
+
+			var actual []State
+			var last error
+			for event := range o.events {
+				actual = append(actual, event.State)
+				last = event.Err
+			}
+			require.Equal(t, tc.expect, actual)
+			require.Equal(t, tc.err, last)
+			if tc.err == nil {
+				require.Contains(t, log.Messages(), fmt.Sprintf("W Received creating state after running at %s, "+
+					"container is not expected to be created again", o.socket))
+			}
+		})
+	}
+}
+
+func TestObserveState_Coalesce(t *testing.T) {
+	defer checkLeaks(t)()
+
+	tt := []struct {
+		name   string
+		opts   []ObserveOption
+		expect []State
+	}{
+		{
+			name:   "default",
+			expect: []State{StateRunning, StateRunning, StateRunning, StatePaused, StateRunning, StateExited},
+		},
+		{
+			name:   "coalesce",
+			opts:   []ObserveOption{WithCoalesce()},
+			expect: []State{StateRunning, StatePaused, StateRunning, StateExited},
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			opts := append([]ObserveOption{WithBufferSize(8)}, tc.opts...)
+			state, addr, err := ObserveStateOn(ctx, "", opts...)
+			require.NoError(t, err, "could not listen on socket")
+			c, err := net.Dial(addr.Network(), addr.String())
+			require.NoError(t, err)
+			defer c.Close()
+			_, err = c.Write([]byte(`{"status": "running"} {"status": "running"} {"status": "running"}
+				{"status": "paused"} {"status": "running"} {"status": "stopped"}`))
+			require.NoError(t, err)
+
+			var actual []State
+			for s := range state {
+				actual = append(actual, s)
+			}
+			require.Equal(t, tc.expect, actual)
+		})
+	}
+}
+
+func TestObserveStateEvents_CoalesceActivity(t *testing.T) {
+	defer checkLeaks(t)()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	o := newObserver("", WithCoalesce(), WithInactivityTimeout(100*time.Millisecond))
+	o.events = make(chan StateEvent, 4)
+	require.NoError(t, o.start(ctx), "could not listen on socket")
+	c, err := net.Dial(o.addr.Network(), o.addr.String())
+	require.NoError(t, err)
+	defer c.Close()
+
+	// keepalives are not passed, but keep observation going
+	for i := 0; i < 6; i++ {
+		_, err = c.Write([]byte(`{"status": "running"}`))
+		require.NoError(t, err)
+		time.Sleep(40 * time.Millisecond)
+	}
+	_, err = c.Write([]byte(`{"status": "stopped"}`))
+	require.NoError(t, err)
+
+	var actual []State
+	for event := range o.events {
+		require.NoError(t, event.Err)
+		actual = append(actual, event.State)
+	}
+	require.Equal(t, []State{StateRunning, StateExited}, actual)
+}
+
+func TestObserveStateEvents_StartError(t *testing.T) {
+	defer checkLeaks(t)()
+
+	tt := []struct {
+		name   string
+		input  string
+		expect error
+	}{
+		{
+			name:   "exited while creating",
+			input:  `{"status": "creating"} {"status": "stopped", "exitCode": 255}`,
+			expect: &StartError{Last: StateCreating},
+		},
+		{
+			name:   "exited while created",
+			input:  `{"status": "creating"} {"status": "created"} {"status": "stopped", "exitCode": 1}`,
+			expect: &StartError{Last: StateCreated},
+		},
+		{
+			name:  "exited after running",
+			input: `{"status": "creating"} {"status": "created"} {"status": "running"} {"status": "stopped"}`,
+		},
+		{
+			name:  "exited while paused",
+			input: `{"status": "running"} {"status": "paused"} {"status": "stopped"}`,
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			o := newObserver("")
+			o.events = make(chan StateEvent, 4)
+			require.NoError(t, o.start(ctx), "could not listen on socket")
+			c, err := net.Dial(o.addr.Network(), o.addr.String())
+			require.NoError(t, err)
+			defer c.Close()
+			_, err = c.Write([]byte(tc.input))
+			require.NoError(t, err)
+
+			var last StateEvent
+			for event := range o.events {
+				if event.State != StateExited {
+					require.NoError(t, event.StartErr)
+				}
+				last = event
+			}
+			require.Equal(t, StateExited, last.State)
+			require.NoError(t, last.Err)
+			require.Equal(t, tc.expect, last.StartErr)
+
+			obs := &Observer{o: o}
+			require.Equal(t, tc.expect, obs.StartErr())
+			require.NoError(t, obs.Err())
+		})
+	}
+}
+
+func TestObserveState_PauseResume(t *testing.T) {
+	defer checkLeaks(t)()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	state, addr, err := ObserveStateOn(ctx, "", WithStrictTransitions(), WithBufferSize(8))
+	require.NoError(t, err, "could not listen on socket")
+	c, err := net.Dial(addr.Network(), addr.String())
+	require.NoError(t, err)
+	defer c.Close()
+	_, err = c.Write([]byte(`{"status": "running"} {"status": "paused"} {"status": "resumed"}
+		{"status": "running"} {"status": "paused"} {"status": "resumed"} {"status": "stopped"}`))
+	require.NoError(t, err)
+
+	expect := []State{StateRunning, StatePaused, StateResumed, StateRunning, StatePaused, StateResumed, StateExited}
+	var actual []State
+	for s := range state {
+		actual = append(actual, s)
+	}
+	require.Equal(t, expect, actual)
+}
+
+func TestState_JSON(t *testing.T) {
+	for _, state := range states {
+		t.Run(state.String(), func(t *testing.T) {
+			data, err := json.Marshal(state)
+			require.NoError(t, err)
+			require.Equal(t, fmt.Sprintf("%q", state), string(data))
+
+			var actual State
+			require.NoError(t, json.Unmarshal(data, &actual))
+			require.Equal(t, state, actual)
+		})
+	}
+
+	var s State
+	require.EqualError(t, json.Unmarshal([]byte(`"bogus"`), &s), `unknown state "bogus"`)
+	require.Error(t, json.Unmarshal([]byte(`3`), &s))
+}
+
+func TestParseStatus(t *testing.T) {
+	for _, state := range states {
+		t.Run(state.String(), func(t *testing.T) {
+			status := StatusString(state)
+			actual, ok := ParseStatus(status)
+			if state == StateUnknown || state == StateError {
+				require.Empty(t, status)
+				require.False(t, ok)
+				return
+			}
+			require.True(t, ok)
+			require.Equal(t, state, actual)
+			require.Equal(t, state, StatusToState(status))
+		})
+	}
+
+	require.Equal(t, StatusStopped, StatusString(StateExited))
+	state, ok := ParseStatus("exited")
+	require.False(t, ok)
+	require.Equal(t, StateUnknown, state)
+}
+
+func TestObserveState_SocketPermissions(t *testing.T) {
+	defer checkLeaks(t)()
+
+	tt := []struct {
+		name   string
+		opts   []ObserveOption
+		expect os.FileMode
+	}{
+		{
+			name:   "default",
+			expect: DefaultSocketPermissions,
+		},
+		{
+			name:   "custom",
+			opts:   []ObserveOption{WithSocketPermissions(0660)},
+			expect: 0660,
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			socket := filepath.Join(os.TempDir(), fmt.Sprintf("cri-test-perm-%d.sock", time.Now().UnixNano()))
+
+			state, err := ObserveState(ctx, socket, tc.opts...)
+			require.NoError(t, err, "could not listen on socket")
+			fi, err := os.Stat(socket)
+			require.NoError(t, err)
+			require.Equal(t, os.ModeSocket|tc.expect, fi.Mode())
+
+			cancel()
+			for range state {
+			}
+			assert.True(t, os.IsNotExist(os.Remove(socket)))
+		})
+	}
+}
+
+func TestObserveState_SocketInUse(t *testing.T) {
+	defer checkLeaks(t)()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	socket := filepath.Join(os.TempDir(), fmt.Sprintf("cri-test-%s.sock", t.Name()))
+
+	// socket is listened on by someone else
+	ln, err := net.Listen("unix", socket)
+	require.NoError(t, err)
+	defer ln.Close()
+	_, err = ObserveState(ctx, socket)
+	require.EqualError(t, err, fmt.Sprintf("could not listen sync socket: socket %s is in use", socket))
+}
+
+func TestObserveState_AlreadyObserving(t *testing.T) {
+	defer checkLeaks(t)()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	socket := filepath.Join(os.TempDir(), fmt.Sprintf("cri-test-%s.sock", t.Name()))
+
+	var (
+		wg     sync.WaitGroup
+		mu     sync.Mutex
+		states []<-chan State
+		errs   []error
+	)
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func(socket string) {
+			defer wg.Done()
+			state, err := ObserveState(ctx, socket)
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				errs = append(errs, err)
+				return
+			}
+			states = append(states, state)
+		}([]string{socket, "unix://" + socket}[i])
+	}
+	wg.Wait()
+	require.Len(t, states, 1)
+	require.Equal(t, []error{ErrAlreadyObserving}, errs)
+
+	// socket may be observed again once observation is over
+	cancel()
+	for range states[0] {
+	}
+	ctx, cancel = context.WithCancel(context.Background())
+	defer cancel()
+	_, err := ObserveState(ctx, socket)
+	require.NoError(t, err)
+}
+
+func TestObserver_Err(t *testing.T) {
+	tt := []struct {
+		name      string
+		opts      []ObserveOption
+		send      string
+		cancel    bool
+		expectErr string
+	}{
+		{
+			name: "exited",
+			send: `{"status": "running"}{"status": "stopped"}`,
+		},
+		{
+			name:      "context done",
+			send:      `{"status": "running"}`,
+			cancel:    true,
+			expectErr: context.Canceled.Error(),
+		},
+		{
+			name:      "invalid json",
+			send:      `{"this": is [invalid json}`,
+			expectErr: "could not read state: invalid character 'i' looking for beginning of value",
+		},
+		{
+			name:      "invalid transition",
+			opts:      []ObserveOption{WithStrictTransitions()},
+			send:      `{"status": "running"}{"status": "created"}`,
+			expectErr: "invalid state transition from running to created",
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			o, err := Observe(ctx, "", tc.opts...)
+			require.NoError(t, err, "could not listen on socket")
+			c, err := net.Dial(o.Addr().Network(), o.Addr().String())
+			require.NoError(t, err)
+			defer c.Close()
+			_, err = c.Write([]byte(tc.send))
+			require.NoError(t, err)
+
+			if tc.cancel {
+				assert.Equal(t, StateRunning, <-o.States())
+				cancel()
+			}
+			for range o.States() {
+			}
+			if tc.expectErr == "" {
+				require.NoError(t, o.Err())
+			} else {
+				require.EqualError(t, o.Err(), tc.expectErr)
+			}
+		})
+	}
+}
+
+func TestObserveState_BufferSize(t *testing.T) {
+	defer checkLeaks(t)()
+
+	tt := []struct {
+		name      string
+		opts      []ObserveOption
+		expectCap int
+	}{
+		{
+			name:      "default",
+			expectCap: DefaultBufferSize,
+		},
+		{
+			name:      "unbuffered",
+			opts:      []ObserveOption{WithBufferSize(0)},
+			expectCap: 0,
+		},
+		{
+			name:      "negative",
+			opts:      []ObserveOption{WithBufferSize(-1)},
+			expectCap: 0,
+		},
+		{
+			name:      "buffered",
+			opts:      []ObserveOption{WithBufferSize(16)},
+			expectCap: 16,
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			state, err := ObserveState(ctx, "", tc.opts...)
+			require.NoError(t, err, "could not listen on socket")
+			require.Equal(t, tc.expectCap, cap(state))
+		})
+	}
+}
+
+func TestObserveState_SlowConsumer(t *testing.T) {
+	defer checkLeaks(t)()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	state, addr, err := ObserveStateOn(ctx, "", WithBufferSize(16))
+	require.NoError(t, err, "could not listen on socket")
+	c, err := net.Dial(addr.Network(), addr.String())
+	require.NoError(t, err)
+	defer c.Close()
+	for i := 0; i < 15; i++ {
+		_, err = c.Write([]byte(`{"status": "running"}`))
+		require.NoError(t, err)
+	}
+	_, err = c.Write([]byte(`{"status": "stopped"}`))
+	require.NoError(t, err)
+
+	// whole sequence is buffered without anyone reading it
+	for len(state) < 16 {
+		time.Sleep(time.Millisecond)
+	}
+	for i := 0; i < 15; i++ {
+		require.Equal(t, StateRunning, <-state)
+	}
+	require.Equal(t, StateExited, <-state)
+}
+
+func TestObserveState_SocketNameLen(t *testing.T) {
+	defer checkLeaks(t)()
+
+	longDir := filepath.Join(os.TempDir(), strings.Repeat("d", 60), strings.Repeat("d", 60))
+	require.NoError(t, os.MkdirAll(longDir, 0755))
+	defer os.RemoveAll(filepath.Dir(longDir))
+
+	tt := []struct {
+		name        string
+		socket      string
+		expectError string
+	}{
+		{
+			name:   "long path",
+			socket: filepath.Join(longDir, "cri-test.sock"),
+		},
+		{
+			name:        "long file name",
+			socket:      filepath.Join(os.TempDir(), strings.Repeat("s", 108)),
+			expectError: "could not listen sync socket: socket file name is 108 bytes long, but at most 107 bytes are allowed",
+		},
+		{
+			name:   "abstract",
+			socket: "@" + strings.Repeat("s", 107),
+		},
+		{
+			name:        "long abstract",
+			socket:      "@" + strings.Repeat("s", 108),
+			expectError: "could not listen sync socket: abstract socket name is 109 bytes long, but at most 108 bytes are allowed",
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			state, err := ObserveState(ctx, tc.socket)
+			if tc.expectError != "" {
+				require.EqualError(t, err, tc.expectError)
+				return
+			}
+			require.NoError(t, err, "could not listen on socket")
+			c, err := dialSocket(ctx, tc.socket)
+			require.NoError(t, err)
+			defer c.Close()
+			_, err = c.Write([]byte(`{"status": "stopped"}`))
+			require.NoError(t, err)
+			require.Equal(t, StateExited, <-state)
+		})
+	}
+}
+
+func TestObserveStateEvents_InactivityTimeout(t *testing.T) {
+	defer checkLeaks(t)()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	socket := filepath.Join(os.TempDir(), fmt.Sprintf("cri-test-%s.sock", t.Name()))
+
+	events, err := ObserveStateEvents(ctx, socket, WithInactivityTimeout(time.Millisecond*100))
+	require.NoError(t, err, "could not listen on socket")
+	c, err := unix.Dial(socket)
+	require.NoError(t, err)
+	defer c.Close()
+	// runtime reports the first states and hangs without closing connection
+	for _, status := range []string{"created", "running"} {
+		_, err = c.Write([]byte(fmt.Sprintf(`{"status": %q}`, status)))
+		require.NoError(t, err)
+		time.Sleep(time.Millisecond * 60)
+	}
+
+	start := time.Now()
+	assert.Equal(t, StateCreated, (<-events).State)
+	assert.Equal(t, StateRunning, (<-events).State)
+	event := <-events
+	assert.Equal(t, ErrInactive, event.Err)
+	assert.True(t, time.Since(start) < time.Second)
+	_, ok := <-events
+	assert.False(t, ok)
+}
+
+func TestObserver_ErrInactive(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	o, err := Observe(ctx, "", WithInactivityTimeout(time.Millisecond*50))
+	require.NoError(t, err, "could not listen on socket")
+	for range o.States() {
+	}
+	require.Equal(t, ErrInactive, o.Err())
+}
+
+func TestObserveState_Framing(t *testing.T) {
+	defer checkLeaks(t)()
+
+	tt := []struct {
+		name   string
+		stream string
+	}{
+		{
+			name:   "compact",
+			stream: `{"status":"created"}{"status":"running"}{"status":"stopped"}`,
+		},
+		{
+			name:   "json lines",
+			stream: "{\"status\": \"created\"}\n{\"status\": \"running\"}\n{\"status\": \"stopped\"}\n",
+		},
+		{
+			name: "pretty printed",
+			stream: `{
+	"status": "created"
+}
+{
+	"status": "running",
+	"pid": 42
+}
+{
+	"status": "stopped"
+}
+`,
+		},
+		{
+			name:   "blank lines",
+			stream: "\n\n{\"status\": \"created\"}\r\n\n  \t\n{\"status\": \"running\"}\n\n\n{\"status\": \"stopped\"}\n\n",
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			state, addr, err := ObserveStateOn(ctx, "")
+			require.NoError(t, err, "could not listen on socket")
+			c, err := net.Dial(addr.Network(), addr.String())
+			require.NoError(t, err)
+			defer c.Close()
+			// split stream to make sure objects are not required to come in a single read
+			for _, part := range []string{tc.stream[:len(tc.stream)/2], tc.stream[len(tc.stream)/2:]} {
+				_, err = c.Write([]byte(part))
+				require.NoError(t, err)
+				time.Sleep(time.Millisecond * 10)
+			}
+
+			assert.Equal(t, StateCreated, <-state)
+			assert.Equal(t, StateRunning, <-state)
+			assert.Equal(t, StateExited, <-state)
+			_, ok := <-state
+			assert.False(t, ok)
+		})
+	}
+}
+
+func TestObserveStateEvents_OnState(t *testing.T) {
+	defer checkLeaks(t)()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	release := make(chan struct{})
+	var called []State
+	hook := func(event StateEvent) error {
+		called = append(called, event.State)
+		<-release
+		return nil
+	}
+	failing := func(StateEvent) error {
+		return fmt.Errorf("no network")
+	}
+
+	o := newObserver("", OnState(StateCreated, hook), OnState(StateRunning, failing))
+	o.events = make(chan StateEvent, o.bufferSize)
+	require.NoError(t, o.start(ctx), "could not listen on socket")
+	c, err := net.Dial(o.addr.Network(), o.addr.String())
+	require.NoError(t, err)
+	defer c.Close()
+	_, err = c.Write([]byte(`{"status": "created"}{"status": "running"}`))
+	require.NoError(t, err)
+
+	// nothing is passed until the hook returns
+	select {
+	case event := <-o.events:
+		t.Fatalf("unexpected event %v", event.State)
+	case <-time.After(time.Millisecond * 50):
+	}
+	close(release)
+
+	event := <-o.events
+	assert.Equal(t, StateCreated, event.State)
+	assert.NoError(t, event.Err)
+	event = <-o.events
+	assert.Equal(t, StateRunning, event.State)
+	assert.EqualError(t, event.Err, "running state hook failed: no network")
+	var hookErr *HookError
+	require.True(t, errors.As(event.Err, &hookErr))
+	assert.Equal(t, StateRunning, hookErr.State)
+	assert.EqualError(t, hookErr.Err, "no network")
+	_, ok := <-o.events
+	assert.False(t, ok)
+	assert.Equal(t, []State{StateCreated}, called)
+	assert.EqualError(t, o.err, "running state hook failed: no network")
+}
+
+func TestObserveState_LoggerTagsAll(t *testing.T) {
+	defer checkLeaks(t)()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	socket := filepath.Join(os.TempDir(), fmt.Sprintf("cri-test-%s.sock", t.Name()))
+
+	ln, err := net.Listen("unix", socket)
+	require.NoError(t, err, "could not create stale socket")
+	ln.(*net.UnixListener).SetUnlinkOnClose(false)
+	require.NoError(t, ln.Close())
+
+	log := &testLogger{}
+	state, err := ObserveState(ctx, socket, WithLogger(log), WithContainerID("test-id"))
+	require.NoError(t, err, "could not listen on socket")
+	cancel()
+	for range state {
+	}
+
+	messages := log.Messages()
+	require.Len(t, messages, 2)
+	for _, msg := range messages {
+		assert.Contains(t, msg, " test-id: ")
+	}
+}
+
+func TestObserveState_ConnCallbacks(t *testing.T) {
+	defer checkLeaks(t)()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	socket := filepath.Join(os.TempDir(), fmt.Sprintf("cri-test-%s.sock", t.Name()))
+
+	var (
+		mu       sync.Mutex
+		timeline []string
+	)
+	onConnect := func(addr net.Addr) {
+		mu.Lock()
+		defer mu.Unlock()
+		timeline = append(timeline, "connect")
+	}
+	onDisconnect := func(addr net.Addr, err error) {
+		mu.Lock()
+		defer mu.Unlock()
+		timeline = append(timeline, fmt.Sprintf("disconnect: %v", err))
+	}
+
+	state, err := ObserveState(ctx, socket, OnConnect(onConnect), OnDisconnect(onDisconnect))
+	require.NoError(t, err, "could not listen on socket")
+	for _, data := range []string{`{"status": "running"}`, `{"status": "ru`, `{"status": "stopped"}`} {
+		c, err := unix.Dial(socket)
+		require.NoError(t, err)
+		_, err = c.Write([]byte(data))
+		require.NoError(t, err)
+		require.NoError(t, c.Close())
+		time.Sleep(time.Millisecond * 20)
+	}
+
+	assert.Equal(t, StateRunning, <-state)
+	assert.Equal(t, StateExited, <-state)
+	_, ok := <-state
+	assert.False(t, ok)
+
+	mu.Lock()
+	defer mu.Unlock()
+	assert.Equal(t, []string{
+		"connect",
+		"disconnect: <nil>",
+		"connect",
+		"disconnect: unexpected EOF",
+		"connect",
+		"disconnect: <nil>",
+	}, timeline)
+}
+
+func TestObserveStateEvents_ConnectTimeout(t *testing.T) {
+	defer checkLeaks(t)()
+
+	tt := []struct {
+		name        string
+		connect     bool
+		expectError error
+	}{
+		{
+			name:        "never connected",
+			expectError: ErrNoConnection,
+		},
+		{
+			name:    "connected",
+			connect: true,
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			socket := filepath.Join(os.TempDir(), fmt.Sprintf("cri-test-connect-%d.sock", time.Now().UnixNano()))
+
+			events, err := ObserveStateEvents(ctx, socket, WithConnectTimeout(time.Millisecond*50))
+			require.NoError(t, err, "could not listen on socket")
+			if tc.connect {
+				c, err := unix.Dial(socket)
+				require.NoError(t, err)
+				defer c.Close()
+				_, err = c.Write([]byte(`{"status": "running"}`))
+				require.NoError(t, err)
+				assert.Equal(t, StateRunning, (<-events).State)
+			}
+
+			select {
+			case event, ok := <-events:
+				require.NotNil(t, tc.expectError, "unexpected event")
+				require.True(t, ok)
+				require.Equal(t, tc.expectError, event.Err)
+				_, ok = <-events
+				require.False(t, ok)
+			case <-time.After(time.Millisecond * 200):
+				require.Nil(t, tc.expectError, "observation is not stopped")
+			}
+		})
+	}
+}
+
+func TestObserveStateEvents_StateTimeout(t *testing.T) {
+	defer checkLeaks(t)()
+
+	tt := []struct {
+		name        string
+		write       []string
+		expect      []State
+		expectError error
+		// before is the max time since the first state error is reported
+		before time.Duration
+	}{
+		{
+			name:        "stuck creating",
+			write:       []string{"creating"},
+			expect:      []State{StateCreating},
+			expectError: &StateTimeoutError{State: StateCreating, Timeout: time.Millisecond * 100},
+		},
+		{
+			name:        "repeated creating",
+			write:       []string{"creating", "creating"},
+			expect:      []State{StateCreating, StateCreating},
+			expectError: &StateTimeoutError{State: StateCreating, Timeout: time.Millisecond * 100},
+			before:      time.Millisecond * 150,
+		},
+		{
+			name:        "stuck created",
+			write:       []string{"creating", "created"},
+			expect:      []State{StateCreating, StateCreated},
+			expectError: &StateTimeoutError{State: StateCreated, Timeout: time.Millisecond * 150},
+		},
+		{
+			name:   "running",
+			write:  []string{"creating", "created", "running"},
+			expect: []State{StateCreating, StateCreated, StateRunning},
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			o := newObserver("",
+				WithStateTimeout(StateCreating, time.Millisecond*100),
+				WithStateTimeout(StateCreated, time.Millisecond*150),
+			)
+			o.events = make(chan StateEvent, len(tc.write)+1)
+			require.NoError(t, o.start(ctx))
+			c, err := net.Dial(o.addr.Network(), o.addr.String())
+			require.NoError(t, err)
+			defer c.Close()
+			// runtime stalls without closing connection
+			for _, status := range tc.write {
+				_, err = c.Write([]byte(fmt.Sprintf(`{"status": %q}`, status)))
+				require.NoError(t, err)
+				time.Sleep(time.Millisecond * 70)
+			}
+
+			var first time.Time
+			for i, state := range tc.expect {
+				event := <-o.events
+				assert.Equal(t, state, event.State)
+				if i == 0 {
+					first = event.Time
+				}
+			}
+			select {
+			case event, ok := <-o.events:
+				require.NotNil(t, tc.expectError, "unexpected event")
+				require.True(t, ok)
+				require.Equal(t, tc.expectError, event.Err)
+				if tc.before > 0 {
+					require.True(t, event.Time.Sub(first) < tc.before, "timeout is reset by repeated state")
+				}
+				_, ok = <-o.events
+				require.False(t, ok)
+			case <-time.After(time.Millisecond * 300):
+				require.Nil(t, tc.expectError, "observation is not stopped")
+			}
+		})
+	}
+}
+
+func TestObserver_Current(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	o, err := Observe(ctx, "")
+	require.NoError(t, err, "could not listen on socket")
+	require.Equal(t, StateUnknown, o.Current())
+
+	c, err := net.Dial(o.Addr().Network(), o.Addr().String())
+	require.NoError(t, err)
+	defer c.Close()
+	_, err = c.Write([]byte(`{"status": "created"}{"status": "running"}`))
+	require.NoError(t, err)
+
+	// states are not read from the channel yet
+	for o.Current() != StateRunning {
+		time.Sleep(time.Millisecond)
+	}
+	require.Equal(t, StateCreated, <-o.States())
+	require.Equal(t, StateRunning, <-o.States())
+	require.Equal(t, StateRunning, o.Current())
+}
+
+func TestObserveState_StatusFields(t *testing.T) {
+	defer checkLeaks(t)()
+
+	tt := []struct {
+		name   string
+		fields []string
+		stream string
+		expect []State
+	}{
+		{
+			name:   "default",
+			stream: `{"status": "running"}{"state": "paused"}{"status": "stopped"}`,
+			expect: []State{StateRunning, StateUnknown, StateExited},
+		},
+		{
+			name:   "status alias",
+			fields: []string{"status"},
+			stream: `{"status": "running"}{"status": "stopped"}`,
+			expect: []State{StateRunning, StateExited},
+		},
+		{
+			name:   "state alias",
+			fields: []string{"state"},
+			stream: `{"state": "running"}{"status": "paused"}{"state": "stopped"}`,
+			expect: []State{StateRunning, StateUnknown, StateExited},
+		},
+		{
+			name:   "phase alias",
+			fields: []string{"phase"},
+			stream: `{"phase": "running", "pid": 42}{"phase": "stopped"}`,
+			expect: []State{StateRunning, StateExited},
+		},
+		{
+			name:   "first present field is used",
+			fields: []string{"status", "state", "phase"},
+			stream: `{"state": "created"}{"phase": "running", "state": "paused"}{"status": "stopped", "phase": "running"}`,
+			expect: []State{StateCreated, StatePaused, StateExited},
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			var opts []ObserveOption
+			if tc.fields != nil {
+				opts = append(opts, WithStatusFields(tc.fields...))
+			}
+			state, addr, err := ObserveStateOn(ctx, "", opts...)
+			require.NoError(t, err, "could not listen on socket")
+			c, err := net.Dial(addr.Network(), addr.String())
+			require.NoError(t, err)
+			defer c.Close()
+			_, err = c.Write([]byte(tc.stream))
+			require.NoError(t, err)
+
+			var actual []State
+			for s := range state {
+				actual = append(actual, s)
+			}
+			require.Equal(t, tc.expect, actual)
+		})
+	}
+}
+
+func TestObserveState_StatusFieldsInvalid(t *testing.T) {
+	defer checkLeaks(t)()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	o, err := Observe(ctx, "", WithStatusFields("state"))
+	require.NoError(t, err, "could not listen on socket")
+	c, err := net.Dial(o.Addr().Network(), o.Addr().String())
+	require.NoError(t, err)
+	defer c.Close()
+	_, err = c.Write([]byte(`{"state": 42}`))
+	require.NoError(t, err)
+
+	for range o.States() {
+	}
+	require.Error(t, o.Err())
+}
+
+func TestObserveState_TerminalStatuses(t *testing.T) {
+	defer checkLeaks(t)()
+
+	tt := []struct {
+		name     string
+		terminal []string
+		stream   string
+		expect   []State
+	}{
+		{
+			name:   "default",
+			stream: `{"status": "running"}{"status": "stopped"}{"status": "deleted"}`,
+			expect: []State{StateRunning, StateExited},
+		},
+		{
+			name:     "stopped then deleted",
+			terminal: []string{"deleted"},
+			stream:   `{"status": "running"}{"status": "stopped"}{"status": "deleted"}{"status": "running"}`,
+			expect:   []State{StateRunning, StateExited, StateUnknown},
+		},
+		{
+			name:     "any of terminal statuses",
+			terminal: []string{"deleted", "gone"},
+			stream:   `{"status": "stopped"}{"status": "gone"}{"status": "deleted"}`,
+			expect:   []State{StateExited, StateUnknown},
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			var opts []ObserveOption
+			if tc.terminal != nil {
+				opts = append(opts, WithTerminalStatuses(tc.terminal...))
+			}
+			o, err := Observe(ctx, "", opts...)
+			require.NoError(t, err, "could not listen on socket")
+			c, err := net.Dial(o.Addr().Network(), o.Addr().String())
+			require.NoError(t, err)
+			defer c.Close()
+			_, err = c.Write([]byte(tc.stream))
+			require.NoError(t, err)
+
+			var actual []State
+			for s := range o.States() {
+				actual = append(actual, s)
+			}
+			require.Equal(t, tc.expect, actual)
+			require.NoError(t, o.Err())
+		})
+	}
+}
+
+func TestObserveStateEvents_OnPauseResume(t *testing.T) {
+	defer checkLeaks(t)()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var called []State
+	fail := fmt.Errorf("could not update cgroup")
+	callback := func(e StateEvent) error {
+		called = append(called, e.State)
+		if e.State == StateResumed {
+			return fail
+		}
+		return nil
+	}
+	socket := filepath.Join(os.TempDir(), fmt.Sprintf("cri-test-%s.sock", t.Name()))
+	events, err := ObserveStateEvents(ctx, socket, OnPauseResume(callback), WithBufferSize(8))
+	require.NoError(t, err, "could not listen on socket")
+	c, err := unix.Dial(socket)
+	require.NoError(t, err)
+	defer c.Close()
+	_, err = c.Write([]byte(`{"status": "running"}{"status": "paused"}{"status": "resumed"}{"status": "stopped"}`))
+	require.NoError(t, err)
+
+	var actual []StateEvent
+	for e := range events {
+		require.NoError(t, e.Err)
+		actual = append(actual, e)
+	}
+	require.Len(t, actual, 4)
+	require.Equal(t, []State{StatePaused, StateResumed}, called)
+	require.NoError(t, actual[0].HookErr)
+	require.NoError(t, actual[1].HookErr)
+	require.Equal(t, fail, actual[2].HookErr)
+	require.Equal(t, StateExited, actual[3].State)
+}
+
+func TestObserveState_ConnIdleTimeout(t *testing.T) {
+	defer checkLeaks(t)()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	disconnected := make(chan error, 2)
+	o, err := Observe(ctx, "",
+		WithConnIdleTimeout(time.Millisecond*50),
+		OnDisconnect(func(_ net.Addr, err error) {
+			disconnected <- err
+		}),
+	)
+	require.NoError(t, err, "could not listen on socket")
+
+	// wedged writer never finishes the status
+	c, err := net.Dial(o.Addr().Network(), o.Addr().String())
+	require.NoError(t, err)
+	defer c.Close()
+	_, err = c.Write([]byte(`{"status": "running"}{"status": `))
+	require.NoError(t, err)
+	require.Equal(t, StateRunning, <-o.States())
+	require.True(t, errors.Is(<-disconnected, os.ErrDeadlineExceeded))
+
+	// observation continues over a new connection
+	c, err = net.Dial(o.Addr().Network(), o.Addr().String())
+	require.NoError(t, err)
+	defer c.Close()
+	_, err = c.Write([]byte(`{"status": "stopped"}`))
+	require.NoError(t, err)
+	require.Equal(t, StateExited, <-o.States())
+	for range o.States() {
+	}
+	require.NoError(t, o.Err())
+}
+
+func TestObserveState_KeepAlive(t *testing.T) {
+	defer checkLeaks(t)()
+
+	tt := []struct {
+		name   string
+		period time.Duration
+	}{
+		{
+			name:   "default",
+			period: DefaultKeepAlive,
+		},
+		{
+			name:   "custom",
+			period: time.Second,
+		},
+		{
+			name:   "disabled",
+			period: -1,
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			state, addr, err := ObserveStateOn(ctx, "tcp://127.0.0.1:0", WithKeepAlive(tc.period))
+			require.NoError(t, err, "could not listen on socket")
+			require.NoError(t, PushState(ctx, "tcp://"+addr.String(), StateRunning, StateExited))
+			require.Equal(t, StateRunning, <-state)
+			require.Equal(t, StateExited, <-state)
+		})
+	}
+}
+
+func TestObserveStateEvents_InferredExit(t *testing.T) {
+	defer checkLeaks(t)()
+
+	tt := []struct {
+		name         string
+		infer        bool
+		stream       string
+		expectStates []State
+		expectExit   *StateEvent
+	}{
+		{
+			name:         "eof after running",
+			infer:        true,
+			stream:       `{"status": "created"}{"status": "running"}`,
+			expectStates: []State{StateCreated, StateRunning, StateExited},
+			expectExit:   &StateEvent{State: StateExited, Inferred: true},
+		},
+		{
+			name:         "dropped after running",
+			infer:        true,
+			stream:       `{"status": "running"}{"status": "sto`,
+			expectStates: []State{StateRunning, StateExited},
+			expectExit:   &StateEvent{State: StateExited, Inferred: true},
+		},
+		{
+			name:         "real exit",
+			infer:        true,
+			stream:       `{"status": "running"}{"status": "stopped"}`,
+			expectStates: []State{StateRunning, StateExited},
+			expectExit:   &StateEvent{State: StateExited, Status: "stopped"},
+		},
+		{
+			name:         "eof before running",
+			infer:        true,
+			stream:       `{"status": "created"}`,
+			expectStates: []State{StateCreated},
+		},
+		{
+			name:         "inference disabled",
+			stream:       `{"status": "running"}`,
+			expectStates: []State{StateRunning},
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			socket := filepath.Join(os.TempDir(), fmt.Sprintf("cri-test-%d.sock", time.Now().UnixNano()))
+			var opts []ObserveOption
+			if tc.infer {
+				opts = append(opts, WithInferredExit())
+			}
+			events, err := ObserveStateEvents(ctx, socket, opts...)
+			require.NoError(t, err, "could not listen on socket")
+			c, err := unix.Dial(socket)
+			require.NoError(t, err)
+			_, err = c.Write([]byte(tc.stream))
+			require.NoError(t, err)
+			require.NoError(t, c.Close())
+
+			var states []State
+			var last StateEvent
+			for range tc.expectStates {
+				last = <-events
+				states = append(states, last.State)
+			}
+			require.Equal(t, tc.expectStates, states)
+			if tc.expectExit != nil {
+				require.Equal(t, tc.expectExit.Inferred, last.Inferred)
+				require.Equal(t, tc.expectExit.Status, last.Status)
+				_, ok := <-events
+				require.False(t, ok)
+			}
+		})
+	}
+}
+
+func TestObserver_Reset(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	socket := filepath.Join(os.TempDir(), fmt.Sprintf("cri-test-%s.sock", t.Name()))
+
+	o, err := Observe(ctx, socket, WithStatusMapping(map[string]State{
+		"up":   StateRunning,
+		"down": StateExited,
+	}))
+	require.NoError(t, err, "could not listen on socket")
+
+	// first incarnation exits
+	first := o.States()
+	c, err := unix.Dial(socket)
+	require.NoError(t, err)
+	_, err = c.Write([]byte(`{"status": "up"}{"status": "down"}`))
+	require.NoError(t, err)
+	require.NoError(t, c.Close())
+	require.Equal(t, StateRunning, <-first)
+	require.Equal(t, StateExited, <-first)
+
+	require.NoError(t, o.Reset(ctx))
+	_, ok := <-first
+	require.False(t, ok, "previous channel is not closed")
+	require.Equal(t, StateUnknown, o.Current())
+
+	// second incarnation is reset while running, mapping is preserved
+	c, err = unix.Dial(socket)
+	require.NoError(t, err)
+	_, err = c.Write([]byte(`{"status": "up"}`))
+	require.NoError(t, err)
+	require.Equal(t, StateRunning, <-o.States())
+	second := o.States()
+	require.NoError(t, o.Reset(ctx))
+	for range second {
+	}
+	c.Close()
+
+	third := o.States()
+	require.NoError(t, PushState(ctx, socket, StateRunning))
+	require.Equal(t, StateUnknown, <-third, "mapping is not preserved")
+
+	var history []State
+	for _, e := range o.History() {
+		history = append(history, e.State)
+	}
+	require.Equal(t, []State{StateRunning, StateExited, StateRunning, StateUnknown}, history)
+
+	cancel()
+	for range third {
+	}
+	require.Equal(t, context.Canceled, o.Err())
+}
+
+func TestObserveState_ErrorKinds(t *testing.T) {
+	defer checkLeaks(t)()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	_, err := ObserveState(ctx, "udp://127.0.0.1:0")
+	require.True(t, errors.Is(err, ErrListen), "unexpected error: %v", err)
+	require.False(t, errors.Is(err, ErrDecode))
+
+	o, err := Observe(ctx, "")
+	require.NoError(t, err, "could not listen on socket")
+	c, err := net.Dial(o.Addr().Network(), o.Addr().String())
+	require.NoError(t, err)
+	defer c.Close()
+	_, err = c.Write([]byte(`{"status": 42}`))
+	require.NoError(t, err)
+	for range o.States() {
+	}
+	require.True(t, errors.Is(o.Err(), ErrDecode), "unexpected error: %v", o.Err())
+	var typeErr *json.UnmarshalTypeError
+	require.True(t, errors.As(o.Err(), &typeErr), "underlying error is lost")
+	require.Equal(t, "could not read state: "+typeErr.Error(), o.Err().Error())
+}
+
+func TestObserveState_Filter(t *testing.T) {
+	defer checkLeaks(t)()
+
+	running := func(s State) bool { return s == StateRunning }
+	tt := []struct {
+		name   string
+		filter func(State) bool
+		stream string
+		expect []State
+	}{
+		{
+			name:   "running only",
+			filter: running,
+			stream: `{"status": "creating"}{"status": "created"}{"status": "running"}{"status": "stopped"}`,
+			expect: []State{StateRunning},
+		},
+		{
+			name:   "exited only",
+			filter: func(s State) bool { return s == StateExited },
+			stream: `{"status": "created"}{"status": "running"}{"status": "stopped"}{"status": "running"}`,
+			expect: []State{StateExited},
+		},
+		{
+			name:   "nothing passes",
+			filter: func(State) bool { return false },
+			stream: `{"status": "created"}{"status": "stopped"}{"status": "running"}`,
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			o, err := Observe(ctx, "", WithFilter(tc.filter))
+			require.NoError(t, err, "could not listen on socket")
+			c, err := net.Dial(o.Addr().Network(), o.Addr().String())
+			require.NoError(t, err)
+			defer c.Close()
+			_, err = c.Write([]byte(tc.stream))
+			require.NoError(t, err)
+
+			var actual []State
+			for s := range o.States() {
+				actual = append(actual, s)
+			}
+			require.Equal(t, tc.expect, actual)
+			require.NoError(t, o.Err())
+			require.Equal(t, StateExited, o.Current())
+		})
+	}
+}
+
+func BenchmarkObserveState(b *testing.B) {
+	const transitions = 10000
+
+	var stream bytes.Buffer
+	for i := 0; i < transitions/2; i++ {
+		stream.WriteString(`{"status": "paused"}{"status": "resumed"}`)
+	}
+	stream.WriteString(`{"status": "stopped"}`)
+
+	b.ReportAllocs()
+	b.SetBytes(int64(stream.Len()))
+	for i := 0; i < b.N; i++ {
+		o, err := Observe(context.Background(), "")
+		require.NoError(b, err, "could not listen on socket")
+		c, err := net.Dial(o.Addr().Network(), o.Addr().String())
+		require.NoError(b, err)
+		go func() {
+			c.Write(stream.Bytes())
+			c.Close()
+		}()
+
+		var n int
+		for range o.States() {
+			n++
+		}
+		require.Equal(b, transitions+1, n)
+	}
+}
+
+func TestObserver_Close(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	socket := filepath.Join(os.TempDir(), fmt.Sprintf("cri-test-%s.sock", t.Name()))
+
+	for i := 0; i < 20; i++ {
+		o, err := Observe(ctx, socket)
+		require.NoError(t, err, "could not listen on socket after Close")
+		if i%2 == 0 {
+			require.NoError(t, PushState(ctx, socket, StateRunning))
+			require.Equal(t, StateRunning, <-o.States())
+		}
+		require.NoError(t, o.Close())
+		_, ok := <-o.States()
+		require.False(t, ok, "channel is not closed")
+		require.NoError(t, o.Close())
+	}
+	_, err := os.Stat(socket)
+	require.True(t, os.IsNotExist(err), "socket is not removed")
+
+	// error observation has stopped with is reported
+	o, err := Observe(ctx, socket, WithConnectTimeout(time.Millisecond))
+	require.NoError(t, err, "could not listen on socket")
+	for range o.States() {
+	}
+	require.True(t, errors.Is(o.Close(), ErrNoConnection))
+	require.NoError(t, o.Close())
+}
+
+func TestNewObserver(t *testing.T) {
+	socket := filepath.Join(os.TempDir(), fmt.Sprintf("cri-test-%s.sock", t.Name()))
+
+	o, err := NewObserver(socket)
+	require.NoError(t, err, "could not listen on socket")
+	require.NoError(t, PushState(context.Background(), socket, StateRunning))
+	require.Equal(t, StateRunning, <-o.States())
+
+	require.NoError(t, o.Close())
+	_, ok := <-o.States()
+	require.False(t, ok, "channel is not closed")
+	require.Equal(t, context.Canceled, o.Err())
+	_, err = os.Stat(socket)
+	require.True(t, os.IsNotExist(err), "socket is not removed")
+}
+
+func TestObserver_Next(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	o, err := Observe(ctx, "")
+	require.NoError(t, err, "could not listen on socket")
+
+	waitCtx, waitCancel := context.WithTimeout(ctx, time.Millisecond*50)
+	defer waitCancel()
+	_, ok, err := o.Next(waitCtx)
+	require.False(t, ok)
+	require.Equal(t, context.DeadlineExceeded, err)
+
+	require.NoError(t, PushState(ctx, o.Addr().String(), StateCreated, StateRunning, StateExited))
+	var actual []State
+	for {
+		state, ok, err := o.Next(ctx)
+		if !ok {
+			require.NoError(t, err)
+			break
+		}
+		actual = append(actual, state)
+	}
+	require.Equal(t, []State{StateCreated, StateRunning, StateExited}, actual)
+
+	_, ok, err = o.Next(ctx)
+	require.False(t, ok)
+	require.NoError(t, err)
+}
+
+func TestObserveStateEvents_Truncated(t *testing.T) {
+	defer checkLeaks(t)()
+
+	tt := []struct {
+		name   string
+		opts   []ObserveOption
+		expect []StateEvent
+	}{
+		{
+			name: "inferred exit",
+			opts: []ObserveOption{WithInferredExit()},
+			expect: []StateEvent{
+				{State: StateRunning, Status: "running"},
+				{State: StateExited, Inferred: true, Truncated: true},
+			},
+		},
+		{
+			name: "runtime reconnects",
+			expect: []StateEvent{
+				{State: StateRunning, Status: "running"},
+				{State: StateExited, Status: "stopped"},
+			},
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			disconnected := make(chan error, 2)
+			opts := append(tc.opts, OnDisconnect(func(_ net.Addr, err error) {
+				disconnected <- err
+			}))
+			o := newObserver("", opts...)
+			o.events = make(chan StateEvent, len(tc.expect))
+			require.NoError(t, o.start(ctx))
+
+			// runtime is killed in the middle of writing status
+			c, err := net.Dial(o.addr.Network(), o.addr.String())
+			require.NoError(t, err)
+			_, err = c.Write([]byte(`{"status":"running"}{"status":"run`))
+			require.NoError(t, err)
+			require.NoError(t, c.Close())
+			require.Equal(t, io.ErrUnexpectedEOF, <-disconnected)
+			if !o.inferExitOnClose {
+				require.NoError(t, PushState(ctx, o.addr.String(), StateExited))
+			}
+
+			var events []StateEvent
+			for event := range o.events {
+				event.Time = time.Time{}
+				events = append(events, event)
+			}
+			require.Equal(t, tc.expect, events)
+		})
+	}
+}
+
+func TestObserveStateEvents_Snapshot(t *testing.T) {
+	defer checkLeaks(t)()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	o := newObserver("", WithStrictTransitions())
+	o.events = make(chan StateEvent, 4)
+	require.NoError(t, o.start(ctx))
+
+	c, err := net.Dial(o.addr.Network(), o.addr.String())
+	require.NoError(t, err)
+	_, err = c.Write([]byte(`{"status": "created"}`))
+	require.NoError(t, err)
+	require.NoError(t, c.Close())
+	require.Equal(t, StateCreated, (<-o.events).State)
+
+	// observer has missed running state while runtime was restarted,
+	// snapshot is passed regardless of strict transitions
+	c, err = net.Dial(o.addr.Network(), o.addr.String())
+	require.NoError(t, err)
+	_, err = c.Write([]byte(`{"status": "paused", "snapshot": true} {"status": "running"} {"status": "stopped"}`))
+	require.NoError(t, err)
+	require.NoError(t, c.Close())
+
+	var events []StateEvent
+	for event := range o.events {
+		event.Time = time.Time{}
+		events = append(events, event)
+	}
+	require.Equal(t, []StateEvent{
+		{State: StatePaused, Status: "paused", Snapshot: true},
+		{State: StateRunning, Status: "running"},
+		{State: StateExited, Status: "stopped"},
+	}, events)
+}
+
+func TestObserveStateEvents_DecodeError(t *testing.T) {
+	defer checkLeaks(t)()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	o := newObserver("")
+	o.events = make(chan StateEvent, 4)
+	require.NoError(t, o.start(ctx))
+	c, err := net.Dial(o.addr.Network(), o.addr.String())
+	require.NoError(t, err)
+	defer c.Close()
+	_, err = c.Write([]byte(`{"status": "running"} {status`))
+	require.NoError(t, err)
+
+	var events []StateEvent
+	for event := range o.events {
+		events = append(events, event)
+	}
+	require.Len(t, events, 2)
+	require.Equal(t, StateRunning, events[0].State)
+	require.NoError(t, events[0].Err)
+	require.Equal(t, StateError, events[1].State)
+	require.True(t, errors.Is(events[1].Err, ErrDecode), "unexpected error: %v", events[1].Err)
+	require.Equal(t, events[1].Err, o.err)
+}
+
+func TestObserver_Done(t *testing.T) {
+	tt := []struct {
+		name   string
+		opts   []ObserveOption
+		push   []State
+		cancel bool
+		err    error
+	}{
+		{
+			name: "exited",
+			push: []State{StateRunning, StateExited},
+		},
+		{
+			name:   "context done",
+			push:   []State{StateRunning},
+			cancel: true,
+			err:    context.Canceled,
+		},
+		{
+			name: "error",
+			opts: []ObserveOption{WithConnectTimeout(time.Millisecond)},
+			err:  ErrNoConnection,
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			o, err := Observe(ctx, "", tc.opts...)
+			require.NoError(t, err, "could not listen on socket")
+			if len(tc.push) > 0 {
+				require.NoError(t, PushState(ctx, o.Addr().String(), tc.push...))
+			}
+			if tc.cancel {
+				require.Equal(t, StateRunning, <-o.States())
+				cancel()
+			}
+
+			select {
+			case <-o.Done():
+			case <-time.After(time.Second):
+				t.Fatal("observation is not over")
+			}
+			require.True(t, errors.Is(o.Err(), tc.err), "unexpected error %v", o.Err())
+			if tc.err == nil {
+				require.NoError(t, o.Err())
+			}
+		})
+	}
+}
+
+func TestObserveState_OnTransition(t *testing.T) {
+	defer checkLeaks(t)()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	clock := &testClock{now: time.Date(2019, 1, 1, 0, 0, 0, 0, time.UTC)}
+	type transition struct {
+		prev, next State
+		at         time.Time
+	}
+	var transitions []transition
+	o, err := Observe(ctx, "",
+		WithClock(clock.Now),
+		OnState(StateCreated, func(StateEvent) error {
+			clock.Advance(time.Second)
+			return nil
+		}),
+		OnTransition(func(prev, next State, at time.Time) {
+			transitions = append(transitions, transition{prev, next, at})
+		}),
+	)
+	require.NoError(t, err, "could not listen on socket")
+
+	c, err := net.Dial(o.Addr().Network(), o.Addr().String())
+	require.NoError(t, err)
+	defer c.Close()
+	_, err = c.Write([]byte(`{"status":"creating"}{"status":"created"}{"status":"created"}` +
+		`{"status":"booting"}{"status":"running"}{"status":"stopped"}`))
+	require.NoError(t, err)
+	for range o.States() {
+	}
+
+	start := time.Date(2019, 1, 1, 0, 0, 0, 0, time.UTC)
+	require.Equal(t, []transition{
+		{StateUnknown, StateCreating, start},
+		{StateCreating, StateCreated, start},
+		{StateCreated, StateRunning, start.Add(2 * time.Second)},
+		{StateRunning, StateExited, start.Add(2 * time.Second)},
+	}, transitions)
+}
+
+func TestObserver_Veto(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	denied := fmt.Errorf("image is not signed")
+	o, err := Observe(ctx, "", OnState(StateRunning, func(StateEvent) error {
+		return denied
+	}))
+	require.NoError(t, err, "could not listen on socket")
+	require.NoError(t, PushState(ctx, o.Addr().String(), StateCreated, StateRunning, StateExited))
+
+	var states []State
+	for s := range o.States() {
+		states = append(states, s)
+	}
+	require.Equal(t, []State{StateCreated}, states)
+	require.True(t, errors.Is(o.Err(), denied), "unexpected error %v", o.Err())
+}
+
+func TestObserveStateEvents_StrictStatuses(t *testing.T) {
+	defer checkLeaks(t)()
+
+	tt := []struct {
+		name         string
+		strict       bool
+		expectStates []State
+		expectErr    bool
+	}{
+		{
+			name:         "lenient",
+			expectStates: []State{StateRunning, StateUnknown, StateExited},
+		},
+		{
+			name:         "strict",
+			strict:       true,
+			expectStates: []State{StateRunning, StateUnknown},
+			expectErr:    true,
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			var opts []ObserveOption
+			if tc.strict {
+				opts = append(opts, WithStrictStatuses())
+			}
+			o := newObserver("", opts...)
+			o.events = make(chan StateEvent, o.bufferSize)
+			require.NoError(t, o.start(ctx), "could not listen on socket")
+			c, err := net.Dial(o.addr.Network(), o.addr.String())
+			require.NoError(t, err)
+			defer c.Close()
+			_, err = c.Write([]byte(`{"status": "running"}{"status": "hibernated"}{"status": "stopped"}`))
+			require.NoError(t, err)
+
+			var states []State
+			var last StateEvent
+			for event := range o.events {
+				states = append(states, event.State)
+				last = event
+			}
+			require.Equal(t, tc.expectStates, states)
+			if !tc.expectErr {
+				require.NoError(t, last.Err)
+				require.NoError(t, o.err)
+				return
+			}
+			require.EqualError(t, last.Err, `could not read state: unknown status "hibernated"`)
+			require.True(t, errors.Is(last.Err, ErrDecode))
+			require.True(t, errors.Is(last.Err, ErrUnknownStatus))
+			require.Equal(t, "hibernated", last.Status)
+			require.True(t, errors.Is(o.err, ErrUnknownStatus))
+		})
+	}
+}
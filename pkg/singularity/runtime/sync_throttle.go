@@ -0,0 +1,134 @@
+// Copyright (c) 2018-2019 Sylabs, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package runtime
+
+import (
+	"context"
+)
+
+// throttleReadAhead is the maximum number of status objects read from
+// a connection while handling of a status is throttled, see WithThrottle.
+const throttleReadAhead = 16
+
+// WithThrottle sets the gate observer consults before handling each
+// non-terminal status, e.g. to back off while the node is under memory
+// pressure. Wait should block until the status may be handled and return
+// nil, or return an error once ctx is done, in which case the status is
+// handled right away. Terminal statuses always bypass the gate: while
+// waiting, observer keeps reading a few status objects ahead, and once
+// a terminal one is read, statuses held so far are handled without
+// waiting, so container exit is never delayed by the gate. By default
+// statuses are not throttled.
+func WithThrottle(wait func(ctx context.Context) error) ObserveOption {
+	return func(o *observer) {
+		o.throttle = wait
+	}
+}
+
+// aheadStatus is a status object read ahead while throttled.
+type aheadStatus struct {
+	status syncStatus
+	err    error
+}
+
+// throttledReader reads status objects of a connection, returning
+// ones that were read ahead while throttled first.
+type throttledReader struct {
+	// read reads the next status object from the connection.
+	read  func() (syncStatus, error)
+	ahead []aheadStatus
+	// inflight receives the status object being read ahead, if any.
+	// The connection is read by nobody else until it is received.
+	inflight chan aheadStatus
+}
+
+// next returns the next status object.
+func (r *throttledReader) next() (syncStatus, error) {
+	if len(r.ahead) == 0 && r.inflight != nil {
+		r.ahead = append(r.ahead, <-r.inflight)
+		r.inflight = nil
+	}
+	if len(r.ahead) > 0 {
+		s := r.ahead[0]
+		r.ahead = r.ahead[1:]
+		return s.status, s.err
+	}
+	return r.read()
+}
+
+// buffered returns true if any status object is read ahead.
+func (r *throttledReader) buffered() bool {
+	return len(r.ahead) > 0 || r.inflight != nil
+}
+
+// readAhead starts reading the next status object unless one is being
+// read already, too many are read ahead or reading has failed.
+func (r *throttledReader) readAhead() {
+	if r.inflight != nil || len(r.ahead) >= throttleReadAhead {
+		return
+	}
+	if n := len(r.ahead); n > 0 && r.ahead[n-1].err != nil {
+		return
+	}
+	r.inflight = make(chan aheadStatus, 1)
+	go func(inflight chan<- aheadStatus) {
+		status, err := r.read()
+		inflight <- aheadStatus{status: status, err: err}
+	}(r.inflight)
+}
+
+// terminalAhead returns true if any of the status objects
+// read ahead stops observation.
+func (o *observer) terminalAhead(r *throttledReader) bool {
+	for _, s := range r.ahead {
+		if s.err == nil && o.isTerminal(o.event(s.status)) {
+			return true
+		}
+	}
+	return false
+}
+
+// throttleStatus waits until throttle allows status to be handled unless
+// status is terminal. While waiting, status objects are read ahead, so that
+// terminal status received in the meantime stops waiting.
+func (o *observer) throttleStatus(ctx context.Context, r *throttledReader, status syncStatus) {
+	if o.isTerminal(o.event(status)) || o.terminalAhead(r) {
+		return
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	allowed := make(chan error, 1)
+	go func() {
+		allowed <- o.throttle(ctx)
+	}()
+	for {
+		r.readAhead()
+		select {
+		case err := <-allowed:
+			if err != nil {
+				o.log.Debugf("Handling status %q at %s without throttling: %v", status.Status, o.socket, err)
+			}
+			return
+		case s := <-r.inflight:
+			r.inflight = nil
+			r.ahead = append(r.ahead, s)
+			if s.err == nil && o.isTerminal(o.event(s.status)) {
+				o.log.Debugf("Terminal status %q at %s bypasses throttling", s.status.Status, o.socket)
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,119 @@
+// Copyright (c) 2018-2019 Sylabs, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package runtime
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestObserveState_Throttle(t *testing.T) {
+	defer checkLeaks(t)()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	release := make(chan struct{})
+	waits := make(chan string, 10)
+	o, err := Observe(ctx, "", WithThrottle(func(ctx context.Context) error {
+		waits <- "wait"
+		select {
+		case <-release:
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}))
+	require.NoError(t, err, "could not listen on socket")
+	defer o.Close()
+
+	c, err := net.Dial(o.Addr().Network(), o.Addr().String())
+	require.NoError(t, err)
+	defer c.Close()
+	_, err = c.Write([]byte(`{"status": "creating"}`))
+	require.NoError(t, err)
+
+	// draining is paused until throttle allows it
+	<-waits
+	select {
+	case state := <-o.States():
+		t.Fatalf("unexpected state %v while throttled", state)
+	case <-time.After(50 * time.Millisecond):
+	}
+	release <- struct{}{}
+	require.Equal(t, StateCreating, <-o.States())
+}
+
+func TestObserveState_ThrottleTerminal(t *testing.T) {
+	defer checkLeaks(t)()
+
+	tt := []struct {
+		name   string
+		stream string
+		// later is written once the first state is throttled
+		later  string
+		expect []State
+	}{
+		{
+			name:   "terminal only",
+			stream: `{"status": "stopped"}`,
+			expect: []State{StateExited},
+		},
+		{
+			name:   "terminal read ahead",
+			stream: `{"status": "creating"} {"status": "created"} {"status": "running"} {"status": "stopped"}`,
+			expect: []State{StateCreating, StateCreated, StateRunning, StateExited},
+		},
+		{
+			name:   "terminal received later",
+			stream: `{"status": "creating"}`,
+			later:  `{"status": "created"} {"status": "stopped"}`,
+			expect: []State{StateCreating, StateCreated, StateExited},
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			// throttle never allows anything
+			o, err := Observe(ctx, "", WithThrottle(func(ctx context.Context) error {
+				<-ctx.Done()
+				return ctx.Err()
+			}))
+			require.NoError(t, err, "could not listen on socket")
+			defer o.Close()
+
+			c, err := net.Dial(o.Addr().Network(), o.Addr().String())
+			require.NoError(t, err)
+			defer c.Close()
+			_, err = c.Write([]byte(tc.stream))
+			require.NoError(t, err)
+			if tc.later != "" {
+				time.Sleep(20 * time.Millisecond)
+				_, err = c.Write([]byte(tc.later))
+				require.NoError(t, err)
+			}
+
+			require.Equal(t, tc.expect, readAll(t, o.States()))
+			require.NoError(t, o.Err())
+		})
+	}
+}
@@ -0,0 +1,65 @@
+// Copyright (c) 2018-2019 Sylabs, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package runtime
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"time"
+)
+
+// tlsHandshakeTimeout is how long runtime may take to complete TLS handshake,
+// connections are accepted one at a time so a silent peer must not block them.
+const tlsHandshakeTimeout = 10 * time.Second
+
+// WithTLS makes observer accept only TLS connections on the socket, so that
+// states may be reported across trust boundaries, e.g. from a VM over
+// vsock://cid:port or from another host over tcp://host:port. Runtime must
+// present a certificate that verifies against cfg.ClientCAs unless cfg sets
+// a different ClientAuth explicitly. Status objects are read from the TLS
+// connection as usual. Connection that fails handshake is closed without
+// stopping observation. TLS is only applied to listened sockets, it is
+// ignored by DialObserveState. By default connections are not encrypted.
+func WithTLS(cfg *tls.Config) ObserveOption {
+	return func(o *observer) {
+		o.tlsConfig = cfg
+	}
+}
+
+// wrapTLS wraps ln so that accepted connections are TLS ones if TLS is
+// enabled, see WithTLS. Client certificate is required by default.
+func (o *observer) wrapTLS(ln net.Listener) net.Listener {
+	if o.tlsConfig == nil {
+		return ln
+	}
+	cfg := o.tlsConfig.Clone()
+	if cfg.ClientAuth == tls.NoClientCert {
+		cfg.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return tls.NewListener(ln, cfg)
+}
+
+// handshakeTLS completes TLS handshake of conn, if it is a TLS connection,
+// so that handshake failure is not mistaken for an undecodable status.
+func handshakeTLS(ctx context.Context, conn net.Conn) error {
+	tc, ok := conn.(*tls.Conn)
+	if !ok {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(ctx, tlsHandshakeTimeout)
+	defer cancel()
+	return tc.HandshakeContext(ctx)
+}
@@ -0,0 +1,119 @@
+// Copyright (c) 2018-2019 Sylabs, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package runtime
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// testCert issues certificate for name signed by parent, or a self-signed
+// CA certificate if parent is nil.
+func testCert(t *testing.T, name string, parent *tls.Certificate) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	signer, signerKey := tmpl, interface{}(key)
+	if parent == nil {
+		tmpl.IsCA = true
+		tmpl.BasicConstraintsValid = true
+		tmpl.KeyUsage = x509.KeyUsageCertSign
+	} else {
+		signer = parent.Leaf
+		signerKey = parent.PrivateKey
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, signer, &key.PublicKey, signerKey)
+	require.NoError(t, err)
+	leaf, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}
+}
+
+func TestObserveState_TLS(t *testing.T) {
+	defer checkLeaks(t)()
+
+	ca := testCert(t, "ca", nil)
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.Leaf)
+	server := testCert(t, "server", &ca)
+	client := testCert(t, "client", &ca)
+	other := testCert(t, "other", nil)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	o, err := Observe(ctx, "tcp://127.0.0.1:0", WithTLS(&tls.Config{
+		Certificates: []tls.Certificate{server},
+		ClientCAs:    pool,
+	}))
+	require.NoError(t, err)
+
+	dial := func(certs ...tls.Certificate) (*tls.Conn, error) {
+		return tls.Dial("tcp", o.Addr().String(), &tls.Config{
+			Certificates: certs,
+			RootCAs:      pool,
+		})
+	}
+	push := func(c *tls.Conn, status string) error {
+		if _, err := c.Write([]byte(`{"status":"` + status + `"}`)); err != nil {
+			return err
+		}
+		// handshake failures surface on read once server closes
+		c.SetReadDeadline(time.Now().Add(time.Second))
+		_, err := c.Read(make([]byte, 1))
+		return err
+	}
+
+	// runtime without an accepted certificate is rejected
+	// and observation continues
+	for _, certs := range [][]tls.Certificate{nil, {other}} {
+		c, err := dial(certs...)
+		if err == nil {
+			require.Error(t, push(c, "running"))
+			c.Close()
+		}
+	}
+
+	c, err := dial(client)
+	require.NoError(t, err)
+	_, err = c.Write([]byte(`{"status":"running"}{"status":"stopped"}`))
+	require.NoError(t, err)
+	defer c.Close()
+
+	var states []State
+	for state := range o.States() {
+		states = append(states, state)
+	}
+	require.Equal(t, []State{StateRunning, StateExited}, states)
+	require.NoError(t, o.Err())
+}
@@ -0,0 +1,73 @@
+// Copyright (c) 2018-2019 Sylabs, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package runtime
+
+import (
+	"context"
+	"time"
+)
+
+// Tracer is used by observer to trace lifecycle of the observed container.
+// It is intended to be implemented by adapters to tracing systems, e.g.
+// OpenTelemetry trace.Tracer starting span with container ID attribute.
+type Tracer interface {
+	// StartSpan is called once observation is started. Passed context
+	// is the one observation is started with, so span may have a parent.
+	StartSpan(ctx context.Context, containerID string) Span
+}
+
+// Span traces a single container's observation.
+type Span interface {
+	// AddEvent is called for each state passed to the channel
+	// with the time the state was received.
+	AddEvent(name string, t time.Time)
+	// End is called once observation is over with the
+	// reason it is over, see Observer.Err.
+	End(err error)
+}
+
+// WithTracer sets tracer observation is traced with. By default
+// observation is not traced. Container ID passed to the tracer
+// is the one set with WithContainerID.
+func WithTracer(t Tracer) ObserveOption {
+	return func(o *observer) {
+		o.tracer = t
+	}
+}
+
+// startSpan starts tracing observation if tracer is set.
+func (o *observer) startSpan(ctx context.Context) {
+	if o.tracer == nil {
+		return
+	}
+	o.span = o.tracer.StartSpan(ctx, o.containerID)
+}
+
+// traceEvent adds event that was passed to the channel to the span.
+// Events carrying an error are reported once span is ended.
+func (o *observer) traceEvent(event StateEvent) {
+	if o.span == nil || event.Err != nil {
+		return
+	}
+	o.span.AddEvent(event.State.String(), event.Time)
+}
+
+// endSpan ends the span with the reason observation is over.
+func (o *observer) endSpan(err error) {
+	if o.span == nil {
+		return
+	}
+	o.span.End(err)
+}
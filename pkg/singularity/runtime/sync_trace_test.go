@@ -0,0 +1,124 @@
+// Copyright (c) 2018-2019 Sylabs, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package runtime
+
+import (
+	"context"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+type testTracer struct {
+	containerID string
+	span        *testSpan
+}
+
+func (t *testTracer) StartSpan(ctx context.Context, containerID string) Span {
+	t.containerID = containerID
+	t.span = &testSpan{}
+	return t.span
+}
+
+type testSpan struct {
+	mu     sync.Mutex
+	events []string
+	times  []time.Time
+	ended  int
+	err    error
+}
+
+func (s *testSpan) AddEvent(name string, t time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.events = append(s.events, name)
+	s.times = append(s.times, t)
+}
+
+func (s *testSpan) End(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.ended++
+	s.err = err
+}
+
+func TestObserveState_Tracer(t *testing.T) {
+	defer checkLeaks(t)()
+
+	tt := []struct {
+		name         string
+		stream       string
+		expectEvents []string
+		expectErr    error
+	}{
+		{
+			name:         "exited",
+			stream:       `{"status": "created"}{"status": "running"}{"status": "stopped"}`,
+			expectEvents: []string{"created", "running", "exited"},
+		},
+		{
+			name:         "invalid transition",
+			stream:       `{"status": "running"}{"status": "created"}`,
+			expectEvents: []string{"running"},
+			expectErr:    &TransitionError{From: StateRunning, To: StateCreated},
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			tr := &testTracer{}
+			o, err := Observe(ctx, "", WithTracer(tr), WithContainerID("test-id"), WithStrictTransitions())
+			require.NoError(t, err, "could not listen on socket")
+			require.Equal(t, "test-id", tr.containerID)
+
+			c, err := net.Dial(o.Addr().Network(), o.Addr().String())
+			require.NoError(t, err)
+			defer c.Close()
+			_, err = c.Write([]byte(tc.stream))
+			require.NoError(t, err)
+			for range o.States() {
+			}
+
+			span := tr.span
+			span.mu.Lock()
+			defer span.mu.Unlock()
+			require.Equal(t, tc.expectEvents, span.events)
+			for _, ts := range span.times {
+				require.False(t, ts.IsZero())
+			}
+			require.Equal(t, 1, span.ended)
+			require.Equal(t, tc.expectErr, span.err)
+		})
+	}
+}
+
+func TestObserveState_TracerListenError(t *testing.T) {
+	defer checkLeaks(t)()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	tr := &testTracer{}
+	_, err := ObserveState(ctx, "bogus://socket", WithTracer(tr))
+	require.Error(t, err)
+	require.Equal(t, 1, tr.span.ended)
+	require.Equal(t, err, tr.span.err)
+}
@@ -0,0 +1,262 @@
+// Copyright (c) 2018-2019 Sylabs, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package runtime
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// vsockAddr is a virtio socket address.
+type vsockAddr struct {
+	cid  uint32
+	port uint32
+}
+
+// Network returns the address's network name, "vsock".
+func (a vsockAddr) Network() string {
+	return "vsock"
+}
+
+// String returns address in "cid:port" form.
+func (a vsockAddr) String() string {
+	return fmt.Sprintf("%d:%d", a.cid, a.port)
+}
+
+// parseVsockAddr parses address in "cid:port" form. Empty cid
+// means any cid, i.e. VMADDR_CID_ANY.
+func parseVsockAddr(address string) (vsockAddr, error) {
+	i := strings.LastIndex(address, ":")
+	if i < 0 {
+		return vsockAddr{}, fmt.Errorf("missing port in vsock address %q", address)
+	}
+
+	addr := vsockAddr{cid: unix.VMADDR_CID_ANY}
+	if cid := address[:i]; cid != "" {
+		v, err := strconv.ParseUint(cid, 10, 32)
+		if err != nil {
+			return vsockAddr{}, fmt.Errorf("invalid vsock cid %q: %v", cid, err)
+		}
+		addr.cid = uint32(v)
+	}
+	port, err := strconv.ParseUint(address[i+1:], 10, 32)
+	if err != nil {
+		return vsockAddr{}, fmt.Errorf("invalid vsock port %q: %v", address[i+1:], err)
+	}
+	addr.port = uint32(port)
+	return addr, nil
+}
+
+// vsockListener is a net.Listener for virtio sockets, which
+// are not supported by the standard net package.
+type vsockListener struct {
+	file *os.File
+	conn syscall.RawConn
+	addr vsockAddr
+}
+
+func listenVsock(address string) (net.Listener, error) {
+	addr, err := parseVsockAddr(address)
+	if err != nil {
+		return nil, err
+	}
+
+	fd, err := unix.Socket(unix.AF_VSOCK, unix.SOCK_STREAM|unix.SOCK_NONBLOCK|unix.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return nil, fmt.Errorf("could not create vsock socket: %v", err)
+	}
+	if err := unix.Bind(fd, &unix.SockaddrVM{CID: addr.cid, Port: addr.port}); err != nil {
+		unix.Close(fd)
+		return nil, fmt.Errorf("could not bind vsock socket: %v", err)
+	}
+	if err := unix.Listen(fd, unix.SOMAXCONN); err != nil {
+		unix.Close(fd)
+		return nil, fmt.Errorf("could not listen vsock socket: %v", err)
+	}
+
+	file := os.NewFile(uintptr(fd), "vsock:"+addr.String())
+	conn, err := file.SyscallConn()
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("could not get raw vsock connection: %v", err)
+	}
+	return &vsockListener{
+		file: file,
+		conn: conn,
+		addr: addr,
+	}, nil
+}
+
+// Accept waits for and returns the next connection to the listener.
+func (l *vsockListener) Accept() (net.Conn, error) {
+	var (
+		nfd       int
+		sa        unix.Sockaddr
+		acceptErr error
+	)
+	err := l.conn.Read(func(fd uintptr) bool {
+		nfd, sa, acceptErr = unix.Accept4(int(fd), unix.SOCK_NONBLOCK|unix.SOCK_CLOEXEC)
+		return acceptErr != unix.EAGAIN
+	})
+	if errors.Is(err, os.ErrClosed) {
+		err = net.ErrClosed
+	}
+	if err == nil {
+		err = acceptErr
+	}
+	if err != nil {
+		return nil, &net.OpError{Op: "accept", Net: "vsock", Addr: l.addr, Err: err}
+	}
+
+	var remote vsockAddr
+	if vm, ok := sa.(*unix.SockaddrVM); ok {
+		remote = vsockAddr{cid: vm.CID, port: vm.Port}
+	}
+	return &vsockConn{
+		file:   os.NewFile(uintptr(nfd), "vsock:"+remote.String()),
+		local:  l.addr,
+		remote: remote,
+	}, nil
+}
+
+// Close closes the listener.
+func (l *vsockListener) Close() error {
+	return l.file.Close()
+}
+
+// Addr returns the listener's network address.
+func (l *vsockListener) Addr() net.Addr {
+	return l.addr
+}
+
+// vsockConn is a net.Conn for virtio sockets.
+type vsockConn struct {
+	file   *os.File
+	local  vsockAddr
+	remote vsockAddr
+}
+
+func (c *vsockConn) Read(b []byte) (int, error) {
+	return c.file.Read(b)
+}
+
+func (c *vsockConn) Write(b []byte) (int, error) {
+	return c.file.Write(b)
+}
+
+func (c *vsockConn) Close() error {
+	return c.file.Close()
+}
+
+func (c *vsockConn) LocalAddr() net.Addr {
+	return c.local
+}
+
+func (c *vsockConn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+func (c *vsockConn) SetDeadline(t time.Time) error {
+	return c.file.SetDeadline(t)
+}
+
+func (c *vsockConn) SetReadDeadline(t time.Time) error {
+	return c.file.SetReadDeadline(t)
+}
+
+func (c *vsockConn) SetWriteDeadline(t time.Time) error {
+	return c.file.SetWriteDeadline(t)
+}
+
+func dialVsock(ctx context.Context, address string) (net.Conn, error) {
+	addr, err := parseVsockAddr(address)
+	if err != nil {
+		return nil, err
+	}
+
+	fd, err := unix.Socket(unix.AF_VSOCK, unix.SOCK_STREAM|unix.SOCK_NONBLOCK|unix.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return nil, fmt.Errorf("could not create vsock socket: %v", err)
+	}
+	err = unix.Connect(fd, &unix.SockaddrVM{CID: addr.cid, Port: addr.port})
+	if err != nil && err != unix.EINPROGRESS {
+		unix.Close(fd)
+		return nil, fmt.Errorf("could not connect vsock socket: %v", err)
+	}
+
+	file := os.NewFile(uintptr(fd), "vsock:"+addr.String())
+	if err == unix.EINPROGRESS {
+		if err := waitConnected(ctx, file); err != nil {
+			file.Close()
+			return nil, fmt.Errorf("could not connect vsock socket: %v", err)
+		}
+	}
+
+	local := vsockAddr{}
+	if sa, err := unix.Getsockname(fd); err == nil {
+		if vm, ok := sa.(*unix.SockaddrVM); ok {
+			local = vsockAddr{cid: vm.CID, port: vm.Port}
+		}
+	}
+	return &vsockConn{
+		file:   file,
+		local:  local,
+		remote: addr,
+	}, nil
+}
+
+// waitConnected waits for non-blocking connect to complete.
+func waitConnected(ctx context.Context, file *os.File) error {
+	if deadline, ok := ctx.Deadline(); ok {
+		file.SetWriteDeadline(deadline)
+		defer file.SetWriteDeadline(time.Time{})
+	}
+	conn, err := file.SyscallConn()
+	if err != nil {
+		return err
+	}
+
+	var (
+		waited     bool
+		connectErr error
+	)
+	err = conn.Write(func(fd uintptr) bool {
+		// socket becomes writable once connect completes
+		if !waited {
+			waited = true
+			return false
+		}
+		v, err := unix.GetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_ERROR)
+		if err != nil {
+			connectErr = err
+		} else if v != 0 {
+			connectErr = syscall.Errno(v)
+		}
+		return true
+	})
+	if err != nil {
+		return err
+	}
+	return connectErr
+}
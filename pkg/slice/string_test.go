@@ -83,3 +83,37 @@ func TestRemoveFromString(t *testing.T) {
 		})
 	}
 }
+
+func TestContainsString(t *testing.T) {
+	tt := []struct {
+		name   string
+		s      []string
+		v      string
+		expect bool
+	}{
+		{
+			name:   "not found",
+			s:      []string{"gcr.io/cri-tools/test-image-tags:1", "gcr.io/cri-tools/test-image-tags:2"},
+			v:      "gcr.io/cri-tools/test-image-tags:3",
+			expect: false,
+		},
+		{
+			name:   "found",
+			s:      []string{"gcr.io/cri-tools/test-image-tags:1", "gcr.io/cri-tools/test-image-tags:2"},
+			v:      "gcr.io/cri-tools/test-image-tags:2",
+			expect: true,
+		},
+		{
+			name:   "empty slice",
+			v:      "gcr.io/cri-tools/test-image-tags:1",
+			expect: false,
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			actual := ContainsString(tc.s, tc.v)
+			require.Equal(t, tc.expect, actual)
+		})
+	}
+}